@@ -0,0 +1,28 @@
+-- Example plugin using every permission: it reads events, transforms outgoing text, adds /shout and shows a status bar widget.
+
+local heard = 0
+
+function on_event(event)
+	if event.type == "message" and event.incoming then
+		heard = heard + 1
+	end
+end
+
+function transform(peer, text)
+	if text:sub(-2) == "!!" then
+		return text:upper()
+	end
+end
+
+commands = {
+	shout = function(peer, args)
+		if #args == 0 then
+			error("usage: /shout <text>", 0)
+		end
+		bokkoli.send(table.concat(args, " "):upper())
+	end,
+}
+
+function status()
+	return "📣 " .. heard .. " heard"
+end
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/message"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Version prefix of every endpoint
+const PATH_PREFIX string = "/api/v1"
+
+// Request bodies larger than this are rejected, large enough for any chat message
+const MAX_BODY_SIZE int64 = 1024 * 1024
+
+// An event stream whose client doesn't take a frame within this long is dropped
+const WRITE_TIMEOUT time.Duration = 10 * time.Second
+
+var logger = logging.For(logging.API)
+
+// Serves a backend over HTTP on a loopback address. The backend stays owned by the caller.
+//
+//	GET  /api/v1/status                             listen address and connected peers
+//	GET  /api/v1/conversations                      one entry per peer with its latest message
+//	GET  /api/v1/messages?peer=&since=&until=&limit= stored messages, oldest first
+//	POST /api/v1/messages {"to": "...", "text": "..."} send a message
+//	GET  /api/v1/events                             WebSocket stream of message.Event
+//
+// Every request needs the token, as "Authorization: Bearer <token>" or, for browsers opening
+// a WebSocket, as the "token" query parameter.
+type Server struct {
+	backend  message.Backend
+	token    string
+	listener net.Listener
+	http     *http.Server
+
+	mu      sync.Mutex
+	streams map[*websocket.Conn]struct{}
+	closed  bool
+}
+
+// Start listening; only loopback addresses are accepted, the API is not meant to be reachable from other machines
+func Listen(address string, backend message.Backend, token string) (*Server, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("the API only listens on loopback, got %q", host)
+	}
+	if token == "" {
+		return nil, errors.New("the API needs a token")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		backend:  backend,
+		token:    token,
+		listener: listener,
+		streams:  make(map[*websocket.Conn]struct{}),
+	}
+	s.http = &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	return s, nil
+}
+
+// Address the server ended up on, useful with port 0
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Answer requests until the server is closed
+func (s *Server) Serve() error {
+	err := s.http.Serve(s.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Stop listening and end every event stream
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	streams := make([]*websocket.Conn, 0, len(s.streams))
+	for stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.mu.Unlock()
+
+	// Closing waits a few seconds at most for each client to answer, so they are closed side by side
+	var wg sync.WaitGroup
+	for _, stream := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream.Close(websocket.StatusGoingAway, "server closed")
+		}()
+	}
+	wg.Wait()
+
+	return s.http.Close()
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+PATH_PREFIX+"/status", s.handleStatus)
+	mux.HandleFunc("GET "+PATH_PREFIX+"/conversations", s.handleConversations)
+	mux.HandleFunc("GET "+PATH_PREFIX+"/messages", s.handleHistory)
+	mux.HandleFunc("POST "+PATH_PREFIX+"/messages", s.handleSend)
+	mux.HandleFunc("GET "+PATH_PREFIX+"/events", s.handleEvents)
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = bearer
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bokkoli"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.backend.Status()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleConversations(w http.ResponseWriter, r *http.Request) {
+	conversations, err := s.backend.Conversations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, conversations)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	messages, err := s.backend.History(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if messages == nil {
+		messages = []db.Message{}
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// Same shape as the daemon's send request; without "to" the message goes to the only connected peer
+type sendRequest struct {
+	To   string `json:"to,omitempty"`
+	Text string `json:"text"`
+}
+
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	var request sendRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE))
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed request: %v", err))
+		return
+	}
+	if strings.TrimSpace(request.Text) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("refusing to send an empty message"))
+		return
+	}
+
+	// Delivery problems, e.g. no connection to the peer, are the request's fault rather than the server's
+	sent, err := s.backend.Send(request.To, request.Text)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sent)
+}
+
+// Push every backend event as a JSON text frame until the client goes away
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	// The token authenticates the stream as it does every other request, whatever page it was opened from
+	stream, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		logger.Debug("could not start an event stream", logging.KeyErr, err)
+		return
+	}
+	defer stream.CloseNow()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		stream.Close(websocket.StatusGoingAway, "server closed")
+		return
+	}
+	s.streams[stream] = struct{}{}
+	s.mu.Unlock()
+
+	events, unsubscribe := s.backend.Subscribe()
+	defer func() {
+		unsubscribe()
+		s.mu.Lock()
+		delete(s.streams, stream)
+		s.mu.Unlock()
+	}()
+
+	// Answers pings and the client's close; a message from the client ends the stream
+	gone := stream.CloseRead(context.Background())
+	for {
+		select {
+		case <-gone.Done():
+			logger.Debug("event stream ended", logging.KeyErr, context.Cause(gone))
+			return
+		case event, ok := <-events:
+			if !ok {
+				stream.Close(websocket.StatusGoingAway, "backend closed")
+				return
+			}
+			jsonData, err := json.Marshal(event)
+			if err != nil {
+				logger.Error("could not encode event", logging.KeyErr, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(gone, WRITE_TIMEOUT)
+			err = stream.Write(ctx, websocket.MessageText, jsonData)
+			cancel()
+			if err != nil {
+				logger.Debug("event stream ended", logging.KeyErr, err)
+				return
+			}
+		}
+	}
+}
+
+// Query parameters of GET /messages, timestamps in RFC 3339
+func parseFilter(r *http.Request) (db.MessageFilter, error) {
+	query := r.URL.Query()
+	filter := db.MessageFilter{Peer: query.Get("peer")}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return filter, fmt.Errorf("invalid since, expected an RFC 3339 timestamp: %q", since)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339Nano, until); err != nil {
+			return filter, fmt.Errorf("invalid until, expected an RFC 3339 timestamp: %q", until)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			return filter, fmt.Errorf("invalid limit, expected a positive number: %q", limit)
+		}
+	}
+	return filter, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Warn("could not write response", logging.KeyErr, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Read the token from path, generating one the first time
+func LoadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return RotateToken(path)
+}
+
+// Replace the token, locking out every client that used the old one
+func RotateToken(path string) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write the API token: %v", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/message"
+	"bokkoli/internal/message/messagetest"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const testToken string = "test-token"
+
+func newTestServer(t *testing.T, backend message.Backend) string {
+	server, err := Listen("127.0.0.1:0", backend, testToken)
+	if err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve()
+	return "http://" + server.Addr() + PATH_PREFIX
+}
+
+func request(t *testing.T, method string, url string, body string, result any) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Got an error on request: ", err)
+	}
+	defer response.Body.Close()
+
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatal("Got an error decoding the response: ", err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestListenOnlyOnLoopback(t *testing.T) {
+	if _, err := Listen("0.0.0.0:0", messagetest.NewNode(t, "alice"), testToken); err == nil {
+		t.Error("Expected an error listening on every interface")
+	}
+	if _, err := Listen("127.0.0.1:0", messagetest.NewNode(t, "alice"), ""); err == nil {
+		t.Error("Expected an error listening without a token")
+	}
+}
+
+func TestRequiresToken(t *testing.T) {
+	url := newTestServer(t, messagetest.NewNode(t, "alice"))
+
+	for _, target := range []string{url + "/status", url + "/status?token=wrong"} {
+		response, err := http.Get(target)
+		if err != nil {
+			t.Fatal("Got an error on request: ", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", target, response.StatusCode)
+		}
+	}
+
+	response, err := http.Get(url + "/status?token=" + testToken)
+	if err != nil {
+		t.Fatal("Got an error on request: ", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected the token query parameter to be accepted, got %d", response.StatusCode)
+	}
+}
+
+func TestSendAndHistory(t *testing.T) {
+	receiver := messagetest.NewNode(t, "bob")
+	if err := receiver.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	sender := messagetest.NewNode(t, "alice")
+	address, err := sender.Connect(messagetest.ListenPort(t, receiver))
+	if err != nil {
+		t.Fatal("Got an error connecting: ", err)
+	}
+	url := newTestServer(t, sender)
+
+	var sent db.Message
+	if status := request(t, http.MethodPost, url+"/messages", `{"to": "`+address+`", "text": "hello bob"}`, &sent); status != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", status)
+	}
+	if sent.Text != "hello bob" || sent.Direction != db.Outgoing {
+		t.Errorf("Expected the sent message back, got %+v", sent)
+	}
+
+	var failure map[string]string
+	if status := request(t, http.MethodPost, url+"/messages", `{"text": " "}`, &failure); status != http.StatusBadRequest || failure["error"] == "" {
+		t.Errorf("Expected 400 with an error for an empty message, got %d %v", status, failure)
+	}
+
+	var messages []db.Message
+	if status := request(t, http.MethodGet, url+"/messages?limit=10", "", &messages); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if len(messages) != 1 || messages[0].Text != "hello bob" {
+		t.Errorf("Expected one stored message, got %+v", messages)
+	}
+
+	if status := request(t, http.MethodGet, url+"/messages?since=yesterday", "", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid since, got %d", status)
+	}
+
+	var conversations []db.Conversation
+	if status := request(t, http.MethodGet, url+"/conversations", "", &conversations); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if len(conversations) != 1 || conversations[0].MessageCount != 1 || conversations[0].LastMessage.Text != "hello bob" {
+		t.Errorf("Expected one conversation, got %+v", conversations)
+	}
+}
+
+// Open the event stream the way a browser would, with the token as query parameter
+func dialEvents(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, _, err := websocket.Dial(ctx, strings.Replace(url, "http://", "ws://", 1)+"/events?token="+testToken, nil)
+	if err != nil {
+		t.Fatal("Got an error opening the event stream: ", err)
+	}
+	t.Cleanup(func() { stream.CloseNow() })
+	return stream
+}
+
+func TestEventStream(t *testing.T) {
+	node := messagetest.NewNode(t, "alice")
+	stream := dialEvents(t, newTestServer(t, node))
+
+	// Subscribing happens after the handshake, keep connecting until an event arrives
+	received := make(chan message.Event, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		kind, payload, err := stream.Read(ctx)
+		var event message.Event
+		if err == nil && kind == websocket.MessageText && json.Unmarshal(payload, &event) == nil {
+			received <- event
+		}
+		close(received)
+	}()
+	if err := node.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	port := messagetest.ListenPort(t, node)
+	for {
+		peer, err := net.Dial("tcp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatal("Got an error connecting: ", err)
+		}
+		defer peer.Close()
+
+		select {
+		case event, ok := <-received:
+			if !ok {
+				t.Fatal("Expected an event frame")
+			}
+			if event.Type != message.EventListening && event.Type != message.EventConnected {
+				t.Errorf("Expected a listening or connection event, got %+v", event)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestCloseEndsEventStreams(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", messagetest.NewNode(t, "alice"), testToken)
+	if err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	go server.Serve()
+	stream := dialEvents(t, "http://"+server.Addr()+PATH_PREFIX)
+
+	closed := make(chan error, 1)
+	go func() { closed <- server.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := stream.Read(ctx); websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Errorf("Expected the stream to be closed as going away, got %v", err)
+	}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Got an error closing: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected Close to return once the client answered")
+	}
+}
+
+func TestLoadToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.token")
+
+	token, err := LoadToken(path)
+	if err != nil || len(token) != 64 {
+		t.Fatalf("Expected a generated token, got %q (%v)", token, err)
+	}
+	again, err := LoadToken(path)
+	if err != nil || again != token {
+		t.Errorf("Expected the same token the second time, got %q (%v)", again, err)
+	}
+	rotated, err := RotateToken(path)
+	if err != nil || rotated == token {
+		t.Errorf("Expected a new token after rotating, got %q (%v)", rotated, err)
+	}
+}
@@ -0,0 +1,261 @@
+package bot
+
+import (
+	"bokkoli/internal/command"
+	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/message"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Runes of the original message quoted by a reaction
+const REACTION_QUOTE_SIZE int = 40
+
+var logger = logging.For(logging.BOT)
+
+// Handles one incoming message; a returned error is sent back to whoever wrote it
+type Handler func(c *Context) error
+
+// A task run on a ticker, e.g. for scheduled posts; errors are only logged
+type Task func(b *Bot) error
+
+type commandHandler struct {
+	help    string
+	handler Handler
+}
+
+type patternHandler struct {
+	pattern *regexp.Regexp
+	handler Handler
+}
+
+type scheduledTask struct {
+	interval time.Duration
+	task     Task
+}
+
+// A headless chat participant on top of a backend. Register handlers first, then Start it.
+// The backend stays owned by the caller.
+type Bot struct {
+	backend  message.Backend
+	commands map[string]commandHandler
+	patterns []patternHandler
+	tasks    []scheduledTask
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func New(backend message.Backend) *Bot {
+	b := &Bot{backend: backend, commands: make(map[string]commandHandler)}
+	b.commands["help"] = commandHandler{help: "List the commands this bot answers to", handler: b.help}
+	return b
+}
+
+func (b *Bot) Backend() message.Backend {
+	return b.backend
+}
+
+func (b *Bot) Listen(port string) error {
+	return b.backend.Listen(port)
+}
+
+func (b *Bot) Connect(address string) (string, error) {
+	return b.backend.Connect(address)
+}
+
+// Answer "/name args..." with the handler; names are case-insensitive and replace earlier ones, "help" included
+func (b *Bot) Command(name string, help string, handler Handler) error {
+	name = strings.ToLower(strings.TrimPrefix(name, command.PREFIX))
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid command name %q", name)
+	}
+	b.commands[name] = commandHandler{help: help, handler: handler}
+	return nil
+}
+
+// Answer messages matching the regular expression. Only the first matching pattern runs, commands never reach patterns.
+func (b *Bot) Hear(pattern string, handler Handler) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	b.patterns = append(b.patterns, patternHandler{pattern: re, handler: handler})
+	return nil
+}
+
+// Run the task every interval while the bot runs
+func (b *Bot) Every(interval time.Duration, task Task) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", interval)
+	}
+	b.tasks = append(b.tasks, scheduledTask{interval: interval, task: task})
+	return nil
+}
+
+// Send a message to a peer by username or address
+func (b *Bot) Post(to string, text string) error {
+	_, err := b.backend.Send(to, text)
+	return err
+}
+
+// Start answering incoming messages and running the scheduled tasks, until Stop or until the backend goes away
+func (b *Bot) Start() {
+	events, unsubscribe := b.backend.Subscribe()
+	b.stop, b.done = make(chan struct{}), make(chan struct{})
+	go b.run(events, unsubscribe)
+}
+
+// Stop the bot and wait for the running handler and tasks to finish
+func (b *Bot) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	<-b.done
+}
+
+// Closed once the bot has stopped
+func (b *Bot) Done() <-chan struct{} {
+	return b.done
+}
+
+func (b *Bot) run(events <-chan message.Event, unsubscribe func()) {
+	defer close(b.done)
+	defer unsubscribe()
+
+	var tasks sync.WaitGroup
+	finished := make(chan struct{})
+	defer func() {
+		close(finished)
+		tasks.Wait()
+	}()
+	for _, t := range b.tasks {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			b.schedule(t, finished)
+		}()
+	}
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == message.EventMessage && event.Incoming && event.Message != nil {
+				b.dispatch(event)
+			}
+		}
+	}
+}
+
+func (b *Bot) schedule(t scheduledTask, done <-chan struct{}) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := t.task(b); err != nil {
+				logger.Warn("scheduled task failed", logging.KeyErr, err)
+			}
+		}
+	}
+}
+
+// Hand a message to its command or the first matching pattern
+func (b *Bot) dispatch(event message.Event) {
+	c := &Context{bot: b, From: event.Name, Peer: event.Peer, Message: *event.Message}
+	if c.From == "" {
+		c.From = event.Peer
+	}
+
+	text := strings.TrimSpace(event.Message.Text)
+	var handler Handler
+	if strings.HasPrefix(text, command.PREFIX) {
+		fields := strings.Fields(strings.TrimPrefix(text, command.PREFIX))
+		if len(fields) == 0 {
+			return
+		}
+		cmd, ok := b.commands[strings.ToLower(fields[0])]
+		if !ok {
+			handler = func(c *Context) error {
+				return fmt.Errorf("unknown command %s%s, try %shelp", command.PREFIX, fields[0], command.PREFIX)
+			}
+		} else {
+			handler, c.Args = cmd.handler, fields[1:]
+		}
+	} else {
+		for _, p := range b.patterns {
+			if match := p.pattern.FindStringSubmatch(text); match != nil {
+				handler, c.Match = p.handler, match
+				break
+			}
+		}
+	}
+	if handler == nil {
+		return
+	}
+
+	if err := handler(c); err != nil {
+		logger.Debug("handler failed", logging.KeyPeer, c.From, logging.KeyErr, err)
+		if err := c.Reply(err.Error()); err != nil {
+			logger.Warn("could not reply", logging.KeyPeer, c.From, logging.KeyErr, err)
+		}
+	}
+}
+
+func (b *Bot) help(c *Context) error {
+	names := make([]string, 0, len(b.commands))
+	for name := range b.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, command.PREFIX+name+" - "+b.commands[name].help)
+	}
+	return c.Reply(strings.Join(lines, "\n"))
+}
+
+// The message a handler runs for
+type Context struct {
+	bot *Bot
+	// Username of the sender, or their address when they never said
+	From string
+	// Address of the connection the message arrived on
+	Peer    string
+	Message db.Message
+	// Words after the command name, for command handlers
+	Args []string
+	// The match and its submatches, for pattern handlers
+	Match []string
+}
+
+func (c *Context) Bot() *Bot {
+	return c.bot
+}
+
+// Answer the sender over the connection the message arrived on
+func (c *Context) Reply(text string) error {
+	return c.bot.Post(c.Peer, text)
+}
+
+// The protocol has no reactions, so they are sent as a message quoting the start of the original
+func (c *Context) React(emoji string) error {
+	quote := strings.Join(strings.Fields(c.Message.Text), " ")
+	if utf8.RuneCountInString(quote) > REACTION_QUOTE_SIZE {
+		quote = string([]rune(quote)[:REACTION_QUOTE_SIZE]) + "…"
+	}
+	return c.Reply(fmt.Sprintf("%s > %s", emoji, quote))
+}
@@ -0,0 +1,165 @@
+package bot
+
+import (
+	"bokkoli/internal/message"
+	"bokkoli/internal/message/messagetest"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A node listening on a free port, which it returns along with the node
+func newTestNode(t *testing.T, username string) (*message.Node, string) {
+	node := messagetest.NewNode(t, username)
+	if err := node.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	return node, messagetest.ListenPort(t, node)
+}
+
+type chat struct {
+	t      *testing.T
+	alice  *message.Node
+	bot    string
+	events <-chan message.Event
+}
+
+// Start the bot on one node and connect alice to it, the bot replies over alice's connection
+func startBot(t *testing.T, setup func(b *Bot) error) *chat {
+	botNode, botPort := newTestNode(t, "bot")
+	alice, _ := newTestNode(t, "alice")
+	events, unsubscribe := alice.Subscribe()
+	t.Cleanup(unsubscribe)
+
+	address, err := alice.Connect(botPort)
+	if err != nil {
+		t.Fatal("Got an error connecting: ", err)
+	}
+
+	b := New(botNode)
+	if err := setup(b); err != nil {
+		t.Fatal("Got an error setting up the bot: ", err)
+	}
+	b.Start()
+	t.Cleanup(b.Stop)
+	return &chat{t: t, alice: alice, bot: address, events: events}
+}
+
+// Send as alice and return the text of the bot's next message
+func (c *chat) ask(text string) string {
+	c.t.Helper()
+	if _, err := c.alice.Send(c.bot, text); err != nil {
+		c.t.Fatal("Got an error sending: ", err)
+	}
+	return c.next(2 * time.Second)
+}
+
+func (c *chat) next(timeout time.Duration) string {
+	c.t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-c.events:
+			if event.Type == message.EventMessage && event.Incoming {
+				return event.Message.Text
+			}
+		case <-deadline:
+			c.t.Fatal("Timed out waiting for the bot")
+			return ""
+		}
+	}
+}
+
+func TestCommandsAndPatterns(t *testing.T) {
+	c := startBot(t, func(b *Bot) error {
+		if err := b.Command("/Ping", "Answer with pong", func(c *Context) error {
+			return c.Reply("pong " + strings.Join(c.Args, " "))
+		}); err != nil {
+			return err
+		}
+		return b.Hear(`^hello (\w+)`, func(c *Context) error {
+			return c.Reply("hi " + c.Match[1] + ", I'm talking to " + c.From)
+		})
+	})
+
+	if reply := c.ask("/ping a b"); reply != "pong a b" {
+		t.Errorf("Expected 'pong a b', got %q", reply)
+	}
+	if reply := c.ask("hello bot"); reply != "hi bot, I'm talking to alice" {
+		t.Errorf("Expected the pattern handler to answer, got %q", reply)
+	}
+	if reply := c.ask("/frobnicate"); !strings.Contains(reply, "unknown command /frobnicate") {
+		t.Errorf("Expected an unknown command error, got %q", reply)
+	}
+	if reply := c.ask("/help"); !strings.Contains(reply, "/ping - Answer with pong") || !strings.Contains(reply, "/help - ") {
+		t.Errorf("Expected the commands listed, got %q", reply)
+	}
+}
+
+func TestReactAndErrors(t *testing.T) {
+	c := startBot(t, func(b *Bot) error {
+		return b.Command("check", "", func(c *Context) error {
+			if len(c.Args) == 0 {
+				return c.React("👍")
+			}
+			return errors.New("invalid arguments")
+		})
+	})
+
+	if reply := c.ask("/check"); reply != "👍 > /check" {
+		t.Errorf("Expected a reaction quoting the message, got %q", reply)
+	}
+	if reply := c.ask("/check this"); reply != "invalid arguments" {
+		t.Errorf("Expected the handler's error as reply, got %q", reply)
+	}
+}
+
+func TestReminder(t *testing.T) {
+	c := startBot(t, Reminder)
+
+	if reply := c.ask("/remind 1s put the kettle on"); !strings.HasPrefix(reply, "I'll remind you at ") {
+		t.Errorf("Expected a confirmation, got %q", reply)
+	}
+	if reply := c.next(3 * time.Second); reply != "⏰ put the kettle on" {
+		t.Errorf("Expected the reminder, got %q", reply)
+	}
+	if reply := c.ask("/remind soon tea"); !strings.Contains(reply, "expected a duration") {
+		t.Errorf("Expected a usage error, got %q", reply)
+	}
+}
+
+func TestDice(t *testing.T) {
+	c := startBot(t, Dice)
+
+	if reply := c.ask("/roll 3d1+2"); reply != "🎲 3d1+2: 1 + 1 + 1 +2 = 5" {
+		t.Errorf("Expected a sum of 5, got %q", reply)
+	}
+	if reply := c.ask("/roll 0d6"); !strings.Contains(reply, "between 1 and") {
+		t.Errorf("Expected a limit error, got %q", reply)
+	}
+
+	cases := map[string][3]int{"d20": {1, 20, 0}, "2d6": {2, 6, 0}, "4d8-1": {4, 8, -1}}
+	for notation, expected := range cases {
+		count, sides, modifier, err := parseDice(notation)
+		if err != nil || [3]int{count, sides, modifier} != expected {
+			t.Errorf("%s: expected %v, got %d %d %d (%v)", notation, expected, count, sides, modifier, err)
+		}
+	}
+	if _, _, _, err := parseDice("banana"); err == nil {
+		t.Error("Expected an error for a malformed roll")
+	}
+}
+
+func TestRegistrationErrors(t *testing.T) {
+	b := New(nil)
+	if err := b.Command("two words", "", nil); err == nil {
+		t.Error("Expected an error for a command name with a space")
+	}
+	if err := b.Hear("(", nil); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+	if err := b.Every(0, nil); err == nil {
+		t.Error("Expected an error for a zero interval")
+	}
+}
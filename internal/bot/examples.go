@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the dice roller, so a roll fits in a message
+const (
+	MAX_DICE  int = 100
+	MAX_SIDES int = 1000
+)
+
+// How often the reminder bot looks for reminders that are due
+const REMINDER_CHECK_INTERVAL time.Duration = time.Second
+
+// Example bots, run headless with 'bokkoli bot <name>'
+var Examples = map[string]func(b *Bot) error{
+	"echo":     Echo,
+	"dice":     Dice,
+	"reminder": Reminder,
+}
+
+// Sends every message back to whoever wrote it
+func Echo(b *Bot) error {
+	return b.Hear(`(?s).+`, func(c *Context) error {
+		return c.Reply(c.Message.Text)
+	})
+}
+
+var dicePattern = regexp.MustCompile(`^(\d*)d(\d+)([+-]\d+)?$`)
+
+// Rolls dice in the usual notation: "/roll 2d6+1", one six-sided die by default
+func Dice(b *Bot) error {
+	return b.Command("roll", "Roll dice, e.g. /roll 2d6+1", func(c *Context) error {
+		notation := "1d6"
+		if len(c.Args) > 0 {
+			notation = strings.ToLower(strings.Join(c.Args, ""))
+		}
+		count, sides, modifier, err := parseDice(notation)
+		if err != nil {
+			return err
+		}
+
+		rolls := make([]string, count)
+		total, highest := modifier, true
+		for i := range rolls {
+			roll := rand.IntN(sides) + 1
+			rolls[i] = strconv.Itoa(roll)
+			total += roll
+			highest = highest && roll == sides
+		}
+
+		result := fmt.Sprintf("🎲 %s: %s", notation, strings.Join(rolls, " + "))
+		if modifier != 0 {
+			result += fmt.Sprintf(" %+d", modifier)
+		}
+		if count > 1 || modifier != 0 {
+			result += fmt.Sprintf(" = %d", total)
+		}
+		if err := c.Reply(result); err != nil {
+			return err
+		}
+		if highest && sides > 1 {
+			return c.React("🎉")
+		}
+		return nil
+	})
+}
+
+func parseDice(notation string) (count int, sides int, modifier int, err error) {
+	match := dicePattern.FindStringSubmatch(notation)
+	if match == nil {
+		return 0, 0, 0, fmt.Errorf("expected dice like 2d6 or d20+3, got %q", notation)
+	}
+
+	count = 1
+	if match[1] != "" {
+		count, _ = strconv.Atoi(match[1])
+	}
+	sides, _ = strconv.Atoi(match[2])
+	if match[3] != "" {
+		modifier, _ = strconv.Atoi(match[3])
+	}
+
+	if count < 1 || count > MAX_DICE {
+		return 0, 0, 0, fmt.Errorf("roll between 1 and %d dice", MAX_DICE)
+	}
+	if sides < 1 || sides > MAX_SIDES {
+		return 0, 0, 0, fmt.Errorf("dice have between 1 and %d sides", MAX_SIDES)
+	}
+	return count, sides, modifier, nil
+}
+
+type reminder struct {
+	to   string
+	text string
+	due  time.Time
+}
+
+// Reminders are kept in memory, they are lost when the bot stops
+type reminders struct {
+	mu      sync.Mutex
+	pending []reminder
+}
+
+// Posts a message back after a while: "/remind 10m stretch"
+func Reminder(b *Bot) error {
+	r := &reminders{}
+
+	err := b.Command("remind", "Remind you later, e.g. /remind 10m stretch", func(c *Context) error {
+		if len(c.Args) < 2 {
+			return fmt.Errorf("usage: /remind <duration> <text>, e.g. /remind 1h30m call bob")
+		}
+		after, err := time.ParseDuration(c.Args[0])
+		if err != nil || after < REMINDER_CHECK_INTERVAL {
+			return fmt.Errorf("expected a duration of at least %s like 90s or 1h30m, got %q", REMINDER_CHECK_INTERVAL, c.Args[0])
+		}
+
+		due := time.Now().Add(after)
+		r.mu.Lock()
+		r.pending = append(r.pending, reminder{to: c.Peer, text: strings.Join(c.Args[1:], " "), due: due})
+		r.mu.Unlock()
+		return c.Reply("I'll remind you at " + due.Format("15:04:05"))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.Command("reminders", "List your pending reminders", func(c *Context) error {
+		r.mu.Lock()
+		var lines []string
+		for _, rem := range r.pending {
+			if rem.to == c.Peer {
+				lines = append(lines, rem.due.Format("15:04:05")+" "+rem.text)
+			}
+		}
+		r.mu.Unlock()
+
+		if len(lines) == 0 {
+			return c.Reply("No reminders pending")
+		}
+		sort.Strings(lines)
+		return c.Reply(strings.Join(lines, "\n"))
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.Every(REMINDER_CHECK_INTERVAL, r.postDue)
+}
+
+func (r *reminders) postDue(b *Bot) error {
+	now := time.Now()
+	r.mu.Lock()
+	var due []reminder
+	pending := r.pending[:0]
+	for _, rem := range r.pending {
+		if rem.due.After(now) {
+			pending = append(pending, rem)
+		} else {
+			due = append(due, rem)
+		}
+	}
+	r.pending = pending
+	r.mu.Unlock()
+
+	var errs []error
+	for _, rem := range due {
+		if err := b.Post(rem.to, "⏰ "+rem.text); err != nil {
+			errs = append(errs, fmt.Errorf("reminder for %s: %v", rem.to, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"bokkoli/internal/api"
+	"bokkoli/internal/message"
+	"fmt"
+	"os"
+)
+
+// 'api' serves the HTTP API in the foreground, on top of the daemon when one is running; 'api token' prints the token
+func runAPI(env *environment, args []string) error {
+	flags := env.flagSet("api", "[--address <host:port>] [--socket <path>] [token [--rotate]]")
+	address := flags.String("address", env.config.APIAddress, "loopback host and port to listen on")
+	socket := flags.String("socket", env.config.SocketPath(), "control socket of a running daemon to attach to")
+	rotate := flags.Bool("rotate", false, "with 'token', replace the token, locking out current clients")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		backend, closeBackend, err := env.openBackend(*socket)
+		if err != nil {
+			return err
+		}
+		defer closeBackend()
+		return env.serveAPI(*address, backend)
+	}
+
+	// Flags may also follow the action
+	action := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return err
+	}
+	if action != "token" || flags.NArg() > 0 {
+		return usageError(flags, "unknown action, expected 'token'")
+	}
+
+	if err := os.MkdirAll(env.config.ProfileDir(), 0o700); err != nil {
+		return fmt.Errorf("failed to create profile directory: %v", err)
+	}
+	load := api.LoadToken
+	if *rotate {
+		load = api.RotateToken
+	}
+	token, err := load(env.config.APITokenPath())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(env.stdout, token)
+	return nil
+}
+
+// Serve the API until interrupted
+func (env *environment) serveAPI(address string, backend message.Backend) error {
+	server, err := env.startAPI(address, backend)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	waitForInterrupt()
+	return nil
+}
+
+func (env *environment) startAPI(address string, backend message.Backend) (*api.Server, error) {
+	if err := os.MkdirAll(env.config.ProfileDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create profile directory: %v", err)
+	}
+	token, err := api.LoadToken(env.config.APITokenPath())
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := api.Listen(address, backend, token)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	fmt.Fprintf(env.stderr, "HTTP API on http://%s%s, token in %s\n", server.Addr(), api.PATH_PREFIX, env.config.APITokenPath())
+	return server, nil
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"bokkoli/internal/bot"
+	"fmt"
+	"strings"
+)
+
+// 'bot <name>' runs one of the example bots headless until interrupted, on top of the daemon when one is running
+func runBot(env *environment, args []string) error {
+	names := sortedKeys(bot.Examples)
+	flags := env.flagSet("bot", "<"+strings.Join(names, "|")+"> [--port <port>] [--connect <address>] [--username <name>] [--socket <path>]")
+	port := flags.String("port", "", "port to listen on for peers")
+	connect := flags.String("connect", "", "comma separated peers to connect to, e.g. to post to them first")
+	username := flags.String("username", "", "username to chat as, by default the profile's")
+	socket := flags.String("socket", env.config.SocketPath(), "control socket of a running daemon to attach to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	positional, err := parseInterleaved(flags, flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(flags, "expected the name of a bot: %s", strings.Join(names, ", "))
+	}
+	setup, ok := bot.Examples[positional[0]]
+	if !ok {
+		return usageError(flags, "unknown bot %q, expected one of: %s", positional[0], strings.Join(names, ", "))
+	}
+
+	backend, closeBackend, err := env.openBackend(*socket)
+	if err != nil {
+		return err
+	}
+	defer closeBackend()
+
+	b := bot.New(backend)
+	if err := setup(b); err != nil {
+		return err
+	}
+
+	if *username != "" {
+		if err := backend.SetUsername(*username); err != nil {
+			return err
+		}
+	}
+	if *port != "" {
+		if err := b.Listen(*port); err != nil {
+			return err
+		}
+	}
+	for _, address := range splitList(*connect) {
+		if _, err := b.Connect(address); err != nil {
+			return err
+		}
+	}
+
+	b.Start()
+	go func() {
+		waitForInterrupt()
+		b.Stop()
+	}()
+	fmt.Fprintf(env.stderr, "%s bot running, Ctrl-C to stop\n", positional[0])
+	<-b.Done()
+	return nil
+}
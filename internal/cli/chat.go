@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"bokkoli/internal/message"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const PEER_NAME_TIMEOUT time.Duration = time.Second
+
+// Listen until interrupted, printing every incoming message (text) or every event (json lines)
+func runListen(env *environment, args []string) error {
+	flags := env.flagSet("listen", "[--port <port>] [--format text|json]")
+	port := flags.String("port", "", "port to listen on, defaults to the port in your settings")
+	format := flags.String("format", FORMAT_TEXT, "output format: text or json (one event per line)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+
+	profileLock, err := env.config.LockProfile()
+	if err != nil {
+		return err
+	}
+	defer profileLock.Release()
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	settings, _ := dbHandler.ReadSetup()
+	if *port == "" {
+		*port = settings.Port
+	}
+	if *port == "" {
+		return usageError(flags, "no port given and none saved in your settings")
+	}
+
+	node, err := env.newNode(dbHandler, settings.Username, false)
+	if err != nil {
+		return err
+	}
+	events, _ := node.Subscribe()
+	if err := node.Listen(*port); err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	for {
+		select {
+		case <-interrupt:
+			return node.Close()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := env.printEvent(event, *format); err != nil {
+				node.Close()
+				return err
+			}
+		}
+	}
+}
+
+func (env *environment) printEvent(event message.Event, format string) error {
+	if format == FORMAT_JSON {
+		return env.writeJSON(event)
+	}
+
+	switch event.Type {
+	case message.EventMessage:
+		_, err := fmt.Fprintf(env.stdout, "%s %s: %s\n", event.Message.Timestamp.Format("2006-01-02 15:04"), event.Message.Sender, event.Message.Text)
+		return err
+	case message.EventListening:
+		fmt.Fprintln(env.stderr, "listening on", event.Peer)
+	case message.EventConnected, message.EventDisconnected:
+		fmt.Fprintln(env.stderr, event.Peer, event.Type)
+	case message.EventError:
+		fmt.Fprintln(env.stderr, "error:", event.Error)
+	case message.EventRejected:
+		fmt.Fprintf(env.stderr, "rejected %s: %s\n", event.Peer, event.Error)
+	}
+	return nil
+}
+
+// Send one message and exit; the text comes from the arguments, or stdin when there are none or it is "-"
+func runSend(env *environment, args []string) error {
+	flags := env.flagSet("send", "--to <host:port> [--format text|json] [--] [text...]")
+	to := flags.String("to", "", "peer address as port or host:port (required)")
+	format := flags.String("format", FORMAT_TEXT, "output format: text (silent) or json (the sent message)")
+	words, err := parseInterleaved(flags, args)
+	if err != nil {
+		return err
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+	if *to == "" {
+		return usageError(flags, "--to is required")
+	}
+
+	text := strings.Join(words, " ")
+	if text == "" || text == "-" {
+		data, err := io.ReadAll(bufio.NewReader(env.stdin))
+		if err != nil {
+			return fmt.Errorf("failed to read message from stdin: %v", err)
+		}
+		text = strings.TrimRight(string(data), "\n")
+	}
+	if strings.TrimSpace(text) == "" {
+		return usageError(flags, "refusing to send an empty message")
+	}
+
+	profileLock, err := env.config.LockProfile()
+	if err != nil {
+		return err
+	}
+	defer profileLock.Release()
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	settings, _ := dbHandler.ReadSetup()
+	node, err := env.newNode(dbHandler, settings.Username, false)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	events, _ := node.Subscribe()
+	address, err := node.Connect(*to)
+	if err != nil {
+		return err
+	}
+	awaitPeerName(events, address)
+
+	sent, err := node.Send(address, text)
+	if err != nil {
+		return err
+	}
+
+	if *format == FORMAT_JSON {
+		return env.writeJSON(sent)
+	}
+	return nil
+}
+
+// Wait briefly for the first pong so the message is stored under the peer's username rather than its address
+func awaitPeerName(events <-chan message.Event, address string) {
+	timeout := time.After(PEER_NAME_TIMEOUT)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == message.EventLatency && event.Peer == address {
+				return
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package cli
+
+import (
+	"bokkoli/internal/config"
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"bokkoli/internal/message"
+	"bokkoli/internal/webhook"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exit codes shared by every subcommand
+const (
+	EXIT_OK      int = 0
+	EXIT_FAILURE int = 1
+	EXIT_USAGE   int = 2
+)
+
+const (
+	FORMAT_TEXT  string = "text"
+	FORMAT_JSON  string = "json"
+	FORMAT_JSONL string = "jsonl"
+)
+
+// Returned by subcommands when the arguments are wrong, mapped to EXIT_USAGE
+var errUsage = errors.New("usage error")
+
+type subcommand struct {
+	name    string
+	summary string
+	run     func(env *environment, args []string) error
+}
+
+// What a subcommand needs from the outside world, swapped out in tests
+type environment struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	config *config.Config
+	// Buffers stdin when passphrases are read from it line by line
+	stdinReader *bufio.Reader
+}
+
+func subcommands() []subcommand {
+	return []subcommand{
+		{name: "listen", summary: "Listen for peers and print incoming messages", run: runListen},
+		{name: "send", summary: "Send a single message to a peer", run: runSend},
+		{name: "pipe", summary: "Chat through JSON lines on stdin and stdout", run: runPipe},
+		{name: "history", summary: "Print stored messages", run: runHistory},
+		{name: "export", summary: "Write conversations as JSON, Markdown, HTML or IRC-style logs", run: runExport},
+		{name: "import", summary: "Add messages from exports, IRC logs and CSV files to the history", run: runImport},
+		{name: "profiles", summary: "List profiles and whether they are in use", run: runProfiles},
+		{name: "config", summary: "Read or change settings", run: runConfig},
+		{name: "daemon", summary: "Keep connections open in the background for the chat to attach to", run: runDaemon},
+		{name: "api", summary: "Serve the local HTTP and WebSocket API", run: runAPI},
+		{name: "irc", summary: "Serve an IRC gateway for IRC clients to chat through", run: runIRC},
+		{name: "webhook", summary: "Manage webhooks told about messages and connections", run: runWebhook},
+		{name: "bot", summary: "Run one of the example bots headless", run: runBot},
+		{name: "plugin", summary: "Install, enable and remove chat plugins", run: runPlugin},
+		{name: "contacts", summary: "List, allow and block the peers asked about", run: runContacts},
+		{name: "passphrase", summary: "Encrypt the profile with a passphrase, change or remove it", run: runPassphrase},
+		{name: "db", summary: "Show database statistics, run maintenance and archive conversations", run: runDb},
+	}
+}
+
+// Run a subcommand and return the process exit code
+func Run(cfg *config.Config, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	env := &environment{stdin: stdin, stdout: stdout, stderr: stderr, config: cfg}
+	return env.run(args)
+}
+
+func (env *environment) run(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		env.usage()
+		return EXIT_OK
+	}
+
+	for _, sub := range subcommands() {
+		if sub.name != args[0] {
+			continue
+		}
+
+		err := sub.run(env, args[1:])
+		switch {
+		case err == nil:
+			return EXIT_OK
+		case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+			return EXIT_USAGE
+		default:
+			fmt.Fprintln(env.stderr, "bokkoli "+sub.name+":", err)
+			return EXIT_FAILURE
+		}
+	}
+
+	fmt.Fprintf(env.stderr, "bokkoli: unknown command %q\n\n", args[0])
+	env.usage()
+	return EXIT_USAGE
+}
+
+func (env *environment) usage() {
+	fmt.Fprintln(env.stderr, "Usage: bokkoli [global flags] [command] [flags]")
+	fmt.Fprintln(env.stderr, "\nWithout a command the interactive chat is started.\n\nCommands:")
+	for _, sub := range subcommands() {
+		fmt.Fprintf(env.stderr, "  %-10s %s\n", sub.name, sub.summary)
+	}
+	fmt.Fprintln(env.stderr, "\nGlobal flags, which override the config file and environment variables:")
+	config.PrintFlags(env.stderr)
+	fmt.Fprintln(env.stderr, "\nRun 'bokkoli <command> -h' for the flags of a command.")
+}
+
+func (env *environment) flagSet(name string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "Usage: bokkoli %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Report a usage problem together with the command's usage text
+func usageError(flags *flag.FlagSet, format string, args ...any) error {
+	fmt.Fprintf(flags.Output(), format+"\n", args...)
+	flags.Usage()
+	return errUsage
+}
+
+// Parse flags that come after positional arguments too, returning the positional ones. Everything after "--" is positional.
+func parseInterleaved(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for len(args) > 0 {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		if parsed := len(args) - flags.NArg(); parsed > 0 && args[parsed-1] == "--" {
+			positional = append(positional, flags.Args()...)
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	return positional, nil
+}
+
+func validateFormat(flags *flag.FlagSet, format string, allowed ...string) error {
+	for _, a := range allowed {
+		if format == a {
+			return nil
+		}
+	}
+	return usageError(flags, "unknown format %q, expected one of: %s", format, strings.Join(allowed, ", "))
+}
+
+func (env *environment) openDb() (*db.DbHandler, error) {
+	if err := os.MkdirAll(env.config.ProfileDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	dbHandler, err := db.NewDbHandler(env.config.DbPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dbHandler.SetupSchemas(); err != nil {
+		dbHandler.Close()
+		return nil, fmt.Errorf("failed to set up database: %v", err)
+	}
+	if err := env.unlock(dbHandler); err != nil {
+		dbHandler.Close()
+		return nil, err
+	}
+	return dbHandler, nil
+}
+
+// Node with the profile's identity and the configured bind address and room password. Interactive nodes
+// ask about unknown peers when configured to; the others have nobody to ask and turn them away instead,
+// while contacts still get in or stay blocked as before.
+func (env *environment) newNode(dbHandler *db.DbHandler, username string, interactive bool) (*message.Node, error) {
+	key, err := identity.Load(env.config.IdentityPath(), dbHandler.Key())
+	if err != nil {
+		return nil, fmt.Errorf("could not load your identity key: %v", err)
+	}
+
+	node := message.NewNode(dbHandler, username)
+	node.SetIdentity(key)
+	node.SetBindAddress(env.config.BindAddress)
+	node.SetRoomPassword(env.config.RoomPassword)
+	policy := message.PeerPolicy(env.config.UnknownPeers)
+	if policy == message.PolicyAsk && !interactive {
+		policy = message.PolicyDeny
+	}
+	node.SetUnknownPeers(policy)
+	if !interactive {
+		allow := "bokkoli contacts allow"
+		if env.config.Profile != "" {
+			allow = "bokkoli --profile " + env.config.Profile + " contacts allow"
+		}
+		node.AddHook(&rejectionNotice{stderr: env.stderr, dbHandler: dbHandler, allow: allow})
+	}
+	node.AddHook(webhook.NewDispatcher(dbHandler))
+	if env.config.MaintenanceInterval > 0 {
+		node.StartMaintenance(env.retention(), time.Duration(env.config.MaintenanceInterval)*time.Hour)
+	}
+	return node, nil
+}
+
+// Tells whoever runs a headless command that a peer was turned away, and how to let it in if it was only unknown
+type rejectionNotice struct {
+	mu        sync.Mutex
+	stderr    io.Writer
+	dbHandler *db.DbHandler
+	// The command that allows a contact in this profile
+	allow string
+}
+
+func (r *rejectionNotice) HandleEvent(event message.Event) {
+	if event.Type != message.EventRejected {
+		return
+	}
+	who := event.Peer
+	if event.Name != "" {
+		who = fmt.Sprintf("%s (%s)", event.Name, event.Peer)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.stderr, "turned away %s: %s\n", who, event.Error)
+	if event.Fingerprint == "" {
+		return
+	}
+	if contact, err := r.dbHandler.FindContact(event.Fingerprint); err == nil && contact.Status == db.ContactPending {
+		fmt.Fprintf(r.stderr, "unknown peers are denied when nobody can be asked, let it in with: %s %q\n", r.allow, event.Fingerprint)
+	}
+}
+
+func (r *rejectionNotice) Close() error {
+	return nil
+}
+
+// Block until the process is asked to stop with Ctrl-C or SIGTERM
+func waitForInterrupt() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	<-interrupt
+}
+
+func (env *environment) writeJSON(value any) error {
+	encoder := json.NewEncoder(env.stdout)
+	return encoder.Encode(value)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
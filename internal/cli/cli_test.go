@@ -0,0 +1,498 @@
+package cli
+
+import (
+	"bokkoli/internal/config"
+	"bokkoli/internal/db"
+	"bokkoli/internal/db/dbtest"
+	"bokkoli/internal/identity"
+	"bokkoli/internal/message"
+	"bokkoli/internal/message/messagetest"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEnvironment(t *testing.T) (*environment, *bytes.Buffer, *bytes.Buffer) {
+	var stdout, stderr bytes.Buffer
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	env := &environment{
+		stdin:  strings.NewReader(""),
+		stdout: &stdout,
+		stderr: &stderr,
+		config: &cfg,
+	}
+	return env, &stdout, &stderr
+}
+
+func TestUnknownCommandExitCode(t *testing.T) {
+	env, _, _ := newTestEnvironment(t)
+
+	if code := env.run([]string{"veggie"}); code != EXIT_USAGE {
+		t.Errorf("Expected %d, got %d", EXIT_USAGE, code)
+	}
+}
+
+func TestConfigSetAndGet(t *testing.T) {
+	env, stdout, _ := newTestEnvironment(t)
+
+	if code := env.run([]string{"config", "set", "username", "Pickle132"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+	if code := env.run([]string{"config", "set", "port", "8080"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+
+	if code := env.run([]string{"config", "get", "username"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+	if result := stdout.String(); result != "Pickle132\n" {
+		t.Errorf("Expected 'Pickle132', got %q", result)
+	}
+}
+
+func TestConfigSetInvalidValue(t *testing.T) {
+	env, _, _ := newTestEnvironment(t)
+
+	if code := env.run([]string{"config", "set", "port", "20"}); code != EXIT_FAILURE {
+		t.Errorf("Expected %d, got %d", EXIT_FAILURE, code)
+	}
+	if code := env.run([]string{"config", "set", "veggie", "town"}); code != EXIT_USAGE {
+		t.Errorf("Expected %d, got %d", EXIT_USAGE, code)
+	}
+}
+
+func TestSendAndHistory(t *testing.T) {
+	env, stdout, stderr := newTestEnvironment(t)
+
+	receiverDb := dbtest.New(t)
+
+	receiver := message.NewNode(receiverDb, "bob")
+	defer receiver.Close()
+	events, _ := receiver.Subscribe()
+	if err := receiver.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+
+	env.run([]string{"config", "set", "username", "alice"})
+	stdout.Reset()
+	// Flags may follow the text
+	if code := env.run([]string{"send", "hello", "--to", messagetest.ListenPort(t, receiver), "bob", "--format", "json"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+	var sent db.Message
+	if err := json.Unmarshal(stdout.Bytes(), &sent); err != nil || sent.Text != "hello bob" {
+		t.Errorf("Expected the sent message as JSON, got %q (%v)", stdout.String(), err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for received := false; !received; {
+		select {
+		case event := <-events:
+			received = event.Type == message.EventMessage
+			if received && event.Message.Text != "hello bob" {
+				t.Errorf("Expected 'hello bob', got %q", event.Message.Text)
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the message")
+		}
+	}
+
+	stdout.Reset()
+	if code := env.run([]string{"history", "--peer", "bob", "--since", "1h", "--format", "json"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+
+	var messages []db.Message
+	if err := json.Unmarshal(stdout.Bytes(), &messages); err != nil {
+		t.Fatal("History is not valid JSON: ", err)
+	}
+	if len(messages) != 1 || messages[0].Text != "hello bob" || messages[0].Direction != db.Outgoing {
+		t.Errorf("Expected the outgoing 'hello bob', got %+v", messages)
+	}
+}
+
+// Nobody can answer a request outside the chat and daemon, so asking turns unknown peers away; contacts still get in
+func TestNonInteractiveUnknownPeers(t *testing.T) {
+	env, _, stderr := newTestEnvironment(t)
+	if env.config.UnknownPeers != config.UnknownPeersAsk {
+		t.Fatalf("Expected unknown peers to be asked about by default, got %q", env.config.UnknownPeers)
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		t.Fatal("Got an error opening the database: ", err)
+	}
+	defer dbHandler.Close()
+	node, err := env.newNode(dbHandler, "alice", false)
+	if err != nil {
+		t.Fatal("Got an error creating the node: ", err)
+	}
+	defer node.Close()
+	if err := node.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	port := messagetest.ListenPort(t, node)
+
+	strangerDb := dbtest.New(t)
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	connect := func() error {
+		stranger := message.NewNode(strangerDb, "bob")
+		defer stranger.Close()
+		stranger.SetIdentity(key)
+		_, err := stranger.Connect(port)
+		return err
+	}
+
+	if err := connect(); err == nil || !strings.Contains(err.Error(), "not accepted") {
+		t.Errorf("Expected an unknown peer to be turned away, got %v", err)
+	}
+	fingerprint := identity.Fingerprint(public)
+	if notice := stderr.String(); !strings.Contains(notice, "turned away bob") || !strings.Contains(notice, `bokkoli contacts allow "`+fingerprint+`"`) {
+		t.Errorf("Expected a notice on how to let the peer in, got %q", notice)
+	}
+
+	// The peer was remembered as pending, so the command from the notice lets it in
+	contact, known, _ := dbHandler.ReadContact(hex.EncodeToString(public))
+	if !known || contact.Status != db.ContactPending {
+		t.Fatalf("Expected the peer to be pending, got %+v", contact)
+	}
+	if code := env.run([]string{"contacts", "allow", fingerprint}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+	if err := connect(); err != nil {
+		t.Error("Expected an allowed contact to get in, got: ", err)
+	}
+}
+
+func TestSendWithoutPeer(t *testing.T) {
+	env, _, _ := newTestEnvironment(t)
+
+	if code := env.run([]string{"send", "hello"}); code != EXIT_USAGE {
+		t.Errorf("Expected %d, got %d", EXIT_USAGE, code)
+	}
+}
+
+func TestParseWhen(t *testing.T) {
+	now := time.Date(2025, 2, 22, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]time.Time{
+		"":           {},
+		"2d":         now.Add(-48 * time.Hour),
+		"1w":         now.Add(-7 * 24 * time.Hour),
+		"90m":        now.Add(-90 * time.Minute),
+		"2025-01-31": time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC),
+	}
+
+	for value, expected := range tests {
+		result, err := parseWhen(value, now)
+		if err != nil || !result.Equal(expected) {
+			t.Errorf("%q: expected %v, got %v (%v)", value, expected, result, err)
+		}
+	}
+
+	if _, err := parseWhen("yesterday", now); err == nil {
+		t.Error("Expected an error for 'yesterday', got nil")
+	}
+}
+
+func TestParseInterleaved(t *testing.T) {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	to := flags.String("to", "", "")
+	flags.SetOutput(io.Discard)
+
+	words, err := parseInterleaved(flags, []string{"it's", "--to", "8080", "-5", "--", "--to", "-4", "outside"})
+	if err == nil {
+		t.Errorf("Expected -5 to be refused as a flag, got %v", words)
+	}
+	words, err = parseInterleaved(flags, []string{"it's", "--to", "8080", "--", "--to", "-4", "outside"})
+	if err != nil || *to != "8080" || strings.Join(words, " ") != "it's --to -4 outside" {
+		t.Errorf("Expected everything after -- as text, got %q to %q (%v)", words, *to, err)
+	}
+}
+
+func TestDaemonStatusAndStop(t *testing.T) {
+	env, stdout, _ := newTestEnvironment(t)
+	env.run([]string{"config", "set", "username", "alice"})
+
+	// The daemon gets its own output so it does not race with the commands below
+	daemonEnv := *env
+	daemonEnv.stderr = io.Discard
+	done := make(chan int)
+	go func() { done <- daemonEnv.run([]string{"daemon"}) }()
+
+	// The daemon needs a moment to create its socket
+	var code int
+	for i := 0; i < 50; i++ {
+		if code = env.run([]string{"daemon", "status", "--format", "json"}); code == EXIT_OK {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+
+	var status message.Status
+	if err := json.Unmarshal(stdout.Bytes(), &status); err != nil {
+		t.Fatal("Got an error decoding status: ", err)
+	}
+	if status.Username != "alice" {
+		t.Errorf("Expected 'alice', got %q", status.Username)
+	}
+
+	if code := env.run([]string{"daemon", "stop"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+	select {
+	case code := <-done:
+		if code != EXIT_OK {
+			t.Errorf("Expected the daemon to exit with %d, got %d", EXIT_OK, code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the daemon to stop")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	env, stdout, stderr := newTestEnvironment(t)
+
+	receiverDb := dbtest.New(t)
+
+	receiver := message.NewNode(receiverDb, "bob")
+	defer receiver.Close()
+	if err := receiver.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	port := messagetest.ListenPort(t, receiver)
+
+	env.stdin = strings.NewReader(strings.Join([]string{
+		`{"id":"1","command":"connect","args":["` + port + `"]}`,
+		`{"id":"2","text":"hello from a script"}`,
+		`{"id":"3","command":"dance"}`,
+		`not json`,
+		`{"id":"4","command":"quit"}`,
+	}, "\n"))
+	if code := env.run([]string{"pipe"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+
+	receipts := map[string]pipeReceipt{}
+	malformed := 0
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		var receipt pipeReceipt
+		if err := json.Unmarshal([]byte(line), &receipt); err != nil {
+			t.Fatalf("Output line is not valid JSON: %q", line)
+		}
+		if receipt.Type != EventReceipt {
+			continue
+		}
+		if receipt.ID == "" {
+			malformed++
+		}
+		receipts[receipt.ID] = receipt
+	}
+
+	if !receipts["1"].OK || receipts["1"].Peer != "localhost:"+port {
+		t.Errorf("Expected the connect to succeed, got %+v", receipts["1"])
+	}
+	if !receipts["2"].OK || receipts["2"].Message == nil || receipts["2"].Message.Text != "hello from a script" {
+		t.Errorf("Expected the sent message in the receipt, got %+v", receipts["2"])
+	}
+	if receipts["3"].OK || receipts["3"].Error == "" {
+		t.Errorf("Expected an error for an unknown command, got %+v", receipts["3"])
+	}
+	if malformed != 1 {
+		t.Errorf("Expected one receipt for the malformed line, got %d", malformed)
+	}
+	if !receipts["4"].OK {
+		t.Errorf("Expected quit to succeed, got %+v", receipts["4"])
+	}
+}
+
+func TestConfigShow(t *testing.T) {
+	env, stdout, _ := newTestEnvironment(t)
+	env.config.Set("theme", "light", config.SourceEnv)
+
+	if code := env.run([]string{"config", "show"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+
+	output := stdout.String()
+	for _, expected := range []string{"theme = \"light\" # env", "lock_after = 15 # default", "[features]", "daemon = true # default"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, output)
+		}
+	}
+
+	stdout.Reset()
+	if code := env.run([]string{"config", "show", "--format", "json"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+	var shown struct {
+		Values map[string]struct {
+			Value  any    `json:"value"`
+			Source string `json:"source"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &shown); err != nil {
+		t.Fatal("Config is not valid JSON: ", err)
+	}
+	expected := map[string]any{"theme": "light", "lock_after": float64(15), "features.daemon": true}
+	for name, value := range expected {
+		if shown.Values[name].Value != value {
+			t.Errorf("%s: expected %#v, got %#v", name, value, shown.Values[name].Value)
+		}
+	}
+}
+
+func TestProfileLock(t *testing.T) {
+	env, stdout, stderr := newTestEnvironment(t)
+	env.config.Profile = "alice"
+
+	profileLock, err := env.config.LockProfile()
+	if err != nil {
+		t.Fatal("Got an error locking the profile: ", err)
+	}
+	defer profileLock.Release()
+
+	if code := env.run([]string{"send", "--to", "45126", "hello"}); code != EXIT_FAILURE {
+		t.Errorf("Expected %d while the profile is in use, got %d", EXIT_FAILURE, code)
+	}
+	if !strings.Contains(stderr.String(), `profile "alice" is already in use`) {
+		t.Errorf("Expected the profile to be reported in use, got %q", stderr.String())
+	}
+
+	if code := env.run([]string{"profiles"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d", EXIT_OK, code)
+	}
+	if !strings.Contains(stdout.String(), "* alice") || !strings.Contains(stdout.String(), "(in use)") {
+		t.Errorf("Expected alice to be listed as active and in use, got:\n%s", stdout.String())
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	env, stdout, stderr := newTestEnvironment(t)
+	env.run([]string{"contacts", "me"})
+	fingerprint := stdout.String()
+
+	env.stdin = strings.NewReader("short\n")
+	if code := env.run([]string{"passphrase", "set"}); code != EXIT_FAILURE || !strings.Contains(stderr.String(), "at least 8") {
+		t.Errorf("Expected a short passphrase to be refused, got %d: %s", code, stderr.String())
+	}
+	env.stdin = strings.NewReader("correct horse\ncorrect horse\n")
+	env.stdinReader = nil
+	if code := env.run([]string{"passphrase", "set"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+
+	if data, _ := os.ReadFile(env.config.IdentityPath()); !strings.HasPrefix(string(data), "sealed:") {
+		t.Errorf("Expected the identity key to be encrypted, got %q", data)
+	}
+	stderr.Reset()
+	if code := env.run([]string{"history"}); code != EXIT_FAILURE || !strings.Contains(stderr.String(), PASSPHRASE_ENV) {
+		t.Errorf("Expected the locked profile to ask for %s, got %d: %s", PASSPHRASE_ENV, code, stderr.String())
+	}
+
+	t.Setenv(PASSPHRASE_ENV, "correct horse")
+	stdout.Reset()
+	if code := env.run([]string{"contacts", "me"}); code != EXIT_OK || stdout.String() != fingerprint {
+		t.Errorf("Expected the same identity once unlocked, got %q: %s", stdout.String(), stderr.String())
+	}
+
+	if code := env.run([]string{"passphrase", "remove"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+	os.Unsetenv(PASSPHRASE_ENV)
+	if code := env.run([]string{"history"}); code != EXIT_OK {
+		t.Errorf("Expected the profile to open without a passphrase again, got %d: %s", code, stderr.String())
+	}
+}
+
+func TestDbStats(t *testing.T) {
+	env, stdout, stderr := newTestEnvironment(t)
+	if code := env.run([]string{"db", "archive", "bob"}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+	if code := env.run([]string{"db", "stats"}); code != EXIT_OK || !strings.Contains(stdout.String(), "archived_conversations") {
+		t.Errorf("Expected the row counts, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	if code := env.run([]string{"db", "maintain", "--format", "json"}); code != EXIT_OK || !strings.Contains(stdout.String(), `"reclaimed"`) {
+		t.Errorf("Expected a maintenance report, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	if code := env.run([]string{"db", "unarchive", "carol"}); code != EXIT_FAILURE {
+		t.Errorf("Expected unarchiving an unknown conversation to fail, got %d", code)
+	}
+}
+
+func TestExport(t *testing.T) {
+	env, stdout, stderr := newTestEnvironment(t)
+	dbHandler, err := env.openDb()
+	if err != nil {
+		t.Fatal("Got an error opening the database: ", err)
+	}
+	for _, peer := range []string{"bob", "carol"} {
+		dbHandler.SaveMessage(db.Message{Text: "hi " + peer, Sender: "alice", Direction: db.Outgoing, Timestamp: time.Now(), Peer: peer})
+	}
+	dbHandler.Close()
+
+	if code := env.run([]string{"export", "--peer", "bob", "--format", "irc"}); code != EXIT_OK || !strings.Contains(stdout.String(), "<alice> hi bob") || strings.Contains(stdout.String(), "carol") {
+		t.Errorf("Expected bob's conversation as an IRC log, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	dir := filepath.Join(t.TempDir(), "transcripts") + string(os.PathSeparator)
+	if code := env.run([]string{"export", "--format", "html", "--output", dir}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 || entries[0].Name() != "bob.html" {
+		t.Errorf("Expected a page per conversation, got %v", entries)
+	}
+	if code := env.run([]string{"export", "--format", "pdf"}); code != EXIT_USAGE {
+		t.Errorf("Expected an unknown format to be a usage error, got %d", code)
+	}
+}
+
+func TestImport(t *testing.T) {
+	env, stdout, stderr := newTestEnvironment(t)
+	dir := t.TempDir()
+	log := filepath.Join(dir, "bob.log")
+	os.WriteFile(log, []byte("--- Log opened Sat Jan 31 12:00:00 2026\n12:00 <bob> hi\n12:01 <alice> hello bob\n"), 0o600)
+
+	if code := env.run([]string{"import", "--me", "alice", "--dry-run", log}); code != EXIT_OK || !strings.Contains(stdout.String(), "would import 2 messages") {
+		t.Fatalf("Expected a dry run report, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	stdout.Reset()
+	if code := env.run([]string{"import", "--me", "alice", "--map", "bob=robert", log, "--format", "json"}); code != EXIT_OK || !strings.Contains(stdout.String(), `"robert":2`) {
+		t.Fatalf("Expected 2 messages imported into robert's conversation, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	// An export of what was imported adds nothing
+	export := filepath.Join(dir, "all.json")
+	if code := env.run([]string{"export", "--format", "json", "--output", export}); code != EXIT_OK {
+		t.Fatalf("Expected %d, got %d: %s", EXIT_OK, code, stderr.String())
+	}
+	stdout.Reset()
+	if code := env.run([]string{"import", export}); code != EXIT_OK || !strings.Contains(stdout.String(), "imported 0 messages, 2 already stored") {
+		t.Errorf("Expected the export to be all duplicates, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	notes := filepath.Join(dir, "notes.md")
+	os.WriteFile(notes, []byte("# Notes\n"), 0o600)
+	if code := env.run([]string{"import", notes}); code != EXIT_FAILURE || !strings.Contains(stderr.String(), "--from") {
+		t.Errorf("Expected a file of unknown format to fail, got %d", code)
+	}
+	if code := env.run([]string{"import"}); code != EXIT_USAGE {
+		t.Errorf("Expected no files to be a usage error, got %d", code)
+	}
+}
@@ -0,0 +1,179 @@
+package cli
+
+import (
+	"bokkoli/internal/config"
+	"bokkoli/internal/db"
+	"bokkoli/internal/message"
+	"bokkoli/internal/theme"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A setting readable and writable with 'bokkoli config'
+type setting struct {
+	get func(settings db.Setup) string
+	set func(env *environment, dbHandler *db.DbHandler, settings db.Setup, value string) error
+}
+
+var settingKeys = map[string]setting{
+	"port": {
+		get: func(settings db.Setup) string { return settings.Port },
+		set: func(env *environment, dbHandler *db.DbHandler, settings db.Setup, value string) error {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < message.LOWERBOUND_PORT_NUMBER || port > message.UPPERBOUND_PORT_NUMBER {
+				return fmt.Errorf("only ports in the range %d-%d are allowed", message.LOWERBOUND_PORT_NUMBER, message.UPPERBOUND_PORT_NUMBER)
+			}
+			return dbHandler.SaveSetup(value, settings.Username)
+		},
+	},
+	"username": {
+		get: func(settings db.Setup) string { return settings.Username },
+		set: func(env *environment, dbHandler *db.DbHandler, settings db.Setup, value string) error {
+			if value == "" {
+				return fmt.Errorf("username cannot be left empty")
+			}
+			return dbHandler.SaveSetup(settings.Port, value)
+		},
+	},
+	"theme": {
+		get: func(settings db.Setup) string { return settings.Theme },
+		set: func(env *environment, dbHandler *db.DbHandler, settings db.Setup, value string) error {
+			if err := theme.LoadFile(env.config.ThemesPath()); err != nil {
+				return err
+			}
+			if _, ok := theme.Get(value); !ok {
+				return fmt.Errorf("unknown theme %q", value)
+			}
+			return dbHandler.SaveTheme(value)
+		},
+	},
+	"markdown": {
+		get: func(settings db.Setup) string { return strconv.FormatBool(settings.RenderMarkdown) },
+		set: func(env *environment, dbHandler *db.DbHandler, settings db.Setup, value string) error {
+			renderMarkdown, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("expected true or false, got %q", value)
+			}
+			return dbHandler.SaveRenderMarkdown(renderMarkdown)
+		},
+	},
+}
+
+// 'config get [key]' prints one value, or every setting as key=value; 'config set <key> <value>' changes one.
+// 'config show' prints the effective configuration from the config file, environment and global flags.
+func runConfig(env *environment, args []string) error {
+	flags := env.flagSet("config", "get [key] | set <key> <value> | show [--format text|json]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		return usageError(flags, "expected 'get', 'set' or 'show'")
+	}
+	if args[0] == "show" {
+		format := flags.String("format", FORMAT_TEXT, "output format for show: text (TOML) or json")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() > 0 {
+			return usageError(flags, "show takes no arguments")
+		}
+		if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+			return err
+		}
+		return env.showConfig(*format)
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	settings, _ := dbHandler.ReadSetup()
+
+	switch args[0] {
+	case "get":
+		if len(args) == 1 {
+			for _, key := range sortedKeys(settingKeys) {
+				fmt.Fprintf(env.stdout, "%s=%s\n", key, settingKeys[key].get(settings))
+			}
+			return nil
+		}
+		if len(args) > 2 {
+			return usageError(flags, "expected a single key")
+		}
+
+		key, ok := settingKeys[args[1]]
+		if !ok {
+			return usageError(flags, "unknown key %q, expected one of: %v", args[1], sortedKeys(settingKeys))
+		}
+		fmt.Fprintln(env.stdout, key.get(settings))
+		return nil
+	case "set":
+		if len(args) != 3 {
+			return usageError(flags, "expected a key and a value")
+		}
+
+		key, ok := settingKeys[args[1]]
+		if !ok {
+			return usageError(flags, "unknown key %q, expected one of: %v", args[1], sortedKeys(settingKeys))
+		}
+		if err := key.set(env, dbHandler, settings, args[2]); err != nil {
+			return fmt.Errorf("%s: %v", args[1], err)
+		}
+		return nil
+	default:
+		return usageError(flags, "unknown action %q, expected 'get', 'set' or 'show'", args[0])
+	}
+}
+
+// A configuration value and where it came from, as 'config show --format json' prints it
+type configValue struct {
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// Print the effective configuration as TOML or JSON, with where each value came from
+func (env *environment) showConfig(format string) error {
+	values := make(map[string]configValue)
+	for _, name := range config.Keys() {
+		value, source, err := env.config.Value(name)
+		if err != nil {
+			return err
+		}
+		values[name] = configValue{Value: value, Source: source}
+	}
+	if format == FORMAT_JSON {
+		return env.writeJSON(struct {
+			File   string                 `json:"file"`
+			Values map[string]configValue `json:"values"`
+		}{env.config.File, values})
+	}
+
+	file := env.config.File
+	if file == "" {
+		file = "none"
+	}
+	fmt.Fprintf(env.stdout, "# config file: %s\n", file)
+
+	table := ""
+	for _, name := range config.Keys() {
+		value := values[name]
+		// Dotted keys are written in their TOML table, e.g. features.daemon as daemon under [features]
+		if section, key, nested := strings.Cut(name, "."); nested {
+			if section != table {
+				fmt.Fprintf(env.stdout, "\n[%s]\n", section)
+				table = section
+			}
+			name = key
+		}
+		text := fmt.Sprint(value.Value)
+		if _, ok := value.Value.(string); ok {
+			text = strconv.Quote(text)
+		}
+		fmt.Fprintf(env.stdout, "%s = %s # %s\n", name, text, value.Source)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+)
+
+// 'contacts list' shows the peers we decided about, 'allow', 'block' and 'remove <fingerprint>' change them.
+// 'contacts me' prints this profile's own fingerprint, to read out to peers.
+func runContacts(env *environment, args []string) error {
+	flags := env.flagSet("contacts", "list | me | allow <fingerprint> | block <fingerprint> | remove <fingerprint> [--format text|json]")
+	format := flags.String("format", FORMAT_TEXT, "output format of 'list': text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageError(flags, "expected 'list', 'me', 'allow', 'block' or 'remove'")
+	}
+
+	action := flags.Arg(0)
+	rest, err := parseInterleaved(flags, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+	// Fingerprints are shown in groups, take them quoted or not
+	fingerprint := strings.Join(rest, " ")
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	switch {
+	case action == "me" && len(rest) == 0:
+		key, err := identity.Load(env.config.IdentityPath(), dbHandler.Key())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(env.stdout, identity.Fingerprint(key.Public().(ed25519.PublicKey)))
+		return nil
+	case action == "list" && len(rest) == 0:
+		contacts, err := dbHandler.ReadContacts()
+		if err != nil {
+			return err
+		}
+		if *format == FORMAT_JSON {
+			return env.writeJSON(contacts)
+		}
+		for _, contact := range contacts {
+			verified := ""
+			if contact.Verified {
+				verified = "verified"
+			}
+			fmt.Fprintf(env.stdout, "%s  %-7s %-8s %s\n", contact.Fingerprint, contact.Status, verified, contact.Name)
+		}
+		return nil
+	case (action == "allow" || action == "block") && len(rest) > 0:
+		contact, err := dbHandler.FindContact(fingerprint)
+		if err != nil {
+			return err
+		}
+		contact.Status = db.ContactAllowed
+		if action == "block" {
+			contact.Status = db.ContactBlocked
+		}
+		return dbHandler.SaveContact(contact)
+	case action == "remove" && len(rest) > 0:
+		contact, err := dbHandler.FindContact(fingerprint)
+		if err != nil {
+			return err
+		}
+		return dbHandler.DeleteContact(contact.Key)
+	default:
+		return usageError(flags, "unknown action or wrong number of arguments: %s", strings.Join(append([]string{action}, rest...), " "))
+	}
+}
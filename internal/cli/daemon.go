@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"bokkoli/internal/daemon"
+	"bokkoli/internal/message"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// 'daemon' runs in the foreground until interrupted or stopped; 'daemon stop' and 'daemon status' talk to a running one
+func runDaemon(env *environment, args []string) error {
+	flags := env.flagSet("daemon", "[--socket <path>] [--port <port>] [stop | status [--format text|json]]")
+	socket := flags.String("socket", env.config.SocketPath(), "path of the control socket")
+	port := flags.String("port", "", "port to listen for peers on, defaults to the port in your settings")
+	format := flags.String("format", FORMAT_TEXT, "output format of 'status': text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return env.serveDaemon(*socket, *port)
+	}
+
+	// Flags may also follow the action
+	action := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "expected a single action")
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+
+	client, err := daemon.Dial(*socket)
+	if err != nil {
+		return fmt.Errorf("no daemon running on %s", *socket)
+	}
+	defer client.Close()
+
+	switch action {
+	case "stop":
+		return client.Shutdown()
+	case "status":
+		status, err := client.Status()
+		if err != nil {
+			return err
+		}
+		return env.printStatus(status, *format)
+	default:
+		return usageError(flags, "unknown action %q, expected 'stop' or 'status'", action)
+	}
+}
+
+func (env *environment) serveDaemon(socket string, port string) error {
+	profileLock, err := env.config.LockProfile()
+	if err != nil {
+		return err
+	}
+	defer profileLock.Release()
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	settings, _ := dbHandler.ReadSetup()
+	// Attached chats answer for the daemon
+	node, err := env.newNode(dbHandler, settings.Username, true)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	server, err := daemon.Listen(socket, node)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	go server.Serve()
+	fmt.Fprintln(env.stderr, "daemon control socket on", socket)
+
+	if env.config.Features.API {
+		apiServer, err := env.startAPI(env.config.APIAddress, node)
+		if err != nil {
+			return err
+		}
+		defer apiServer.Close()
+	}
+	if env.config.Features.IRC {
+		gateway, err := env.startIRC(env.config.IRCAddress, node)
+		if err != nil {
+			return err
+		}
+		defer gateway.Close()
+	}
+
+	if port == "" {
+		port = settings.Port
+	}
+	if port != "" {
+		if err := node.Listen(port); err != nil {
+			return err
+		}
+		fmt.Fprintln(env.stderr, "listening on", node.ListenAddress())
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	select {
+	case <-interrupt:
+	case <-server.Done():
+	}
+	return nil
+}
+
+func (env *environment) printStatus(status message.Status, format string) error {
+	if format == FORMAT_JSON {
+		return env.writeJSON(status)
+	}
+
+	listening := status.ListenAddress
+	if listening == "" {
+		listening = "not listening"
+	}
+	fmt.Fprintln(env.stdout, "username:", status.Username)
+	fmt.Fprintln(env.stdout, "listening:", listening)
+	for _, peer := range status.Peers {
+		direction := "out"
+		if peer.Incoming {
+			direction = "in"
+		}
+		name := peer.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(env.stdout, "peer: %s %s %s\n", direction, peer.Address, name)
+	}
+	return nil
+}
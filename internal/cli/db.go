@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"bokkoli/internal/db"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 'db stats' shows row counts and sizes per conversation, 'db maintain' purges, applies the retention policy
+// and vacuums right away, 'db archive' and 'db unarchive <peer>' exempt a conversation from retention or stop doing so
+func runDb(env *environment, args []string) error {
+	flags := env.flagSet("db", "stats | maintain | archive <peer> | unarchive <peer> [--format text|json]")
+	format := flags.String("format", FORMAT_TEXT, "output format of 'stats' and 'maintain': text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageError(flags, "expected 'stats', 'maintain', 'archive' or 'unarchive'")
+	}
+
+	action := flags.Arg(0)
+	rest, err := parseInterleaved(flags, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	switch {
+	case action == "stats" && len(rest) == 0:
+		stats, err := dbHandler.Stats()
+		if err != nil {
+			return err
+		}
+		if *format == FORMAT_JSON {
+			return env.writeJSON(stats)
+		}
+		env.printStats(stats)
+		return nil
+	case action == "maintain" && len(rest) == 0:
+		report, err := dbHandler.Maintain(env.retention(), time.Now())
+		if err != nil {
+			return err
+		}
+		if *format == FORMAT_JSON {
+			return env.writeJSON(report)
+		}
+		fmt.Fprintf(env.stdout, "deleted %d expired and %d messages past retention, reclaimed %s (%s now) in %s\n",
+			report.Expired, report.Retained, formatSize(report.Reclaimed), formatSize(report.SizeAfter), report.Duration)
+		return nil
+	case (action == "archive" || action == "unarchive") && len(rest) == 1:
+		return dbHandler.SetArchived(rest[0], action == "archive")
+	default:
+		return usageError(flags, "unknown action or wrong number of arguments: %s", strings.Join(append([]string{action}, rest...), " "))
+	}
+}
+
+func (env *environment) retention() db.Retention {
+	return db.Retention{Days: env.config.RetentionDays, Messages: env.config.RetentionMessages}
+}
+
+func (env *environment) printStats(stats db.Stats) {
+	fmt.Fprintf(env.stdout, "%s  %s, %s free\n\n", stats.Path, formatSize(stats.FileSize), formatSize(stats.FreeSize))
+	for _, table := range sortedKeys(stats.Rows) {
+		fmt.Fprintf(env.stdout, "%-24s %8d rows\n", table, stats.Rows[table])
+	}
+
+	if len(stats.Conversations) == 0 {
+		return
+	}
+	fmt.Fprintf(env.stdout, "\n%-24s %8s %9s  %-10s  %-10s\n", "conversation", "messages", "size", "first", "last")
+	for _, c := range stats.Conversations {
+		peer := c.Peer
+		if peer == "" {
+			peer = "(unknown peer)"
+		}
+		archived := ""
+		if c.Archived {
+			archived = "  archived"
+		}
+		fmt.Fprintf(env.stdout, "%-24s %8d %9s  %-10s  %-10s%s\n", peer, c.Messages, formatSize(c.Size),
+			c.First.Format("2006-01-02"), c.Last.Format("2006-01-02"), archived)
+	}
+}
+
+// Bytes in the largest unit that keeps the number at least 1
+func formatSize(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
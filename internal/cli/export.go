@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/export"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Write one conversation or all of them as a transcript: to stdout, a file, a directory with a file
+// per conversation, or a zip archive of such a directory when the output ends in .zip
+func runExport(env *environment, args []string) error {
+	flags := env.flagSet("export", "[--peer <name>] [--since <when>] [--until <when>] [--format json|md|html|irc] [--output <file|dir/|file.zip>]")
+	peer := flags.String("peer", "", "only the conversation with this peer")
+	since := flags.String("since", "", "only messages newer than this: a duration like 2d, 3h, 1w or a date like 2025-01-31")
+	until := flags.String("until", "", "only messages older than this, same formats as --since")
+	formatName := flags.String("format", string(export.FormatMarkdown), "json, md (Markdown), html or irc (IRC-style log)")
+	output := flags.String("output", "-", "file to write, a directory ending in / for a file per conversation, a .zip archive, or - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	format, err := export.ParseFormat(*formatName)
+	if err != nil {
+		return usageError(flags, "%v", err)
+	}
+
+	filter := db.MessageFilter{Peer: *peer}
+	now := time.Now()
+	if filter.Since, err = parseWhen(*since, now); err != nil {
+		return usageError(flags, "invalid --since: %v", err)
+	}
+	if filter.Until, err = parseWhen(*until, now); err != nil {
+		return usageError(flags, "invalid --until: %v", err)
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	messages, err := dbHandler.ReadMessages(filter)
+	if err != nil {
+		return fmt.Errorf("failed to read messages: %v", err)
+	}
+	settings, _ := dbHandler.ReadSetup()
+	transcript := export.NewTranscript(messages, settings.Username, filter)
+
+	switch {
+	case *output == "-":
+		return export.Write(env.stdout, format, transcript)
+	case strings.HasSuffix(*output, string(os.PathSeparator)) || isDir(*output):
+		if err := export.WriteDir(*output, format, transcript); err != nil {
+			return err
+		}
+	default:
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(strings.ToLower(*output), ".zip") {
+			err = export.WriteZip(file, format, transcript)
+		} else {
+			err = export.Write(file, format, transcript)
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(env.stderr, "exported %d messages to %s\n", len(messages), *output)
+	return nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
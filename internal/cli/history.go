@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"bokkoli/internal/db"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DAY time.Duration = 24 * time.Hour
+
+// Print stored messages, optionally for one peer and a time window
+func runHistory(env *environment, args []string) error {
+	flags := env.flagSet("history", "[--peer <name>] [--since <when>] [--until <when>] [--limit <n>] [--format text|json|jsonl]")
+	peer := flags.String("peer", "", "only messages with this peer")
+	since := flags.String("since", "", "only messages newer than this: a duration like 2d, 3h, 1w or a date like 2025-01-31")
+	until := flags.String("until", "", "only messages older than this, same formats as --since")
+	limit := flags.Int("limit", 0, "only the most recent n messages")
+	format := flags.String("format", FORMAT_TEXT, "output format: text, json (an array) or jsonl (one message per line)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON, FORMAT_JSONL); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	filter := db.MessageFilter{Peer: *peer, Limit: *limit}
+	var err error
+	now := time.Now()
+	if filter.Since, err = parseWhen(*since, now); err != nil {
+		return usageError(flags, "invalid --since: %v", err)
+	}
+	if filter.Until, err = parseWhen(*until, now); err != nil {
+		return usageError(flags, "invalid --until: %v", err)
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	messages, err := dbHandler.ReadMessages(filter)
+	if err != nil {
+		return fmt.Errorf("failed to read messages: %v", err)
+	}
+
+	switch *format {
+	case FORMAT_JSON:
+		if messages == nil {
+			messages = []db.Message{}
+		}
+		return env.writeJSON(messages)
+	case FORMAT_JSONL:
+		for _, message := range messages {
+			if err := env.writeJSON(message); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, message := range messages {
+			fmt.Fprintf(env.stdout, "%s %s: %s\n", message.Timestamp.Format("2006-01-02 15:04"), message.Sender, message.Text)
+		}
+	}
+	return nil
+}
+
+// Parse a point in time given as a duration before now ("2d", "90m", "1w") or as a date/timestamp
+func parseWhen(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	units := map[string]time.Duration{"d": DAY, "w": 7 * DAY}
+	for suffix, unit := range units {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			count, err := strconv.Atoi(number)
+			if err != nil || count < 0 {
+				return time.Time{}, fmt.Errorf("%q is not a whole number of %s", value, suffix)
+			}
+			return now.Add(-time.Duration(count) * unit), nil
+		}
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if when, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return when, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%q is neither a duration like 2d nor a date like 2006-01-02", value)
+}
@@ -0,0 +1,169 @@
+package cli
+
+import (
+	"archive/zip"
+	"bokkoli/internal/db"
+	"bokkoli/internal/export"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Renames given with --map old=new, which may repeat
+type mappings map[string]string
+
+func (m mappings) String() string {
+	pairs := make([]string, 0, len(m))
+	for old, renamed := range m {
+		pairs = append(pairs, old+"="+renamed)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m mappings) Set(value string) error {
+	old, renamed, ok := strings.Cut(value, "=")
+	if !ok || old == "" || renamed == "" {
+		return fmt.Errorf("expected old=new, got %q", value)
+	}
+	m[old] = renamed
+	return nil
+}
+
+// Add messages from JSON exports, IRC logs and CSV files to the history, skipping the ones already stored.
+// Zip archives, like 'export' writes them, are read entry by entry.
+func runImport(env *environment, args []string) error {
+	flags := env.flagSet("import", "[--from json|irc|csv] [--peer <name>] [--me <username>] [--map old=new]... [--dry-run] [--format text|json] <file>...")
+	from := flags.String("from", "", "format of the files: json, irc or csv, by default going by their extension")
+	peer := flags.String("peer", "", "conversation of messages whose file doesn't name one, by default the file's name")
+	me := flags.String("me", "", "username whose messages are outgoing, by default this profile's")
+	dryRun := flags.Bool("dry-run", false, "only report what would be imported")
+	format := flags.String("format", FORMAT_TEXT, "output format of the report: text or json")
+	renames := mappings{}
+	flags.Var(renames, "map", "rename a peer or sender, old=new, may repeat")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	files, err := parseInterleaved(flags, flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return usageError(flags, "expected files to import")
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+	if *from != "" {
+		if _, err := export.ParseImportFormat(*from); err != nil {
+			return usageError(flags, "%v", err)
+		}
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	options := export.ReadOptions{Peer: *peer, Me: *me}
+	if options.Me == "" {
+		settings, _ := dbHandler.ReadSetup()
+		options.Me = settings.Username
+	}
+
+	var messages []db.Message
+	for _, path := range files {
+		read, err := readImport(path, *from, options)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		messages = append(messages, read...)
+	}
+	for i := range messages {
+		if renamed, ok := renames[messages[i].Peer]; ok {
+			messages[i].Peer = renamed
+		}
+		if renamed, ok := renames[messages[i].Sender]; ok {
+			messages[i].Sender = renamed
+		}
+	}
+
+	report, err := dbHandler.ImportMessages(messages, *dryRun)
+	if err != nil {
+		return fmt.Errorf("failed to import: %v", err)
+	}
+	if *format == FORMAT_JSON {
+		return env.writeJSON(report)
+	}
+
+	verb := "imported"
+	if report.DryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(env.stdout, "%s %d messages, %d already stored\n", verb, report.Added, report.Duplicates)
+	peers := make([]string, 0, len(report.Conversations))
+	for peer := range report.Conversations {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for _, peer := range peers {
+		fmt.Fprintf(env.stdout, "  %-20s %d\n", peer, report.Conversations[peer])
+	}
+	return nil
+}
+
+// Messages of one file, or of every entry of a zip archive
+func readImport(path string, from string, options export.ReadOptions) ([]db.Message, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".zip" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readImportFile(file, path, from, options)
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	var messages []db.Message
+	for _, entry := range archive.File {
+		// Skip what isn't a log, like the Markdown or HTML files of other exports
+		if _, err := export.FormatOf(entry.Name); entry.FileInfo().IsDir() || (from == "" && err != nil) {
+			continue
+		}
+		file, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		read, err := readImportFile(file, entry.Name, from, options)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		messages = append(messages, read...)
+	}
+	return messages, nil
+}
+
+func readImportFile(r io.Reader, name string, from string, options export.ReadOptions) ([]db.Message, error) {
+	// Logs are kept a file per conversation, named after the peer
+	if options.Peer == "" {
+		options.Peer = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	}
+	format := export.Format(from)
+	if format == "" {
+		var err error
+		if format, err = export.FormatOf(name); err != nil {
+			return nil, fmt.Errorf("%v, name it with --from", err)
+		}
+	}
+	return export.Read(r, format, options)
+}
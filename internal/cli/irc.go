@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"bokkoli/internal/api"
+	"bokkoli/internal/irc"
+	"bokkoli/internal/message"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 'irc' serves the IRC gateway in the foreground, on top of the daemon when one is running
+func runIRC(env *environment, args []string) error {
+	flags := env.flagSet("irc", "[--address <host:port>] [--socket <path>]")
+	address := flags.String("address", env.config.IRCAddress, "loopback host and port to listen on")
+	socket := flags.String("socket", env.config.SocketPath(), "control socket of a running daemon to attach to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	backend, closeBackend, err := env.openBackend(*socket)
+	if err != nil {
+		return err
+	}
+	defer closeBackend()
+
+	gateway, err := env.startIRC(*address, backend)
+	if err != nil {
+		return err
+	}
+	defer gateway.Close()
+
+	waitForInterrupt()
+	return nil
+}
+
+// Clients log in with the API token as server password
+func (env *environment) startIRC(address string, backend message.Backend) (*irc.Gateway, error) {
+	if err := os.MkdirAll(env.config.ProfileDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create profile directory: %v", err)
+	}
+	password, err := api.LoadToken(env.config.APITokenPath())
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, err := irc.Listen(address, backend, password)
+	if err != nil {
+		return nil, err
+	}
+	go gateway.Serve()
+	fmt.Fprintf(env.stderr, "IRC gateway on %s, the server password is printed by 'bokkoli api token'\n", gateway.Addr())
+	return gateway, nil
+}
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"bokkoli/internal/vault"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Read by every command that opens an encrypted profile, before asking on the terminal
+const PASSPHRASE_ENV string = "BOKKOLI_PASSPHRASE"
+
+// 'passphrase set' encrypts the profile, 'change' re-encrypts it under a new passphrase and 'remove' decrypts it.
+// The new passphrase is asked on the terminal, or read from stdin when it isn't one.
+func runPassphrase(env *environment, args []string) error {
+	flags := env.flagSet("passphrase", "set | change | remove")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError(flags, "expected 'set', 'change' or 'remove'")
+	}
+	action := flags.Arg(0)
+	if action != "set" && action != "change" && action != "remove" {
+		return usageError(flags, "unknown action %q, expected 'set', 'change' or 'remove'", action)
+	}
+
+	// Nothing else may write while the data is re-encrypted
+	profileLock, err := env.config.LockProfile()
+	if err != nil {
+		return err
+	}
+	defer profileLock.Release()
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	encrypted, err := dbHandler.Encrypted()
+	if err != nil {
+		return err
+	}
+	switch {
+	case action == "set" && encrypted:
+		return errors.New("the profile already has a passphrase, use 'passphrase change'")
+	case action != "set" && !encrypted:
+		return errors.New("the profile has no passphrase, use 'passphrase set'")
+	}
+
+	passphrase := ""
+	if action != "remove" {
+		if passphrase, err = env.newPassphrase(); err != nil {
+			return err
+		}
+	}
+	return changePassphrase(env.config.IdentityPath(), dbHandler, passphrase)
+}
+
+// Move the database and the identity key over to the passphrase, an empty one removes the encryption
+func changePassphrase(identityPath string, dbHandler *db.DbHandler, passphrase string) error {
+	params, err := vault.NewParams()
+	if err != nil {
+		return err
+	}
+	var key *vault.Key
+	if passphrase != "" {
+		if key, err = vault.Derive(passphrase, params); err != nil {
+			return err
+		}
+	}
+
+	finish, err := identity.Reseal(identityPath, dbHandler.Key(), key)
+	if err != nil {
+		return fmt.Errorf("could not re-encrypt your identity key: %v", err)
+	}
+	if _, err := dbHandler.ChangePassphrase(passphrase, params); err != nil {
+		finish(false)
+		return err
+	}
+	return finish(true)
+}
+
+// Ask for a new passphrase twice, so a typo doesn't lock the user out
+func (env *environment) newPassphrase() (string, error) {
+	passphrase, err := env.readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if err := vault.Validate(passphrase); err != nil {
+		return "", err
+	}
+	again, err := env.readPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("the passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+// Unlock an encrypted database with the passphrase from BOKKOLI_PASSPHRASE, or else from the terminal
+func (env *environment) unlock(dbHandler *db.DbHandler) error {
+	encrypted, err := dbHandler.Encrypted()
+	if err != nil || !encrypted {
+		return err
+	}
+
+	passphrase, ok := os.LookupEnv(PASSPHRASE_ENV)
+	if !ok {
+		if !env.terminal() {
+			return fmt.Errorf("the profile is encrypted, set %s to its passphrase", PASSPHRASE_ENV)
+		}
+		if passphrase, err = env.readPassphrase("Passphrase: "); err != nil {
+			return err
+		}
+	}
+	if _, err := dbHandler.Unlock(passphrase); err != nil {
+		return fmt.Errorf("could not unlock the profile: %v", err)
+	}
+	return nil
+}
+
+func (env *environment) terminal() bool {
+	file, ok := env.stdin.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
+
+// Read a passphrase without echoing it on a terminal, or a line from stdin otherwise
+func (env *environment) readPassphrase(prompt string) (string, error) {
+	if env.terminal() {
+		fmt.Fprint(env.stderr, prompt)
+		passphrase, err := term.ReadPassword(int(env.stdin.(*os.File).Fd()))
+		fmt.Fprintln(env.stderr)
+		return string(passphrase), err
+	}
+
+	if env.stdinReader == nil {
+		env.stdinReader = bufio.NewReader(env.stdin)
+	}
+	line, err := env.stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("expected a passphrase on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
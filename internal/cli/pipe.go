@@ -0,0 +1,200 @@
+package cli
+
+import (
+	"bokkoli/internal/daemon"
+	"bokkoli/internal/db"
+	"bokkoli/internal/message"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pipeListen  string = "listen"
+	pipeConnect string = "connect"
+	pipeNick    string = "nick"
+	pipeStatus  string = "status"
+	pipeQuit    string = "quit"
+)
+
+// Written for every line read, after the request was carried out
+const EventReceipt message.EventType = "receipt"
+
+// One line on stdin. Without a command it is an outgoing message in the db.Message shape,
+// sent to Peer by address or username, or to the only connected peer when Peer is empty.
+type pipeRequest struct {
+	// Echoed back on the receipt so callers can match it up
+	ID      string   `json:"id,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	db.Message
+}
+
+type pipeReceipt struct {
+	Type    message.EventType `json:"type"`
+	ID      string            `json:"id,omitempty"`
+	OK      bool              `json:"ok"`
+	Error   string            `json:"error,omitempty"`
+	Peer    string            `json:"peer,omitempty"`
+	Message *db.Message       `json:"message,omitempty"`
+	Status  *message.Status   `json:"status,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+// Read messages and commands as JSON lines on stdin, write every event and a receipt per line as JSON lines on stdout
+func runPipe(env *environment, args []string) error {
+	flags := env.flagSet("pipe", "[--port <port>] [--socket <path>]")
+	port := flags.String("port", "", "port to listen on at start, by default peers must be connected to")
+	socket := flags.String("socket", env.config.SocketPath(), "control socket of a running daemon to attach to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	backend, closeBackend, err := env.openBackend(*socket)
+	if err != nil {
+		return err
+	}
+	defer closeBackend()
+
+	output := &pipeWriter{env: env}
+	events, unsubscribe := backend.Subscribe()
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for event := range events {
+			output.write(event)
+		}
+	}()
+	defer func() {
+		unsubscribe()
+		<-forwarded
+	}()
+
+	if *port != "" {
+		if err := backend.Listen(*port); err != nil {
+			return err
+		}
+	}
+
+	scanner := bufio.NewScanner(env.stdin)
+	scanner.Buffer(make([]byte, 0, 4096), daemon.MAX_REQUEST_SIZE)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var request pipeRequest
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			output.write(pipeReceipt{Type: EventReceipt, Error: fmt.Sprintf("malformed request: %v", err), Time: time.Now()})
+			continue
+		}
+
+		receipt := handlePipeRequest(backend, request)
+		receipt.Type, receipt.ID, receipt.OK, receipt.Time = EventReceipt, request.ID, receipt.Error == "", time.Now()
+		output.write(receipt)
+
+		if request.Command == pipeQuit && receipt.OK {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func handlePipeRequest(backend message.Backend, request pipeRequest) pipeReceipt {
+	var receipt pipeReceipt
+	var err error
+
+	switch request.Command {
+	case "":
+		if strings.TrimSpace(request.Text) == "" {
+			err = fmt.Errorf("refusing to send an empty message")
+			break
+		}
+		var sent db.Message
+		sent, err = backend.Send(request.Peer, request.Text)
+		if err == nil {
+			receipt.Message = &sent
+		}
+	case pipeListen:
+		err = backend.Listen(strings.Join(request.Args, ""))
+	case pipeConnect:
+		if len(request.Args) != 1 {
+			err = fmt.Errorf("connect expects an address")
+			break
+		}
+		receipt.Peer, err = backend.Connect(request.Args[0])
+	case pipeNick:
+		if len(request.Args) == 0 {
+			err = fmt.Errorf("nick expects a username")
+			break
+		}
+		err = backend.SetUsername(strings.Join(request.Args, " "))
+	case pipeStatus:
+		var status message.Status
+		status, err = backend.Status()
+		if err == nil {
+			receipt.Status = &status
+		}
+	case pipeQuit:
+	default:
+		err = fmt.Errorf("unknown command %q, expected one of: %s", request.Command,
+			strings.Join([]string{pipeListen, pipeConnect, pipeNick, pipeStatus, pipeQuit}, ", "))
+	}
+
+	if err != nil {
+		receipt.Error = err.Error()
+	}
+	return receipt
+}
+
+// Events and receipts are written from different goroutines, each must stay on its own line
+type pipeWriter struct {
+	mu  sync.Mutex
+	env *environment
+}
+
+func (w *pipeWriter) write(value any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.env.writeJSON(value)
+}
+
+// Attach to the daemon when one is running, otherwise run an in-process node on the database
+func (env *environment) openBackend(socket string) (message.Backend, func(), error) {
+	if env.config.Features.Daemon {
+		if client, err := daemon.Dial(socket); err == nil {
+			return client, func() { client.Close() }, nil
+		}
+	}
+
+	profileLock, err := env.config.LockProfile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		profileLock.Release()
+		return nil, nil, err
+	}
+
+	settings, _ := dbHandler.ReadSetup()
+	node, err := env.newNode(dbHandler, settings.Username, false)
+	if err != nil {
+		dbHandler.Close()
+		profileLock.Release()
+		return nil, nil, err
+	}
+	return node, func() {
+		node.Close()
+		dbHandler.Close()
+		profileLock.Release()
+	}, nil
+}
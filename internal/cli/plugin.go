@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"bokkoli/internal/plugin"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type pluginInfo struct {
+	plugin.Manifest
+	Enabled bool `json:"enabled"`
+}
+
+// 'plugin install <dir>' copies a plugin into the profile, 'enable' and 'disable' switch it for the chat, 'list' and 'remove' manage them
+func runPlugin(env *environment, args []string) error {
+	flags := env.flagSet("plugin", "list [--format text|json] | install <dir> | remove <name> | enable <name> | disable <name>")
+	format := flags.String("format", FORMAT_TEXT, "output format of 'list': text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	positional, err := parseInterleaved(flags, flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageError(flags, "expected 'list', 'install', 'remove', 'enable' or 'disable'")
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+	action, rest := positional[0], positional[1:]
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+	pluginDir := env.config.PluginDir()
+
+	switch {
+	case action == "list" && len(rest) == 0:
+		installed, listErr := plugin.Installed(pluginDir)
+		enabled, err := dbHandler.ReadEnabledPlugins()
+		if err != nil {
+			return err
+		}
+
+		plugins := make([]pluginInfo, len(installed))
+		for i, manifest := range installed {
+			plugins[i] = pluginInfo{Manifest: manifest, Enabled: slices.Contains(enabled, manifest.Name)}
+		}
+		if *format == FORMAT_JSON {
+			if err := env.writeJSON(plugins); err != nil {
+				return err
+			}
+		} else {
+			for _, p := range plugins {
+				state := "disabled"
+				if p.Enabled {
+					state = "enabled"
+				}
+				fmt.Fprintf(env.stdout, "%s %s %s\n", p.Name, state, p.Description)
+			}
+		}
+		return listErr
+	case action == "install" && len(rest) == 1:
+		manifest, err := plugin.Install(rest[0], pluginDir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(env.stdout, "installed %s, 'bokkoli plugin enable %s' to turn it on\n", manifest.Name, manifest.Name)
+		return nil
+	case action == "remove" && len(rest) == 1:
+		if err := plugin.Remove(pluginDir, rest[0]); err != nil {
+			return err
+		}
+		return dbHandler.DeletePlugin(rest[0])
+	case (action == "enable" || action == "disable") && len(rest) == 1:
+		manifest, err := plugin.LoadManifest(filepath.Join(pluginDir, rest[0]))
+		if err == nil && manifest.Name != rest[0] {
+			err = fmt.Errorf("installed as %s", manifest.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("plugin %s: %v", rest[0], err)
+		}
+		if err := dbHandler.SetPluginEnabled(manifest.Name, action == "enable"); err != nil {
+			return err
+		}
+		if action == "enable" {
+			fmt.Fprintf(env.stdout, "%s may:\n  %s\n", manifest.Name, strings.Join(manifest.Describe(), "\n  "))
+		}
+		return nil
+	default:
+		return usageError(flags, "unexpected arguments for %q: %s", action, strings.Join(rest, " "))
+	}
+}
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"bokkoli/internal/config"
+	"bokkoli/internal/lock"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type profileInfo struct {
+	Name   string `json:"name"`
+	Dir    string `json:"dir"`
+	InUse  bool   `json:"in_use"`
+	Active bool   `json:"active"`
+}
+
+// List the profiles in the data directory and whether a process is using them
+func runProfiles(env *environment, args []string) error {
+	flags := env.flagSet("profiles", "[--format text|json]")
+	format := flags.String("format", FORMAT_TEXT, "output format: text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	names, err := env.config.Profiles()
+	if err != nil {
+		return err
+	}
+
+	// The data directory itself is the default profile
+	profiles := []profileInfo{}
+	for _, name := range append([]string{""}, names...) {
+		cfg := *env.config
+		cfg.Profile = name
+		profiles = append(profiles, profileInfo{
+			Name:   cfg.ProfileName(),
+			Dir:    cfg.ProfileDir(),
+			InUse:  profileInUse(&cfg),
+			Active: name == env.config.Profile,
+		})
+	}
+
+	if *format == FORMAT_JSON {
+		return env.writeJSON(profiles)
+	}
+	for _, profile := range profiles {
+		marker := " "
+		if profile.Active {
+			marker = "*"
+		}
+		status := ""
+		if profile.InUse {
+			status = " (in use)"
+		}
+		fmt.Fprintf(env.stdout, "%s %-16s %s%s\n", marker, profile.Name, profile.Dir, status)
+	}
+	return nil
+}
+
+func profileInUse(cfg *config.Config) bool {
+	profileLock, err := lock.Acquire(cfg.LockPath())
+	if err != nil {
+		return errors.Is(err, lock.ErrLocked)
+	}
+	profileLock.Release()
+	return false
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"bokkoli/internal/webhook"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 'webhook add <url>' registers a webhook and prints its secret; 'list', 'remove <id>' and 'deliveries' manage them.
+// Webhooks fire from whichever process talks to peers on this profile, e.g. the daemon.
+func runWebhook(env *environment, args []string) error {
+	flags := env.flagSet("webhook", "add <url> [--events <list>] [--secret <secret>] | list | remove <id> | deliveries [--limit <n>] [--format text|json]")
+	events := flags.String("events", webhook.EventMessage, "comma separated events to deliver: "+strings.Join(webhook.Events, ", "))
+	secret := flags.String("secret", "", "key for the HMAC signature, generated when left out")
+	limit := flags.Int("limit", 20, "number of deliveries to show, most recent first")
+	format := flags.String("format", FORMAT_TEXT, "output format of 'list' and 'deliveries': text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageError(flags, "expected 'add', 'list', 'remove' or 'deliveries'")
+	}
+
+	// Flags may also follow the action and its argument
+	action := flags.Arg(0)
+	rest, err := parseInterleaved(flags, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if err := validateFormat(flags, *format, FORMAT_TEXT, FORMAT_JSON); err != nil {
+		return err
+	}
+
+	dbHandler, err := env.openDb()
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	switch {
+	case action == "add" && len(rest) == 1:
+		hook, err := webhook.New(rest[0], splitList(*events), *secret)
+		if err != nil {
+			return err
+		}
+		if hook.ID, err = dbHandler.SaveWebhook(hook); err != nil {
+			return err
+		}
+		fmt.Fprintf(env.stdout, "webhook %d: %s on %s\n", hook.ID, hook.URL, strings.Join(hook.Events, ", "))
+		fmt.Fprintf(env.stdout, "secret: %s\n", hook.Secret)
+		return nil
+	case action == "list" && len(rest) == 0:
+		webhooks, err := dbHandler.ReadWebhooks()
+		if err != nil {
+			return err
+		}
+		if *format == FORMAT_JSON {
+			return env.writeJSON(webhooks)
+		}
+		for _, hook := range webhooks {
+			fmt.Fprintf(env.stdout, "%d %s %s\n", hook.ID, hook.URL, strings.Join(hook.Events, ","))
+		}
+		return nil
+	case action == "remove" && len(rest) == 1:
+		id, err := strconv.ParseInt(rest[0], 10, 64)
+		if err != nil {
+			return usageError(flags, "expected a webhook id, got %q", rest[0])
+		}
+		return dbHandler.DeleteWebhook(id)
+	case action == "deliveries" && len(rest) == 0:
+		deliveries, err := dbHandler.ReadDeliveries("", *limit)
+		if err != nil {
+			return err
+		}
+		if *format == FORMAT_JSON {
+			return env.writeJSON(deliveries)
+		}
+		for _, d := range deliveries {
+			outcome := d.Error
+			if d.StatusCode != 0 && outcome == "" {
+				outcome = strconv.Itoa(d.StatusCode)
+			}
+			fmt.Fprintf(env.stdout, "%d webhook=%d %s %s attempts=%d %s %s\n",
+				d.ID, d.WebhookID, d.Event, d.Status, d.Attempts, d.UpdatedAt.Local().Format("2006-01-02 15:04:05"), outcome)
+		}
+		return nil
+	default:
+		return usageError(flags, "unknown action or wrong number of arguments: %s", strings.Join(append([]string{action}, rest...), " "))
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,287 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const PREFIX string = "/"
+
+var (
+	ErrNotACommand     = errors.New("input is not a command")
+	ErrUnknownCommand  = errors.New("unknown command")
+	ErrAlreadyExists   = errors.New("command already registered")
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+// A single positional argument accepted by a command
+type Arg struct {
+	Name     string
+	Required bool
+	// Rest consumes the remainder of the input, spaces included. Only valid on the last argument.
+	Rest bool
+	// Optional validation, run before the command handler
+	Validate func(value string) error
+	// Optional tab completion candidates for the given partial value
+	Complete func(partial string) []string
+}
+
+type Command struct {
+	Name    string
+	Aliases []string
+	Args    []Arg
+	Help    string
+	Run     func(args []string) tea.Cmd
+}
+
+// Usage line for the command, e.g. "/connect <address>" or "/listen [port]"
+func (c Command) Usage() string {
+	var usage strings.Builder
+	usage.WriteString(PREFIX + c.Name)
+
+	for _, arg := range c.Args {
+		name := arg.Name
+		if arg.Rest {
+			name += "..."
+		}
+
+		if arg.Required {
+			usage.WriteString(fmt.Sprintf(" <%s>", name))
+		} else {
+			usage.WriteString(fmt.Sprintf(" [%s]", name))
+		}
+	}
+
+	return usage.String()
+}
+
+type Registry struct {
+	commands map[string]*Command
+	aliases  map[string]string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		commands: make(map[string]*Command),
+		aliases:  make(map[string]string),
+	}
+}
+
+// Register a command; names and aliases are case-insensitive and must be unique across the registry
+func (r *Registry) Register(cmd Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " \t") {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+
+	for i, arg := range cmd.Args {
+		if arg.Rest && i != len(cmd.Args)-1 {
+			return fmt.Errorf("command %q: only the last argument may consume the rest of the input", cmd.Name)
+		}
+	}
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if _, exists := r.resolve(name); exists {
+			return fmt.Errorf("%w: %s", ErrAlreadyExists, PREFIX+name)
+		}
+	}
+
+	cmd.Name = strings.ToLower(cmd.Name)
+	r.commands[cmd.Name] = &cmd
+	for _, alias := range cmd.Aliases {
+		r.aliases[strings.ToLower(alias)] = cmd.Name
+	}
+
+	return nil
+}
+
+// Remove a command and its aliases, e.g. when the plugin that added it is disabled
+func (r *Registry) Unregister(name string) bool {
+	cmd, ok := r.resolve(strings.TrimPrefix(name, PREFIX))
+	if !ok {
+		return false
+	}
+
+	delete(r.commands, cmd.Name)
+	for _, alias := range cmd.Aliases {
+		delete(r.aliases, strings.ToLower(alias))
+	}
+	return true
+}
+
+func (r *Registry) resolve(name string) (*Command, bool) {
+	name = strings.ToLower(name)
+	if target, ok := r.aliases[name]; ok {
+		name = target
+	}
+
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// Lookup a command by name or alias, with or without the leading slash
+func (r *Registry) Lookup(name string) (Command, bool) {
+	cmd, ok := r.resolve(strings.TrimPrefix(name, PREFIX))
+	if !ok {
+		return Command{}, false
+	}
+
+	return *cmd, true
+}
+
+// All registered commands sorted by name
+func (r *Registry) Commands() []Command {
+	commands := make([]Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		commands = append(commands, *cmd)
+	}
+
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+
+	return commands
+}
+
+func IsCommand(input string) bool {
+	return strings.HasPrefix(input, PREFIX)
+}
+
+// Parse input into a command and its validated arguments. Argument casing is preserved.
+func (r *Registry) Parse(input string) (Command, []string, error) {
+	if !IsCommand(input) {
+		return Command{}, nil, ErrNotACommand
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimPrefix(input, PREFIX), " ")
+	cmd, ok := r.resolve(name)
+	if !ok {
+		return Command{}, nil, fmt.Errorf("%w: %s", ErrUnknownCommand, PREFIX+name)
+	}
+
+	args, err := splitArgs(*cmd, rest)
+	if err != nil {
+		return *cmd, nil, err
+	}
+
+	for i, value := range args {
+		if validate := cmd.Args[i].Validate; validate != nil {
+			if err := validate(value); err != nil {
+				return *cmd, nil, fmt.Errorf("%w: %s: %v", ErrInvalidArgument, cmd.Args[i].Name, err)
+			}
+		}
+	}
+
+	return *cmd, args, nil
+}
+
+// Parse and run the command, returning the handler's tea.Cmd
+func (r *Registry) Execute(input string) (tea.Cmd, error) {
+	cmd, args, err := r.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.Run == nil {
+		return nil, nil
+	}
+
+	return cmd.Run(args), nil
+}
+
+func splitArgs(cmd Command, rest string) ([]string, error) {
+	var args []string
+	rest = strings.TrimSpace(rest)
+
+	for _, arg := range cmd.Args {
+		if rest == "" {
+			break
+		}
+
+		if arg.Rest {
+			args = append(args, rest)
+			rest = ""
+			break
+		}
+
+		var value string
+		value, rest, _ = strings.Cut(rest, " ")
+		rest = strings.TrimSpace(rest)
+		args = append(args, value)
+	}
+
+	if rest != "" {
+		return nil, fmt.Errorf("%w: too many arguments, usage: %s", ErrInvalidArgument, cmd.Usage())
+	}
+
+	for i := len(args); i < len(cmd.Args); i++ {
+		if cmd.Args[i].Required {
+			return nil, fmt.Errorf("%w: missing <%s>, usage: %s", ErrInvalidArgument, cmd.Args[i].Name, cmd.Usage())
+		}
+	}
+
+	return args, nil
+}
+
+// Tab completion candidates for the input, each a full replacement of the input line
+func (r *Registry) Complete(input string) []string {
+	if !IsCommand(input) {
+		return nil
+	}
+
+	name, rest, hasArgs := strings.Cut(strings.TrimPrefix(input, PREFIX), " ")
+
+	var candidates []string
+	if !hasArgs {
+		for _, cmd := range r.Commands() {
+			if strings.HasPrefix(cmd.Name, strings.ToLower(name)) {
+				candidates = append(candidates, PREFIX+cmd.Name+" ")
+			}
+		}
+		return candidates
+	}
+
+	cmd, ok := r.resolve(name)
+	if !ok {
+		return nil
+	}
+
+	// Only the last, partially typed argument is completed
+	fields := strings.Split(rest, " ")
+	index := len(fields) - 1
+	if index >= len(cmd.Args) || cmd.Args[index].Complete == nil {
+		return nil
+	}
+
+	partial := fields[index]
+	head := strings.TrimSuffix(input, partial)
+	for _, value := range cmd.Args[index].Complete(partial) {
+		if strings.HasPrefix(value, partial) {
+			candidates = append(candidates, head+value)
+		}
+	}
+
+	return candidates
+}
+
+// Longest prefix shared by every candidate, used to extend the input when completion is ambiguous
+func CommonPrefix(candidates []string) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+
+	return prefix
+}
@@ -0,0 +1,175 @@
+package command
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func newTestRegistry(t *testing.T) *Registry {
+	registry := NewRegistry()
+	commands := []Command{
+		{Name: "listen", Args: []Arg{{Name: "port"}}},
+		{Name: "list"},
+		{
+			Name: "connect",
+			Args: []Arg{{
+				Name:     "address",
+				Required: true,
+				Complete: func(partial string) []string { return []string{"8080", "8081", "9000"} },
+			}},
+		},
+		{Name: "nick", Args: []Arg{{Name: "username", Required: true, Rest: true}}},
+		{Name: "quit", Aliases: []string{"exit"}},
+	}
+
+	for _, cmd := range commands {
+		if err := registry.Register(cmd); err != nil {
+			t.Fatal("Got an error registering command: ", err)
+		}
+	}
+	return registry
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	err := registry.Register(Command{Name: "EXIT"})
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Expected %v, got %v", ErrAlreadyExists, err)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	if !registry.Unregister("/QUIT") {
+		t.Fatal("Expected /quit to be removed")
+	}
+	if _, ok := registry.Lookup("exit"); ok {
+		t.Error("Expected the alias to be removed along with the command")
+	}
+	if err := registry.Register(Command{Name: "exit"}); err != nil {
+		t.Errorf("Expected the name to be free again, got %v", err)
+	}
+	if registry.Unregister("quit") {
+		t.Error("Expected nothing to remove the second time")
+	}
+}
+
+func TestParsePreservesArgumentCase(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	cmd, args, err := registry.Parse("/NICK Pickle Rick")
+	if err != nil {
+		t.Fatal("Got an error parsing command: ", err)
+	}
+
+	if cmd.Name != "nick" || !slices.Equal(args, []string{"Pickle Rick"}) {
+		t.Errorf("Expected nick [Pickle Rick], got %s %v", cmd.Name, args)
+	}
+}
+
+func TestParseAlias(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	cmd, _, err := registry.Parse("/exit")
+	if err != nil || cmd.Name != "quit" {
+		t.Errorf("Expected quit, got %s (%v)", cmd.Name, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	tests := map[string]error{
+		"hello":             ErrNotACommand,
+		"/veggie":           ErrUnknownCommand,
+		"/connect":          ErrInvalidArgument,
+		"/listen 8080 8081": ErrInvalidArgument,
+	}
+
+	for input, expected := range tests {
+		if _, _, err := registry.Parse(input); !errors.Is(err, expected) {
+			t.Errorf("%q: expected %v, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(Command{
+		Name: "listen",
+		Args: []Arg{{Name: "port", Validate: func(string) error { return errors.New("bad port") }}},
+	})
+
+	if _, _, err := registry.Parse("/listen 20"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected %v, got %v", ErrInvalidArgument, err)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	registry := NewRegistry()
+	var got []string
+	registry.Register(Command{
+		Name: "connect",
+		Args: []Arg{{Name: "address", Required: true}},
+		Run: func(args []string) tea.Cmd {
+			got = args
+			return nil
+		},
+	})
+
+	if _, err := registry.Execute("/connect localhost:8080"); err != nil {
+		t.Fatal("Got an error executing command: ", err)
+	}
+
+	if !slices.Equal(got, []string{"localhost:8080"}) {
+		t.Errorf("Expected [localhost:8080], got %v", got)
+	}
+}
+
+func TestCompleteCommandName(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	expected := []string{"/list ", "/listen "}
+	result := registry.Complete("/lis")
+
+	if !slices.Equal(expected, result) {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+
+	if prefix := CommonPrefix(result); prefix != "/list" {
+		t.Errorf("Expected common prefix '/list', got %q", prefix)
+	}
+}
+
+func TestCompleteArgument(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	expected := []string{"/connect 8080", "/connect 8081"}
+	result := registry.Complete("/connect 80")
+
+	if !slices.Equal(expected, result) {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	tests := map[string]string{
+		"listen":  "/listen [port]",
+		"connect": "/connect <address>",
+		"nick":    "/nick <username...>",
+	}
+
+	for name, expected := range tests {
+		cmd, _ := registry.Lookup(name)
+		if result := cmd.Usage(); result != expected {
+			t.Errorf("Expected %q, got %q", expected, result)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package config
+
+import (
+	"bokkoli/internal/lock"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const APP_NAME string = "bokkoli"
+
+// Environment variables are the key in upper case with this prefix, e.g. BOKKOLI_DATA_DIR or BOKKOLI_FEATURES_DAEMON
+const ENV_PREFIX string = "BOKKOLI_"
+
+// Named profiles live in this directory under the data directory
+const PROFILES_DIR_NAME string = "profiles"
+
+// Installed plugins live in this directory under the profile directory, one directory each
+const PLUGINS_DIR_NAME string = "plugins"
+
+// /export writes transcripts to this directory under the profile directory
+const EXPORTS_DIR_NAME string = "exports"
+
+// Files kept in the data and config directories
+const (
+	DB_FILE_NAME     string = "bokkoli.db"
+	SOCKET_FILE_NAME string = "bokkoli.sock"
+	LOG_FILE_NAME    string = "debug.log"
+	LOCK_FILE_NAME   string = "bokkoli.lock"
+	CONFIG_FILE_NAME string = "config.toml"
+	THEMES_FILE_NAME string = "themes.json"
+	// Bearer token for the HTTP API, generated on first use
+	API_TOKEN_FILE_NAME string = "api.token"
+	// The profile's identity key, generated on first use
+	IDENTITY_FILE_NAME string = "identity.key"
+)
+
+// What to do with incoming peers that aren't in the contacts
+const (
+	UnknownPeersAsk    string = "ask"
+	UnknownPeersAccept string = "accept"
+	UnknownPeersDeny   string = "deny"
+)
+
+// Where a value came from, later sources override earlier ones
+const (
+	SourceDefault string = "default"
+	SourceFile    string = "file"
+	SourceEnv     string = "env"
+	SourceFlag    string = "flag"
+)
+
+var ErrUnknownKey = errors.New("unknown key")
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Switches for optional parts of Bokkoli
+type Features struct {
+	// Attach to a running daemon instead of opening connections in-process
+	Daemon bool
+	// Allow rendering messages as Markdown, /markdown only works when this is on
+	Markdown  bool
+	StatusBar bool
+	// Serve the HTTP API from the daemon
+	API bool
+	// Serve the IRC gateway from the daemon
+	IRC bool
+}
+
+// Effective configuration: defaults, overridden by the config file, then BOKKOLI_* environment variables, then flags
+type Config struct {
+	DataDir string
+	// Named profile with its own database, socket and log, empty for the data directory itself
+	Profile string
+	// Host to accept peer connections on, empty for every interface
+	BindAddress string
+	// Overrides the theme saved in the user settings when set
+	Theme    string
+	LogLevel string
+	// Size in megabytes at which the log file is rotated, and how many rotated files are kept
+	LogMaxSize int
+	LogBackups int
+	// Log message content, addresses and every protocol frame, for debugging the protocol
+	LogTrace bool
+	// Loopback host and port the HTTP API and the IRC gateway listen on
+	APIAddress string
+	IRCAddress string
+	// Password peers must prove they know before they may connect to us, and that we prove to rooms we connect to
+	RoomPassword string
+	// ask, accept or deny peers whose identity key isn't in the contacts
+	UnknownPeers string
+	// Minutes without input before the chat locks, 0 never. Only with a passphrase, it is what unlocks it.
+	LockAfter int
+	// Days and number of messages per conversation to keep, 0 keeps everything. Archived conversations are exempt.
+	RetentionDays     int
+	RetentionMessages int
+	// Hours between database maintenance runs, 0 never
+	MaintenanceInterval int
+	Features            Features
+
+	// Config file that was read, empty when there was none
+	File    string
+	sources map[string]string
+}
+
+// A configuration key as written in the config file
+type key struct {
+	name  string
+	usage string
+	get   func(c *Config) string
+	set   func(c *Config, value string) error
+	// The value with its TOML type, for keys that aren't strings
+	typed func(c *Config) any
+}
+
+var keys = []key{
+	{
+		name:  "data_dir",
+		usage: "directory for the database, daemon socket, log file and profiles",
+		get:   func(c *Config) string { return c.DataDir },
+		set: func(c *Config, value string) error {
+			if value == "" {
+				return errors.New("cannot be empty")
+			}
+			c.DataDir = expandHome(value)
+			return nil
+		},
+	},
+	{
+		name:  "profile",
+		usage: "named profile, each with its own database, socket and log file",
+		get:   func(c *Config) string { return c.Profile },
+		set: func(c *Config, value string) error {
+			if value != "" && !profileNamePattern.MatchString(value) {
+				return fmt.Errorf("profile names may only contain letters, digits, '-' and '_', got %q", value)
+			}
+			c.Profile = value
+			return nil
+		},
+	},
+	{
+		name:  "bind_address",
+		usage: "host to accept peer connections on, all interfaces when empty",
+		get:   func(c *Config) string { return c.BindAddress },
+		set: func(c *Config, value string) error {
+			if _, _, err := net.SplitHostPort(value); err == nil {
+				return errors.New("expected a host without a port, the port is part of your settings")
+			}
+			c.BindAddress = value
+			return nil
+		},
+	},
+	{
+		name:  "theme",
+		usage: "color theme, overrides the theme saved in your settings",
+		get:   func(c *Config) string { return c.Theme },
+		set:   func(c *Config, value string) error { c.Theme = value; return nil },
+	},
+	{
+		name:  "log_level",
+		usage: "least severe log level written to the log file: debug, info, warn or error",
+		get:   func(c *Config) string { return c.LogLevel },
+		set: func(c *Config, value string) error {
+			value = strings.ToLower(value)
+			if _, ok := logLevels[value]; !ok {
+				return fmt.Errorf("expected debug, info, warn or error, got %q", value)
+			}
+			c.LogLevel = value
+			return nil
+		},
+	},
+	intKey("log_max_size", "size in megabytes at which the log file is rotated", 1, func(c *Config) *int { return &c.LogMaxSize }),
+	intKey("log_backups", "number of rotated log files to keep", 0, func(c *Config) *int { return &c.LogBackups }),
+	boolKey("log_trace", "log message content, peer addresses and protocol frames", func(c *Config) *bool { return &c.LogTrace }),
+	loopbackKey("api_address", "loopback host and port for the HTTP API", func(c *Config) *string { return &c.APIAddress }),
+	loopbackKey("irc_address", "loopback host and port for the IRC gateway", func(c *Config) *string { return &c.IRCAddress }),
+	{
+		name:  "room_password",
+		usage: "password peers must know to connect to you, empty lets anyone in",
+		// Never shown, only whether one is set
+		get: func(c *Config) string {
+			if c.RoomPassword == "" {
+				return ""
+			}
+			return "********"
+		},
+		set: func(c *Config, value string) error { c.RoomPassword = value; return nil },
+	},
+	{
+		name:  "unknown_peers",
+		usage: "what to do with peers that aren't in your contacts: ask, accept or deny",
+		get:   func(c *Config) string { return c.UnknownPeers },
+		set: func(c *Config, value string) error {
+			value = strings.ToLower(value)
+			if value != UnknownPeersAsk && value != UnknownPeersAccept && value != UnknownPeersDeny {
+				return fmt.Errorf("expected ask, accept or deny, got %q", value)
+			}
+			c.UnknownPeers = value
+			return nil
+		},
+	},
+	intKey("lock_after", "minutes without input before the chat locks, 0 never; needs a passphrase", 0, func(c *Config) *int { return &c.LockAfter }),
+	intKey("retention_days", "days messages are kept, 0 forever; archived conversations are exempt", 0, func(c *Config) *int { return &c.RetentionDays }),
+	intKey("retention_messages", "messages kept per conversation, 0 all; archived conversations are exempt", 0, func(c *Config) *int { return &c.RetentionMessages }),
+	intKey("maintenance_interval", "hours between purging and vacuuming the database, 0 never", 0, func(c *Config) *int { return &c.MaintenanceInterval }),
+	boolKey("features.daemon", "attach to a running daemon", func(c *Config) *bool { return &c.Features.Daemon }),
+	boolKey("features.markdown", "allow rendering messages as Markdown", func(c *Config) *bool { return &c.Features.Markdown }),
+	boolKey("features.status_bar", "show the status bar in the chat", func(c *Config) *bool { return &c.Features.StatusBar }),
+	boolKey("features.api", "serve the HTTP API from the daemon", func(c *Config) *bool { return &c.Features.API }),
+	boolKey("features.irc", "serve the IRC gateway from the daemon", func(c *Config) *bool { return &c.Features.IRC }),
+}
+
+func boolKey(name string, usage string, field func(c *Config) *bool) key {
+	return key{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		typed: func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("expected true or false, got %q", value)
+			}
+			*field(c) = enabled
+			return nil
+		},
+	}
+}
+
+// Host and port that may only be on this machine
+func loopbackKey(name string, usage string, field func(c *Config) *string) key {
+	return key{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			host, _, err := net.SplitHostPort(value)
+			if err != nil {
+				return fmt.Errorf("expected a host and a port, got %q", value)
+			}
+			if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				return fmt.Errorf("only loopback addresses are allowed, got %q", host)
+			}
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func intKey(name string, usage string, minimum int, field func(c *Config) *int) key {
+	return key{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		typed: func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			number, err := strconv.Atoi(value)
+			if err != nil || number < minimum {
+				return fmt.Errorf("expected a whole number of at least %d, got %q", minimum, value)
+			}
+			*field(c) = number
+			return nil
+		},
+	}
+}
+
+func Default() Config {
+	c := Config{
+		DataDir:      DefaultDataDir(),
+		LogLevel:     "info",
+		LogMaxSize:   10,
+		LogBackups:   3,
+		APIAddress:   "127.0.0.1:7787",
+		IRCAddress:   "127.0.0.1:6667",
+		UnknownPeers: UnknownPeersAsk,
+		LockAfter:    15,
+
+		MaintenanceInterval: 24,
+		Features:            Features{Daemon: true, Markdown: true, StatusBar: true},
+		sources:             make(map[string]string),
+	}
+	for _, k := range keys {
+		c.sources[k.name] = SourceDefault
+	}
+	return c
+}
+
+// $XDG_DATA_HOME/bokkoli, or ~/.local/share/bokkoli
+func DefaultDataDir() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, APP_NAME)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "share", APP_NAME)
+	}
+	return "."
+}
+
+// $XDG_CONFIG_HOME/bokkoli, or the platform's equivalent
+func ConfigDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, APP_NAME)
+	}
+	return "."
+}
+
+// Build the configuration from the global flags at the start of args, returning the arguments after them.
+// lookupEnv is os.LookupEnv outside of tests.
+func Load(args []string, lookupEnv func(string) (string, bool), output io.Writer) (Config, []string, error) {
+	c := Default()
+
+	// Flags are parsed first to find the config file, but applied last so they take precedence
+	flags := flag.NewFlagSet(APP_NAME, flag.ContinueOnError)
+	flags.SetOutput(output)
+	// Help is printed by the caller along with the commands, see PrintFlags
+	flags.Usage = func() {}
+	configFile := flags.String("config", "", "config file to read instead of "+filepath.Join(ConfigDir(), CONFIG_FILE_NAME))
+	flagValues := make(map[string]string)
+	for _, k := range keys {
+		name := k.name
+		flags.Func(flagName(name), k.usage, func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	path, explicit := *configFile, *configFile != ""
+	if !explicit {
+		path, explicit = lookupEnv(ENV_PREFIX + "CONFIG")
+	}
+	if !explicit {
+		path = filepath.Join(ConfigDir(), CONFIG_FILE_NAME)
+	}
+	if err := c.loadFile(path, explicit); err != nil {
+		return c, nil, err
+	}
+
+	for _, k := range keys {
+		if value, ok := lookupEnv(envName(k.name)); ok {
+			if err := c.Set(k.name, value, SourceEnv); err != nil {
+				return c, nil, fmt.Errorf("%s: %v", envName(k.name), err)
+			}
+		}
+	}
+
+	for _, k := range keys {
+		if value, ok := flagValues[k.name]; ok {
+			if err := c.Set(k.name, value, SourceFlag); err != nil {
+				return c, nil, fmt.Errorf("--%s: %v", flagName(k.name), err)
+			}
+		}
+	}
+
+	return c, flags.Args(), nil
+}
+
+// Describe the global flags and their environment variables
+func PrintFlags(w io.Writer) {
+	fmt.Fprintf(w, "  --%-28s %s\n", "config <path>", "config file, defaults to "+filepath.Join(ConfigDir(), CONFIG_FILE_NAME))
+	for _, k := range keys {
+		fmt.Fprintf(w, "  --%-28s %s (%s)\n", flagName(k.name)+" <value>", k.usage, envName(k.name))
+	}
+}
+
+// Read a TOML config file; a missing file is only an error when it was asked for explicitly
+func (c *Config) loadFile(path string, required bool) error {
+	values := make(map[string]any)
+	_, err := toml.DecodeFile(path, &values)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+
+	c.File = path
+	for name, value := range flatten("", values) {
+		if err := c.Set(name, fmt.Sprint(value), SourceFile); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// Turn nested tables into dotted keys, e.g. [features] daemon = true into features.daemon
+func flatten(prefix string, values map[string]any) map[string]any {
+	flat := make(map[string]any)
+	for name, value := range values {
+		if table, ok := value.(map[string]any); ok {
+			for nested, v := range flatten(prefix+name+".", table) {
+				flat[nested] = v
+			}
+			continue
+		}
+		flat[prefix+name] = value
+	}
+	return flat
+}
+
+// Change a key, recording where the value came from
+func (c *Config) Set(name string, value string, source string) error {
+	for _, k := range keys {
+		if k.name != name {
+			continue
+		}
+		if err := k.set(c, value); err != nil {
+			return err
+		}
+		c.sources[name] = source
+		return nil
+	}
+	return fmt.Errorf("%w %q", ErrUnknownKey, name)
+}
+
+// A key's effective value and where it came from
+func (c *Config) Get(name string) (string, string, error) {
+	for _, k := range keys {
+		if k.name == name {
+			return k.get(c), c.sources[name], nil
+		}
+	}
+	return "", "", fmt.Errorf("%w %q", ErrUnknownKey, name)
+}
+
+// Like Get, but numbers and booleans keep their type, for writing them out as TOML or JSON
+func (c *Config) Value(name string) (any, string, error) {
+	for _, k := range keys {
+		if k.name == name && k.typed != nil {
+			return k.typed(c), c.sources[name], nil
+		}
+	}
+	return c.Get(name)
+}
+
+// Every key in the order they are documented
+func Keys() []string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.name
+	}
+	return names
+}
+
+// Directory of the active profile, holding its database, socket, keys and logs
+func (c *Config) ProfileDir() string {
+	if c.Profile == "" {
+		return c.DataDir
+	}
+	return filepath.Join(c.DataDir, PROFILES_DIR_NAME, c.Profile)
+}
+
+func (c *Config) DbPath() string {
+	return filepath.Join(c.ProfileDir(), DB_FILE_NAME)
+}
+
+// Versions before the data directory kept the database in the working directory. Move one found in dir
+// into the default profile, unless that already has a database. Returns the path that was moved, if any.
+func (c *Config) MoveLegacyDb(dir string) (string, error) {
+	legacy, err := filepath.Abs(filepath.Join(dir, DB_FILE_NAME))
+	if err != nil {
+		return "", err
+	}
+	target, err := filepath.Abs(filepath.Join(c.DataDir, DB_FILE_NAME))
+	if err != nil || legacy == target {
+		return "", err
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		return "", nil
+	}
+	if _, err := os.Stat(target); err == nil {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(c.DataDir, 0o700); err != nil {
+		return legacy, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	// SQLite keeps recent writes next to the database until a checkpoint
+	for _, suffix := range []string{"-wal", "-shm", "-journal", ""} {
+		if _, err := os.Stat(legacy + suffix); err != nil {
+			continue
+		}
+		if err := os.Rename(legacy+suffix, target+suffix); err != nil {
+			return legacy, fmt.Errorf("could not move %s to %s, move it there to keep your history: %v", legacy, target, err)
+		}
+	}
+	return legacy, nil
+}
+
+func (c *Config) SocketPath() string {
+	return filepath.Join(c.ProfileDir(), SOCKET_FILE_NAME)
+}
+
+func (c *Config) LogPath() string {
+	return filepath.Join(c.ProfileDir(), LOG_FILE_NAME)
+}
+
+func (c *Config) APITokenPath() string {
+	return filepath.Join(c.ProfileDir(), API_TOKEN_FILE_NAME)
+}
+
+func (c *Config) IdentityPath() string {
+	return filepath.Join(c.ProfileDir(), IDENTITY_FILE_NAME)
+}
+
+func (c *Config) PluginDir() string {
+	return filepath.Join(c.ProfileDir(), PLUGINS_DIR_NAME)
+}
+
+func (c *Config) ExportDir() string {
+	return filepath.Join(c.ProfileDir(), EXPORTS_DIR_NAME)
+}
+
+func (c *Config) LockPath() string {
+	return filepath.Join(c.ProfileDir(), LOCK_FILE_NAME)
+}
+
+// Claim the profile for this process. Everything that talks to peers holds it, so two processes never share a database.
+func (c *Config) LockProfile() (*lock.Lock, error) {
+	if err := os.MkdirAll(c.ProfileDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create profile directory: %v", err)
+	}
+
+	profileLock, err := lock.Acquire(c.LockPath())
+	if err != nil {
+		return nil, fmt.Errorf("profile %q is %v, pick another with --profile", c.ProfileName(), err)
+	}
+	return profileLock, nil
+}
+
+// Profile name for messages, "default" when none was picked
+func (c *Config) ProfileName() string {
+	if c.Profile == "" {
+		return "default"
+	}
+	return c.Profile
+}
+
+// Names of the profiles that have a directory, sorted
+func (c *Config) Profiles() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(c.DataDir, PROFILES_DIR_NAME))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && profileNamePattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// User-defined themes live next to the config file
+func (c *Config) ThemesPath() string {
+	if c.File != "" {
+		return filepath.Join(filepath.Dir(c.File), THEMES_FILE_NAME)
+	}
+	return filepath.Join(ConfigDir(), THEMES_FILE_NAME)
+}
+
+func (c *Config) SlogLevel() slog.Level {
+	return logLevels[c.LogLevel]
+}
+
+// --data-dir, --features-daemon
+func flagName(name string) string {
+	return strings.NewReplacer("_", "-", ".", "-").Replace(name)
+}
+
+// BOKKOLI_DATA_DIR, BOKKOLI_FEATURES_DAEMON
+func envName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.NewReplacer(".", "_").Replace(name))
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), CONFIG_FILE_NAME)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func lookupIn(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+data_dir = "/from/file"
+theme = "light"
+log_level = "debug"
+
+[features]
+daemon = false
+`)
+	env := map[string]string{
+		"BOKKOLI_CONFIG":   path,
+		"BOKKOLI_THEME":    "dark",
+		"BOKKOLI_DATA_DIR": "/from/env",
+	}
+
+	c, rest, err := Load([]string{"--data-dir", "/from/flag", "history", "--limit", "5"}, lookupIn(env), io.Discard)
+	if err != nil {
+		t.Fatal("Got an error loading: ", err)
+	}
+
+	expected := map[string][2]string{
+		"data_dir":          {"/from/flag", SourceFlag},
+		"theme":             {"dark", SourceEnv},
+		"log_level":         {"debug", SourceFile},
+		"features.daemon":   {"false", SourceFile},
+		"features.markdown": {"true", SourceDefault},
+	}
+	for name, want := range expected {
+		value, source, err := c.Get(name)
+		if err != nil || value != want[0] || source != want[1] {
+			t.Errorf("%s: expected %q from %s, got %q from %s (%v)", name, want[0], want[1], value, source, err)
+		}
+	}
+
+	if len(rest) != 3 || rest[0] != "history" {
+		t.Errorf("Expected the command and its arguments to be left, got %v", rest)
+	}
+	if c.DbPath() != filepath.Join("/from/flag", DB_FILE_NAME) {
+		t.Errorf("Expected the database in the data directory, got %q", c.DbPath())
+	}
+}
+
+func TestLoadWithoutConfigFile(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	c, _, err := Load(nil, lookupIn(nil), io.Discard)
+	if err != nil {
+		t.Fatal("Expected a missing default config file to be fine, got: ", err)
+	}
+	if c.File != "" || !c.Features.Daemon || c.LogLevel != "info" {
+		t.Errorf("Expected the defaults, got %+v", c)
+	}
+
+	if _, _, err := Load([]string{"--config", "/does/not/exist.toml"}, lookupIn(nil), io.Discard); err == nil {
+		t.Error("Expected an error for a missing config file that was asked for")
+	}
+}
+
+func TestLoadInvalidValues(t *testing.T) {
+	tests := map[string]string{
+		"unknown key": "colour = \"red\"\n",
+		"log level":   "log_level = \"chatty\"\n",
+		"bind port":   "bind_address = \"127.0.0.1:8080\"\n",
+		"feature":     "[features]\nmarkdown = \"sometimes\"\n",
+	}
+
+	for name, content := range tests {
+		path := writeConfigFile(t, content)
+		if _, _, err := Load([]string{"--config", path}, lookupIn(nil), io.Discard); err == nil {
+			t.Errorf("%s: expected an error, got nil", name)
+		}
+	}
+
+	if _, _, err := Load(nil, lookupIn(map[string]string{"BOKKOLI_FEATURES_STATUS_BAR": "nope"}), io.Discard); err == nil {
+		t.Error("Expected an error for an invalid environment variable")
+	}
+}
+
+func TestSetUnknownKey(t *testing.T) {
+	c := Default()
+	if err := c.Set("volume", "11", SourceFlag); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestProfileDir(t *testing.T) {
+	c, _, err := Load([]string{"--data-dir", "/data", "--profile", "alice"}, lookupIn(nil), io.Discard)
+	if err != nil {
+		t.Fatal("Got an error loading: ", err)
+	}
+	if c.DbPath() != filepath.Join("/data", PROFILES_DIR_NAME, "alice", DB_FILE_NAME) {
+		t.Errorf("Expected the database in the profile directory, got %q", c.DbPath())
+	}
+
+	if _, _, err := Load([]string{"--profile", "../bob"}, lookupIn(nil), io.Discard); err == nil {
+		t.Error("Expected an error for a profile name with a path in it")
+	}
+}
+
+func TestMoveLegacyDb(t *testing.T) {
+	workDir := t.TempDir()
+	c := Default()
+	c.DataDir = filepath.Join(t.TempDir(), "data")
+
+	if legacy, err := c.MoveLegacyDb(workDir); legacy != "" || err != nil {
+		t.Fatalf("Expected nothing to move, got %q (%v)", legacy, err)
+	}
+
+	for _, name := range []string{DB_FILE_NAME, DB_FILE_NAME + "-wal"} {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy, err := c.MoveLegacyDb(workDir)
+	if err != nil || legacy != filepath.Join(workDir, DB_FILE_NAME) {
+		t.Fatalf("Expected the old database to be moved, got %q (%v)", legacy, err)
+	}
+	for _, name := range []string{DB_FILE_NAME, DB_FILE_NAME + "-wal"} {
+		if content, err := os.ReadFile(filepath.Join(c.DataDir, name)); err != nil || string(content) != name {
+			t.Errorf("Expected %s in the data directory, got %q (%v)", name, content, err)
+		}
+		if _, err := os.Stat(filepath.Join(workDir, name)); err == nil {
+			t.Errorf("Expected %s to be gone from the working directory", name)
+		}
+	}
+
+	// A database in the data directory is never replaced
+	if err := os.WriteFile(filepath.Join(workDir, DB_FILE_NAME), []byte("older"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if legacy, err := c.MoveLegacyDb(workDir); legacy != "" || err != nil {
+		t.Errorf("Expected the existing database to be kept, got %q (%v)", legacy, err)
+	}
+}
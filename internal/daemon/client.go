@@ -0,0 +1,241 @@
+package daemon
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/message"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrDisconnected = errors.New("disconnected from the Bokkoli daemon")
+
+// Frontend side of the control API. Implements message.Backend, so the chat view works the same
+// whether it talks to a daemon or to an in-process Node.
+type Client struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan rpcMessage
+	// Events are requested from the daemon once and fanned out to every local subscriber
+	subscribed  bool
+	subscribers map[chan message.Event]struct{}
+	closed      bool
+}
+
+var _ message.Backend = (*Client)(nil)
+
+// Attach to a running daemon, fails when none is listening on the socket
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:        conn,
+		pending:     make(map[int64]chan rpcMessage),
+		subscribers: make(map[chan message.Event]struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Client) readLoop() {
+	defer c.disconnect()
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 0, 4096), MAX_REQUEST_SIZE)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			logger.Warn("malformed message from daemon", logging.KeyErr, err)
+			continue
+		}
+
+		if msg.Method == methodEvent {
+			var event message.Event
+			if err := json.Unmarshal(msg.Params, &event); err != nil {
+				logger.Warn("malformed event from daemon", logging.KeyErr, err)
+				continue
+			}
+			c.publish(event)
+			continue
+		}
+
+		if msg.ID == nil {
+			continue
+		}
+		c.mu.Lock()
+		response, ok := c.pending[*msg.ID]
+		delete(c.pending, *msg.ID)
+		c.mu.Unlock()
+		if ok {
+			response <- msg
+		}
+	}
+}
+
+func (c *Client) publish(event message.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for events := range c.subscribers {
+		select {
+		case events <- event:
+		default:
+			logger.Warn("subscriber is not keeping up, dropping event", "event", event.Type)
+		}
+	}
+}
+
+// Fail every call still waiting and end all subscriptions
+func (c *Client) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for id, response := range c.pending {
+		delete(c.pending, id)
+		close(response)
+	}
+	for events := range c.subscribers {
+		delete(c.subscribers, events)
+		close(events)
+	}
+}
+
+// Send a request and wait for its response, decoding the result into result when it is not nil
+func (c *Client) call(method string, params any, result any) error {
+	jsonParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrDisconnected
+	}
+	c.nextID++
+	id := c.nextID
+	response := make(chan rpcMessage, 1)
+	c.pending[id] = response
+	c.mu.Unlock()
+
+	jsonData, err := json.Marshal(rpcMessage{JSONRPC: JSONRPC_VERSION, ID: &id, Method: method, Params: jsonParams})
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	_, err = c.conn.Write(append(jsonData, '\n'))
+	c.writeMu.Unlock()
+	if err != nil {
+		return ErrDisconnected
+	}
+
+	msg, ok := <-response
+	if !ok {
+		return ErrDisconnected
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if result != nil {
+		return json.Unmarshal(msg.Result, result)
+	}
+	return nil
+}
+
+func (c *Client) Listen(port string) error {
+	return c.call(methodListen, listenParams{Port: port}, nil)
+}
+
+func (c *Client) Connect(address string) (string, error) {
+	var result connectResult
+	err := c.call(methodConnect, connectParams{Address: address}, &result)
+	return result.Address, err
+}
+
+func (c *Client) Send(to string, text string) (db.Message, error) {
+	var sent db.Message
+	err := c.call(methodSend, sendParams{To: to, Text: text}, &sent)
+	return sent, err
+}
+
+// Receive every daemon event from now on; call the returned function to stop
+func (c *Client) Subscribe() (<-chan message.Event, func()) {
+	events := make(chan message.Event, message.EVENT_BUFFER_SIZE)
+
+	c.mu.Lock()
+	first := !c.subscribed
+	c.subscribed = true
+	if c.closed {
+		close(events)
+	} else {
+		c.subscribers[events] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	if first {
+		if err := c.call(methodSubscribe, nil, nil); err != nil {
+			logger.Error("could not subscribe to daemon events", logging.KeyErr, err)
+		}
+	}
+
+	unsubscribe := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.subscribers[events]; ok {
+			delete(c.subscribers, events)
+			close(events)
+		}
+	}
+	return events, unsubscribe
+}
+
+func (c *Client) History(filter db.MessageFilter) ([]db.Message, error) {
+	messages := []db.Message{}
+	err := c.call(methodHistory, newHistoryParams(filter), &messages)
+	return messages, err
+}
+
+func (c *Client) Conversations() ([]db.Conversation, error) {
+	conversations := []db.Conversation{}
+	err := c.call(methodConversations, nil, &conversations)
+	return conversations, err
+}
+
+func (c *Client) Status() (message.Status, error) {
+	var status message.Status
+	err := c.call(methodStatus, nil, &status)
+	return status, err
+}
+
+func (c *Client) SetUsername(username string) error {
+	return c.call(methodSetUsername, setUsernameParams{Username: username}, nil)
+}
+
+func (c *Client) Decide(address string, decision message.Decision) error {
+	return c.call(methodDecide, decideParams{Address: address, Decision: decision}, nil)
+}
+
+func (c *Client) SetTimer(to string, timer time.Duration) error {
+	return c.call(methodSetTimer, setTimerParams{To: to, Seconds: int64(timer / time.Second)}, nil)
+}
+
+// Ask the daemon to close its connections and exit
+func (c *Client) Shutdown() error {
+	return c.call(methodShutdown, nil, nil)
+}
+
+// Detach from the daemon, which keeps running along with its connections
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
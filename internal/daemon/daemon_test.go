@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/message"
+	"bokkoli/internal/message/messagetest"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, backend message.Backend) (*Server, string) {
+	path := filepath.Join(t.TempDir(), "test-bokkoli.sock")
+	server, err := Listen(path, backend)
+	if err != nil {
+		t.Fatal("Got an error creating the socket: ", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve()
+	return server, path
+}
+
+func awaitEvent(t *testing.T, events <-chan message.Event, eventType message.EventType) message.Event {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("Event stream closed while waiting for ", eventType)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for ", eventType)
+		}
+	}
+}
+
+func TestClientSendAndHistory(t *testing.T) {
+	receiver := messagetest.NewNode(t, "bob")
+	if err := receiver.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+
+	_, path := newTestServer(t, messagetest.NewNode(t, "alice"))
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal("Got an error attaching: ", err)
+	}
+	defer client.Close()
+
+	events, unsubscribe := client.Subscribe()
+	defer unsubscribe()
+
+	port := messagetest.ListenPort(t, receiver)
+	address, err := client.Connect(port)
+	if err != nil {
+		t.Fatal("Got an error connecting: ", err)
+	}
+	if address != "localhost:"+port {
+		t.Errorf("Expected 'localhost:%s', got %q", port, address)
+	}
+	awaitEvent(t, events, message.EventConnected)
+
+	if _, err := client.Send(address, "hello bob"); err != nil {
+		t.Fatal("Got an error sending: ", err)
+	}
+	event := awaitEvent(t, events, message.EventMessage)
+	if event.Message == nil || event.Message.Text != "hello bob" {
+		t.Errorf("Expected the sent message as an event, got %+v", event)
+	}
+
+	history, err := client.History(db.MessageFilter{Limit: 10})
+	if err != nil {
+		t.Fatal("Got an error reading history: ", err)
+	}
+	if len(history) != 1 || history[0].Text != "hello bob" {
+		t.Errorf("Expected one stored message, got %+v", history)
+	}
+
+	conversations, err := client.Conversations()
+	if err != nil {
+		t.Fatal("Got an error reading conversations: ", err)
+	}
+	if len(conversations) != 1 || conversations[0].Peer != "bob" || conversations[0].MessageCount != 1 {
+		t.Errorf("Expected one conversation with bob, got %+v", conversations)
+	}
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatal("Got an error reading status: ", err)
+	}
+	if status.Username != "alice" || len(status.Peers) != 1 {
+		t.Errorf("Expected alice with one peer, got %+v", status)
+	}
+}
+
+func TestClientBackendError(t *testing.T) {
+	_, path := newTestServer(t, messagetest.NewNode(t, "alice"))
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal("Got an error attaching: ", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Send("", "nobody is listening"); err == nil {
+		t.Error("Expected an error sending without peers")
+	}
+	if err := client.Listen("20"); err == nil {
+		t.Error("Expected an error listening on an invalid port")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server, path := newTestServer(t, messagetest.NewNode(t, "alice"))
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal("Got an error attaching: ", err)
+	}
+	defer client.Close()
+
+	if err := client.Shutdown(); err != nil {
+		t.Fatal("Got an error shutting down: ", err)
+	}
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected the server to be done after a shutdown")
+	}
+}
+
+func TestListenAlreadyRunning(t *testing.T) {
+	_, path := newTestServer(t, messagetest.NewNode(t, "alice"))
+
+	if _, err := Listen(path, messagetest.NewNode(t, "bob")); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("Expected ErrAlreadyRunning, got %v", err)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing a unix listener removes its file, recreate it the way a crashed daemon leaves it
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("Expected the stale socket to exist: ", err)
+	}
+
+	server, err := Listen(path, messagetest.NewNode(t, "alice"))
+	if err != nil {
+		t.Fatal("Expected the stale socket to be replaced, got: ", err)
+	}
+	server.Close()
+}
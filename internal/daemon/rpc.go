@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/message"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The control API speaks JSON-RPC 2.0, one JSON object per line, over a Unix domain socket
+const JSONRPC_VERSION string = "2.0"
+
+const (
+	methodListen        string = "listen"
+	methodConnect       string = "connect"
+	methodSend          string = "send"
+	methodSubscribe     string = "subscribe"
+	methodHistory       string = "history"
+	methodConversations string = "conversations"
+	methodStatus        string = "status"
+	methodSetUsername   string = "set_username"
+	methodDecide        string = "decide"
+	methodSetTimer      string = "set_timer"
+	methodShutdown      string = "shutdown"
+
+	// Notification pushed to subscribed clients, its params are a message.Event
+	methodEvent string = "event"
+)
+
+// Error codes from the JSON-RPC 2.0 specification, anything the backend reports is codeBackend
+const (
+	codeParseError     int = -32700
+	codeMethodNotFound int = -32601
+	codeInvalidParams  int = -32602
+	codeBackend        int = -32000
+)
+
+// Requests, responses and notifications all share one shape on the wire; which fields are set tells them apart
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+type listenParams struct {
+	Port string `json:"port"`
+}
+
+type connectParams struct {
+	Address string `json:"address"`
+}
+
+type connectResult struct {
+	Address string `json:"address"`
+}
+
+type sendParams struct {
+	To   string `json:"to,omitempty"`
+	Text string `json:"text"`
+}
+
+type historyParams struct {
+	Peer  string `json:"peer,omitempty"`
+	Since string `json:"since,omitempty"`
+	Until string `json:"until,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type decideParams struct {
+	Address  string           `json:"address"`
+	Decision message.Decision `json:"decision"`
+}
+
+type setTimerParams struct {
+	To      string `json:"to,omitempty"`
+	Seconds int64  `json:"seconds"`
+}
+
+type setUsernameParams struct {
+	Username string `json:"username"`
+}
+
+// Timestamps travel as RFC 3339 so zero values can be left out
+func newHistoryParams(filter db.MessageFilter) historyParams {
+	params := historyParams{Peer: filter.Peer, Limit: filter.Limit}
+	if !filter.Since.IsZero() {
+		params.Since = filter.Since.Format(time.RFC3339Nano)
+	}
+	if !filter.Until.IsZero() {
+		params.Until = filter.Until.Format(time.RFC3339Nano)
+	}
+	return params
+}
+
+func (params historyParams) filter() (db.MessageFilter, error) {
+	filter := db.MessageFilter{Peer: params.Peer, Limit: params.Limit}
+
+	var err error
+	if params.Since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339Nano, params.Since); err != nil {
+			return filter, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if params.Until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339Nano, params.Until); err != nil {
+			return filter, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,303 @@
+package daemon
+
+import (
+	"bokkoli/internal/logging"
+	"bokkoli/internal/message"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lines longer than this are rejected, large enough for any chat message
+const MAX_REQUEST_SIZE int = 1024 * 1024
+
+var logger = logging.For(logging.DAEMON)
+
+var ErrAlreadyRunning = errors.New("a Bokkoli daemon is already running")
+
+// Serves a backend's control API on a Unix domain socket. The backend stays owned by the caller.
+type Server struct {
+	backend  message.Backend
+	listener net.Listener
+	path     string
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// Create the socket, replacing a stale one left behind by a daemon that did not shut down cleanly
+func Listen(path string, backend message.Backend) (*Server, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w on %s", ErrAlreadyRunning, path)
+		}
+		logger.Info("removing stale daemon socket", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Anyone who can open the socket can chat as us
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &Server{
+		backend:  backend,
+		listener: listener,
+		path:     path,
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Accept clients until the server is closed
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			logger.Warn("could not accept control connection", logging.KeyErr, err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// Closed once a client asks the daemon to shut down
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stop accepting clients, disconnect the attached ones and remove the socket
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	os.Remove(s.path)
+	return err
+}
+
+func (s *Server) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// One attached frontend; writes are shared between responses and event notifications
+type session struct {
+	conn         net.Conn
+	writeMu      sync.Mutex
+	subscribeMu  sync.Mutex
+	unsubscribes []func()
+	closed       bool
+}
+
+func (s *session) write(msg rpcMessage) error {
+	msg.JSONRPC = JSONRPC_VERSION
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err = s.conn.Write(append(jsonData, '\n'))
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) {
+	sess := &session{conn: conn}
+	// Answer requests still in flight when the client stops writing, e.g. a one-off request piped through nc
+	var inFlight sync.WaitGroup
+	defer func() {
+		inFlight.Wait()
+
+		sess.subscribeMu.Lock()
+		sess.closed = true
+		for _, unsubscribe := range sess.unsubscribes {
+			unsubscribe()
+		}
+		sess.subscribeMu.Unlock()
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), MAX_REQUEST_SIZE)
+	for scanner.Scan() {
+		var request rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			sess.write(rpcMessage{Error: &rpcError{Code: codeParseError, Message: err.Error()}})
+			continue
+		}
+
+		// Requests are answered concurrently, a slow connect must not hold up sending
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			result, rpcErr := s.dispatch(sess, request)
+			if request.ID == nil {
+				return
+			}
+
+			response := rpcMessage{ID: request.ID, Error: rpcErr}
+			if rpcErr == nil {
+				jsonResult, err := json.Marshal(result)
+				if err != nil {
+					response.Error = &rpcError{Code: codeBackend, Message: err.Error()}
+				} else {
+					response.Result = jsonResult
+				}
+			}
+			if err := sess.write(response); err != nil {
+				logger.Warn("could not write control response", "method", request.Method, logging.KeyErr, err)
+			}
+		}()
+	}
+}
+
+func (s *Server) dispatch(sess *session, request rpcMessage) (any, *rpcError) {
+	switch request.Method {
+	case methodListen:
+		var params listenParams
+		if err := decodeParams(request, &params); err != nil {
+			return nil, err
+		}
+		return nil, backendError(s.backend.Listen(params.Port))
+	case methodConnect:
+		var params connectParams
+		if err := decodeParams(request, &params); err != nil {
+			return nil, err
+		}
+		address, err := s.backend.Connect(params.Address)
+		return connectResult{Address: address}, backendError(err)
+	case methodSend:
+		var params sendParams
+		if err := decodeParams(request, &params); err != nil {
+			return nil, err
+		}
+		sent, err := s.backend.Send(params.To, params.Text)
+		return sent, backendError(err)
+	case methodSubscribe:
+		s.subscribe(sess)
+		return nil, nil
+	case methodHistory:
+		var params historyParams
+		if err := decodeParams(request, &params); err != nil {
+			return nil, err
+		}
+		filter, err := params.filter()
+		if err != nil {
+			return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+		}
+		messages, err := s.backend.History(filter)
+		return messages, backendError(err)
+	case methodConversations:
+		conversations, err := s.backend.Conversations()
+		return conversations, backendError(err)
+	case methodStatus:
+		status, err := s.backend.Status()
+		return status, backendError(err)
+	case methodSetUsername:
+		var params setUsernameParams
+		if err := decodeParams(request, &params); err != nil {
+			return nil, err
+		}
+		return nil, backendError(s.backend.SetUsername(params.Username))
+	case methodDecide:
+		var params decideParams
+		if err := decodeParams(request, &params); err != nil {
+			return nil, err
+		}
+		return nil, backendError(s.backend.Decide(params.Address, params.Decision))
+	case methodSetTimer:
+		var params setTimerParams
+		if err := decodeParams(request, &params); err != nil {
+			return nil, err
+		}
+		return nil, backendError(s.backend.SetTimer(params.To, time.Duration(params.Seconds)*time.Second))
+	case methodShutdown:
+		s.shutdown()
+		return nil, nil
+	default:
+		return nil, &rpcError{Code: codeMethodNotFound, Message: fmt.Sprintf("unknown method %q", request.Method)}
+	}
+}
+
+// Forward every backend event to the session as a notification until either side goes away
+func (s *Server) subscribe(sess *session) {
+	sess.subscribeMu.Lock()
+	defer sess.subscribeMu.Unlock()
+	if sess.closed {
+		return
+	}
+
+	events, unsubscribe := s.backend.Subscribe()
+	sess.unsubscribes = append(sess.unsubscribes, unsubscribe)
+
+	go func() {
+		for event := range events {
+			params, err := json.Marshal(event)
+			if err != nil {
+				logger.Error("could not encode event", logging.KeyErr, err)
+				continue
+			}
+			if err := sess.write(rpcMessage{Method: methodEvent, Params: params}); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func decodeParams(request rpcMessage, params any) *rpcError {
+	if len(request.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(request.Params, params); err != nil {
+		return &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func backendError(err error) *rpcError {
+	if err == nil {
+		return nil
+	}
+	return &rpcError{Code: codeBackend, Message: err.Error()}
+}
@@ -1,6 +1,10 @@
 package db
 
 import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -14,10 +18,37 @@ const (
 )
 
 type Message struct {
+	// Random ID the sender gives the message, so both sides and every export know it by the same one.
+	// Messages from before IDs existed get one derived from their content.
+	ID        string    `json:"id,omitempty"`
 	Text      string    `json:"text"`
 	Sender    string    `json:"sender"`
 	Direction Direction `json:"direction"`
 	Timestamp time.Time `json:"timestamp"`
+	// The other side of the conversation, set locally when a message is sent or received
+	Peer string `json:"peer,omitempty"`
+	// Seconds after being read that the message disappears, 0 keeps it. The sender sets it from the conversation's timer.
+	Timer int64 `json:"timer,omitempty"`
+	// When the message disappears, set locally once it was read
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Hex encoded identity key the sender proved in the handshake, set locally on incoming messages.
+	// Unlike the sender's name it can't be made up, so it is what tells whether a message comes from a verified peer.
+	SenderKey string `json:"sender_key,omitempty"`
+}
+
+// Criteria for reading back messages; zero values match everything
+type MessageFilter struct {
+	Peer  string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// Summary of the messages exchanged with one peer
+type Conversation struct {
+	Peer         string  `json:"peer"`
+	MessageCount int     `json:"message_count"`
+	LastMessage  Message `json:"last_message"`
 }
 
 func (handler *DbHandler) setupMessageSchema() error {
@@ -27,19 +58,145 @@ func (handler *DbHandler) setupMessageSchema() error {
         text TEXT NOT NULL,
         sender TEXT NOT NULL,
 		direction TEXT NOT NULL,
-        timestamp DATETIME NOT NULL
+        timestamp DATETIME NOT NULL,
+		peer TEXT NOT NULL DEFAULT '',
+		timer INTEGER NOT NULL DEFAULT 0,
+		expires_at DATETIME,
+		uid TEXT NOT NULL DEFAULT '',
+		sender_key TEXT NOT NULL DEFAULT ''
     );`
 
-	_, err := handler.ExecuteQuery(query)
+	if _, err := handler.ExecuteQuery(query); err != nil {
+		return err
+	}
+
+	columns := []struct{ name, definition string }{
+		{"peer", "TEXT NOT NULL DEFAULT ''"},
+		{"timer", "INTEGER NOT NULL DEFAULT 0"},
+		{"expires_at", "DATETIME"},
+		{"uid", "TEXT NOT NULL DEFAULT ''"},
+		{"sender_key", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, column := range columns {
+		if err := handler.addColumnIfMissing("messages", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	// A message we sent to ourselves is stored twice under one ID, once in each direction
+	_, err := handler.ExecuteQuery("CREATE UNIQUE INDEX IF NOT EXISTS messages_uid ON messages (uid, direction) WHERE uid != ''")
 	return err
 }
 
 func (handler *DbHandler) SaveMessage(msg Message) error {
 	query := `
-	INSERT INTO messages (text, sender, direction, timestamp)
-	VALUES (?, ?, ?, ?);
+	INSERT INTO messages (uid, text, sender, direction, timestamp, peer, timer, expires_at, sender_key)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`
 
-	_, err := handler.ExecuteQuery(query, msg.Text, msg.Sender, msg.Direction, msg.Timestamp)
+	text, err := handler.seal(msg.Text)
+	if err != nil {
+		return err
+	}
+	_, err = handler.ExecuteQuery(query, msg.ID, text, msg.Sender, msg.Direction, msg.Timestamp, msg.Peer, msg.Timer, nullTime(msg.ExpiresAt), msg.SenderKey)
 	return err
 }
+
+// Read messages matching the filter, oldest first. With a limit, the most recent messages are kept.
+// Expired messages the purge didn't get to yet are left out.
+func (handler *DbHandler) ReadMessages(filter MessageFilter) ([]Message, error) {
+	conditions := []string{notExpired}
+	args := []any{time.Now()}
+
+	if filter.Peer != "" {
+		conditions = append(conditions, "peer = ?")
+		args = append(args, filter.Peer)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "julianday(timestamp) >= julianday(?)")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "julianday(timestamp) < julianday(?)")
+		args = append(args, filter.Until)
+	}
+
+	query := "SELECT uid, text, sender, direction, timestamp, peer, timer, expires_at, sender_key FROM messages"
+	query += " WHERE " + strings.Join(conditions, " AND ")
+	query += " ORDER BY julianday(timestamp) DESC, id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	open, err := handler.opener()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := handler.QueryArgs(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&msg.ID, &msg.Text, &msg.Sender, &msg.Direction, &msg.Timestamp, &msg.Peer, &msg.Timer, &expiresAt, &msg.SenderKey); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			msg.ExpiresAt = &expiresAt.Time
+		}
+		if msg.Text, err = open(msg.Text); err != nil {
+			return nil, err
+		}
+		if msg.ID == "" {
+			msg.ID = ContentID(msg)
+		}
+		messages = append(messages, msg)
+	}
+
+	slices.Reverse(messages)
+	return messages, rows.Err()
+}
+
+// One entry per peer with its most recent message, most recently active first.
+// Messages saved before peers were recorded have no peer and are left out.
+func (handler *DbHandler) ReadConversations() ([]Conversation, error) {
+	query := `
+	SELECT text, sender, direction, timestamp, peer, message_count FROM (
+		SELECT text, sender, direction, timestamp, peer,
+			ROW_NUMBER() OVER (PARTITION BY peer ORDER BY julianday(timestamp) DESC, id DESC) AS position,
+			COUNT(*) OVER (PARTITION BY peer) AS message_count
+		FROM messages WHERE peer != '' AND ` + notExpired + `
+	)
+	WHERE position = 1
+	ORDER BY julianday(timestamp) DESC;
+	`
+
+	open, err := handler.opener()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := handler.QueryArgs(query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		var c Conversation
+		msg := &c.LastMessage
+		if err := rows.Scan(&msg.Text, &msg.Sender, &msg.Direction, &msg.Timestamp, &msg.Peer, &c.MessageCount); err != nil {
+			return nil, err
+		}
+		if msg.Text, err = open(msg.Text); err != nil {
+			return nil, err
+		}
+		c.Peer = msg.Peer
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"slices"
 	"testing"
 	"time"
@@ -92,3 +93,36 @@ func TestSaveMessage(t *testing.T) {
 		}
 	}
 }
+
+// Databases from before _time_format=sqlite hold timestamps as time.Time.String wrote them
+func TestMigrateLegacyTimestamps(t *testing.T) {
+	handler, err := NewDbHandler(filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	defer handler.Close()
+	if err := handler.setupMessageSchema(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+
+	old := time.Now().AddDate(0, 0, -30)
+	insert := "INSERT INTO messages (text, sender, direction, timestamp, peer) VALUES (?, 'bob', 'incoming', ?, 'bob')"
+	for _, legacy := range []string{old.String(), old.Round(0).UTC().String()} {
+		if _, err := handler.ExecuteQuery(insert, legacy, legacy); err != nil {
+			t.Fatal("Inserting a legacy row produced an error: ", err)
+		}
+	}
+
+	if err := handler.SetupSchemas(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+	messages, err := handler.ReadMessages(MessageFilter{Since: old.AddDate(0, 0, -1), Until: old.AddDate(0, 0, 1)})
+	if err != nil || len(messages) != 2 || !messages[0].Timestamp.Equal(old.Round(0)) {
+		t.Errorf("Expected both legacy messages in the date range, got %+v (%v)", messages, err)
+	}
+
+	var version int
+	if err := handler.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != SCHEMA_VERSION {
+		t.Errorf("Expected schema version %d, got %d (%v)", SCHEMA_VERSION, version, err)
+	}
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ContactStatus string
+
+const (
+	// Let in without asking
+	ContactAllowed ContactStatus = "allowed"
+	// Turned away without asking
+	ContactBlocked ContactStatus = "blocked"
+	// Turned away because nobody was there to ask; still unknown, but 'contacts allow' can let it in
+	ContactPending ContactStatus = "pending"
+)
+
+// A peer identity we decided about, by its public identity key
+type Contact struct {
+	// Hex encoded public key, and its fingerprint as shown to the user
+	Key         string        `json:"key"`
+	Fingerprint string        `json:"fingerprint"`
+	Name        string        `json:"name"`
+	Status      ContactStatus `json:"status"`
+	// Set once the safety number was compared with the peer
+	Verified  bool      `json:"verified"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (handler *DbHandler) setupContactSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS contacts (
+		key TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`
+
+	if _, err := handler.ExecuteQuery(query); err != nil {
+		return err
+	}
+	return handler.addColumnIfMissing("contacts", "verified", "BOOLEAN NOT NULL DEFAULT 0")
+}
+
+// Add a contact, or change the name, status and verification of an existing one
+func (handler *DbHandler) SaveContact(contact Contact) error {
+	query := `
+	INSERT INTO contacts (key, fingerprint, name, status, verified, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (key) DO UPDATE SET name = excluded.name, status = excluded.status, verified = excluded.verified;
+	`
+	_, err := handler.ExecuteQuery(query, contact.Key, contact.Fingerprint, contact.Name, contact.Status, contact.Verified, time.Now())
+	return err
+}
+
+// The contact with the key, ok is false when we never decided about it
+func (handler *DbHandler) ReadContact(key string) (Contact, bool, error) {
+	rows, err := handler.QueryArgs("SELECT key, fingerprint, name, status, verified, created_at FROM contacts WHERE key = ?", key)
+	if err != nil {
+		return Contact{}, false, err
+	}
+	contacts, err := scanContacts(rows)
+	if err != nil || len(contacts) == 0 {
+		return Contact{}, false, err
+	}
+	return contacts[0], true, nil
+}
+
+// Every contact, by name
+func (handler *DbHandler) ReadContacts() ([]Contact, error) {
+	rows, err := handler.Query("SELECT key, fingerprint, name, status, verified, created_at FROM contacts ORDER BY name, fingerprint")
+	if err != nil {
+		return nil, err
+	}
+	return scanContacts(rows)
+}
+
+func scanContacts(rows *sql.Rows) ([]Contact, error) {
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		var contact Contact
+		if err := rows.Scan(&contact.Key, &contact.Fingerprint, &contact.Name, &contact.Status, &contact.Verified, &contact.CreatedAt); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+// Find a contact by fingerprint, spaces don't matter and any unambiguous start of it will do
+func (handler *DbHandler) FindContact(fingerprint string) (Contact, error) {
+	contacts, err := handler.ReadContacts()
+	if err != nil {
+		return Contact{}, err
+	}
+
+	prefix := compactFingerprint(fingerprint)
+	if prefix == "" {
+		return Contact{}, errors.New("expected a fingerprint")
+	}
+	var found []Contact
+	for _, contact := range contacts {
+		if strings.HasPrefix(compactFingerprint(contact.Fingerprint), prefix) {
+			found = append(found, contact)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return Contact{}, fmt.Errorf("no contact with fingerprint %q", fingerprint)
+	case 1:
+		return found[0], nil
+	default:
+		return Contact{}, fmt.Errorf("%d contacts match %q, give more of the fingerprint", len(found), fingerprint)
+	}
+}
+
+func compactFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, " ", ""))
+}
+
+func (handler *DbHandler) DeleteContact(key string) error {
+	result, err := handler.ExecuteQuery("DELETE FROM contacts WHERE key = ?", key)
+	if err != nil {
+		return err
+	}
+	if removed, err := result.RowsAffected(); err == nil && removed == 0 {
+		return errors.New("no such contact")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestContacts(t *testing.T) {
+	if err := dbHandler.setupContactSchema(); err != nil {
+		t.Error("Got an error on DB schema setup: ", err)
+	}
+
+	bob := Contact{Key: "b0b", Fingerprint: "ab12 cd34 ef56", Name: "bob", Status: ContactAllowed}
+	mallory := Contact{Key: "ma11", Fingerprint: "ab99 0000 1111", Name: "mallory", Status: ContactAllowed}
+	for _, contact := range []Contact{bob, mallory} {
+		if err := dbHandler.SaveContact(contact); err != nil {
+			t.Fatal("Saving a contact produced an error: ", err)
+		}
+	}
+
+	// Saving again changes the status rather than adding a second row
+	mallory.Status = ContactBlocked
+	if err := dbHandler.SaveContact(mallory); err != nil {
+		t.Fatal("Updating a contact produced an error: ", err)
+	}
+	if contact, ok, err := dbHandler.ReadContact("ma11"); err != nil || !ok || contact.Status != ContactBlocked {
+		t.Errorf("Expected mallory to be blocked, got %+v (%v)", contact, err)
+	}
+	bob.Verified = true
+	if err := dbHandler.SaveContact(bob); err != nil {
+		t.Fatal("Verifying a contact produced an error: ", err)
+	}
+	if contact, _, _ := dbHandler.ReadContact("b0b"); !contact.Verified || contact.Status != ContactAllowed {
+		t.Errorf("Expected bob to be verified, got %+v", contact)
+	}
+	if _, ok, _ := dbHandler.ReadContact("unknown"); ok {
+		t.Error("Expected an unknown key not to be found")
+	}
+
+	if _, err := dbHandler.FindContact("AB"); err == nil {
+		t.Error("Expected an ambiguous fingerprint to be refused")
+	}
+	if contact, err := dbHandler.FindContact("AB12CD"); err != nil || contact.Name != "bob" {
+		t.Errorf("Expected bob by the start of his fingerprint, got %+v (%v)", contact, err)
+	}
+
+	if err := dbHandler.DeleteContact("b0b"); err != nil {
+		t.Error("Deleting a contact produced an error: ", err)
+	}
+	if err := dbHandler.DeleteContact("b0b"); err == nil {
+		t.Error("Expected an error deleting a missing contact")
+	}
+	if contacts, _ := dbHandler.ReadContacts(); len(contacts) != 1 || contacts[0].Name != "mallory" {
+		t.Errorf("Expected only mallory left, got %+v", contacts)
+	}
+}
@@ -1,17 +1,31 @@
 package db
 
 import (
+	"bokkoli/internal/logging"
+	"bokkoli/internal/vault"
 	"database/sql"
 	"fmt"
-	"log"
+	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
-const DefaultDbFilePath string = "./bokkoli.db"
+var logger = logging.For(logging.DB)
+
+// Kept in PRAGMA user_version, for migrations that rewrite data instead of adding columns
+const SCHEMA_VERSION int = 1
+
+// Timestamps as _time_format=sqlite writes them, which SQLite's date functions understand
+const SQLITE_TIME_LAYOUT string = "2006-01-02 15:04:05.999999999-07:00"
+
+// Timestamps as the driver wrote them before, with time.Time.String
+const LEGACY_TIME_LAYOUT string = "2006-01-02 15:04:05.999999999 -0700 MST"
 
 type DbHandler struct {
 	db *sql.DB
+	// Seals and opens the sealed columns, nil until unlocked or when there is no passphrase
+	key *vault.Key
 }
 
 // Execute a query without returning any rows, includes a SQL result
@@ -26,7 +40,7 @@ func (handler DbHandler) ExecuteQuery(query string, args ...any) (sql.Result, er
 	}
 
 	if err != nil {
-		log.Printf("failed to execute query: %v", err)
+		logger.Error("failed to execute query", logging.KeyErr, err)
 		return result, err
 	}
 
@@ -37,7 +51,18 @@ func (handler DbHandler) ExecuteQuery(query string, args ...any) (sql.Result, er
 func (handler DbHandler) Query(query string) (*sql.Rows, error) {
 	result, err := handler.db.Query(query)
 	if err != nil {
-		log.Println("failed to query: ", err)
+		logger.Error("failed to query", logging.KeyErr, err)
+		return result, err
+	}
+
+	return result, nil
+}
+
+// Run a query with arguments that returns records/rows
+func (handler DbHandler) QueryArgs(query string, args ...any) (*sql.Rows, error) {
+	result, err := handler.db.Query(query, args...)
+	if err != nil {
+		logger.Error("failed to query", logging.KeyErr, err)
 		return result, err
 	}
 
@@ -45,7 +70,10 @@ func (handler DbHandler) Query(query string) (*sql.Rows, error) {
 }
 
 func NewDbHandler(filePath string) (*DbHandler, error) {
-	db, err := sql.Open("sqlite", filePath)
+	// Timestamps are written in a format SQLite's date functions understand, so they can be compared in queries.
+	// Writers from other goroutines or processes are waited for instead of failing with "database is locked".
+	// Deleted rows are overwritten, so expired messages don't linger in free pages.
+	db, err := sql.Open("sqlite", filePath+"?_time_format=sqlite&_pragma=busy_timeout(5000)&_pragma=secure_delete(1)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
@@ -57,6 +85,12 @@ func (handler DbHandler) SetupSchemas() error {
 	schemas := []func() error{
 		handler.setupMessageSchema,
 		handler.setupSetupSchema,
+		handler.setupWebhookSchema,
+		handler.setupPluginSchema,
+		handler.setupContactSchema,
+		handler.setupVaultSchema,
+		handler.setupTimerSchema,
+		handler.setupArchiveSchema,
 	}
 
 	for _, setupFn := range schemas {
@@ -64,7 +98,103 @@ func (handler DbHandler) SetupSchemas() error {
 			return err
 		}
 	}
-	return nil
+	return handler.migrate()
+}
+
+// Bring the data of databases written by older versions up to SCHEMA_VERSION
+func (handler DbHandler) migrate() error {
+	var version int
+	if err := handler.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= SCHEMA_VERSION {
+		return nil
+	}
+
+	// 1: message timestamps written before _time_format=sqlite, which julianday() can't read
+	if version < 1 {
+		if err := handler.rewriteLegacyTimes("messages", "timestamp"); err != nil {
+			return fmt.Errorf("could not migrate message timestamps: %v", err)
+		}
+	}
+	_, err := handler.ExecuteQuery(fmt.Sprintf("PRAGMA user_version = %d", SCHEMA_VERSION))
+	return err
+}
+
+// Rewrite the column's values in LEGACY_TIME_LAYOUT to SQLITE_TIME_LAYOUT, in one transaction
+func (handler DbHandler) rewriteLegacyTimes(table string, column string) error {
+	tx, err := handler.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Without its declared type the column comes back as the text that was written
+	query := fmt.Sprintf("SELECT rowid, CAST(%s AS TEXT) FROM %s WHERE %s IS NOT NULL AND julianday(%s) IS NULL", column, table, column, column)
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	values := map[int64]time.Time{}
+	for rows.Next() {
+		var id int64
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		t, err := parseLegacyTime(value)
+		if err != nil {
+			logger.Warn("leaving a timestamp that can't be read", "table", table, "rowid", id, logging.KeyErr, err)
+			continue
+		}
+		values[id] = t
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column)
+	for id, t := range values {
+		if _, err := tx.Exec(update, t.Format(SQLITE_TIME_LAYOUT), id); err != nil {
+			return err
+		}
+	}
+	if len(values) > 0 {
+		logger.Info("migrated legacy timestamps", "table", table, "rows", len(values))
+	}
+	return tx.Commit()
+}
+
+// time.Time.String adds the monotonic clock reading, as in "... +0000 UTC m=+0.012", which Parse doesn't take
+func parseLegacyTime(value string) (time.Time, error) {
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	return time.Parse(LEGACY_TIME_LAYOUT, value)
+}
+
+// Add a column to an existing table, used to migrate databases created by older versions
+func (handler DbHandler) addColumnIfMissing(table string, column string, definition string) error {
+	rows, err := handler.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+
+	_, err = handler.ExecuteQuery(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
 // Close the DB connection
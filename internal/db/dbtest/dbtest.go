@@ -0,0 +1,22 @@
+// Package dbtest sets up databases for the tests of packages that store messages.
+package dbtest
+
+import (
+	"bokkoli/internal/db"
+	"path/filepath"
+	"testing"
+)
+
+// A database with every table, in a directory removed after the test
+func New(t testing.TB) *db.DbHandler {
+	t.Helper()
+	dbHandler, err := db.NewDbHandler(filepath.Join(t.TempDir(), "test-bokkoli.db"))
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	t.Cleanup(func() { dbHandler.Close() })
+	if err := dbHandler.SetupSchemas(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+	return dbHandler
+}
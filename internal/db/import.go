@@ -0,0 +1,111 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// What an import added, or would add on a dry run
+type ImportReport struct {
+	Added      int `json:"added"`
+	Duplicates int `json:"duplicates"`
+	// Messages added per conversation
+	Conversations map[string]int `json:"conversations"`
+	DryRun        bool           `json:"dry_run"`
+}
+
+// ID for a message that has none, from what it says, who said it, to whom and when.
+// The same message always gets the same one, so importing a log twice adds it once.
+func ContentID(msg Message) string {
+	parts := []string{msg.Sender, msg.Peer, msg.Timestamp.UTC().Format(time.RFC3339Nano), msg.Text}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Add the messages that aren't stored yet, by ID and direction, in one transaction. Messages without an ID
+// get their ContentID. A dry run does all the same work and rolls it back, so the report is exact.
+func (handler *DbHandler) ImportMessages(messages []Message, dryRun bool) (ImportReport, error) {
+	report := ImportReport{Conversations: map[string]int{}, DryRun: dryRun}
+
+	open, err := handler.opener()
+	if err != nil {
+		return report, err
+	}
+	tx, err := handler.db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	// Stored messages from before IDs existed are compared by their content ID, so give them one
+	if err := backfillIDs(tx, open); err != nil {
+		return report, fmt.Errorf("could not give stored messages an ID: %v", err)
+	}
+
+	insert := `
+	INSERT INTO messages (uid, text, sender, direction, timestamp, peer, timer, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT DO NOTHING;
+	`
+	for _, msg := range messages {
+		if msg.ID == "" {
+			msg.ID = ContentID(msg)
+		}
+		text, err := handler.seal(msg.Text)
+		if err != nil {
+			return report, err
+		}
+		result, err := tx.Exec(insert, msg.ID, text, msg.Sender, msg.Direction, msg.Timestamp, msg.Peer, msg.Timer, nullTime(msg.ExpiresAt))
+		if err != nil {
+			return report, fmt.Errorf("could not import message %s: %v", msg.ID, err)
+		}
+		if added, _ := result.RowsAffected(); added == 0 {
+			report.Duplicates++
+			continue
+		}
+		report.Added++
+		report.Conversations[msg.Peer]++
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+func backfillIDs(tx *sql.Tx, open func(string) (string, error)) error {
+	rows, err := tx.Query("SELECT id, text, sender, timestamp, peer FROM messages WHERE uid = ''")
+	if err != nil {
+		return err
+	}
+	ids := map[int64]string{}
+	for rows.Next() {
+		var rowID int64
+		var msg Message
+		if err := rows.Scan(&rowID, &msg.Text, &msg.Sender, &msg.Timestamp, &msg.Peer); err != nil {
+			rows.Close()
+			return err
+		}
+		if msg.Text, err = open(msg.Text); err != nil {
+			rows.Close()
+			return err
+		}
+		ids[rowID] = ContentID(msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Two identical rows in the same direction share a content ID, the second one keeps none
+	for rowID, id := range ids {
+		if _, err := tx.Exec("UPDATE OR IGNORE messages SET uid = ? WHERE id = ?", id, rowID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportMessages(t *testing.T) {
+	handler, err := NewDbHandler(filepath.Join(t.TempDir(), "import.db"))
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	defer handler.Close()
+	if err := handler.SetupSchemas(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+
+	now := time.Now()
+	stored := Message{Text: "hi", Sender: "bob", Direction: Incoming, Timestamp: now, Peer: "bob"}
+	if err := handler.SaveMessage(stored); err != nil {
+		t.Fatal("Saving message produced an error: ", err)
+	}
+
+	messages := []Message{
+		stored,
+		{ID: "abc", Text: "hello", Sender: "me", Direction: Outgoing, Timestamp: now, Peer: "bob"},
+		{Text: "new", Sender: "carol", Direction: Incoming, Timestamp: now, Peer: "carol"},
+	}
+	report, err := handler.ImportMessages(messages, true)
+	if err != nil || report.Added != 2 || report.Duplicates != 1 || !report.DryRun {
+		t.Fatalf("Expected a dry run to report 2 new messages and 1 duplicate, got %+v (%v)", report, err)
+	}
+	if read, _ := handler.ReadMessages(MessageFilter{}); len(read) != 1 {
+		t.Errorf("Expected a dry run to store nothing, got %+v", read)
+	}
+
+	if report, err := handler.ImportMessages(messages, false); err != nil || report.Added != 2 || report.Conversations["carol"] != 1 {
+		t.Fatalf("Expected 2 messages imported, got %+v (%v)", report, err)
+	}
+	if report, err := handler.ImportMessages(messages, false); err != nil || report.Added != 0 || report.Duplicates != 3 {
+		t.Errorf("Expected importing again to add nothing, got %+v (%v)", report, err)
+	}
+	read, err := handler.ReadMessages(MessageFilter{Peer: "bob"})
+	if err != nil || len(read) != 2 || read[1].ID != "abc" {
+		t.Errorf("Expected the imported message with its ID, got %+v (%v)", read, err)
+	}
+}
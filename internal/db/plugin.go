@@ -0,0 +1,48 @@
+package db
+
+// Whether each installed plugin is enabled; plugins without a row are disabled
+func (handler *DbHandler) setupPluginSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS plugins (
+		name TEXT PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT 0
+	);`
+
+	_, err := handler.ExecuteQuery(query)
+	return err
+}
+
+// Names of the enabled plugins, sorted
+func (handler *DbHandler) ReadEnabledPlugins() ([]string, error) {
+	rows, err := handler.Query(`SELECT name FROM plugins WHERE enabled ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (handler *DbHandler) SetPluginEnabled(name string, enabled bool) error {
+	query := `
+	INSERT INTO plugins (name, enabled)
+	VALUES (?, ?)
+	ON CONFLICT (name) DO UPDATE SET enabled = excluded.enabled;
+	`
+	_, err := handler.ExecuteQuery(query, name, enabled)
+	return err
+}
+
+// Forget a removed plugin, so a later one with the same name starts out disabled
+func (handler *DbHandler) DeletePlugin(name string) error {
+	_, err := handler.ExecuteQuery(`DELETE FROM plugins WHERE name = ?`, name)
+	return err
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"bokkoli/internal/logging"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// How long messages are kept, zero values keep everything. Archived conversations are exempt.
+type Retention struct {
+	// Days after which messages are deleted
+	Days int
+	// Most recent messages kept per conversation
+	Messages int
+}
+
+// What a maintenance run did, sizes are in bytes
+type MaintenanceReport struct {
+	Expired    int64     `json:"expired"`
+	Retained   int64     `json:"retained"`
+	SizeBefore int64     `json:"size_before"`
+	SizeAfter  int64     `json:"size_after"`
+	Reclaimed  int64     `json:"reclaimed"`
+	Duration   string    `json:"duration"`
+	Time       time.Time `json:"time"`
+}
+
+// Row counts and sizes, overall and per conversation
+type Stats struct {
+	Path string `json:"path"`
+	// The database file on disk, and the part of it that is free pages waiting for a VACUUM
+	FileSize int64            `json:"file_size"`
+	FreeSize int64            `json:"free_size"`
+	Rows     map[string]int64 `json:"rows"`
+	// Most active first
+	Conversations []ConversationStats `json:"conversations"`
+}
+
+type ConversationStats struct {
+	Peer     string `json:"peer"`
+	Messages int64  `json:"messages"`
+	// Bytes the messages take up in their columns, without SQLite's own overhead
+	Size     int64     `json:"size"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Archived bool      `json:"archived"`
+}
+
+// Tables counted by Stats
+var statsTables = []string{"messages", "contacts", "timers", "archived_conversations", "webhooks", "webhook_deliveries", "plugins"}
+
+// Conversations the retention policy leaves alone
+func (handler *DbHandler) setupArchiveSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS archived_conversations (
+		peer TEXT PRIMARY KEY,
+		archived_at DATETIME NOT NULL
+	);`
+
+	_, err := handler.ExecuteQuery(query)
+	return err
+}
+
+// Archive the conversation with the peer, so retention keeps all of it, or unarchive it
+func (handler *DbHandler) SetArchived(peer string, archived bool) error {
+	if !archived {
+		result, err := handler.ExecuteQuery("DELETE FROM archived_conversations WHERE peer = ?", peer)
+		if err != nil {
+			return err
+		}
+		if count, _ := result.RowsAffected(); count == 0 {
+			return fmt.Errorf("the conversation with %s is not archived", peer)
+		}
+		return nil
+	}
+	_, err := handler.ExecuteQuery("INSERT OR IGNORE INTO archived_conversations (peer, archived_at) VALUES (?, ?)", peer, time.Now())
+	return err
+}
+
+// Delete the messages the retention policy no longer keeps, returns how many were deleted
+func (handler *DbHandler) ApplyRetention(retention Retention, now time.Time) (int64, error) {
+	var deleted int64
+	notArchived := "peer NOT IN (SELECT peer FROM archived_conversations)"
+
+	if retention.Days > 0 {
+		cutoff := now.AddDate(0, 0, -retention.Days)
+		result, err := handler.ExecuteQuery("DELETE FROM messages WHERE julianday(timestamp) < julianday(?) AND "+notArchived, cutoff)
+		if err != nil {
+			return deleted, err
+		}
+		count, _ := result.RowsAffected()
+		deleted += count
+	}
+	if retention.Messages > 0 {
+		query := `
+		DELETE FROM messages WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY peer ORDER BY julianday(timestamp) DESC, id DESC) AS position
+				FROM messages WHERE ` + notArchived + `
+			)
+			WHERE position > ?
+		);`
+		result, err := handler.ExecuteQuery(query, retention.Messages)
+		if err != nil {
+			return deleted, err
+		}
+		count, _ := result.RowsAffected()
+		deleted += count
+	}
+	return deleted, nil
+}
+
+// Purge expired messages and the ones past retention, then VACUUM to give the space back and ANALYZE
+// to keep the query planner's statistics current
+func (handler *DbHandler) Maintain(retention Retention, now time.Time) (MaintenanceReport, error) {
+	report := MaintenanceReport{Time: now}
+	start := time.Now()
+
+	var err error
+	if report.SizeBefore, _, err = handler.pageSizes(); err != nil {
+		return report, err
+	}
+	if report.Expired, err = handler.PurgeExpired(now); err != nil {
+		return report, fmt.Errorf("could not purge expired messages: %v", err)
+	}
+	if report.Retained, err = handler.ApplyRetention(retention, now); err != nil {
+		return report, fmt.Errorf("could not apply retention: %v", err)
+	}
+	for _, statement := range []string{"VACUUM", "ANALYZE"} {
+		if _, err := handler.ExecuteQuery(statement); err != nil {
+			return report, fmt.Errorf("could not %s: %v", strings.ToLower(statement), err)
+		}
+	}
+	if report.SizeAfter, _, err = handler.pageSizes(); err != nil {
+		return report, err
+	}
+
+	report.Reclaimed = max(report.SizeBefore-report.SizeAfter, 0)
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return report, nil
+}
+
+// Run Maintain every interval until quit is closed, logging what each run reclaimed
+func (handler *DbHandler) MaintenanceLoop(retention Retention, interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			report, err := handler.Maintain(retention, now)
+			if err != nil {
+				logger.Warn("database maintenance failed", logging.KeyErr, err)
+				continue
+			}
+			logger.Info("database maintenance done", "expired", report.Expired, "retained", report.Retained,
+				"reclaimed", report.Reclaimed, "size", report.SizeAfter, "duration", report.Duration)
+		}
+	}
+}
+
+func (handler *DbHandler) Stats() (Stats, error) {
+	stats := Stats{Rows: map[string]int64{}, Conversations: []ConversationStats{}}
+
+	var file string
+	if err := handler.db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&file); err != nil {
+		return stats, err
+	}
+	stats.Path = file
+	if info, err := os.Stat(file); err == nil {
+		stats.FileSize = info.Size()
+	}
+	var err error
+	if _, stats.FreeSize, err = handler.pageSizes(); err != nil {
+		return stats, err
+	}
+
+	for _, table := range statsTables {
+		var count int64
+		if err := handler.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			return stats, err
+		}
+		stats.Rows[table] = count
+	}
+
+	query := `
+	SELECT peer, COUNT(*),
+		SUM(length(CAST(text AS BLOB)) + length(CAST(sender AS BLOB)) + length(CAST(peer AS BLOB))),
+		MIN(timestamp), MAX(timestamp),
+		peer IN (SELECT peer FROM archived_conversations)
+	FROM messages GROUP BY peer ORDER BY COUNT(*) DESC, peer;
+	`
+	rows, err := handler.Query(query)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c ConversationStats
+		var first, last string
+		if err := rows.Scan(&c.Peer, &c.Messages, &c.Size, &first, &last, &c.Archived); err != nil {
+			return stats, err
+		}
+		c.First, _ = parseSqliteTime(first)
+		c.Last, _ = parseSqliteTime(last)
+		stats.Conversations = append(stats.Conversations, c)
+	}
+	return stats, rows.Err()
+}
+
+// Size of the database in pages, and of its free pages, in bytes
+func (handler *DbHandler) pageSizes() (int64, int64, error) {
+	var pageSize, pageCount, freePages int64
+	err := handler.db.QueryRow("SELECT page_size, page_count, freelist_count FROM pragma_page_size, pragma_page_count, pragma_freelist_count").
+		Scan(&pageSize, &pageCount, &freePages)
+	return pageSize * pageCount, pageSize * freePages, err
+}
+
+// MIN and MAX lose the column's type, so timestamps come back as the text _time_format=sqlite wrote
+func parseSqliteTime(value string) (time.Time, error) {
+	return time.Parse(SQLITE_TIME_LAYOUT, value)
+}
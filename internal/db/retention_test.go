@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	handler, err := NewDbHandler(filepath.Join(t.TempDir(), "retention.db"))
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	defer handler.Close()
+	if err := handler.SetupSchemas(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+
+	now := time.Now()
+	for _, peer := range []string{"bob", "carol", "dave"} {
+		for i := 0; i < 20; i++ {
+			text := strings.Repeat("x", 1000)
+			msg := Message{Text: text, Sender: peer, Direction: Incoming, Timestamp: now.AddDate(0, 0, -i*2), Peer: peer}
+			if err := handler.SaveMessage(msg); err != nil {
+				t.Fatal("Saving message produced an error: ", err)
+			}
+		}
+	}
+	if err := handler.SetArchived("dave", true); err != nil {
+		t.Fatal("Archiving produced an error: ", err)
+	}
+
+	// 30 days keeps the 15 most recent messages, then 5 per conversation keeps the newest five
+	report, err := handler.Maintain(Retention{Days: 30, Messages: 5}, now)
+	if err != nil {
+		t.Fatal("Maintenance produced an error: ", err)
+	}
+	if report.Retained != 30 {
+		t.Errorf("Expected 30 messages past retention, got %+v", report)
+	}
+	if report.SizeAfter >= report.SizeBefore || report.Reclaimed != report.SizeBefore-report.SizeAfter {
+		t.Errorf("Expected the vacuum to reclaim space, got %+v", report)
+	}
+
+	stats, err := handler.Stats()
+	if err != nil {
+		t.Fatal("Reading stats produced an error: ", err)
+	}
+	if stats.Rows["messages"] != 30 || stats.FileSize == 0 {
+		t.Errorf("Expected 30 messages left in a non-empty file, got %+v", stats)
+	}
+	counts := map[string]int64{}
+	for _, c := range stats.Conversations {
+		counts[c.Peer] = c.Messages
+		if c.Archived != (c.Peer == "dave") || c.Size < c.Messages*1000 || c.Last.Before(c.First) {
+			t.Errorf("Unexpected stats for %s: %+v", c.Peer, c)
+		}
+	}
+	if counts["bob"] != 5 || counts["carol"] != 5 || counts["dave"] != 20 {
+		t.Errorf("Expected the archived conversation to be kept whole, got %v", counts)
+	}
+
+	if err := handler.SetArchived("dave", false); err != nil {
+		t.Error("Unarchiving produced an error: ", err)
+	}
+	if err := handler.SetArchived("dave", false); err == nil {
+		t.Error("Expected an error unarchiving a conversation that isn't archived")
+	}
+}
+
+// Messages from before _time_format=sqlite are migrated first, retention then sees their age like any other
+func TestRetentionLegacyTimestamps(t *testing.T) {
+	handler, err := NewDbHandler(filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	defer handler.Close()
+	if err := handler.setupMessageSchema(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+
+	now := time.Now()
+	insert := "INSERT INTO messages (text, sender, direction, timestamp, peer) VALUES (?, 'bob', 'incoming', ?, 'bob')"
+	for i, age := range []int{30, 20, 1} {
+		legacy := now.AddDate(0, 0, -age).String()
+		if _, err := handler.ExecuteQuery(insert, fmt.Sprint(i), legacy); err != nil {
+			t.Fatal("Inserting a legacy row produced an error: ", err)
+		}
+	}
+	if err := handler.SetupSchemas(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+
+	if deleted, err := handler.ApplyRetention(Retention{Days: 25}, now); err != nil || deleted != 1 {
+		t.Errorf("Expected the 30 day old message deleted, got %d (%v)", deleted, err)
+	}
+	if deleted, err := handler.ApplyRetention(Retention{Messages: 1}, now); err != nil || deleted != 1 {
+		t.Errorf("Expected the older of the two left deleted, got %d (%v)", deleted, err)
+	}
+	if messages, _ := handler.ReadMessages(MessageFilter{}); len(messages) != 1 || messages[0].Text != "2" {
+		t.Errorf("Expected the newest message kept, got %+v", messages)
+	}
+}
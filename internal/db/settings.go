@@ -1,8 +1,9 @@
 package db
 
 import (
+	"bokkoli/internal/logging"
 	"errors"
-	"log"
+	"fmt"
 
 	_ "modernc.org/sqlite"
 )
@@ -10,6 +11,9 @@ import (
 type Setup struct {
 	Port     string
 	Username string
+	Theme    string
+	// Render messages as Markdown, raw text otherwise
+	RenderMarkdown bool
 }
 
 func (handler *DbHandler) setupSetupSchema() error {
@@ -17,11 +21,20 @@ func (handler *DbHandler) setupSetupSchema() error {
     CREATE TABLE IF NOT EXISTS setup (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         port TEXT NOT NULL,
-		username TEXT NOT NULL
+		username TEXT NOT NULL,
+		theme TEXT NOT NULL DEFAULT '',
+		render_markdown BOOLEAN NOT NULL DEFAULT 1
     );`
 
-	_, err := handler.ExecuteQuery(query)
-	return err
+	if _, err := handler.ExecuteQuery(query); err != nil {
+		return err
+	}
+
+	// Databases created by older versions are missing the newer columns
+	if err := handler.addColumnIfMissing("setup", "theme", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return handler.addColumnIfMissing("setup", "render_markdown", "BOOLEAN NOT NULL DEFAULT 1")
 }
 
 // Save user settings to the DB; new record is created if one doesn't exist. Otherwise, previous record is overwritten.
@@ -41,7 +54,7 @@ func (handler *DbHandler) SaveSetup(port string, username string) error {
 	for rows.Next() {
 		count++
 		if count > 1 {
-			log.Fatal("More than 1 row inserted into setup, please identify issue.")
+			logging.Fatal(logger, "more than 1 row inserted into setup, please identify issue")
 		}
 
 		rows.Scan(&id)
@@ -62,19 +75,19 @@ func (handler *DbHandler) SaveSetup(port string, username string) error {
 	SET port = ?, username = ?
 	WHERE id = ?
 	`
-	result, err := handler.ExecuteQuery(query, port, username, id)
-	log.Println(result.LastInsertId())
+	_, err = handler.ExecuteQuery(query, port, username, id)
+	logger.Debug("settings updated", "id", id)
 	return err
 }
 
 func (handler *DbHandler) ReadSetup() (Setup, error) {
 	query := `
-	SELECT id, port, username
+	SELECT id, port, username, theme, render_markdown
 	FROM setup
 	LIMIT 1
 	`
 
-	var setup Setup
+	setup := Setup{RenderMarkdown: true}
 
 	rows, err := handler.Query(query)
 	if err != nil {
@@ -83,16 +96,51 @@ func (handler *DbHandler) ReadSetup() (Setup, error) {
 
 	var id int
 	for rows.Next() {
-		rows.Scan(&id, &setup.Port, &setup.Username)
+		rows.Scan(&id, &setup.Port, &setup.Username, &setup.Theme, &setup.RenderMarkdown)
 	}
 
 	if setup.Port == "" || setup.Username == "" {
-		log.Println("Port and/or Username are empty", setup.Port, setup.Username)
+		logger.Debug("port and/or username are empty", "port", setup.Port, "has_username", setup.Username != "")
 		return setup, errors.New("no results in the read setup query")
 	}
 
-	log.Println("Port and Username values read from DB: ", setup.Port, setup.Username)
+	logger.Debug("settings read", "port", setup.Port)
 
 	return setup, nil
 
 }
+
+// Save the selected theme name; a settings record is created if one doesn't exist
+func (handler *DbHandler) SaveTheme(theme string) error {
+	return handler.saveSetupColumn("theme", theme)
+}
+
+// Save whether messages are rendered as Markdown or shown as raw text
+func (handler *DbHandler) SaveRenderMarkdown(renderMarkdown bool) error {
+	return handler.saveSetupColumn("render_markdown", renderMarkdown)
+}
+
+// Update a single settings column, inserting a record with empty port and username if none exists yet
+func (handler *DbHandler) saveSetupColumn(column string, value any) error {
+	query := fmt.Sprintf(`
+	UPDATE setup
+	SET %s = ?
+	`, column)
+
+	result, err := handler.ExecuteQuery(query, value)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+
+	query = fmt.Sprintf(`
+	INSERT INTO setup (port, username, %s)
+	VALUES ('', '', ?);
+	`, column)
+
+	_, err = handler.ExecuteQuery(query, value)
+	return err
+}
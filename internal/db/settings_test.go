@@ -0,0 +1,54 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestSaveTheme(t *testing.T) {
+	err := dbHandler.setupSetupSchema()
+	if err != nil {
+		t.Error("Got an error on DB schema setup: ", err)
+	}
+
+	if err := dbHandler.SaveSetup("8080", "Pickle132"); err != nil {
+		t.Error("Saving setup produced an error: ", err)
+	}
+
+	if err := dbHandler.SaveTheme("light"); err != nil {
+		t.Error("Saving theme produced an error: ", err)
+	}
+
+	setup, err := dbHandler.ReadSetup()
+	if err != nil {
+		t.Error("Reading setup produced an error: ", err)
+	}
+
+	if setup.Theme != "light" || setup.Username != "Pickle132" {
+		t.Errorf("Expected theme light for Pickle132, got %s for %s", setup.Theme, setup.Username)
+	}
+}
+
+func TestSaveRenderMarkdown(t *testing.T) {
+	err := dbHandler.setupSetupSchema()
+	if err != nil {
+		t.Error("Got an error on DB schema setup: ", err)
+	}
+
+	if err := dbHandler.SaveRenderMarkdown(false); err != nil {
+		t.Error("Saving Markdown setting produced an error: ", err)
+	}
+
+	setup, _ := dbHandler.ReadSetup()
+	if setup.RenderMarkdown {
+		t.Errorf("Expected %t, got %t", false, setup.RenderMarkdown)
+	}
+
+	if err := dbHandler.SaveRenderMarkdown(true); err != nil {
+		t.Error("Saving Markdown setting produced an error: ", err)
+	}
+
+	setup, _ = dbHandler.ReadSetup()
+	if !setup.RenderMarkdown {
+		t.Errorf("Expected %t, got %t", true, setup.RenderMarkdown)
+	}
+}
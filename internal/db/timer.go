@@ -0,0 +1,126 @@
+package db
+
+import (
+	"bokkoli/internal/logging"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Condition leaving out messages whose time ran out, takes the current time as its argument
+const notExpired string = "(expires_at IS NULL OR julianday(expires_at) > julianday(?))"
+
+// Disappearing message timers, one per conversation, in seconds. A conversation without a row keeps its messages.
+func (handler *DbHandler) setupTimerSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS timers (
+		peer TEXT PRIMARY KEY,
+		seconds INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`
+
+	_, err := handler.ExecuteQuery(query)
+	return err
+}
+
+// Set the timer of the conversation with the peer, 0 turns it off. Applies to messages sent from now on.
+func (handler *DbHandler) SaveTimer(peer string, seconds int64) error {
+	if seconds <= 0 {
+		_, err := handler.ExecuteQuery("DELETE FROM timers WHERE peer = ?", peer)
+		return err
+	}
+	query := `
+	INSERT INTO timers (peer, seconds, updated_at) VALUES (?, ?, ?)
+	ON CONFLICT (peer) DO UPDATE SET seconds = excluded.seconds, updated_at = excluded.updated_at;
+	`
+	_, err := handler.ExecuteQuery(query, peer, seconds, time.Now())
+	return err
+}
+
+// Timer of the conversation with the peer in seconds, 0 when it has none
+func (handler *DbHandler) ReadTimer(peer string) (int64, error) {
+	var seconds int64
+	err := handler.db.QueryRow("SELECT seconds FROM timers WHERE peer = ?", peer).Scan(&seconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return seconds, err
+}
+
+// Every conversation with a timer, by peer
+func (handler *DbHandler) ReadTimers() (map[string]int64, error) {
+	rows, err := handler.Query("SELECT peer, seconds FROM timers")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timers := map[string]int64{}
+	for rows.Next() {
+		var peer string
+		var seconds int64
+		if err := rows.Scan(&peer, &seconds); err != nil {
+			return nil, err
+		}
+		timers[peer] = seconds
+	}
+	return timers, rows.Err()
+}
+
+// Start the timers of the incoming messages with the IDs that weren't read yet, returns how many were started.
+// Only the messages the user was shown are passed, outgoing messages count as read when they are sent.
+func (handler *DbHandler) MarkRead(at time.Time, ids []string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	query := `
+	UPDATE messages SET expires_at = strftime('%Y-%m-%d %H:%M:%f', ?, '+' || timer || ' seconds')
+	WHERE timer > 0 AND expires_at IS NULL AND direction = ? AND uid IN (?` + strings.Repeat(", ?", len(ids)-1) + `);
+	`
+	args := []any{at, Incoming}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	result, err := handler.ExecuteQuery(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Delete the messages whose timer ran out by now, returns how many were deleted
+func (handler *DbHandler) PurgeExpired(now time.Time) (int64, error) {
+	result, err := handler.ExecuteQuery("DELETE FROM messages WHERE expires_at IS NOT NULL AND NOT "+notExpired, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Purge expired messages every interval until quit is closed
+func (handler *DbHandler) PurgeLoop(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			purged, err := handler.PurgeExpired(now)
+			if err != nil {
+				logger.Warn("could not purge expired messages", logging.KeyErr, err)
+			} else if purged > 0 {
+				logger.Info("purged expired messages", "count", purged)
+			}
+		}
+	}
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
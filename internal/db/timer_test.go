@@ -0,0 +1,68 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDisappearingMessages(t *testing.T) {
+	for _, setup := range []func() error{dbHandler.setupMessageSchema, dbHandler.setupTimerSchema} {
+		if err := setup(); err != nil {
+			t.Fatal("Got an error on DB schema setup: ", err)
+		}
+	}
+
+	if err := dbHandler.SaveTimer("carol", 60); err != nil {
+		t.Fatal("Saving a timer produced an error: ", err)
+	}
+	if seconds, err := dbHandler.ReadTimer("carol"); err != nil || seconds != 60 {
+		t.Errorf("Expected a timer of 60 seconds, got %d (%v)", seconds, err)
+	}
+
+	now := time.Now()
+	past := now.Add(-time.Second)
+	messages := []Message{
+		{ID: "shown", Text: "unread", Sender: "carol", Direction: Incoming, Timestamp: now, Peer: "carol", Timer: 60},
+		{ID: "not-shown", Text: "unread", Sender: "dave", Direction: Incoming, Timestamp: now, Peer: "dave", Timer: 60},
+		{Text: "gone", Sender: "me", Direction: Outgoing, Timestamp: now, Peer: "carol", Timer: 60, ExpiresAt: &past},
+		{Text: "kept", Sender: "carol", Direction: Incoming, Timestamp: now, Peer: "carol"},
+	}
+	for _, msg := range messages {
+		if err := dbHandler.SaveMessage(msg); err != nil {
+			t.Fatal("Saving message produced an error: ", err)
+		}
+	}
+
+	read, err := dbHandler.ReadMessages(MessageFilter{Peer: "carol"})
+	if err != nil || len(read) != 2 {
+		t.Fatalf("Expected the expired message to be left out, got %+v (%v)", read, err)
+	}
+
+	if started, err := dbHandler.MarkRead(now, []string{"shown", "gone"}); err != nil || started != 1 {
+		t.Errorf("Expected only the shown message's timer to start, got %d (%v)", started, err)
+	}
+	if unshown, _ := dbHandler.ReadMessages(MessageFilter{Peer: "dave"}); len(unshown) != 1 || unshown[0].ExpiresAt != nil {
+		t.Errorf("Expected the message that wasn't shown to wait, got %+v", unshown)
+	}
+	read, _ = dbHandler.ReadMessages(MessageFilter{Peer: "carol"})
+	if read[0].ExpiresAt == nil || read[0].ExpiresAt.Sub(now).Round(time.Second) != time.Minute {
+		t.Errorf("Expected the read message to expire in a minute, got %v", read[0].ExpiresAt)
+	}
+	if read[1].ExpiresAt != nil {
+		t.Errorf("Expected the message without a timer to be kept, got %v", read[1].ExpiresAt)
+	}
+
+	if purged, err := dbHandler.PurgeExpired(now.Add(2 * time.Minute)); err != nil || purged != 2 {
+		t.Errorf("Expected both timed messages to be purged, got %d (%v)", purged, err)
+	}
+	if read, _ := dbHandler.ReadMessages(MessageFilter{Peer: "carol"}); len(read) != 1 || read[0].Text != "kept" {
+		t.Errorf("Expected only the kept message left, got %+v", read)
+	}
+
+	if err := dbHandler.SaveTimer("carol", 0); err != nil {
+		t.Fatal("Turning a timer off produced an error: ", err)
+	}
+	if timers, err := dbHandler.ReadTimers(); err != nil || len(timers) != 0 {
+		t.Errorf("Expected no timers left, got %v (%v)", timers, err)
+	}
+}
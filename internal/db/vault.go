@@ -0,0 +1,224 @@
+package db
+
+import (
+	"bokkoli/internal/logging"
+	"bokkoli/internal/vault"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrLocked = errors.New("the database is encrypted, unlock it with your passphrase")
+
+// Columns that hold message content or secrets, sealed while a passphrase is set
+var sealedColumns = []struct{ table, column string }{
+	{"messages", "text"},
+	{"webhooks", "secret"},
+	{"webhook_deliveries", "payload"},
+}
+
+// Value stored sealed with the key, opening it tells whether a passphrase is the right one
+const CHECK_VALUE string = "bokkoli"
+
+func (handler *DbHandler) setupVaultSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS encryption (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		salt BLOB NOT NULL,
+		n INTEGER NOT NULL,
+		r INTEGER NOT NULL,
+		p INTEGER NOT NULL,
+		check_value TEXT NOT NULL
+	);`
+
+	_, err := handler.ExecuteQuery(query)
+	return err
+}
+
+// The passphrase parameters and check value, ok is false without a passphrase.
+// A database whose schema was never set up has no encryption table and no passphrase either.
+func (handler *DbHandler) readVault() (vault.Params, string, bool, error) {
+	var params vault.Params
+	var check string
+	var exists bool
+	if err := handler.db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'encryption')").Scan(&exists); err != nil || !exists {
+		return params, "", false, err
+	}
+	err := handler.db.QueryRow("SELECT salt, n, r, p, check_value FROM encryption WHERE id = 1").
+		Scan(&params.Salt, &params.N, &params.R, &params.P, &check)
+	if errors.Is(err, sql.ErrNoRows) {
+		return params, "", false, nil
+	}
+	return params, check, err == nil, err
+}
+
+// Whether a passphrase protects the database
+func (handler *DbHandler) Encrypted() (bool, error) {
+	_, _, ok, err := handler.readVault()
+	return ok, err
+}
+
+// Derive the key from the passphrase and keep it for reading and writing sealed columns
+func (handler *DbHandler) Unlock(passphrase string) (*vault.Key, error) {
+	params, check, ok, err := handler.readVault()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("the database is not encrypted")
+	}
+
+	key, err := vault.Derive(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := key.Open(check); err != nil {
+		return nil, vault.ErrWrongPassphrase
+	}
+	handler.key = key
+	return key, nil
+}
+
+// Use a key another handler on the same database unlocked
+func (handler *DbHandler) SetKey(key *vault.Key) {
+	handler.key = key
+}
+
+func (handler *DbHandler) Key() *vault.Key {
+	return handler.key
+}
+
+// Seal a value for a sealed column, as is when there is no passphrase
+func (handler *DbHandler) seal(value string) (string, error) {
+	if handler.key != nil {
+		return handler.key.Seal([]byte(value))
+	}
+	encrypted, err := handler.Encrypted()
+	if err != nil {
+		return "", err
+	}
+	if encrypted {
+		return "", ErrLocked
+	}
+	return value, nil
+}
+
+// Opens the values read from sealed columns. Whether they are sealed follows from the encryption row and
+// not from the values themselves, as plain text may start with vault.PREFIX too. Called once per read,
+// since ChangePassphrase moves every sealed column over in one transaction.
+func (handler *DbHandler) opener() (func(value string) (string, error), error) {
+	encrypted, err := handler.Encrypted()
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return func(value string) (string, error) { return value, nil }, nil
+	}
+
+	key := handler.key
+	return func(value string) (string, error) {
+		if key == nil {
+			return "", ErrLocked
+		}
+		plaintext, err := key.Open(value)
+		return string(plaintext), err
+	}, nil
+}
+
+// Set, change or with an empty passphrase remove the passphrase, re-encrypting every sealed column in one
+// transaction. The database must be unlocked when it is encrypted. Afterwards the file is vacuumed, so the
+// old values don't linger in free pages.
+func (handler *DbHandler) ChangePassphrase(passphrase string, params vault.Params) (*vault.Key, error) {
+	encrypted, err := handler.Encrypted()
+	if err != nil {
+		return nil, err
+	}
+	if encrypted && handler.key == nil {
+		return nil, ErrLocked
+	}
+	open, err := handler.opener()
+	if err != nil {
+		return nil, err
+	}
+
+	var key *vault.Key
+	var check string
+	if passphrase != "" {
+		if key, err = vault.Derive(passphrase, params); err != nil {
+			return nil, err
+		}
+		if check, err = key.Seal([]byte(CHECK_VALUE)); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, sealed := range sealedColumns {
+		if err := rekeyColumn(tx, sealed.table, sealed.column, open, key); err != nil {
+			return nil, fmt.Errorf("could not re-encrypt %s: %v", sealed.table, err)
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM encryption"); err != nil {
+		return nil, err
+	}
+	if key != nil {
+		query := "INSERT INTO encryption (id, salt, n, r, p, check_value) VALUES (1, ?, ?, ?, ?, ?)"
+		if _, err := tx.Exec(query, params.Salt, params.N, params.R, params.P, check); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	handler.key = key
+	if _, err := handler.ExecuteQuery("VACUUM"); err != nil {
+		logger.Warn("could not vacuum after changing the passphrase", logging.KeyErr, err)
+	}
+	return key, nil
+}
+
+// Open every value of the column and seal it with the new key, or leave it plain without one
+func rekeyColumn(tx *sql.Tx, table string, column string, open func(string) (string, error), key *vault.Key) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s", column, table))
+	if err != nil {
+		return err
+	}
+	values := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		values[id] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column)
+	for id, value := range values {
+		value, err := open(value)
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			if value, err = key.Seal([]byte(value)); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(update, value, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bokkoli/internal/vault"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassphrase(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "encrypted.db")
+	handler, err := NewDbHandler(filePath)
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	defer handler.Close()
+	if err := handler.SetupSchemas(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+
+	handler.SaveMessage(Message{Text: "written before", Sender: "alice", Direction: Outgoing, Timestamp: time.Now(), Peer: "bob"})
+	params, _ := vault.NewParams()
+	if _, err := handler.ChangePassphrase("correct horse", params); err != nil {
+		t.Fatal("Got an error setting the passphrase: ", err)
+	}
+	handler.SaveMessage(Message{Text: "written after", Sender: "alice", Direction: Outgoing, Timestamp: time.Now(), Peer: "bob"})
+
+	data, _ := os.ReadFile(filePath)
+	if strings.Contains(string(data), "written") {
+		t.Error("Expected no message text left in the file")
+	}
+
+	// Another process opening the database has to unlock it first
+	other, _ := NewDbHandler(filePath)
+	defer other.Close()
+	if _, err := other.ReadMessages(MessageFilter{}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected reading to fail while locked, got %v", err)
+	}
+	if err := other.SaveMessage(Message{Text: "sneaky", Timestamp: time.Now()}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected writing to fail while locked, got %v", err)
+	}
+	if _, err := other.Unlock("wrong horse"); !errors.Is(err, vault.ErrWrongPassphrase) {
+		t.Errorf("Expected a wrong passphrase to be refused, got %v", err)
+	}
+	if _, err := other.Unlock("correct horse"); err != nil {
+		t.Fatal("Got an error unlocking: ", err)
+	}
+	messages, err := other.ReadMessages(MessageFilter{})
+	if err != nil || len(messages) != 2 || messages[0].Text != "written before" || messages[1].Text != "written after" {
+		t.Errorf("Expected both messages readable once unlocked, got %+v (%v)", messages, err)
+	}
+
+	params, _ = vault.NewParams()
+	if _, err := other.ChangePassphrase("battery staple", params); err != nil {
+		t.Fatal("Got an error changing the passphrase: ", err)
+	}
+	if _, err := handler.Unlock("correct horse"); err == nil {
+		t.Error("Expected the old passphrase to stop working")
+	}
+
+	if _, err := other.ChangePassphrase("", vault.Params{}); err != nil {
+		t.Fatal("Got an error removing the passphrase: ", err)
+	}
+	if encrypted, _ := handler.Encrypted(); encrypted {
+		t.Error("Expected the database to be decrypted")
+	}
+	handler.SetKey(nil)
+	if messages, err := handler.ReadMessages(MessageFilter{}); err != nil || len(messages) != 2 || messages[1].Text != "written after" {
+		t.Errorf("Expected the messages in plain text again, got %+v (%v)", messages, err)
+	}
+}
+
+// A peer can send text that looks sealed, it must not lock the history or block setting a passphrase
+func TestSealedLookingText(t *testing.T) {
+	handler, err := NewDbHandler(filepath.Join(t.TempDir(), "prefix.db"))
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	defer handler.Close()
+	if err := handler.SetupSchemas(); err != nil {
+		t.Fatal("Got an error on DB schema setup: ", err)
+	}
+
+	text := vault.PREFIX + "hello"
+	handler.SaveMessage(Message{Text: text, Sender: "mallory", Direction: Incoming, Timestamp: time.Now(), Peer: "mallory"})
+	if messages, err := handler.ReadMessages(MessageFilter{}); err != nil || len(messages) != 1 || messages[0].Text != text {
+		t.Fatalf("Expected the message as sent, got %+v (%v)", messages, err)
+	}
+	if _, err := handler.ReadConversations(); err != nil {
+		t.Errorf("Expected the conversations readable, got %v", err)
+	}
+
+	params, _ := vault.NewParams()
+	if _, err := handler.ChangePassphrase("correct horse", params); err != nil {
+		t.Fatal("Got an error setting the passphrase: ", err)
+	}
+	if messages, err := handler.ReadMessages(MessageFilter{}); err != nil || len(messages) != 1 || messages[0].Text != text {
+		t.Errorf("Expected the message as sent once encrypted, got %+v (%v)", messages, err)
+	}
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Endpoint that is told about chat activity, Events lists which kinds of activity
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// One payload for one webhook, along with how delivering it went so far
+type WebhookDelivery struct {
+	ID         int64          `json:"id"`
+	WebhookID  int64          `json:"webhook_id"`
+	Event      string         `json:"event"`
+	Payload    string         `json:"payload"`
+	Status     DeliveryStatus `json:"status"`
+	Attempts   int            `json:"attempts"`
+	StatusCode int            `json:"status_code,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+func (handler *DbHandler) setupWebhookSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		events TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`
+
+	_, err := handler.ExecuteQuery(query)
+	return err
+}
+
+func (handler *DbHandler) SaveWebhook(webhook Webhook) (int64, error) {
+	query := `
+	INSERT INTO webhooks (url, events, secret, created_at)
+	VALUES (?, ?, ?, ?);
+	`
+
+	secret, err := handler.seal(webhook.Secret)
+	if err != nil {
+		return 0, err
+	}
+	result, err := handler.ExecuteQuery(query, webhook.URL, strings.Join(webhook.Events, ","), secret, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Every webhook, oldest first
+func (handler *DbHandler) ReadWebhooks() ([]Webhook, error) {
+	rows, err := handler.Query("SELECT id, url, events, secret, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return handler.scanWebhooks(rows)
+}
+
+func (handler *DbHandler) ReadWebhook(id int64) (Webhook, error) {
+	rows, err := handler.QueryArgs("SELECT id, url, events, secret, created_at FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhooks, err := handler.scanWebhooks(rows)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if len(webhooks) == 0 {
+		return Webhook{}, fmt.Errorf("no webhook with id %d", id)
+	}
+	return webhooks[0], nil
+}
+
+func (handler *DbHandler) scanWebhooks(rows *sql.Rows) ([]Webhook, error) {
+	defer rows.Close()
+	open, err := handler.opener()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &events, &webhook.Secret, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		if webhook.Secret, err = open(webhook.Secret); err != nil {
+			return nil, err
+		}
+		webhook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// Remove a webhook along with its deliveries
+func (handler *DbHandler) DeleteWebhook(id int64) error {
+	if _, err := handler.ExecuteQuery("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		return err
+	}
+	result, err := handler.ExecuteQuery("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if removed, err := result.RowsAffected(); err == nil && removed == 0 {
+		return fmt.Errorf("no webhook with id %d", id)
+	}
+	return nil
+}
+
+// Record a delivery that is yet to be attempted
+func (handler *DbHandler) SaveDelivery(delivery WebhookDelivery) (int64, error) {
+	query := `
+	INSERT INTO webhook_deliveries (webhook_id, event, payload, status, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?);
+	`
+
+	payload, err := handler.seal(delivery.Payload)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	result, err := handler.ExecuteQuery(query, delivery.WebhookID, delivery.Event, payload, DeliveryPending, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Record the outcome of an attempt
+func (handler *DbHandler) UpdateDelivery(delivery WebhookDelivery) error {
+	query := `
+	UPDATE webhook_deliveries SET status = ?, attempts = ?, status_code = ?, error = ?, updated_at = ?
+	WHERE id = ?;
+	`
+
+	_, err := handler.ExecuteQuery(query, delivery.Status, delivery.Attempts, delivery.StatusCode, delivery.Error, time.Now(), delivery.ID)
+	return err
+}
+
+// Most recent deliveries first; with a status only those, e.g. the pending ones to resume after a restart
+func (handler *DbHandler) ReadDeliveries(status DeliveryStatus, limit int) ([]WebhookDelivery, error) {
+	query := "SELECT id, webhook_id, event, payload, status, attempts, status_code, error, created_at, updated_at FROM webhook_deliveries"
+	var args []any
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	open, err := handler.opener()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := handler.QueryArgs(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.StatusCode, &d.Error, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if d.Payload, err = open(d.Payload); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,222 @@
+// Package export writes stored messages as transcripts for people outside Bokkoli: JSON for other tools,
+// Markdown, a self-contained HTML page styled like the chat, and IRC-style text logs. It also reads
+// JSON exports, IRC logs and CSV files back in, for importing.
+package export
+
+import (
+	"archive/zip"
+	"bokkoli/internal/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatMarkdown Format = "md"
+	FormatHTML     Format = "html"
+	FormatIRC      Format = "irc"
+)
+
+// Formats in the order they are offered
+var Formats = []Format{FormatJSON, FormatMarkdown, FormatHTML, FormatIRC}
+
+// Bumped when the JSON shape changes in a way importers have to know about
+const VERSION int = 1
+
+// Messages to export along with where they came from, which is also the JSON document
+type Transcript struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	// Username of the profile that exported the messages
+	ExportedBy string `json:"exported_by,omitempty"`
+	// The one conversation exported, empty for all of them
+	Peer     string       `json:"peer,omitempty"`
+	Since    *time.Time   `json:"since,omitempty"`
+	Until    *time.Time   `json:"until,omitempty"`
+	Messages []db.Message `json:"messages"`
+}
+
+// Messages with one peer, oldest first
+type conversation struct {
+	Peer     string
+	Messages []db.Message
+}
+
+// Transcript of the messages read with the filter, exported now by the user
+func NewTranscript(messages []db.Message, exportedBy string, filter db.MessageFilter) Transcript {
+	t := Transcript{Version: VERSION, ExportedAt: time.Now(), ExportedBy: exportedBy, Peer: filter.Peer, Messages: messages}
+	if !filter.Since.IsZero() {
+		t.Since = &filter.Since
+	}
+	if !filter.Until.IsZero() {
+		t.Until = &filter.Until
+	}
+	return t
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func ParseFormat(value string) (Format, error) {
+	return parseFormat(value, Formats)
+}
+
+func parseFormat(value string, formats []Format) (Format, error) {
+	for _, format := range formats {
+		if string(format) == value {
+			return format, nil
+		}
+	}
+	names := make([]string, len(formats))
+	for i, format := range formats {
+		names[i] = string(format)
+	}
+	return "", fmt.Errorf("unknown format %q, expected one of: %s", value, strings.Join(names, ", "))
+}
+
+// File name extension for the format, with the dot
+func (f Format) Extension() string {
+	if f == FormatIRC {
+		return ".log"
+	}
+	return "." + string(f)
+}
+
+// Write the transcript as a single document
+func Write(w io.Writer, format Format, t Transcript) error {
+	if t.Messages == nil {
+		t.Messages = []db.Message{}
+	}
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(t)
+	case FormatMarkdown:
+		return writeMarkdown(w, t)
+	case FormatHTML:
+		return writeHTML(w, t)
+	case FormatIRC:
+		return writeIRC(w, t)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// Write one file per conversation into the directory, creating it when needed
+func WriteDir(dir string, format Format, t Transcript) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return writeBundle(format, t, func(name string, write func(io.Writer) error) error {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		if err := write(file); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+}
+
+// Write one file per conversation into a zip archive
+func WriteZip(w io.Writer, format Format, t Transcript) error {
+	archive := zip.NewWriter(w)
+	err := writeBundle(format, t, func(name string, write func(io.Writer) error) error {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: t.ExportedAt})
+		if err != nil {
+			return err
+		}
+		return write(file)
+	})
+	if err != nil {
+		archive.Close()
+		return err
+	}
+	return archive.Close()
+}
+
+// Hand every conversation to create as its own transcript. Messages carry no attachments yet,
+// so the transcripts are all there is to bundle.
+func writeBundle(format Format, t Transcript, create func(name string, write func(io.Writer) error) error) error {
+	used := map[string]bool{}
+	for _, c := range groupConversations(t.Messages) {
+		name := FileName(c.Peer, format)
+		for i := 2; used[name]; i++ {
+			name = strings.TrimSuffix(FileName(c.Peer, format), format.Extension()) + fmt.Sprintf("-%d", i) + format.Extension()
+		}
+		used[name] = true
+
+		single := t
+		single.Peer = c.Peer
+		single.Messages = c.Messages
+		if err := create(name, func(w io.Writer) error { return Write(w, format, single) }); err != nil {
+			return fmt.Errorf("could not write %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// File name for the conversation with the peer, safe on every file system
+func FileName(peer string, format Format) string {
+	name := strings.Trim(unsafeFileChars.ReplaceAllString(peer, "_"), "._")
+	if name == "" {
+		name = "unknown"
+	}
+	return name + format.Extension()
+}
+
+// Split the messages by peer, sorted by peer name
+func groupConversations(messages []db.Message) []conversation {
+	byPeer := map[string][]db.Message{}
+	for _, message := range messages {
+		byPeer[message.Peer] = append(byPeer[message.Peer], message)
+	}
+	conversations := make([]conversation, 0, len(byPeer))
+	for peer, messages := range byPeer {
+		conversations = append(conversations, conversation{Peer: peer, Messages: messages})
+	}
+	sort.Slice(conversations, func(i, j int) bool { return conversations[i].Peer < conversations[j].Peer })
+	return conversations
+}
+
+func peerLabel(peer string) string {
+	if peer == "" {
+		return "unknown peer"
+	}
+	return peer
+}
+
+// "Chat with bob" for one conversation, "Bokkoli chats" for all of them
+func title(t Transcript) string {
+	if t.Peer != "" {
+		return "Chat with " + t.Peer
+	}
+	return "Bokkoli chats"
+}
+
+// One line on who exported what, e.g. "Exported by alice on 2026-01-31 15:04 · 12 messages"
+func summary(t Transcript) string {
+	parts := []string{"Exported"}
+	if t.ExportedBy != "" {
+		parts = append(parts, "by", t.ExportedBy)
+	}
+	parts = append(parts, "on", t.ExportedAt.Format("2006-01-02 15:04"))
+	text := strings.Join(parts, " ") + fmt.Sprintf(" · %d messages", len(t.Messages))
+	if t.Since != nil {
+		text += " since " + t.Since.Format("2006-01-02 15:04")
+	}
+	if t.Until != nil {
+		text += " until " + t.Until.Format("2006-01-02 15:04")
+	}
+	return text
+}
@@ -0,0 +1,77 @@
+package export
+
+import (
+	"archive/zip"
+	"bokkoli/internal/db"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTranscript() Transcript {
+	day := time.Date(2026, 1, 31, 23, 58, 0, 0, time.Local)
+	messages := []db.Message{
+		{Text: "hi <bob>", Sender: "alice", Direction: db.Outgoing, Timestamp: day, Peer: "bob"},
+		{Text: "# not a heading\nsecond line", Sender: "bob", Direction: db.Incoming, Timestamp: day.Add(3 * time.Minute), Peer: "bob"},
+		{Text: "hello", Sender: "carol", Direction: db.Incoming, Timestamp: day, Peer: "carol/../x"},
+	}
+	return NewTranscript(messages, "alice", db.MessageFilter{Since: day.Add(-time.Hour)})
+}
+
+func TestWrite(t *testing.T) {
+	cases := map[Format][]string{
+		FormatMarkdown: {"# Bokkoli chats", "## bob", "### 2026-02-01", "> # not a heading\n> second line"},
+		FormatHTML:     {"<title>Bokkoli chats</title>", "hi &lt;bob&gt;", `class="message outgoing"`, "Sunday, 1 February 2026"},
+		FormatIRC: {
+			"--- Conversation with bob\n--- Log opened Sat Jan 31 23:58:00 2026\n23:58 <alice> hi <bob>\n--- Day changed Sun Feb 01 2026\n" +
+				"00:01 <bob> # not a heading\n00:01 <bob> second line\n--- Log closed Sun Feb 01 00:01:00 2026\n",
+		},
+	}
+	for format, expected := range cases {
+		var out bytes.Buffer
+		if err := Write(&out, format, testTranscript()); err != nil {
+			t.Fatalf("Writing %s produced an error: %v", format, err)
+		}
+		for _, part := range expected {
+			if !strings.Contains(out.String(), part) {
+				t.Errorf("Expected the %s export to contain %q, got:\n%s", format, part, out.String())
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := Write(&out, FormatJSON, testTranscript()); err != nil {
+		t.Fatal("Writing JSON produced an error: ", err)
+	}
+	var decoded Transcript
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || decoded.Version != VERSION || len(decoded.Messages) != 3 || decoded.Since == nil {
+		t.Errorf("Expected the transcript back from its JSON, got %+v (%v)", decoded, err)
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteZip(&out, FormatIRC, testTranscript()); err != nil {
+		t.Fatal("Writing the zip produced an error: ", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal("Reading the zip produced an error: ", err)
+	}
+
+	names := []string{}
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	if strings.Join(names, " ") != "bob.log carol_.._x.log" {
+		t.Fatalf("Expected a safe file per conversation, got %v", names)
+	}
+	file, _ := archive.File[1].Open()
+	content, _ := io.ReadAll(file)
+	if strings.Contains(string(content), "Conversation with") || !strings.Contains(string(content), "<carol> hello") {
+		t.Errorf("Expected only carol's conversation in her file, got:\n%s", content)
+	}
+}
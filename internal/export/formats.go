@@ -0,0 +1,166 @@
+package export
+
+import (
+	"bokkoli/internal/db"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// irssi's log timestamps, which IRC log tools and Bokkoli's importer understand
+const (
+	IRC_LOG_OPENED  string = "--- Log opened "
+	IRC_LOG_CLOSED  string = "--- Log closed "
+	IRC_DAY_CHANGED string = "--- Day changed "
+	IRC_OPEN_LAYOUT string = "Mon Jan 02 15:04:05 2006"
+	IRC_DAY_LAYOUT  string = "Mon Jan 02 2006"
+	IRC_TIME_LAYOUT string = "15:04"
+	// Starts each conversation when a log holds several, irssi keeps one per file instead
+	IRC_CONVERSATION string = "--- Conversation with "
+)
+
+// A heading per conversation when there are several, one per day, and each message quoted so
+// Markdown in the text can't break the document's structure
+func writeMarkdown(w io.Writer, t Transcript) error {
+	var doc strings.Builder
+	fmt.Fprintf(&doc, "# %s\n\n_%s_\n", title(t), summary(t))
+
+	for _, c := range groupConversations(t.Messages) {
+		if t.Peer == "" {
+			fmt.Fprintf(&doc, "\n## %s\n", peerLabel(c.Peer))
+		}
+		day := ""
+		for _, message := range c.Messages {
+			if d := message.Timestamp.Format("2006-01-02"); d != day {
+				day = d
+				fmt.Fprintf(&doc, "\n### %s\n", day)
+			}
+			fmt.Fprintf(&doc, "\n**%s** %s\n\n", message.Sender, message.Timestamp.Format("15:04"))
+			for _, line := range strings.Split(message.Text, "\n") {
+				doc.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, doc.String())
+	return err
+}
+
+// One block per conversation in irssi's format: opened and closed lines, a line when the day changes,
+// and a "HH:MM <sender> text" line per line of text
+func writeIRC(w io.Writer, t Transcript) error {
+	var log strings.Builder
+	for _, c := range groupConversations(t.Messages) {
+		first, last := c.Messages[0].Timestamp, c.Messages[len(c.Messages)-1].Timestamp
+		if t.Peer == "" {
+			log.WriteString(IRC_CONVERSATION + peerLabel(c.Peer) + "\n")
+		}
+		log.WriteString(IRC_LOG_OPENED + first.Format(IRC_OPEN_LAYOUT) + "\n")
+
+		day := first.Format("2006-01-02")
+		for _, message := range c.Messages {
+			if d := message.Timestamp.Format("2006-01-02"); d != day {
+				day = d
+				log.WriteString(IRC_DAY_CHANGED + message.Timestamp.Format(IRC_DAY_LAYOUT) + "\n")
+			}
+			for _, line := range strings.Split(message.Text, "\n") {
+				fmt.Fprintf(&log, "%s <%s> %s\n", message.Timestamp.Format(IRC_TIME_LAYOUT), message.Sender, line)
+			}
+		}
+		log.WriteString(IRC_LOG_CLOSED + last.Format(IRC_OPEN_LAYOUT) + "\n")
+	}
+
+	_, err := io.WriteString(w, log.String())
+	return err
+}
+
+type htmlMessage struct {
+	Sender   string
+	Time     string
+	Text     string
+	Outgoing bool
+}
+
+type htmlConversation struct {
+	Peer string
+	Days []htmlDay
+}
+
+type htmlDay struct {
+	Day      string
+	Messages []htmlMessage
+}
+
+// Colors of the dark theme, with its terminal palette colors as the hex values terminals show them in
+var htmlPage = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { background: #1c1c1c; color: #e4e4e4; font-family: ui-monospace, "SFMono-Regular", Menlo, Consolas, monospace; margin: 2em auto; max-width: 48em; padding: 0 1em; }
+h1 { color: #f47d56; font-size: 1.3em; }
+h2 { color: #f47d56; font-size: 1.1em; margin-top: 2em; }
+.summary, .day { color: #626262; }
+.day { margin: 1.5em 0 0.5em; }
+.message { border: 1px solid #5f87ff; border-radius: 0.6em; margin: 0.6em 0; max-width: 38em; padding: 0.8em 1em; }
+.outgoing { margin-left: auto; }
+.meta { margin-bottom: 0.8em; }
+.time { color: #8a8a8a; font-style: italic; }
+.sender { background: #a488f7; color: #fafafa; font-weight: bold; padding: 0 0.3em; }
+.text { white-space: pre-wrap; word-wrap: break-word; }
+</style>
+</head>
+<body>
+<h1>🥦 {{.Title}}</h1>
+<p class="summary">{{.Summary}}</p>
+{{- range .Conversations}}
+{{- if .Peer}}
+<h2>{{.Peer}}</h2>
+{{- end}}
+{{- range .Days}}
+<div class="day">{{.Day}}</div>
+{{- range .Messages}}
+<div class="message{{if .Outgoing}} outgoing{{end}}">
+<div class="meta"><span class="time">{{.Time}}</span> - <span class="sender">{{.Sender}}</span></div>
+<div class="text">{{.Text}}</div>
+</div>
+{{- end}}
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+// A page that needs nothing else, not even a network connection, with the messages laid out like the chat view
+func writeHTML(w io.Writer, t Transcript) error {
+	var conversations []htmlConversation
+	for _, c := range groupConversations(t.Messages) {
+		conversation := htmlConversation{}
+		if t.Peer == "" {
+			conversation.Peer = peerLabel(c.Peer)
+		}
+		for _, message := range c.Messages {
+			day := message.Timestamp.Format("Monday, 2 January 2006")
+			if len(conversation.Days) == 0 || conversation.Days[len(conversation.Days)-1].Day != day {
+				conversation.Days = append(conversation.Days, htmlDay{Day: day})
+			}
+			last := &conversation.Days[len(conversation.Days)-1]
+			last.Messages = append(last.Messages, htmlMessage{
+				Sender:   message.Sender,
+				Time:     message.Timestamp.Format("2006-01-02 15:04"),
+				Text:     message.Text,
+				Outgoing: message.Direction == db.Outgoing,
+			})
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	return htmlPage.Execute(w, struct {
+		Title         string
+		Summary       string
+		Conversations []htmlConversation
+	}{title(t), summary(t), conversations})
+}
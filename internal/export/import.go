@@ -0,0 +1,303 @@
+package export
+
+import (
+	"bokkoli/internal/db"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comma separated values with a header row, only read
+const FormatCSV Format = "csv"
+
+// Formats Read understands, Bokkoli's JSON and IRC logs are also what Write produces
+var ImportFormats = []Format{FormatJSON, FormatIRC, FormatCSV}
+
+// "12:34 <nick> text" as irssi writes it, or "[2025-01-31 12:34:56] <@nick> text" as other clients do.
+// The nick may carry a channel mode prefix.
+var ircLine = regexp.MustCompile(`^\[?(?:(\d{4}-\d{2}-\d{2})[ T])?(\d{1,2}:\d{2}(?::\d{2})?)\]?\s+<[~&@%+ ]?([^>]+)>\s?(.*)$`)
+
+// Timestamps accepted in CSV files, besides Unix seconds
+var csvTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// Header names accepted for each CSV column, compared in lower case
+var csvColumns = map[string][]string{
+	"id":        {"id", "message_id"},
+	"timestamp": {"timestamp", "time", "date", "datetime", "sent_at"},
+	"sender":    {"sender", "from", "user", "username", "author", "nick"},
+	"text":      {"text", "message", "content", "body"},
+	"peer":      {"peer", "conversation", "channel", "to"},
+	"direction": {"direction"},
+}
+
+// What a format may not say about its messages
+type ReadOptions struct {
+	// Conversation of messages that don't name one, in IRC logs until a "Conversation with" line does
+	Peer string
+	// Our username, messages it sent are outgoing
+	Me string
+	// Time zone of timestamps without one
+	Location *time.Location
+}
+
+func ParseImportFormat(value string) (Format, error) {
+	return parseFormat(value, ImportFormats)
+}
+
+// Format of a file going by its extension
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".jsonl":
+		return FormatJSON, nil
+	case ".log", ".txt":
+		return FormatIRC, nil
+	case ".csv":
+		return FormatCSV, nil
+	}
+	return "", fmt.Errorf("can't tell the format of %s from its extension", filepath.Base(path))
+}
+
+// Read messages in the format, filling in what it leaves out from the options
+func Read(r io.Reader, format Format, options ReadOptions) ([]db.Message, error) {
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+
+	var messages []db.Message
+	var err error
+	switch format {
+	case FormatJSON:
+		messages, err = readJSON(r)
+	case FormatIRC:
+		messages, err = readIRC(r, options)
+	case FormatCSV:
+		messages, err = readCSV(r, options)
+	default:
+		return nil, fmt.Errorf("can't import %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		msg := &messages[i]
+		if msg.Peer == "" {
+			msg.Peer = options.Peer
+		}
+		if msg.Direction == "" {
+			msg.Direction = db.Incoming
+			if options.Me != "" && msg.Sender == options.Me {
+				msg.Direction = db.Outgoing
+			}
+		}
+		if msg.Sender == "" || msg.Peer == "" || msg.Timestamp.IsZero() {
+			return nil, fmt.Errorf("message %d has no sender, conversation or time", i+1)
+		}
+		if msg.Direction != db.Incoming && msg.Direction != db.Outgoing {
+			return nil, fmt.Errorf("message %d has an unknown direction %q", i+1, msg.Direction)
+		}
+	}
+	return messages, nil
+}
+
+// An export's transcript, the array 'history --format json' prints, or one message per line as with jsonl
+func readJSON(r io.Reader) ([]db.Message, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var messages []db.Message
+		err := json.Unmarshal(trimmed, &messages)
+		return messages, err
+	}
+
+	var messages []db.Message
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); errors.Is(err, io.EOF) {
+			return messages, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var transcript struct {
+			Messages *[]db.Message `json:"messages"`
+		}
+		if err := json.Unmarshal(raw, &transcript); err == nil && transcript.Messages != nil {
+			messages = append(messages, *transcript.Messages...)
+			continue
+		}
+		var msg db.Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// irssi-style logs take their date from the "Log opened" and "Day changed" lines, other clients put it on lines.
+// Joins, parts, actions and anything else that isn't a message are skipped.
+func readIRC(r io.Reader, options ReadOptions) ([]db.Message, error) {
+	var messages []db.Message
+	var day time.Time
+	peer := options.Peer
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if value, ok := strings.CutPrefix(line, IRC_LOG_OPENED); ok {
+			opened, err := time.ParseInLocation(IRC_OPEN_LAYOUT, value, options.Location)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			day = opened
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, IRC_DAY_CHANGED); ok {
+			changed, err := time.ParseInLocation(IRC_DAY_LAYOUT, value, options.Location)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			day = changed
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, IRC_CONVERSATION); ok {
+			peer = value
+			continue
+		}
+
+		match := ircLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		date := day
+		if match[1] != "" {
+			var err error
+			if date, err = time.ParseInLocation("2006-01-02", match[1], options.Location); err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			day = date
+		}
+		if date.IsZero() {
+			return nil, fmt.Errorf("line %d: no date yet, the log needs a '%s' line before its messages", number, strings.TrimSpace(IRC_LOG_OPENED))
+		}
+
+		clock, err := parseClock(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+		year, month, dayOfMonth := date.Date()
+		messages = append(messages, db.Message{
+			Text:      match[4],
+			Sender:    strings.TrimSpace(match[3]),
+			Timestamp: time.Date(year, month, dayOfMonth, 0, 0, 0, 0, options.Location).Add(clock),
+			Peer:      peer,
+		})
+	}
+	return messages, scanner.Err()
+}
+
+// Time of day as HH:MM or HH:MM:SS
+func parseClock(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	var clock time.Duration
+	units := []time.Duration{time.Hour, time.Minute, time.Second}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		clock += time.Duration(number) * units[i]
+	}
+	if clock >= 24*time.Hour {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return clock, nil
+}
+
+// A header row names the columns, see csvColumns. Timestamp, sender and text are required.
+func readCSV(r io.Reader, options ReadOptions) ([]db.Message, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the header row: %v", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for column, names := range csvColumns {
+			for _, accepted := range names {
+				if _, taken := columns[column]; name == accepted && !taken {
+					columns[column] = i
+				}
+			}
+		}
+	}
+	for _, required := range []string{"timestamp", "sender", "text"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the header row has no %s column, expected one of: %s", required, strings.Join(csvColumns[required], ", "))
+		}
+	}
+
+	var messages []db.Message
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, required := range []string{"timestamp", "sender", "text"} {
+			if columns[required] >= len(record) {
+				return nil, fmt.Errorf("row %d: missing the %s column", row, required)
+			}
+		}
+		field := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		timestamp, err := parseCSVTime(field("timestamp"), options.Location)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		messages = append(messages, db.Message{
+			ID:        field("id"),
+			Text:      record[columns["text"]],
+			Sender:    field("sender"),
+			Direction: db.Direction(strings.ToLower(field("direction"))),
+			Timestamp: timestamp,
+			Peer:      field("peer"),
+		})
+	}
+}
+
+func parseCSVTime(value string, location *time.Location) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, expected e.g. 2025-01-31 12:34:56, RFC 3339 or Unix seconds", value)
+}
@@ -0,0 +1,65 @@
+package export
+
+import (
+	"bokkoli/internal/db"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadWritten(t *testing.T) {
+	for _, format := range []Format{FormatJSON, FormatIRC} {
+		var out bytes.Buffer
+		if err := Write(&out, format, testTranscript()); err != nil {
+			t.Fatalf("Writing %s produced an error: %v", format, err)
+		}
+		messages, err := Read(&out, format, ReadOptions{Me: "alice"})
+		if err != nil {
+			t.Fatalf("Reading %s produced an error: %v", format, err)
+		}
+		// The IRC log has a line per line of text
+		expected := map[Format]int{FormatJSON: 3, FormatIRC: 4}[format]
+		if len(messages) != expected {
+			t.Fatalf("Expected %d messages back from %s, got %+v", expected, format, messages)
+		}
+		first := messages[0]
+		if first.Sender != "alice" || first.Direction != db.Outgoing || first.Peer != "bob" || first.Text != "hi <bob>" {
+			t.Errorf("Expected alice's message to bob back from %s, got %+v", format, first)
+		}
+		if format == FormatIRC && !messages[1].Timestamp.Equal(time.Date(2026, 2, 1, 0, 1, 0, 0, time.Local)) {
+			t.Errorf("Expected the day change to carry into the timestamp, got %v", messages[1].Timestamp)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	jsonl := `{"text":"one","sender":"bob","direction":"incoming","timestamp":"2026-01-31T12:00:00Z","peer":"bob"}
+{"text":"two","sender":"alice","timestamp":"2026-01-31T12:01:00Z"}`
+	messages, err := Read(strings.NewReader(jsonl), FormatJSON, ReadOptions{Peer: "bob", Me: "alice"})
+	if err != nil || len(messages) != 2 || messages[1].Peer != "bob" || messages[1].Direction != db.Outgoing {
+		t.Errorf("Expected both JSON lines with the missing fields filled in, got %+v (%v)", messages, err)
+	}
+
+	irc := "[2026-01-31 12:00:05] <@bob> hello there\n[2026-01-31 12:00:09] * bob waves\n12:01 <alice> hi\n"
+	messages, err = Read(strings.NewReader(irc), FormatIRC, ReadOptions{Peer: "#chat", Location: time.UTC})
+	if err != nil || len(messages) != 2 || messages[0].Sender != "bob" || messages[0].Timestamp.Second() != 5 || messages[1].Timestamp.Day() != 31 {
+		t.Errorf("Expected the action skipped and the date carried to the next line, got %+v (%v)", messages, err)
+	}
+	if _, err := Read(strings.NewReader("12:01 <alice> hi\n"), FormatIRC, ReadOptions{Peer: "bob"}); err == nil {
+		t.Error("Expected an error for a log without a date")
+	}
+
+	csv := "Date,From,Message,Channel\n2026-01-31 12:00:00,bob,\"hi, alice\",bob\n1769860860,alice,hey,\n"
+	messages, err = Read(strings.NewReader(csv), FormatCSV, ReadOptions{Peer: "bob", Me: "alice"})
+	if err != nil || len(messages) != 2 || messages[0].Text != "hi, alice" || messages[1].Direction != db.Outgoing || messages[1].Timestamp.Unix() != 1769860860 {
+		t.Errorf("Expected both CSV rows, got %+v (%v)", messages, err)
+	}
+	if _, err := Read(strings.NewReader("when,who\n"), FormatCSV, ReadOptions{}); err == nil {
+		t.Error("Expected an error for a header without the required columns")
+	}
+	short := "timestamp,sender,text\n2025-01-01 10:00,alice\n"
+	if _, err := Read(strings.NewReader(short), FormatCSV, ReadOptions{Peer: "bob"}); err == nil || !strings.Contains(err.Error(), "row 2: missing the text column") {
+		t.Errorf("Expected an error for a row without text, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+// Package identity holds the long-lived key a profile is known by. Peers sign the connection handshake with it,
+// so the fingerprint shown for a peer is one it proved it holds, not just one it claims.
+package identity
+
+import (
+	"bokkoli/internal/vault"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Bytes of the key's SHA-256 shown as its fingerprint, in groups of FINGERPRINT_GROUP hex digits
+const (
+	FINGERPRINT_SIZE  int = 16
+	FINGERPRINT_GROUP int = 4
+)
+
+// Each key gives SAFETY_GROUPS groups of 5 digits to the safety number, hashed SAFETY_ITERATIONS times
+// so that finding a key with a matching number takes more than a brute force of the digits
+const (
+	SAFETY_GROUPS     int    = 6
+	SAFETY_ITERATIONS int    = 5200
+	SAFETY_VERSION    string = "bokkoli safety number v1"
+)
+
+// The profile's identity key, created on first use. The file holds the hex encoded seed and is only readable by
+// the user. With a passphrase key the seed is sealed, and a sealed file can't be read without one.
+func Load(path string, key *vault.Key) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return create(path, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decode(path, strings.TrimSpace(string(data)), key)
+}
+
+func decode(path string, text string, key *vault.Key) (ed25519.PrivateKey, error) {
+	if vault.IsSealed(text) {
+		if key == nil {
+			return nil, fmt.Errorf("%s is encrypted, unlock it with your passphrase", path)
+		}
+		plaintext, err := key.Open(text)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt %s: %v", path, err)
+		}
+		text = string(plaintext)
+	}
+
+	seed, err := hex.DecodeString(text)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not an identity key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// The seed as written to the file, sealed when there is a key
+func encode(private ed25519.PrivateKey, key *vault.Key) (string, error) {
+	text := hex.EncodeToString(private.Seed())
+	if key == nil {
+		return text + "\n", nil
+	}
+	sealed, err := key.Seal([]byte(text))
+	return sealed + "\n", err
+}
+
+func create(path string, key *vault.Key) (ed25519.PrivateKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	text, err := encode(private, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// O_EXCL so two processes starting at once can't each write their own key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return Load(path, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
+
+// Write the identity key sealed with another passphrase key, or plain with none, next to the current file.
+// finish(true) replaces the file, so it can follow the database to the new passphrase; finish(false) throws
+// the new file away. Without an identity file there is nothing to do.
+func Reseal(path string, from *vault.Key, to *vault.Key) (finish func(apply bool) error, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return func(bool) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	private, err := decode(path, strings.TrimSpace(string(data)), from)
+	if err != nil {
+		return nil, err
+	}
+	text, err := encode(private, to)
+	if err != nil {
+		return nil, err
+	}
+
+	next := path + ".new"
+	if err := os.WriteFile(next, []byte(text), 0o600); err != nil {
+		return nil, err
+	}
+	return func(apply bool) error {
+		if apply {
+			return os.Rename(next, path)
+		}
+		return os.Remove(next)
+	}, nil
+}
+
+// Short, readable digest of a public key, e.g. "3f2a 9c01 …"
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	digits := hex.EncodeToString(sum[:FINGERPRINT_SIZE])
+
+	groups := make([]string, 0, len(digits)/FINGERPRINT_GROUP)
+	for i := 0; i < len(digits); i += FINGERPRINT_GROUP {
+		groups = append(groups, digits[i:i+FINGERPRINT_GROUP])
+	}
+	return strings.Join(groups, " ")
+}
+
+// Number two peers compare to be sure each holds the key the other sees. It is the same on both sides:
+// every key contributes its own half, and the halves are put in order.
+func SafetyNumber(a ed25519.PublicKey, b ed25519.PublicKey) string {
+	halves := []string{safetyHalf(a), safetyHalf(b)}
+	slices.Sort(halves)
+	return halves[0] + " " + halves[1]
+}
+
+func safetyHalf(key ed25519.PublicKey) string {
+	digest := sha512.Sum512(append([]byte(SAFETY_VERSION), key...))
+	for range SAFETY_ITERATIONS - 1 {
+		digest = sha512.Sum512(append(digest[:], key...))
+	}
+
+	groups := make([]string, SAFETY_GROUPS)
+	for i := range groups {
+		chunk := digest[i*5 : i*5+5]
+		value := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+		groups[i] = fmt.Sprintf("%05d", value%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// Parse a hex encoded public key as sent during the handshake
+func ParseKey(text string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(text)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("not an identity key")
+	}
+	return ed25519.PublicKey(key), nil
+}
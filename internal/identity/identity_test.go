@@ -0,0 +1,63 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile", "identity.key")
+	key, err := Load(path, nil)
+	if err != nil {
+		t.Fatal("Got an error creating the key: ", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a key only the user can read, got %v (%v)", info.Mode(), err)
+	}
+
+	again, err := Load(path, nil)
+	if err != nil || !key.Equal(again) {
+		t.Error("Expected the same key to be loaded again")
+	}
+
+	os.WriteFile(path, []byte("not a key\n"), 0o600)
+	if _, err := Load(path, nil); err == nil {
+		t.Error("Expected an error for a broken key file")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	fingerprint := Fingerprint(key)
+	if groups := strings.Fields(fingerprint); len(groups) != 8 || len(groups[0]) != FINGERPRINT_GROUP {
+		t.Errorf("Expected 8 groups of 4 digits, got %q", fingerprint)
+	}
+
+	parsed, err := ParseKey(hex.EncodeToString(key))
+	if err != nil || Fingerprint(parsed) != fingerprint {
+		t.Errorf("Expected the parsed key to have the same fingerprint, got %v", err)
+	}
+	if _, err := ParseKey("abcd"); err == nil {
+		t.Error("Expected a short key to be refused")
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	bob := ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), 1)).Public().(ed25519.PublicKey)
+
+	number := SafetyNumber(alice, bob)
+	if number != SafetyNumber(bob, alice) {
+		t.Error("Expected both sides to see the same number")
+	}
+	if groups := strings.Fields(number); len(groups) != 2*SAFETY_GROUPS || len(groups[0]) != 5 {
+		t.Errorf("Expected 12 groups of 5 digits, got %q", number)
+	}
+	if number == SafetyNumber(alice, alice) {
+		t.Error("Expected another key to give another number")
+	}
+}
@@ -0,0 +1,104 @@
+package irc
+
+import (
+	"bokkoli/internal/logging"
+	"bokkoli/internal/message"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Name the gateway introduces itself with, also the host part of every prefix
+const SERVER_NAME string = "bokkoli"
+
+// Nick to send commands to, e.g. "/msg bokkoli connect localhost:8081"
+const CONTROL_NICK string = "bokkoli"
+
+var logger = logging.For(logging.IRC)
+
+// Local IRC server façade over a backend: every peer is a channel named after it, and a nick to query.
+// The backend stays owned by the caller.
+type Gateway struct {
+	backend  message.Backend
+	password string
+	listener net.Listener
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	closed   bool
+}
+
+// Start listening; only loopback addresses are accepted. Clients must send the password with PASS unless it is empty.
+func Listen(address string, backend message.Backend, password string) (*Gateway, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("the IRC gateway only listens on loopback, got %q", host)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Gateway{
+		backend:  backend,
+		password: password,
+		listener: listener,
+		sessions: make(map[*session]struct{}),
+	}, nil
+}
+
+func (g *Gateway) Addr() string {
+	return g.listener.Addr().String()
+}
+
+// Accept clients until the gateway is closed
+func (g *Gateway) Serve() error {
+	for {
+		conn, err := g.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			logger.Warn("could not accept IRC client", logging.KeyErr, err)
+			continue
+		}
+
+		s := newSession(g, conn)
+		g.mu.Lock()
+		if g.closed {
+			g.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		g.sessions[s] = struct{}{}
+		g.mu.Unlock()
+
+		go func() {
+			s.run()
+			g.mu.Lock()
+			delete(g.sessions, s)
+			g.mu.Unlock()
+		}()
+	}
+}
+
+// Stop accepting clients and disconnect the connected ones
+func (g *Gateway) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+
+	err := g.listener.Close()
+	for s := range g.sessions {
+		s.close("Server shutting down")
+	}
+	return err
+}
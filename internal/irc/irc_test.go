@@ -0,0 +1,230 @@
+package irc
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/db/dbtest"
+	"bokkoli/internal/message"
+	"bokkoli/internal/message/messagetest"
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialGateway(t *testing.T, backend message.Backend, password string) *testClient {
+	gateway, err := Listen("127.0.0.1:0", backend, password)
+	if err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	t.Cleanup(func() { gateway.Close() })
+	go gateway.Serve()
+
+	conn, err := net.Dial("tcp", gateway.Addr())
+	if err != nil {
+		t.Fatal("Got an error dialing: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) write(lines ...string) {
+	for _, l := range lines {
+		if _, err := c.conn.Write([]byte(l + "\r\n")); err != nil {
+			c.t.Fatal("Got an error writing: ", err)
+		}
+	}
+}
+
+// Read lines until one contains every part, returning it
+func (c *testClient) expect(parts ...string) string {
+	c.t.Helper()
+	for {
+		raw, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("Got an error waiting for %q: %v", parts, err)
+		}
+		matched := true
+		for _, part := range parts {
+			matched = matched && strings.Contains(raw, part)
+		}
+		if matched {
+			return strings.TrimRight(raw, "\r\n")
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	node := messagetest.NewNode(t, "")
+	client := dialGateway(t, node, "")
+
+	client.write("CAP LS 302", "NICK alice", "USER alice 0 * :Alice", "CAP END")
+	client.expect(" 001 alice ")
+	client.expect(" 422 alice ")
+
+	if node.Username() != "alice" {
+		t.Errorf("Expected the nick to become the username, got %q", node.Username())
+	}
+
+	client.write("NICK alicia")
+	client.expect(":alice!alice@bokkoli NICK :alicia")
+	if node.Username() != "alicia" {
+		t.Errorf("Expected NICK to change the username, got %q", node.Username())
+	}
+
+	client.write("PING :12345")
+	client.expect("PONG", "12345")
+	client.write("FROB")
+	client.expect(" 421 alicia FROB ")
+}
+
+func TestPassword(t *testing.T) {
+	node := messagetest.NewNode(t, "")
+	client := dialGateway(t, node, "secret")
+
+	client.write("PASS wrong", "NICK alice", "USER alice 0 * :Alice")
+	client.expect(" 464 ")
+	client.expect("ERROR")
+
+	client = dialGateway(t, node, "secret")
+	client.write("PASS secret", "NICK alice", "USER alice 0 * :Alice")
+	client.expect(" 001 alice ")
+}
+
+func TestChannelsAndQueries(t *testing.T) {
+	bob := messagetest.NewNode(t, "bob")
+	if err := bob.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	aliceDb := dbtest.New(t)
+	alice := message.NewNode(aliceDb, "alice")
+	t.Cleanup(func() { alice.Close() })
+	if err := alice.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	if _, err := alice.Connect(messagetest.ListenPort(t, bob)); err != nil {
+		t.Fatal("Got an error connecting: ", err)
+	}
+	if _, err := bob.Connect(messagetest.ListenPort(t, alice)); err != nil {
+		t.Fatal("Got an error connecting back: ", err)
+	}
+	bobEvents, unsubscribe := bob.Subscribe()
+	defer unsubscribe()
+
+	client := dialGateway(t, alice, "")
+	client.write("NICK alice", "USER alice 0 * :Alice")
+	client.expect(" 001 alice ")
+
+	// Once bob has said something, his channel is joined and the conversation goes both ways
+	if _, err := bob.Send("", "hi alice"); err != nil {
+		t.Fatal("Got an error sending: ", err)
+	}
+	client.expect(":alice!alice@bokkoli JOIN :#bob")
+	client.expect(":bob!peer@bokkoli PRIVMSG #bob :hi alice")
+
+	client.write("PRIVMSG #bob :hello from irssi", "PRIVMSG bob :\x01ACTION waves\x01")
+	for _, text := range []string{"hello from irssi", "* waves"} {
+		for {
+			event := <-bobEvents
+			if event.Type == message.EventMessage && event.Incoming {
+				if event.Message.Text != text {
+					t.Errorf("Expected bob to receive %q, got %q", text, event.Message.Text)
+				}
+				break
+			}
+		}
+	}
+
+	stored, err := aliceDb.ReadMessages(db.MessageFilter{Peer: "bob"})
+	if err != nil {
+		t.Fatal("Got an error reading messages: ", err)
+	}
+	if len(stored) != 3 || stored[1].Text != "hello from irssi" || stored[1].Direction != db.Outgoing {
+		t.Errorf("Expected messages sent from IRC to be stored, got %+v", stored)
+	}
+
+	// After leaving the channel, bob's messages arrive as a query
+	client.write("PART #bob")
+	client.expect(":alice!alice@bokkoli PART :#bob")
+	if _, err := bob.Send("", "still there?"); err != nil {
+		t.Fatal("Got an error sending: ", err)
+	}
+	client.expect(":bob!peer@bokkoli PRIVMSG alice :still there?")
+
+	// Joining again replays the conversation
+	client.write("JOIN #bob")
+	client.expect(" 353 alice = #bob :alice bob")
+	client.expect("NOTICE #bob", "hi alice")
+
+	client.write("JOIN #carol", "PRIVMSG carol :anyone?")
+	client.expect(" 403 alice #carol ")
+	client.expect(" 401 alice carol ")
+}
+
+func TestControlNick(t *testing.T) {
+	node := messagetest.NewNode(t, "")
+	client := dialGateway(t, node, "")
+	client.write("NICK alice", "USER alice 0 * :Alice")
+	client.expect(" 001 alice ")
+
+	client.write("PRIVMSG bokkoli :listen 0")
+	line := client.expect(":bokkoli!peer@bokkoli NOTICE alice :Listening on port ")
+	if !strings.HasSuffix(line, " "+messagetest.ListenPort(t, node)) {
+		t.Errorf("Expected the port the node got, got %q", line)
+	}
+
+	client.write("PRIVMSG bokkoli :connect 20")
+	client.expect("NOTICE alice", "only ports")
+}
+
+func TestParseLine(t *testing.T) {
+	l, ok := parseLine(":nick!user@host PRIVMSG #bob :hello  there\r\n")
+	if !ok || l.prefix != "nick!user@host" || l.command != "PRIVMSG" || len(l.params) != 2 || l.params[1] != "hello  there" {
+		t.Errorf("Got %+v", l)
+	}
+
+	l, ok = parseLine("join #a,#b")
+	if !ok || l.command != "JOIN" || len(l.params) != 1 || l.params[0] != "#a,#b" {
+		t.Errorf("Got %+v", l)
+	}
+
+	if _, ok := parseLine(":prefixonly"); ok {
+		t.Error("Expected a line without a command to be rejected")
+	}
+}
+
+func TestToNick(t *testing.T) {
+	cases := map[string]string{
+		"bob":            "bob",
+		"localhost:8081": "localhost_8081",
+		"127.0.0.1:8081": "p127_0_0_1_8081",
+		"Bob Smith":      "Bob_Smith",
+		"":               "p",
+	}
+	for name, expected := range cases {
+		if nick := toNick(name); nick != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, nick)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	long := strings.Repeat("가", MAX_TEXT_SIZE)
+	for _, piece := range splitText(long) {
+		if len(piece) > MAX_TEXT_SIZE || !strings.HasPrefix(piece, "가") {
+			t.Errorf("Expected pieces split between characters, got %d bytes", len(piece))
+		}
+	}
+
+	pieces := splitText("first\nsecond\r\n\nthird")
+	if strings.Join(pieces, "|") != "first|second|third" {
+		t.Errorf("Expected one piece per line, got %q", pieces)
+	}
+}
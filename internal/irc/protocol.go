@@ -0,0 +1,147 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Lines are at most 512 bytes including CRLF; message text is split well below that to leave room for the prefix
+const (
+	MAX_LINE_SIZE int = 512
+	MAX_TEXT_SIZE int = 400
+)
+
+// Numeric replies used by the gateway, from RFC 2812
+const (
+	rplWelcome        string = "001"
+	rplYourHost       string = "002"
+	rplCreated        string = "003"
+	rplMyInfo         string = "004"
+	rplUModeIs        string = "221"
+	rplEndOfWho       string = "315"
+	rplChannelModeIs  string = "324"
+	rplTopic          string = "332"
+	rplNamReply       string = "353"
+	rplEndOfNames     string = "366"
+	errNoSuchNick     string = "401"
+	errNoSuchChannel  string = "403"
+	errCannotSend     string = "404"
+	errNoTextToSend   string = "412"
+	errUnknownCmd     string = "421"
+	errNoMotd         string = "422"
+	errNoNickGiven    string = "431"
+	errBadNick        string = "432"
+	errNotOnChannel   string = "442"
+	errNotRegistered  string = "451"
+	errNeedMoreArgs   string = "461"
+	errPasswdMismatch string = "464"
+)
+
+// One line of the protocol: [":" prefix " "] command {" " param} [" :" trailing]
+type line struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+func parseLine(raw string) (line, bool) {
+	raw = strings.TrimRight(raw, "\r\n")
+	var l line
+
+	if strings.HasPrefix(raw, ":") {
+		prefix, rest, ok := strings.Cut(raw[1:], " ")
+		if !ok {
+			return l, false
+		}
+		l.prefix, raw = prefix, rest
+	}
+
+	for raw != "" {
+		raw = strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(raw, ":") {
+			l.params = append(l.params, raw[1:])
+			break
+		}
+		param, rest, _ := strings.Cut(raw, " ")
+		if param != "" {
+			l.params = append(l.params, param)
+		}
+		raw = rest
+	}
+
+	if len(l.params) == 0 {
+		return l, false
+	}
+	l.command, l.params = strings.ToUpper(l.params[0]), l.params[1:]
+	return l, true
+}
+
+// Format a line, the last parameter is always sent as trailing so it may contain spaces
+func formatLine(prefix string, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, param := range params {
+		if i == len(params)-1 {
+			b.WriteString(" :" + param)
+		} else {
+			b.WriteString(" " + param)
+		}
+	}
+	return b.String()
+}
+
+// Make any Bokkoli username or address usable as an IRC nickname: letters, digits and []\`_^{|}-, not starting with a digit or '-'
+func toNick(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("[]\\`_^{|}-", r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	nick := b.String()
+	if nick == "" || nick[0] == '-' || nick[0] >= '0' && nick[0] <= '9' {
+		nick = "p" + nick
+	}
+	return nick
+}
+
+func validNick(nick string) bool {
+	return nick != "" && toNick(nick) == nick
+}
+
+// Split message text into pieces that fit on a line, never inside a UTF-8 sequence; line breaks start a new piece
+func splitText(text string) []string {
+	var pieces []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		for len(paragraph) > MAX_TEXT_SIZE {
+			cut := MAX_TEXT_SIZE
+			for cut > 0 && !utf8.RuneStart(paragraph[cut]) {
+				cut--
+			}
+			if space := strings.LastIndexByte(paragraph[:cut], ' '); space > MAX_TEXT_SIZE/2 {
+				cut = space + 1
+			}
+			pieces = append(pieces, paragraph[:cut])
+			paragraph = paragraph[cut:]
+		}
+		if paragraph != "" {
+			pieces = append(pieces, paragraph)
+		}
+	}
+	return pieces
+}
+
+// CTCP ACTION, what /me sends, becomes "* text" on the Bokkoli side
+func fromAction(text string) string {
+	if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+		return "* " + strings.TrimSuffix(action, "\x01")
+	}
+	return text
+}
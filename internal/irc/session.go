@@ -0,0 +1,503 @@
+package irc
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/message"
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Messages replayed when joining a peer's channel
+const REPLAY_SIZE int = 20
+
+// One connected IRC client
+type session struct {
+	gateway *Gateway
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	// Registration state, only touched by the goroutine reading from the client
+	password   string
+	user       string
+	registered bool
+
+	mu   sync.Mutex
+	nick string
+	// By channel name without the '#': true while joined, false once the client left it
+	joined map[string]bool
+}
+
+func newSession(g *Gateway, conn net.Conn) *session {
+	return &session{gateway: g, conn: conn, joined: make(map[string]bool)}
+}
+
+func (s *session) backend() message.Backend {
+	return s.gateway.backend
+}
+
+func (s *session) currentNick() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nick == "" {
+		return "*"
+	}
+	return s.nick
+}
+
+func (s *session) send(prefix string, command string, params ...string) {
+	raw := formatLine(prefix, command, params...)
+	if len(raw) > MAX_LINE_SIZE-2 {
+		raw = raw[:MAX_LINE_SIZE-2]
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.conn.Write([]byte(raw + "\r\n")); err != nil {
+		logger.Debug("could not write to IRC client", logging.KeyErr, err)
+	}
+}
+
+// Numeric reply from the server, addressed to the client's nick
+func (s *session) reply(numeric string, params ...string) {
+	s.send(SERVER_NAME, numeric, append([]string{s.currentNick()}, params...)...)
+}
+
+func (s *session) prefix() string {
+	return s.currentNick() + "!" + s.user + "@" + SERVER_NAME
+}
+
+func peerPrefix(nick string) string {
+	return nick + "!peer@" + SERVER_NAME
+}
+
+func (s *session) close(reason string) {
+	s.send("", "ERROR", "Closing link: "+reason)
+	s.conn.Close()
+}
+
+func (s *session) run() {
+	defer s.conn.Close()
+
+	var unsubscribe func()
+	defer func() {
+		if unsubscribe != nil {
+			unsubscribe()
+		}
+	}()
+
+	scanner := bufio.NewScanner(s.conn)
+	scanner.Buffer(make([]byte, 0, MAX_LINE_SIZE), 8*1024)
+	for scanner.Scan() {
+		l, ok := parseLine(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		if !s.registered {
+			if !s.register(l) {
+				return
+			}
+			if s.registered {
+				var events <-chan message.Event
+				events, unsubscribe = s.backend().Subscribe()
+				go s.forward(events)
+			}
+			continue
+		}
+
+		if !s.handle(l) {
+			return
+		}
+	}
+}
+
+// Handle a line before registration completes; false ends the session
+func (s *session) register(l line) bool {
+	switch l.command {
+	case "CAP":
+		// No capabilities are offered, clients carry on without them
+		if len(l.params) > 0 && strings.ToUpper(l.params[0]) == "LS" {
+			s.send(SERVER_NAME, "CAP", "*", "LS", "")
+		}
+	case "PASS":
+		if len(l.params) > 0 {
+			s.password = l.params[0]
+		}
+	case "NICK":
+		if len(l.params) == 0 {
+			s.reply(errNoNickGiven, "No nickname given")
+			return true
+		}
+		if !validNick(l.params[0]) || l.params[0] == CONTROL_NICK {
+			s.reply(errBadNick, l.params[0], "Erroneous nickname")
+			return true
+		}
+		s.mu.Lock()
+		s.nick = l.params[0]
+		s.mu.Unlock()
+	case "USER":
+		if len(l.params) < 4 {
+			s.reply(errNeedMoreArgs, "USER", "Not enough parameters")
+			return true
+		}
+		s.user = toNick(l.params[0])
+	case "PING":
+		s.send(SERVER_NAME, "PONG", append([]string{SERVER_NAME}, l.params...)...)
+	case "QUIT":
+		s.close("Quit")
+		return false
+	default:
+		s.reply(errNotRegistered, "You have not registered")
+	}
+
+	if s.user == "" || s.currentNick() == "*" {
+		return true
+	}
+
+	password := s.gateway.password
+	if password != "" && subtle.ConstantTimeCompare([]byte(s.password), []byte(password)) != 1 {
+		s.reply(errPasswdMismatch, "Password incorrect, it is printed by 'bokkoli api token'")
+		s.close("Bad password")
+		return false
+	}
+
+	// The IRC nick is the Bokkoli username peers see
+	if err := s.backend().SetUsername(s.currentNick()); err != nil {
+		s.close(err.Error())
+		return false
+	}
+	s.registered = true
+	s.welcome()
+	return true
+}
+
+func (s *session) welcome() {
+	s.reply(rplWelcome, "Welcome to Bokkoli, "+s.prefix())
+	s.reply(rplYourHost, "Your host is "+SERVER_NAME+", a gateway to your Bokkoli peers")
+	s.reply(rplCreated, "This server was created for you just now")
+	s.reply(rplMyInfo, SERVER_NAME, "bokkoli", "i", "nt")
+	s.reply(errNoMotd, "MOTD File is missing")
+
+	s.control("Every peer is a channel: /join #name to chat with it, or /msg name for a query.")
+	s.control("/msg " + CONTROL_NICK + " help lists the commands for connecting to peers.")
+	s.listPeers()
+}
+
+// Handle a line from a registered client; false ends the session
+func (s *session) handle(l line) bool {
+	switch l.command {
+	case "PING":
+		s.send(SERVER_NAME, "PONG", append([]string{SERVER_NAME}, l.params...)...)
+	case "PONG", "CAP":
+	case "QUIT":
+		s.close("Quit")
+		return false
+	case "NICK":
+		s.changeNick(l)
+	case "JOIN":
+		if len(l.params) == 0 {
+			s.reply(errNeedMoreArgs, "JOIN", "Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(l.params[0], ",") {
+			s.join(channel, true)
+		}
+	case "PART":
+		if len(l.params) == 0 {
+			s.reply(errNeedMoreArgs, "PART", "Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(l.params[0], ",") {
+			s.part(channel)
+		}
+	case "PRIVMSG":
+		if len(l.params) < 2 || l.params[1] == "" {
+			s.reply(errNoTextToSend, "No text to send")
+			return true
+		}
+		s.privmsg(l.params[0], fromAction(l.params[1]))
+	case "NOTICE":
+		// Never answered, as the protocol requires
+	case "MODE":
+		if len(l.params) > 0 && strings.HasPrefix(l.params[0], "#") {
+			s.reply(rplChannelModeIs, l.params[0], "+nt")
+		} else {
+			s.reply(rplUModeIs, "+i")
+		}
+	case "WHO":
+		target := "*"
+		if len(l.params) > 0 {
+			target = l.params[0]
+		}
+		s.reply(rplEndOfWho, target, "End of WHO list")
+	default:
+		s.reply(errUnknownCmd, l.command, "Unknown command")
+	}
+	return true
+}
+
+func (s *session) changeNick(l line) {
+	if len(l.params) == 0 {
+		s.reply(errNoNickGiven, "No nickname given")
+		return
+	}
+	nick := l.params[0]
+	if !validNick(nick) || nick == CONTROL_NICK {
+		s.reply(errBadNick, nick, "Erroneous nickname")
+		return
+	}
+	if err := s.backend().SetUsername(nick); err != nil {
+		s.control("Could not change your username: " + err.Error())
+		return
+	}
+
+	old := s.prefix()
+	s.mu.Lock()
+	s.nick = nick
+	s.mu.Unlock()
+	s.send(old, "NICK", nick)
+}
+
+// Name a peer goes by in history and on IRC: its username when known, else its address
+func peerName(peer message.PeerInfo) string {
+	if peer.Name != "" {
+		return peer.Name
+	}
+	return peer.Address
+}
+
+// Connected peer behind a nick or channel name, preferring connections we opened since only those can be sent to
+func (s *session) resolve(nick string) (message.PeerInfo, bool) {
+	status, err := s.backend().Status()
+	if err != nil {
+		return message.PeerInfo{}, false
+	}
+
+	var found message.PeerInfo
+	ok := false
+	for _, peer := range status.Peers {
+		if toNick(peerName(peer)) == nick && (!ok || found.Incoming) {
+			found, ok = peer, true
+		}
+	}
+	return found, ok
+}
+
+// Join a peer's channel, replaying recent history when the client asked for it
+func (s *session) join(channel string, replay bool) bool {
+	name, ok := strings.CutPrefix(channel, "#")
+	if !ok || name == "" {
+		s.reply(errNoSuchChannel, channel, "Channels are named after peers, e.g. #alice")
+		return false
+	}
+	peer, ok := s.resolve(name)
+	if !ok {
+		s.reply(errNoSuchChannel, channel, "Not connected to "+name+", try /msg "+CONTROL_NICK+" connect <address>")
+		return false
+	}
+
+	s.mu.Lock()
+	already := s.joined[name]
+	s.joined[name] = true
+	s.mu.Unlock()
+	if already {
+		return true
+	}
+
+	s.send(s.prefix(), "JOIN", channel)
+	s.reply(rplTopic, channel, "Bokkoli conversation with "+peerName(peer))
+	s.reply(rplNamReply, "=", channel, s.currentNick()+" "+name)
+	s.reply(rplEndOfNames, channel, "End of NAMES list")
+
+	if !replay {
+		return true
+	}
+	history, err := s.backend().History(db.MessageFilter{Peer: peerName(peer), Limit: REPLAY_SIZE})
+	if err != nil {
+		logger.Warn("could not read history for an IRC channel", logging.KeyErr, err)
+		return true
+	}
+	for _, msg := range history {
+		from := peerPrefix(name)
+		if msg.Direction == db.Outgoing {
+			from = s.prefix()
+		}
+		for _, piece := range splitText(msg.Text) {
+			s.send(from, "NOTICE", channel, "["+msg.Timestamp.Local().Format("15:04")+"] "+piece)
+		}
+	}
+	return true
+}
+
+func (s *session) part(channel string) {
+	name := strings.TrimPrefix(channel, "#")
+
+	s.mu.Lock()
+	joined := s.joined[name]
+	if joined {
+		s.joined[name] = false
+	}
+	s.mu.Unlock()
+
+	if !joined {
+		s.reply(errNotOnChannel, channel, "You're not on that channel")
+		return
+	}
+	s.send(s.prefix(), "PART", channel)
+}
+
+func (s *session) privmsg(target string, text string) {
+	if target == CONTROL_NICK {
+		s.command(text)
+		return
+	}
+
+	name, isChannel := strings.CutPrefix(target, "#")
+	peer, ok := s.resolve(name)
+	if !ok {
+		if isChannel {
+			s.reply(errCannotSend, target, "Not connected to "+name)
+		} else {
+			s.reply(errNoSuchNick, target, "Not connected to "+name)
+		}
+		return
+	}
+
+	if peer.Incoming {
+		s.reply(errCannotSend, target, name+" connected to you, /msg "+CONTROL_NICK+" connect <their address> to reply")
+		return
+	}
+
+	// Goes through the normal send path, which stores the message
+	if _, err := s.backend().Send(peer.Address, text); err != nil {
+		s.reply(errCannotSend, target, err.Error())
+	}
+}
+
+// Commands sent to the control nick
+func (s *session) command(text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "connect":
+		if len(fields) != 2 {
+			s.control("Usage: connect <address>")
+			return
+		}
+		address, err := s.backend().Connect(fields[1])
+		if err != nil {
+			s.control(err.Error())
+			return
+		}
+		s.control("Connected to " + address + ", /join #" + toNick(address) + " or wait for them to say hello")
+	case "listen":
+		if len(fields) != 2 {
+			s.control("Usage: listen <port>")
+			return
+		}
+		if err := s.backend().Listen(fields[1]); err != nil {
+			s.control(err.Error())
+			return
+		}
+		// The port the backend got, which differs when "0" asked for any free one
+		port := fields[1]
+		if status, err := s.backend().Status(); err == nil {
+			if _, listening, err := net.SplitHostPort(status.ListenAddress); err == nil {
+				port = listening
+			}
+		}
+		s.control("Listening on port " + port)
+	case "status", "peers":
+		s.listPeers()
+	default:
+		s.control("Commands: connect <address>, listen <port>, status")
+	}
+}
+
+func (s *session) control(text string) {
+	s.send(peerPrefix(CONTROL_NICK), "NOTICE", s.currentNick(), text)
+}
+
+func (s *session) listPeers() {
+	status, err := s.backend().Status()
+	if err != nil {
+		s.control(err.Error())
+		return
+	}
+
+	if status.ListenAddress != "" {
+		s.control("Listening on " + status.ListenAddress)
+	}
+	if len(status.Peers) == 0 {
+		s.control("No peers connected")
+		return
+	}
+
+	var lines []string
+	for _, peer := range status.Peers {
+		direction := "outgoing"
+		if peer.Incoming {
+			direction = "incoming"
+		}
+		lines = append(lines, fmt.Sprintf("#%s (%s, %s)", toNick(peerName(peer)), peer.Address, direction))
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		s.control(l)
+	}
+}
+
+// Relay backend events to the client until the subscription ends
+func (s *session) forward(events <-chan message.Event) {
+	for event := range events {
+		switch event.Type {
+		case message.EventMessage:
+			if !event.Incoming || event.Message == nil {
+				continue
+			}
+			name := event.Name
+			if name == "" {
+				name = event.Peer
+			}
+			nick := toNick(name)
+
+			// A conversation shows up as its channel, unless the client left it; then it is a query
+			s.mu.Lock()
+			joined, known := s.joined[nick]
+			s.mu.Unlock()
+
+			target := s.currentNick()
+			if (joined || !known) && s.join("#"+nick, false) {
+				target = "#" + nick
+			}
+			for _, piece := range splitText(event.Message.Text) {
+				s.send(peerPrefix(nick), "PRIVMSG", target, piece)
+			}
+		case message.EventDisconnected:
+			name := event.Name
+			if name == "" {
+				name = event.Peer
+			}
+			nick := toNick(name)
+			s.mu.Lock()
+			joined := s.joined[nick]
+			s.mu.Unlock()
+			if joined {
+				s.send(peerPrefix(CONTROL_NICK), "NOTICE", "#"+nick, name+" disconnected")
+			}
+		case message.EventError:
+			s.control(event.Error)
+		case message.EventRejected:
+			s.control("rejected " + event.Peer + ": " + event.Error)
+		}
+	}
+}
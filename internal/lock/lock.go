@@ -0,0 +1,61 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrLocked = errors.New("already in use")
+
+// Exclusive claim on a file, held until Release or until the process exits
+type Lock struct {
+	file *os.File
+	path string
+}
+
+// Claim the lock file without waiting, failing with ErrLocked when another process holds it.
+// The holder's PID is written to the file so the error can say who has it.
+func Acquire(path string) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, ErrLocked) {
+			if pid := readPid(path); pid != 0 {
+				return nil, fmt.Errorf("%w by process %d", ErrLocked, pid)
+			}
+		}
+		return nil, err
+	}
+
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{file: file, path: path}, nil
+}
+
+func readPid(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package lock
+
+import "os"
+
+// Profiles are not locked on platforms without flock
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
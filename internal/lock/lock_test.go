@@ -0,0 +1,38 @@
+//go:build unix
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcquireTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	first, err := Acquire(path)
+	if err != nil {
+		t.Fatal("Got an error on the first acquire: ", err)
+	}
+
+	_, err = Acquire(path)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	if !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("Expected the holder's PID in %q", err)
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatal("Got an error releasing: ", err)
+	}
+	second, err := Acquire(path)
+	if err != nil {
+		t.Fatal("Expected the lock to be free after a release, got: ", err)
+	}
+	second.Release()
+}
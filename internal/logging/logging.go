@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Subsystems, each logs with a "subsystem" attribute so the log can be filtered by it
+const (
+	NET    string = "net"
+	DB     string = "db"
+	UI     string = "ui"
+	DAEMON string = "daemon"
+	API    string = "api"
+	IRC    string = "irc"
+	BOT    string = "bot"
+	PLUGIN string = "plugin"
+)
+
+// Attribute keys that are redacted unless protocol tracing is on; use them for anything that holds
+// message content or a peer's address. Errors keep their message, minus the addresses in it.
+const (
+	KeyText  string = "text"
+	KeyFrame string = "frame"
+	KeyPeer  string = "peer"
+	KeyAddr  string = "addr"
+	KeyErr   string = "err"
+)
+
+// What a network error can say about a peer: IPv4 and bracketed IPv6 addresses with an optional port, and the
+// host of a failed lookup
+var addressPattern = regexp.MustCompile(`\[[0-9A-Fa-f:.%]+\](:\d+)?|\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b|\blookup [^\s:]+`)
+
+// Until Setup is called, e.g. in tests, nothing is written
+var (
+	root    atomic.Pointer[slog.Handler]
+	tracing atomic.Bool
+)
+
+func init() {
+	var discard slog.Handler = slog.NewTextHandler(io.Discard, nil)
+	root.Store(&discard)
+}
+
+// Send every logger, including the standard library's log package, to w.
+// With trace on, message content and addresses are logged as they are and protocol frames are logged at debug level.
+func Setup(w io.Writer, level slog.Level, trace bool) {
+	if trace {
+		level = slog.LevelDebug
+	}
+	tracing.Store(trace)
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	var handler slog.Handler = slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if trace {
+				return attr
+			}
+			return redact(attr, salt)
+		},
+	})
+	root.Store(&handler)
+	slog.SetDefault(slog.New(&forwardHandler{}))
+}
+
+// Whether verbose protocol tracing was asked for
+func Tracing() bool {
+	return tracing.Load()
+}
+
+// Logger for a subsystem. Safe to keep in a package variable, it follows later calls to Setup.
+func For(subsystem string) *slog.Logger {
+	return slog.New(&forwardHandler{}).With("subsystem", subsystem)
+}
+
+// Log at error level and exit, for failures the program cannot continue after
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	fmt.Fprintln(os.Stderr, "fatal:", msg)
+	os.Exit(1)
+}
+
+func redact(attr slog.Attr, salt []byte) slog.Attr {
+	switch attr.Key {
+	case KeyText, KeyFrame:
+		attr.Value = slog.StringValue(fmt.Sprintf("[%d bytes redacted]", len(attr.Value.String())))
+	case KeyPeer, KeyAddr:
+		if value := attr.Value.String(); value != "" {
+			attr.Value = slog.StringValue(pseudonym(value, salt))
+		}
+	case KeyErr:
+		attr.Value = slog.StringValue(addressPattern.ReplaceAllStringFunc(attr.Value.String(), func(address string) string {
+			if host, found := strings.CutPrefix(address, "lookup "); found {
+				return "lookup " + pseudonym(host, salt)
+			}
+			return pseudonym(address, salt)
+		}))
+	}
+	return attr
+}
+
+// Stable within one run so a peer can be followed through the log, meaningless outside of it
+func pseudonym(value string, salt []byte) string {
+	hash := sha256.Sum256(append(salt, value...))
+	return "peer-" + hex.EncodeToString(hash[:4])
+}
+
+// Hands records to whatever handler Setup installed last, replaying attributes and groups added with With
+type forwardHandler struct {
+	apply []func(slog.Handler) slog.Handler
+}
+
+func (h *forwardHandler) handler() slog.Handler {
+	handler := *root.Load()
+	for _, apply := range h.apply {
+		handler = apply(handler)
+	}
+	return handler
+}
+
+func (h *forwardHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return (*root.Load()).Enabled(ctx, level)
+}
+
+func (h *forwardHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+func (h *forwardHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *forwardHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *forwardHandler) with(apply func(slog.Handler) slog.Handler) slog.Handler {
+	return &forwardHandler{apply: append(append([]func(slog.Handler) slog.Handler{}, h.apply...), apply)}
+}
@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	// Created before Setup, like the package-level loggers
+	logger := For(NET)
+
+	var output bytes.Buffer
+	Setup(&output, slog.LevelInfo, false)
+	t.Cleanup(func() { Setup(&bytes.Buffer{}, slog.LevelInfo, false) })
+
+	logger.Info("message received", KeyText, "secret plans", KeyPeer, "10.0.0.5:8080")
+	logger.Debug("not at this level")
+
+	line := output.String()
+	if strings.Contains(line, "secret plans") || strings.Contains(line, "10.0.0.5") {
+		t.Errorf("Expected content and address to be redacted, got %q", line)
+	}
+	for _, expected := range []string{"subsystem=net", "[12 bytes redacted]", "peer=peer-"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected %q in %q", expected, line)
+		}
+	}
+	if strings.Contains(line, "not at this level") {
+		t.Errorf("Expected debug to be filtered at info level, got %q", line)
+	}
+}
+
+func TestErrorRedaction(t *testing.T) {
+	logger := For(NET)
+
+	var output bytes.Buffer
+	Setup(&output, slog.LevelInfo, false)
+	t.Cleanup(func() { Setup(&bytes.Buffer{}, slog.LevelInfo, false) })
+
+	// A port nobody listens on anymore, so dialing it fails with a *net.OpError naming the address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, err = net.Dial("tcp", address)
+	if err == nil {
+		t.Fatal("Expected dialing a closed port to fail")
+	}
+	if !strings.Contains(err.Error(), address) {
+		t.Fatalf("Expected the dial error to name %s, got %q", address, err)
+	}
+
+	logger.Warn("could not send message", KeyPeer, address, KeyErr, err)
+	logger.Warn("could not connect", KeyErr, errors.New("dial tcp: lookup friend.example on [::1]:53: no such host"))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", output.String())
+	}
+	for _, leaked := range []string{"127.0.0.1", address, "friend.example", "::1"} {
+		if strings.Contains(output.String(), leaked) {
+			t.Errorf("Expected %s to be redacted, got %q", leaked, output.String())
+		}
+	}
+	// The address in the error gets the same pseudonym as the peer, so the two can still be matched up
+	peer := strings.TrimPrefix(regexp.MustCompile(`peer=peer-[0-9a-f]+`).FindString(lines[0]), "peer=")
+	if peer == "" || strings.Count(lines[0], peer) != 2 {
+		t.Errorf("Expected the peer's pseudonym in the error too, got %q", lines[0])
+	}
+	if !strings.Contains(lines[0], "connection refused") || !strings.Contains(lines[1], "no such host") {
+		t.Errorf("Expected the rest of the errors to be kept, got %q", output.String())
+	}
+}
+
+func TestTracing(t *testing.T) {
+	logger := For(NET)
+
+	var output bytes.Buffer
+	Setup(&output, slog.LevelError, true)
+	t.Cleanup(func() { Setup(&bytes.Buffer{}, slog.LevelInfo, false) })
+
+	if !Tracing() {
+		t.Fatal("Expected tracing to be on")
+	}
+	logger.Debug("frame sent", KeyFrame, `{"text":"hi"}`, KeyPeer, "localhost:8080")
+
+	line := output.String()
+	if !strings.Contains(line, "localhost:8080") || !strings.Contains(line, `hi`) {
+		t.Errorf("Expected frames in full at debug level while tracing, got %q", line)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	file, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal("Got an error opening: ", err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"first...\n", "second..\n", "third...\n", "fourth..\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal("Got an error writing: ", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth..\n",
+		path + ".1": "third...\n",
+		path + ".2": "second..\n",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("%s: expected %q, got %q (%v)", filepath.Base(name), content, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("Expected only 2 rotated files to be kept")
+	}
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const MEGABYTE int64 = 1024 * 1024
+
+// Log file that is renamed to path.1 once it grows past maxSize, shifting older ones up to path.<backups>
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	if r.backups > 0 {
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
@@ -1,6 +1,7 @@
 package login
 
 import (
+	"bokkoli/internal/theme"
 	"fmt"
 	"strings"
 
@@ -12,6 +13,21 @@ type Model struct {
 	Cursor   int
 	choices  []string
 	selected map[int]struct{}
+	// Asking for the passphrase of an encrypted profile before showing the menu
+	locked     bool
+	passphrase string
+	unlocking  bool
+	err        string
+}
+
+// Sent when the passphrase was entered, answer with UnlockedMsg
+type UnlockMsg struct {
+	Passphrase string
+}
+
+// Outcome of unlocking, the menu is shown once it succeeded and the passphrase asked again otherwise
+type UnlockedMsg struct {
+	Err error
 }
 
 func New() Model {
@@ -21,11 +37,26 @@ func New() Model {
 	}
 }
 
+// Start with the unlock screen, for a profile protected by a passphrase
+func NewLocked() Model {
+	m := New()
+	m.locked = true
+	return m
+}
+
+func (m Model) Locked() bool {
+	return m.locked
+}
+
 func (m Model) Init() tea.Cmd {
 	return tea.SetWindowTitle("start here")
 }
 
 func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
+	if m.locked {
+		return m.updateLocked(msg)
+	}
+
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
@@ -49,16 +80,76 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 	return m, nil
 }
 
+// Collect the passphrase; it is only handed out once, nothing is typed while it is being checked
+func (m Model) updateLocked(msg tea.Msg) (Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case UnlockedMsg:
+		m.unlocking = false
+		m.passphrase = ""
+		if msg.Err != nil {
+			m.err = msg.Err.Error()
+			return m, nil
+		}
+		m.locked = false
+		m.err = ""
+	case tea.KeyMsg:
+		if m.unlocking {
+			return m, nil
+		}
+		switch msg.Type {
+		case tea.KeyCtrlC:
+			return m, tea.Quit
+		case tea.KeyEnter:
+			if m.passphrase == "" {
+				return m, nil
+			}
+			m.unlocking = true
+			passphrase := m.passphrase
+			return m, func() tea.Msg { return UnlockMsg{Passphrase: passphrase} }
+		case tea.KeyBackspace:
+			if runes := []rune(m.passphrase); len(runes) > 0 {
+				m.passphrase = string(runes[:len(runes)-1])
+			}
+		case tea.KeySpace:
+			m.passphrase += " "
+		case tea.KeyRunes:
+			m.passphrase += string(msg.Runes)
+		}
+	}
+	return m, nil
+}
+
+func (m Model) lockedView() string {
+	s := strings.Builder{}
+	s.WriteString("🥦 Bokkoli 🥦 \n\n")
+	s.WriteString("Enter your passphrase\n\n")
+
+	dots := strings.Repeat("•", min(len([]rune(m.passphrase)), 16))
+	s.WriteString(lipgloss.NewStyle().Foreground(theme.Current().Selected).Render("> "+dots) + "\n")
+
+	switch {
+	case m.unlocking:
+		s.WriteString(lipgloss.NewStyle().Foreground(theme.Current().Muted).Render("unlocking…"))
+	case m.err != "":
+		s.WriteString(lipgloss.NewStyle().Foreground(theme.Current().Error).Render(m.err))
+	}
+	return s.String()
+}
+
 func (m Model) View() string {
+	if m.locked {
+		return m.lockedView()
+	}
+
 	s := strings.Builder{}
 	s.WriteString("🥦 Bokkoli 🥦 \n\n")
 
 	selectedStyle := lipgloss.NewStyle().
-		Foreground(lipgloss.Color("34")).
+		Foreground(theme.Current().Selected).
 		Bold(true)
 
 	defaultStyle := lipgloss.NewStyle().
-		Foreground(lipgloss.Color("240"))
+		Foreground(theme.Current().Muted)
 
 	for i := 0; i < len(m.choices); i++ {
 		itemStyle := defaultStyle
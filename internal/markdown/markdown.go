@@ -0,0 +1,424 @@
+package markdown
+
+import (
+	"bokkoli/internal/theme"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/quick"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/rivo/uniseg"
+)
+
+const (
+	FENCE       string = "```"
+	BULLET      string = "•"
+	QUOTE_BAR   string = "│ "
+	CODE_BAR    string = "┃ "
+	INDENT_SIZE int    = 2
+	// Cells a tab in a code block takes, as lipgloss draws it
+	TAB_WIDTH int = 4
+)
+
+var (
+	bulletItem   = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	numberedItem = regexp.MustCompile(`^(\s*)(\d+)[.)]\s+(.*)$`)
+	quoteLine    = regexp.MustCompile(`^\s*>\s?(.*)$`)
+)
+
+type blockKind int
+
+const (
+	paragraph blockKind = iota
+	quote
+	bulletList
+	numberedList
+	code
+)
+
+type block struct {
+	kind     blockKind
+	text     string
+	language string
+	marker   string
+	indent   int
+}
+
+// Render Markdown text into styled terminal output no wider than width cells.
+// Fenced code blocks keep their whitespace and are syntax highlighted, every other block is reflowed.
+// Code lines wider than the message wrap at the edge instead of being cut off.
+func Render(text string, width int, t theme.Theme) string {
+	var rendered []string
+	for _, b := range parseBlocks(text) {
+		rendered = append(rendered, renderBlock(b, width, t))
+	}
+
+	return strings.Join(rendered, "\n")
+}
+
+func parseBlocks(text string) []block {
+	var blocks []block
+	var current *block
+
+	flush := func() {
+		if current != nil {
+			blocks = append(blocks, *current)
+			current = nil
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, FENCE) {
+			flush()
+			fenced := block{kind: code, language: strings.TrimSpace(strings.TrimPrefix(trimmed, FENCE))}
+
+			var body []string
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != FENCE; i++ {
+				body = append(body, lines[i])
+			}
+			fenced.text = strings.Join(body, "\n")
+			blocks = append(blocks, fenced)
+			continue
+		}
+
+		if trimmed == "" {
+			flush()
+			continue
+		}
+
+		if match := quoteLine.FindStringSubmatch(line); match != nil {
+			if current != nil && current.kind == quote {
+				current.text += " " + match[1]
+				continue
+			}
+			flush()
+			current = &block{kind: quote, text: match[1]}
+			continue
+		}
+
+		if match := bulletItem.FindStringSubmatch(line); match != nil {
+			flush()
+			current = &block{kind: bulletList, text: match[2], marker: BULLET, indent: len(match[1]) / INDENT_SIZE}
+			continue
+		}
+
+		if match := numberedItem.FindStringSubmatch(line); match != nil {
+			flush()
+			current = &block{kind: numberedList, text: match[3], marker: match[2] + ".", indent: len(match[1]) / INDENT_SIZE}
+			continue
+		}
+
+		// Lazy continuation of the previous paragraph, list item or quote
+		if current != nil {
+			current.text += " " + trimmed
+			continue
+		}
+		current = &block{kind: paragraph, text: trimmed}
+	}
+	flush()
+
+	return blocks
+}
+
+func renderBlock(b block, width int, t theme.Theme) string {
+	switch b.kind {
+	case code:
+		return renderCode(b.text, b.language, width, t)
+	case quote:
+		bar := lipgloss.NewStyle().Foreground(t.Muted).Render(QUOTE_BAR)
+		lines := wrapSpans(parseInline(b.text, style{italic: true}), width-uniseg.StringWidth(QUOTE_BAR), t)
+		for i, line := range lines {
+			lines[i] = bar + line
+		}
+		return strings.Join(lines, "\n")
+	case bulletList, numberedList:
+		indent := strings.Repeat(" ", b.indent*INDENT_SIZE)
+		marker := lipgloss.NewStyle().Foreground(t.Highlight).Render(b.marker) + " "
+		hanging := indent + strings.Repeat(" ", uniseg.StringWidth(b.marker)+1)
+
+		lines := wrapSpans(parseInline(b.text, style{}), width-uniseg.StringWidth(hanging), t)
+		for i, line := range lines {
+			if i == 0 {
+				lines[i] = indent + marker + line
+			} else {
+				lines[i] = hanging + line
+			}
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return strings.Join(wrapSpans(parseInline(b.text, style{}), width, t), "\n")
+	}
+}
+
+// Code is never reflowed, lines longer than the message are broken at the edge and go on after the bar
+func renderCode(source string, language string, width int, t theme.Theme) string {
+	source = strings.ReplaceAll(source, "\t", strings.Repeat(" ", TAB_WIDTH))
+	highlighted := highlight(source, language)
+	bar := lipgloss.NewStyle().Foreground(t.Border).Render(CODE_BAR)
+	width = max(width-uniseg.StringWidth(CODE_BAR), 1)
+
+	var lines []string
+	for _, line := range strings.Split(highlighted, "\n") {
+		for _, part := range strings.Split(ansi.Hardwrap(line, width, true), "\n") {
+			lines = append(lines, bar+part)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func highlight(source string, language string) string {
+	if language == "" {
+		return source
+	}
+
+	chromaStyle := "github"
+	if lipgloss.HasDarkBackground() {
+		chromaStyle = "monokai"
+	}
+
+	var highlighted strings.Builder
+	if err := quick.Highlight(&highlighted, source, language, "terminal256", chromaStyle); err != nil {
+		return source
+	}
+
+	// Chroma keeps a trailing newline when the source has one, the block layout adds its own
+	return strings.TrimSuffix(highlighted.String(), "\n")
+}
+
+type style struct {
+	bold   bool
+	italic bool
+	code   bool
+}
+
+func (s style) render(text string, t theme.Theme) string {
+	if s == (style{}) {
+		return text
+	}
+
+	rendered := lipgloss.NewStyle().Bold(s.bold).Italic(s.italic)
+	if s.code {
+		rendered = rendered.Foreground(t.Highlight)
+	}
+	return rendered.Render(text)
+}
+
+type span struct {
+	text  string
+	style style
+}
+
+// Parse inline emphasis and code spans. Unmatched delimiters are kept as literal text.
+func parseInline(text string, base style) []span {
+	var spans []span
+	var plain strings.Builder
+
+	emit := func() {
+		if plain.Len() > 0 {
+			spans = append(spans, span{text: plain.String(), style: base})
+			plain.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		if c == '\\' && i+1 < len(text) && strings.ContainsRune("\\`*_", rune(text[i+1])) {
+			plain.WriteByte(text[i+1])
+			i++
+			continue
+		}
+
+		if c == '`' {
+			if end := strings.IndexByte(text[i+1:], '`'); end > 0 {
+				emit()
+				codeStyle := base
+				codeStyle.code = true
+				spans = append(spans, span{text: text[i+1 : i+1+end], style: codeStyle})
+				i += end + 1
+				continue
+			}
+		}
+
+		if (c == '*' || c == '_') && i+1 < len(text) && text[i+1] == c {
+			delimiter := text[i : i+2]
+			if end := strings.Index(text[i+2:], delimiter); end > 0 && opens(text, i, 2) {
+				emit()
+				boldStyle := base
+				boldStyle.bold = true
+				spans = append(spans, parseInline(text[i+2:i+2+end], boldStyle)...)
+				i += end + 3
+				continue
+			}
+		}
+
+		if c == '*' || c == '_' {
+			if end := closing(text, i); end > 0 && opens(text, i, 1) {
+				emit()
+				italicStyle := base
+				italicStyle.italic = true
+				spans = append(spans, parseInline(text[i+1:end], italicStyle)...)
+				i = end
+				continue
+			}
+		}
+
+		plain.WriteByte(c)
+	}
+	emit()
+
+	return spans
+}
+
+// Underscores inside words, as in snake_case, never start emphasis
+func opens(text string, i int, size int) bool {
+	if i+size >= len(text) || text[i+size] == ' ' {
+		return false
+	}
+	if text[i] == '_' && i > 0 && isWordByte(text[i-1]) {
+		return false
+	}
+	return true
+}
+
+// Index of the single delimiter closing the one at i, or -1
+func closing(text string, i int) int {
+	delimiter := text[i]
+	for j := i + 2; j < len(text); j++ {
+		if text[j] != delimiter || text[j-1] == ' ' {
+			continue
+		}
+		if j+1 < len(text) && text[j+1] == delimiter {
+			j++
+			continue
+		}
+		if delimiter == '_' && j+1 < len(text) && isWordByte(text[j+1]) {
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// A word made of one or more differently styled fragments, e.g. "**bold**ly"
+type word []span
+
+func (w word) width() int {
+	width := 0
+	for _, fragment := range w {
+		width += uniseg.StringWidth(fragment.text)
+	}
+	return width
+}
+
+func (w word) render(t theme.Theme) string {
+	var rendered strings.Builder
+	for _, fragment := range w {
+		rendered.WriteString(fragment.style.render(fragment.text, t))
+	}
+	return rendered.String()
+}
+
+func splitWords(spans []span) []word {
+	var words []word
+	var current word
+
+	for _, s := range spans {
+		parts := strings.Split(s.text, " ")
+		for i, part := range parts {
+			if i > 0 && len(current) > 0 {
+				words = append(words, current)
+				current = nil
+			}
+			if part != "" {
+				current = append(current, span{text: part, style: s.style})
+			}
+		}
+	}
+
+	if len(current) > 0 {
+		words = append(words, current)
+	}
+	return words
+}
+
+// Wrap styled spans on spaces, measuring plain display width so styling never affects where lines break.
+// Words wider than the line are broken between grapheme clusters.
+func wrapSpans(spans []span, width int, t theme.Theme) []string {
+	width = max(width, 1)
+
+	var lines []string
+	var line strings.Builder
+	lineWidth := 0
+
+	for _, w := range splitWords(spans) {
+		for _, piece := range breakWord(w, width) {
+			pieceWidth := piece.width()
+
+			if lineWidth > 0 && lineWidth+1+pieceWidth > width {
+				lines = append(lines, line.String())
+				line.Reset()
+				lineWidth = 0
+			}
+
+			if lineWidth > 0 {
+				line.WriteString(" ")
+				lineWidth++
+			}
+			line.WriteString(piece.render(t))
+			lineWidth += pieceWidth
+		}
+	}
+
+	if lineWidth > 0 || len(lines) == 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+func breakWord(w word, width int) []word {
+	if w.width() <= width {
+		return []word{w}
+	}
+
+	var pieces []word
+	var piece word
+	pieceWidth := 0
+
+	for _, fragment := range w {
+		state := -1
+		rest := fragment.text
+		for len(rest) > 0 {
+			var cluster string
+			var clusterWidth int
+			cluster, rest, clusterWidth, state = uniseg.FirstGraphemeClusterInString(rest, state)
+
+			if pieceWidth+clusterWidth > width && pieceWidth > 0 {
+				pieces = append(pieces, piece)
+				piece = nil
+				pieceWidth = 0
+			}
+
+			if n := len(piece); n > 0 && piece[n-1].style == fragment.style {
+				piece[n-1].text += cluster
+			} else {
+				piece = append(piece, span{text: cluster, style: fragment.style})
+			}
+			pieceWidth += clusterWidth
+		}
+	}
+
+	if len(piece) > 0 {
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
@@ -0,0 +1,115 @@
+package markdown
+
+import (
+	"bokkoli/internal/theme"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/rivo/uniseg"
+)
+
+var ansiEscape = regexp.MustCompile(fmt.Sprintf("%c\\[[0-9;]*m", 0x1b))
+
+// Rendered output with all styling removed, so tests only check the layout
+func renderPlain(text string, width int) string {
+	return ansiEscape.ReplaceAllString(Render(text, width, theme.Current()), "")
+}
+
+func TestParseInline(t *testing.T) {
+	spans := parseInline("plain **bold** *italic* `code` snake_case_name", style{})
+
+	expected := []span{
+		{text: "plain ", style: style{}},
+		{text: "bold", style: style{bold: true}},
+		{text: " ", style: style{}},
+		{text: "italic", style: style{italic: true}},
+		{text: " ", style: style{}},
+		{text: "code", style: style{code: true}},
+		{text: " snake_case_name", style: style{}},
+	}
+
+	if fmt.Sprint(expected) != fmt.Sprint(spans) {
+		t.Errorf("Expected \n%v\n, got \n%v", expected, spans)
+	}
+}
+
+func TestParseInlineUnmatchedDelimiters(t *testing.T) {
+	spans := parseInline("2 * 3 = 6 and a lone ` backtick", style{})
+
+	if len(spans) != 1 || spans[0].text != "2 * 3 = 6 and a lone ` backtick" {
+		t.Errorf("Expected a single plain span, got %v", spans)
+	}
+}
+
+func TestRenderParagraphStripsMarkers(t *testing.T) {
+	expected := "some bold and\nitalic text"
+	result := renderPlain("some **bold** and _italic_ text", 14)
+
+	if expected != result {
+		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
+	}
+}
+
+func TestRenderListsAndQuotes(t *testing.T) {
+	text := "- first item wraps around\n- second\n  - nested\n1. numbered\n> quoted words"
+	expected := strings.Join([]string{
+		"• first item",
+		"  wraps around",
+		"• second",
+		"  • nested",
+		"1. numbered",
+		"│ quoted words",
+	}, "\n")
+
+	result := renderPlain(text, 14)
+
+	if expected != result {
+		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
+	}
+}
+
+func TestRenderCodeBlockKeepsWhitespace(t *testing.T) {
+	text := "look:\n```go\nfunc main() {\n\tif   veggie {    return }\n}\n```"
+	result := renderPlain(text, 40)
+
+	for _, line := range []string{"┃ func main() {", "┃     if   veggie {    return }", "┃ }"} {
+		if !strings.Contains(result, line) {
+			t.Errorf("Expected code line %q to be kept as-is, got \n'%s'", line, result)
+		}
+	}
+
+	if strings.Contains(result, "```") {
+		t.Errorf("Expected fences to be removed, got \n'%s'", result)
+	}
+}
+
+func TestRenderCodeBlockWrapsLongLines(t *testing.T) {
+	expected := strings.Join([]string{
+		"┃ x := 12345",
+		"┃ 6789",
+		"┃ y",
+	}, "\n")
+	result := renderPlain("```\nx := 123456789\ny\n```", 12)
+
+	if expected != result {
+		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
+	}
+
+	// Highlighted lines wrap by their visible width, whatever escape codes color them
+	for _, line := range strings.Split(renderPlain("```go\nvar veggie = \"broccoli\" + \"cauliflower\"\n```", 16), "\n") {
+		if width := uniseg.StringWidth(line); width > 16 {
+			t.Errorf("Expected lines at most 16 cells wide, got %d in %q", width, line)
+		}
+	}
+}
+
+func TestRenderWideCharacters(t *testing.T) {
+	expected := "브로콜리\n보끔밥"
+	result := renderPlain("**브로콜리** 보끔밥", 10)
+
+	if expected != result {
+		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
+	}
+}
@@ -0,0 +1,429 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"bokkoli/internal/logging"
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// How long a peer has to answer the challenge, and a dialer to get through the handshake
+	AUTH_TIMEOUT time.Duration = 10 * time.Second
+	// How long an unknown peer waits for us to accept or deny it before it is turned away
+	APPROVAL_TIMEOUT time.Duration = time.Minute
+	// Failed attempts from one host within the window before its connections are refused for the rest of it
+	MAX_AUTH_FAILURES   int           = 5
+	AUTH_FAILURE_WINDOW time.Duration = time.Minute
+	// Random bytes in a challenge or nonce
+	NONCE_SIZE int = 32
+)
+
+// Proofs and signatures are bound to who made them, so one side's can't be reflected back as the other's
+const (
+	roleDialer   string = "dialer"
+	roleListener string = "listener"
+)
+
+// What to do with a peer whose identity key isn't in the contacts
+type PeerPolicy string
+
+const (
+	PolicyAccept PeerPolicy = "accept"
+	PolicyDeny   PeerPolicy = "deny"
+	// Publish an EventRequest and wait for a frontend to Decide
+	PolicyAsk PeerPolicy = "ask"
+)
+
+// Answer to an EventRequest
+type Decision string
+
+const (
+	DecisionAccept Decision = "accept"
+	// Accept, and let the key in without asking from now on
+	DecisionAlways Decision = "always"
+	DecisionDeny   Decision = "deny"
+	// Deny, and turn the key away without asking from now on
+	DecisionBlock Decision = "block"
+)
+
+var (
+	errWrongPassword = errors.New("wrong room password")
+	errNotAccepted   = errors.New("not accepted")
+)
+
+// A dialer that got through the challenge, along with the ping it sent before it was let in
+type peerHello struct {
+	name string
+	key  ed25519.PublicKey
+	ping *frame
+}
+
+// Require peers connecting to us to prove they know the password; empty lets anyone in.
+// The password also answers the challenges of listeners we connect to.
+func (n *Node) SetRoomPassword(password string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.roomPassword = password
+}
+
+func (n *Node) password() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.roomPassword
+}
+
+// Key to sign handshakes with, see the identity package. A new Node has a throwaway one.
+func (n *Node) SetIdentity(key ed25519.PrivateKey) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.identity = key
+}
+
+func (n *Node) identityKey() ed25519.PrivateKey {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.identity
+}
+
+// What to do with incoming peers that aren't in the contacts, accept unless set
+func (n *Node) SetUnknownPeers(policy PeerPolicy) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.policy = policy
+}
+
+// Answer the EventRequest of the peer at the address
+func (n *Node) Decide(address string, decision Decision) error {
+	switch decision {
+	case DecisionAccept, DecisionAlways, DecisionDeny, DecisionBlock:
+	default:
+		return fmt.Errorf("unknown decision %q, expected accept, always, deny or block", decision)
+	}
+
+	n.mu.Lock()
+	answer, ok := n.requests[address]
+	delete(n.requests, address)
+	n.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not waiting to connect", address)
+	}
+	answer <- decision
+	return nil
+}
+
+func newNonce() string {
+	nonce := make([]byte, NONCE_SIZE)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// What both sides sign and prove: who they are in the handshake and both nonces
+func handshakeData(role string, challenge string, nonce string) []byte {
+	return []byte(role + "\n" + challenge + "\n" + nonce)
+}
+
+// HMAC keyed with the password, the password itself never goes over the wire
+func authProof(password string, role string, challenge string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(handshakeData(role, challenge, nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validProof(proof string, password string, role string, challenge string, nonce string) bool {
+	return hmac.Equal([]byte(proof), []byte(authProof(password, role, challenge, nonce)))
+}
+
+func sign(key ed25519.PrivateKey, role string, challenge string, nonce string) string {
+	return hex.EncodeToString(ed25519.Sign(key, handshakeData(role, challenge, nonce)))
+}
+
+func validSignature(key ed25519.PublicKey, signature string, role string, challenge string, nonce string) bool {
+	data, err := hex.DecodeString(signature)
+	return err == nil && ed25519.Verify(key, handshakeData(role, challenge, nonce), data)
+}
+
+func publicKeyHex(key ed25519.PrivateKey) string {
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// Challenge a peer that connected to us to prove its identity key, and the room password when there is one.
+// Its first ping is held back and answered once it is let in, so the dialer knows the handshake is over when the pong arrives.
+func (n *Node) challengePeer(conn net.Conn, reader *bufio.Reader) (peerHello, error) {
+	conn.SetDeadline(time.Now().Add(AUTH_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	password, key := n.password(), n.identityKey()
+	challenge := newNonce()
+	if err := writeFrame(conn, frame{Type: challengeFrame, Nonce: challenge, Key: publicKeyHex(key), PasswordRequired: password != ""}); err != nil {
+		return peerHello{}, err
+	}
+
+	hello := peerHello{}
+	for {
+		jsonData, err := handleListenerConn(conn, reader)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return hello, errors.New("did not answer the challenge")
+		}
+		if err != nil {
+			return hello, errors.New("disconnected without answering the challenge")
+		}
+		f, err := decodeFrame(jsonData)
+		if err != nil {
+			return hello, fmt.Errorf("sent a malformed frame: %v", err)
+		}
+
+		switch f.Type {
+		case pingFrame:
+			hello.ping = &f
+		case authFrame:
+			if len(f.Nonce) != 2*NONCE_SIZE {
+				return hello, errors.New("answered the challenge without a nonce")
+			}
+			if password != "" && !validProof(f.Proof, password, roleDialer, challenge, f.Nonce) {
+				return hello, errWrongPassword
+			}
+			peerKey, err := identity.ParseKey(f.Key)
+			if err != nil || !validSignature(peerKey, f.Signature, roleDialer, challenge, f.Nonce) {
+				return hello, errors.New("could not prove its identity key")
+			}
+			hello.name, hello.key = f.Sender, peerKey
+
+			welcome := frame{Type: welcomeFrame, Signature: sign(key, roleListener, challenge, f.Nonce)}
+			if password != "" {
+				welcome.Proof = authProof(password, roleListener, challenge, f.Nonce)
+			}
+			return hello, writeFrame(conn, welcome)
+		default:
+			return hello, fmt.Errorf("sent %q before answering the challenge", f.Type)
+		}
+	}
+}
+
+// Decide whether a peer that proved its key may in: contacts first, then the policy for unknown peers
+func (n *Node) admit(conn net.Conn, hello peerHello) error {
+	contact, known, err := n.dbHandler.ReadContact(hex.EncodeToString(hello.key))
+	if err != nil {
+		netLog.Warn("could not look up contact", logging.KeyErr, err)
+	}
+	switch {
+	case known && contact.Status == db.ContactBlocked:
+		return errNotAccepted
+	case known && contact.Status == db.ContactAllowed:
+		return nil
+	}
+
+	n.mu.Lock()
+	policy := n.policy
+	n.mu.Unlock()
+	switch policy {
+	case PolicyDeny:
+		// Remember the key so it can be allowed later, by its fingerprint
+		if !known {
+			pending := db.Contact{Key: hex.EncodeToString(hello.key), Fingerprint: identity.Fingerprint(hello.key), Name: hello.name, Status: db.ContactPending}
+			if err := n.dbHandler.SaveContact(pending); err != nil {
+				netLog.Error("could not save contact", logging.KeyErr, err)
+			}
+		}
+		return errNotAccepted
+	case PolicyAsk:
+		return n.ask(conn, hello)
+	default:
+		return nil
+	}
+}
+
+// Tell the peer to hold on, ask our frontends and wait for one of them to Decide
+func (n *Node) ask(conn net.Conn, hello peerHello) error {
+	address := conn.RemoteAddr().String()
+	answer := make(chan Decision, 1)
+	n.mu.Lock()
+	n.requests[address] = answer
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.requests, address)
+		n.mu.Unlock()
+	}()
+
+	if err := writeFrame(conn, frame{Type: waitFrame}); err != nil {
+		return err
+	}
+	fingerprint := identity.Fingerprint(hello.key)
+	netLog.Info("peer asks to connect", logging.KeyPeer, address, "fingerprint", fingerprint)
+	n.publish(Event{Type: EventRequest, Peer: address, Name: hello.name, Fingerprint: fingerprint, Incoming: true})
+
+	var decision Decision
+	timeout := time.NewTimer(APPROVAL_TIMEOUT)
+	defer timeout.Stop()
+	select {
+	case decision = <-answer:
+	case <-timeout.C:
+		return errors.New("nobody answered the request in time")
+	case <-n.quit:
+		return errNotAccepted
+	}
+
+	contact := db.Contact{Key: hex.EncodeToString(hello.key), Fingerprint: fingerprint, Name: hello.name}
+	switch decision {
+	case DecisionAlways:
+		contact.Status = db.ContactAllowed
+	case DecisionBlock:
+		contact.Status = db.ContactBlocked
+	}
+	if contact.Status != "" {
+		if err := n.dbHandler.SaveContact(contact); err != nil {
+			netLog.Error("could not save contact", logging.KeyErr, err)
+		}
+	}
+
+	if decision == DecisionAccept || decision == DecisionAlways {
+		return nil
+	}
+	return errNotAccepted
+}
+
+// Turn away a peer. Failing the challenge counts towards refusing its host for a while, being denied doesn't.
+// The rejection is published before the peer hears of it.
+func (n *Node) rejectPeer(conn net.Conn, hello peerHello, reason error) {
+	address := conn.RemoteAddr().String()
+	defer conn.Close()
+	defer writeFrame(conn, frame{Type: rejectFrame, Message: db.Message{Text: reason.Error()}})
+
+	text := reason.Error()
+	if !errors.Is(reason, errNotAccepted) && n.recordAuthFailure(remoteHost(conn), time.Now()) {
+		text += fmt.Sprintf(", too many failed attempts so the host is refused for %s", AUTH_FAILURE_WINDOW)
+	}
+	event := Event{Type: EventRejected, Peer: address, Name: hello.name, Incoming: true, Error: text}
+	if hello.key != nil {
+		event.Fingerprint = identity.Fingerprint(hello.key)
+	}
+	netLog.Warn("peer rejected", logging.KeyPeer, address, "fingerprint", event.Fingerprint, "reason", text)
+	n.publish(event)
+}
+
+// Record a failed attempt, returning whether the host is now refused
+func (n *Node) recordAuthFailure(host string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	failures := append(recentFailures(n.authFailures[host], now), now)
+	n.authFailures[host] = failures
+	return len(failures) == MAX_AUTH_FAILURES
+}
+
+// Whether the host failed too often lately to be let in at all
+func (n *Node) authBlocked(host string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	failures := recentFailures(n.authFailures[host], now)
+	if len(failures) == 0 {
+		delete(n.authFailures, host)
+	} else {
+		n.authFailures[host] = failures
+	}
+	return len(failures) >= MAX_AUTH_FAILURES
+}
+
+func (n *Node) clearAuthFailures(host string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.authFailures, host)
+}
+
+func recentFailures(failures []time.Time, now time.Time) []time.Time {
+	for len(failures) > 0 && now.Sub(failures[0]) >= AUTH_FAILURE_WINDOW {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Dialer side: ping, answer the listener's challenge, and wait for the pong that says we're in.
+// Returns the pong and the key the listener proved it holds.
+func (n *Node) handshake(conn net.Conn, reader *bufio.Reader) (frame, ed25519.PublicKey, error) {
+	conn.SetDeadline(time.Now().Add(AUTH_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := sendPing(conn, n.Username()); err != nil {
+		return frame{}, nil, err
+	}
+
+	var challenge frame
+	var nonce string
+	var peerKey ed25519.PublicKey
+	welcomed := false
+	for {
+		jsonData, err := handleListenerConn(conn, reader)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return frame{}, nil, errors.New("the peer did not answer")
+		}
+		if err != nil {
+			return frame{}, nil, errors.New("the peer closed the connection")
+		}
+		f, err := decodeFrame(jsonData)
+		if err != nil {
+			return frame{}, nil, fmt.Errorf("received a malformed frame: %v", err)
+		}
+
+		switch f.Type {
+		case challengeFrame:
+			password, key := n.password(), n.identityKey()
+			if f.PasswordRequired && password == "" {
+				return frame{}, nil, errors.New("the peer requires a room password, set room_password in your config")
+			}
+			if peerKey, err = identity.ParseKey(f.Key); err != nil {
+				return frame{}, nil, errors.New("the peer sent no identity key")
+			}
+			challenge, nonce = f, newNonce()
+			auth := frame{
+				Type: authFrame, Nonce: nonce, Key: publicKeyHex(key), Signature: sign(key, roleDialer, challenge.Nonce, nonce),
+				Message: db.Message{Sender: n.Username()},
+			}
+			if f.PasswordRequired {
+				auth.Proof = authProof(password, roleDialer, challenge.Nonce, nonce)
+			}
+			if err := writeFrame(conn, auth); err != nil {
+				return frame{}, nil, err
+			}
+		case welcomeFrame:
+			if peerKey == nil {
+				return frame{}, nil, errors.New("the peer welcomed us without a challenge")
+			}
+			// The listener proves the password too, so we know we reached the room and not someone posing as it
+			if challenge.PasswordRequired && !validProof(f.Proof, n.password(), roleListener, challenge.Nonce, nonce) {
+				return frame{}, nil, errors.New("the peer does not know the room password")
+			}
+			if !validSignature(peerKey, f.Signature, roleListener, challenge.Nonce, nonce) {
+				return frame{}, nil, errors.New("the peer could not prove its identity key")
+			}
+			welcomed = true
+		case waitFrame:
+			conn.SetDeadline(time.Now().Add(APPROVAL_TIMEOUT + AUTH_TIMEOUT))
+		case rejectFrame:
+			return frame{}, nil, fmt.Errorf("rejected by the peer: %s", f.Text)
+		case pongFrame:
+			// A pong without the handshake would let anyone in between strip the key and password checks
+			if !welcomed {
+				return frame{}, nil, errors.New("the peer skipped the handshake")
+			}
+			return f, peerKey, nil
+		}
+	}
+}
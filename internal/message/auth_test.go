@@ -0,0 +1,301 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/db/dbtest"
+	"bokkoli/internal/identity"
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, username string, password string) *Node {
+	node := NewNode(dbtest.New(t), username)
+	node.SetRoomPassword(password)
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// Listen on a free port and return the one the node got
+func listenOnFreePort(t *testing.T, node *Node) string {
+	t.Helper()
+	if err := node.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	status, _ := node.Status()
+	_, port, err := net.SplitHostPort(status.ListenAddress)
+	if err != nil {
+		t.Fatalf("Expected a listen address, got %q", status.ListenAddress)
+	}
+	return port
+}
+
+func awaitNodeEvent(t *testing.T, events <-chan Event, eventType EventType) Event {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a %s event", eventType)
+		}
+	}
+}
+
+func TestRoomPassword(t *testing.T) {
+	alice := newTestNode(t, "alice", "swordfish")
+	port := listenOnFreePort(t, alice)
+	events, unsubscribe := alice.Subscribe()
+	defer unsubscribe()
+
+	bob := newTestNode(t, "bob", "swordfish")
+	if _, err := bob.Connect(port); err != nil {
+		t.Fatal("Expected the right password to get in, got: ", err)
+	}
+	if status, _ := bob.Status(); len(status.Peers) != 1 || status.Peers[0].Name != "alice" {
+		t.Errorf("Expected the name to be known once connected, got %+v", status.Peers)
+	}
+	if _, err := bob.Send("alice", "hi"); err != nil {
+		t.Fatal("Got an error sending: ", err)
+	}
+	if event := awaitNodeEvent(t, events, EventMessage); event.Message.Text != "hi" {
+		t.Errorf("Expected bob's message, got %+v", event.Message)
+	}
+
+	carol := newTestNode(t, "carol", "tunafish")
+	if _, err := carol.Connect(port); err == nil || !strings.Contains(err.Error(), "wrong room password") {
+		t.Errorf("Expected a wrong password to be rejected, got %v", err)
+	}
+	if event := awaitNodeEvent(t, events, EventRejected); event.Error != "wrong room password" {
+		t.Errorf("Expected the rejection to be reported, got %+v", event)
+	}
+
+	dave := newTestNode(t, "dave", "")
+	if _, err := dave.Connect(port); err == nil || !strings.Contains(err.Error(), "requires a room password") {
+		t.Errorf("Expected a missing password to be explained, got %v", err)
+	}
+	awaitNodeEvent(t, events, EventRejected)
+
+	if status, _ := alice.Status(); len(status.Peers) != 1 {
+		t.Errorf("Expected only bob to be connected, got %+v", status.Peers)
+	}
+}
+
+func TestOpenListener(t *testing.T) {
+	alice := newTestNode(t, "alice", "")
+	port := listenOnFreePort(t, alice)
+
+	// Having a password doesn't stop us from joining rooms without one
+	bob := newTestNode(t, "bob", "swordfish")
+	if _, err := bob.Connect(port); err != nil {
+		t.Fatal("Expected to get in without a password, got: ", err)
+	}
+}
+
+func TestFailedAttemptsAreLimited(t *testing.T) {
+	alice := newTestNode(t, "alice", "swordfish")
+	port := listenOnFreePort(t, alice)
+	events, unsubscribe := alice.Subscribe()
+	defer unsubscribe()
+
+	mallory := newTestNode(t, "mallory", "guess")
+	for i := range MAX_AUTH_FAILURES {
+		if _, err := mallory.Connect(port); err == nil {
+			t.Fatal("Expected a wrong password to be rejected")
+		}
+		event := awaitNodeEvent(t, events, EventRejected)
+		if refused := strings.Contains(event.Error, "refused"); refused != (i == MAX_AUTH_FAILURES-1) {
+			t.Errorf("Expected the host to be refused only after %d failures, got %q after %d", MAX_AUTH_FAILURES, event.Error, i+1)
+		}
+	}
+
+	// Even the right password is turned away until the window has passed
+	bob := newTestNode(t, "bob", "swordfish")
+	if _, err := bob.Connect(port); err == nil {
+		t.Error("Expected the host to be refused")
+	}
+
+	later := time.Now().Add(AUTH_FAILURE_WINDOW)
+	if alice.authBlocked("127.0.0.1", later) {
+		t.Error("Expected the host to be let in again after the window")
+	}
+}
+
+func TestAskToConnect(t *testing.T) {
+	alice := newTestNode(t, "alice", "")
+	alice.SetUnknownPeers(PolicyAsk)
+	port := listenOnFreePort(t, alice)
+	events, unsubscribe := alice.Subscribe()
+	defer unsubscribe()
+
+	_, bobKey, _ := ed25519.GenerateKey(rand.Reader)
+	connect := func(username string, key ed25519.PrivateKey) <-chan error {
+		node := newTestNode(t, username, "")
+		node.SetIdentity(key)
+		done := make(chan error, 1)
+		go func() {
+			_, err := node.Connect(port)
+			done <- err
+		}()
+		return done
+	}
+
+	done := connect("bob", bobKey)
+	request := awaitNodeEvent(t, events, EventRequest)
+	if request.Name != "bob" || request.Fingerprint != identity.Fingerprint(bobKey.Public().(ed25519.PublicKey)) {
+		t.Errorf("Expected bob's name and fingerprint, got %+v", request)
+	}
+	if err := alice.Decide(request.Peer, DecisionAlways); err != nil {
+		t.Fatal("Got an error deciding: ", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Expected bob to get in, got: ", err)
+	}
+	if err := alice.Decide(request.Peer, DecisionAccept); err == nil {
+		t.Error("Expected an error deciding twice")
+	}
+
+	// Always means bob's key gets in without asking, whatever name or address it comes with
+	if err := <-connect("robert", bobKey); err != nil {
+		t.Error("Expected a known key to get in without asking, got: ", err)
+	}
+
+	_, malloryKey, _ := ed25519.GenerateKey(rand.Reader)
+	done = connect("mallory", malloryKey)
+	request = awaitNodeEvent(t, events, EventRequest)
+	alice.Decide(request.Peer, DecisionBlock)
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "not accepted") {
+		t.Errorf("Expected mallory to be turned away, got %v", err)
+	}
+	if err := <-connect("mallory", malloryKey); err == nil {
+		t.Error("Expected a blocked key to be turned away without asking")
+	}
+
+	contacts, _ := alice.dbHandler.ReadContacts()
+	if len(contacts) != 2 || contacts[0].Name != "bob" || contacts[0].Status != db.ContactAllowed || contacts[1].Status != db.ContactBlocked {
+		t.Errorf("Expected bob allowed and mallory blocked, got %+v", contacts)
+	}
+}
+
+// A listener that challenges without knowing the password must not be trusted
+func TestListenerMustProvePassword(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	defer listener.Close()
+
+	proofs := make(chan frame, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		challenge := newNonce()
+		writeFrame(conn, frame{Type: challengeFrame, Nonce: challenge, Key: publicKeyHex(key), PasswordRequired: true})
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			if f, _ := decodeFrame(line); f.Type == authFrame {
+				proofs <- f
+				writeFrame(conn, frame{
+					Type: welcomeFrame, Proof: authProof("guess", roleListener, challenge, f.Nonce),
+					Signature: sign(key, roleListener, challenge, f.Nonce),
+				})
+			}
+		}
+	}()
+
+	bob := newTestNode(t, "bob", "swordfish")
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	if _, err := bob.Connect(port); err == nil || !strings.Contains(err.Error(), "does not know the room password") {
+		t.Errorf("Expected an impostor to be detected, got %v", err)
+	}
+	select {
+	case proof := <-proofs:
+		if strings.Contains(proof.Proof, "swordfish") || len(proof.Proof) != 64 {
+			t.Errorf("Expected only an HMAC on the wire, got %+v", proof)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected bob to answer the challenge")
+	}
+}
+
+// Both sides see the key the other proved, so they arrive at the same safety number
+func TestPeerKeys(t *testing.T) {
+	alice := newTestNode(t, "alice", "")
+	port := listenOnFreePort(t, alice)
+	bob := newTestNode(t, "bob", "")
+	if _, err := bob.Connect(port); err != nil {
+		t.Fatal("Got an error connecting: ", err)
+	}
+
+	aliceStatus, _ := alice.Status()
+	bobStatus, _ := bob.Status()
+	if len(aliceStatus.Peers) != 1 || len(bobStatus.Peers) != 1 {
+		t.Fatalf("Expected one peer on each side, got %+v and %+v", aliceStatus.Peers, bobStatus.Peers)
+	}
+	if aliceStatus.Peers[0].Key != bobStatus.Key || bobStatus.Peers[0].Key != aliceStatus.Key {
+		t.Fatal("Expected each side to know the other's key")
+	}
+
+	safetyNumber := func(status Status) string {
+		ours, _ := identity.ParseKey(status.Key)
+		theirs, _ := identity.ParseKey(status.Peers[0].Key)
+		return identity.SafetyNumber(ours, theirs)
+	}
+	if safetyNumber(aliceStatus) != safetyNumber(bobStatus) {
+		t.Error("Expected both sides to see the same safety number")
+	}
+
+	// Messages carry the key their connection proved, whatever name they were sent under
+	events, unsubscribe := alice.Subscribe()
+	defer unsubscribe()
+	bob.SetUsername("mallory")
+	if _, err := bob.Send(bobStatus.Peers[0].Address, "hi"); err != nil {
+		t.Fatal("Got an error sending: ", err)
+	}
+	if event := awaitNodeEvent(t, events, EventMessage); event.Message.SenderKey != bobStatus.Key {
+		t.Errorf("Expected bob's key on his message, got %+v", event.Message)
+	}
+}
+
+// A listener that answers the ping without a challenge would skip the key and password checks
+func TestBarePongRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if line, err := reader.ReadBytes('\n'); err == nil {
+			if ping, _ := decodeFrame(line); ping.Type == pingFrame {
+				sendPong(conn, ping, "eve")
+			}
+		}
+		reader.ReadBytes('\n')
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	bob := newTestNode(t, "bob", "")
+	if _, err := bob.Connect(port); err == nil || !strings.Contains(err.Error(), "skipped the handshake") {
+		t.Errorf("Expected a bare pong to be refused, got %v", err)
+	}
+}
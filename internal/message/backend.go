@@ -0,0 +1,93 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// Everything a frontend needs to chat. Implemented in-process by *Node and, when a daemon is
+// running, by the daemon's control API client so several frontends can share one identity.
+type Backend interface {
+	Listen(port string) error
+	Connect(address string) (string, error)
+	Send(to string, text string) (db.Message, error)
+	Subscribe() (<-chan Event, func())
+	History(filter db.MessageFilter) ([]db.Message, error)
+	Conversations() ([]db.Conversation, error)
+	Status() (Status, error)
+	SetUsername(username string) error
+	// Accept or deny a peer that asked to connect, see EventRequest
+	Decide(address string, decision Decision) error
+	// Agree on a disappearing message timer with a connected peer, 0 turns it off
+	SetTimer(to string, timer time.Duration) error
+	Close() error
+}
+
+// Snapshot of a backend, used by frontends attaching after connections were made
+type Status struct {
+	Username string `json:"username"`
+	// Our public identity key, hex encoded
+	Key           string     `json:"key"`
+	ListenAddress string     `json:"listen_address,omitempty"`
+	Peers         []PeerInfo `json:"peers"`
+}
+
+type PeerInfo struct {
+	Address     string `json:"address"`
+	Name        string `json:"name,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Incoming    bool   `json:"incoming,omitempty"`
+}
+
+var _ Backend = (*Node)(nil)
+
+func (n *Node) Status() (Status, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{Username: n.username, Key: publicKeyHex(n.identity), Peers: []PeerInfo{}}
+	if n.listener != nil {
+		status.ListenAddress = n.listener.Addr().String()
+	}
+
+	for address := range n.peers {
+		status.Peers = append(status.Peers, n.peerInfo(address, false))
+	}
+	for conn := range n.incoming {
+		status.Peers = append(status.Peers, n.peerInfo(conn.RemoteAddr().String(), true))
+	}
+
+	sort.Slice(status.Peers, func(i, j int) bool {
+		return status.Peers[i].Address < status.Peers[j].Address
+	})
+	return status, nil
+}
+
+// What we know about the peer at the address, the key fields stay empty when it proved none; n.mu must be held
+func (n *Node) peerInfo(address string, incoming bool) PeerInfo {
+	info := PeerInfo{Address: address, Name: n.names[address], Incoming: incoming}
+	if key, ok := n.keys[address]; ok {
+		info.Key = hex.EncodeToString(key)
+		info.Fingerprint = identity.Fingerprint(key)
+	}
+	return info
+}
+
+// Hex encoded identity key the peer at the address proved, empty when it proved none
+func (n *Node) peerKey(address string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.peerInfo(address, false).Key
+}
+
+func (n *Node) History(filter db.MessageFilter) ([]db.Message, error) {
+	return n.dbHandler.ReadMessages(filter)
+}
+
+func (n *Node) Conversations() ([]db.Conversation, error) {
+	return n.dbHandler.ReadConversations()
+}
@@ -0,0 +1,316 @@
+package message
+
+import (
+	"bokkoli/internal/command"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/theme"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Register the built-in chat commands, plugins and later features add their own through Commands()
+func (m *ChatModel) registerCommands() {
+	builtins := []command.Command{
+		{
+			Name: "listen",
+			Args: []command.Arg{
+				{Name: "port", Validate: validatePortArg, Complete: m.completeSettingsPort},
+			},
+			Help: "Start the chat server. Uses the port from 'User Setting' when none is given.",
+			Run: func(args []string) tea.Cmd {
+				if m.listening != "" {
+					return errorCmd("already listening on " + m.listening)
+				}
+
+				port := m.settings.Port
+				if len(args) > 0 {
+					port = args[0]
+				}
+				m.settings.Port = port
+				return listenCmd(m.backend, port)
+			},
+		},
+		{
+			Name: "connect",
+			Args: []command.Arg{
+				{Name: "address", Required: true, Validate: validateAddressArg},
+			},
+			Help: "Connect to a peer by port (same machine) or host:port.",
+			Run: func(args []string) tea.Cmd {
+				return tea.Batch(infoCmd("connecting to "+args[0]), connectCmd(m.backend, args[0]))
+			},
+		},
+		{
+			Name: "switch",
+			Args: []command.Arg{
+				{Name: "peer", Required: true, Complete: m.completePeer},
+			},
+			Help: "Send your messages to another connected peer, by username or address.",
+			Run: func(args []string) tea.Cmd {
+				address, ok := m.findPeer(args[0])
+				if !ok {
+					return errorCmd("not connected to " + args[0])
+				}
+				m.active = address
+				return infoCmd("chatting with " + m.activeConversation())
+			},
+		},
+		{
+			Name: "nick",
+			Args: []command.Arg{
+				{Name: "username", Required: true, Rest: true},
+			},
+			Help: "Change your username and save it to your settings.",
+			Run: func(args []string) tea.Cmd {
+				m.settings.Username = args[0]
+				if err := m.backend.SetUsername(m.settings.Username); err != nil {
+					return errorCmd(err.Error())
+				}
+				if err := m.dbHandler.SaveSetup(m.settings.Port, m.settings.Username); err != nil {
+					uiLog.Error("could not save username", logging.KeyErr, err)
+					return errorCmd("username changed for this session only, saving failed")
+				}
+				return infoCmd("you are now known as " + m.settings.Username)
+			},
+		},
+		{
+			Name: "theme",
+			Args: []command.Arg{
+				{Name: "name", Complete: func(string) []string { return theme.Names() }},
+			},
+			Help: "Switch the color theme, or list the available themes.",
+			Run: func(args []string) tea.Cmd {
+				if len(args) == 0 {
+					return infoCmd("themes: " + strings.Join(theme.Names(), ", "))
+				}
+
+				if err := theme.Set(args[0]); err != nil {
+					return errorCmd(err.Error())
+				}
+				if err := m.dbHandler.SaveTheme(args[0]); err != nil {
+					uiLog.Error("could not save theme", logging.KeyErr, err)
+				}
+				return infoCmd("theme set to " + args[0])
+			},
+		},
+		{
+			Name: "markdown",
+			Args: []command.Arg{
+				{Name: "on|off", Validate: validateToggleArg, Complete: func(string) []string { return []string{"on", "off"} }},
+			},
+			Help: "Render messages as Markdown, or show them as raw text. Toggles when no argument is given.",
+			Run: func(args []string) tea.Cmd {
+				if !m.features.Markdown {
+					return errorCmd("Markdown is turned off in your configuration (features.markdown)")
+				}
+
+				m.settings.RenderMarkdown = !m.settings.RenderMarkdown
+				if len(args) > 0 {
+					m.settings.RenderMarkdown = args[0] == "on"
+				}
+
+				if err := m.dbHandler.SaveRenderMarkdown(m.settings.RenderMarkdown); err != nil {
+					uiLog.Error("could not save Markdown setting", logging.KeyErr, err)
+				}
+
+				if m.settings.RenderMarkdown {
+					return infoCmd("rendering messages as Markdown")
+				}
+				return infoCmd("showing messages as raw text")
+			},
+		},
+		{
+			Name: "rejected",
+			Help: "List the recent connection attempts that failed the room password.",
+			Run: func(args []string) tea.Cmd {
+				if len(m.rejected) == 0 {
+					return infoCmd("nobody was rejected")
+				}
+				lines := make([]string, len(m.rejected))
+				for i, r := range m.rejected {
+					lines[i] = fmt.Sprintf("%s %s: %s", r.time.Format("15:04:05"), r.address, r.reason)
+				}
+				return infoCmd(strings.Join(lines, "; "))
+			},
+		},
+		{
+			Name: "verify",
+			Args: []command.Arg{
+				{Name: "peer", Complete: m.completeKeyedPeer},
+			},
+			Help: "Show the safety number to compare with a peer, the active one when none is given, and mark it verified.",
+			Run: func(args []string) tea.Cmd {
+				return m.startVerify(args)
+			},
+		},
+		{
+			Name: "unverify",
+			Args: []command.Arg{
+				{Name: "peer", Complete: m.completeKeyedPeer},
+			},
+			Help: "Forget that a peer was verified, e.g. after it got a new key.",
+			Run: func(args []string) tea.Cmd {
+				return m.unverify(args)
+			},
+		},
+		{
+			Name: "timer",
+			Args: []command.Arg{
+				{Name: "off|30m|12h|7d", Validate: validateTimerArg, Complete: func(string) []string { return []string{"off", "1h", "1d", "7d"} }},
+			},
+			Help: "Make messages with the active peer disappear some time after they're read, once it agrees. Shows the timer when no argument is given.",
+			Run: func(args []string) tea.Cmd {
+				return m.timerCommand(args)
+			},
+		},
+		{
+			Name: "export",
+			Args: []command.Arg{
+				{Name: "json|md|html|irc", Required: true, Validate: validateExportFormatArg, Complete: completeExportFormat},
+				{Name: "all", Validate: validateAllArg, Complete: func(string) []string { return []string{"all"} }},
+			},
+			Help: "Write the active conversation, or all of them, to a file in the profile's exports directory.",
+			Run: func(args []string) tea.Cmd {
+				return m.exportCommand(args)
+			},
+		},
+		{
+			Name: "lock",
+			Help: "Hide the chat behind the unlock screen until your passphrase is entered.",
+			Run: func(args []string) tea.Cmd {
+				if encrypted, err := m.dbHandler.Encrypted(); err != nil || !encrypted {
+					return errorCmd("locking needs a passphrase, set one with 'bokkoli passphrase set'")
+				}
+				return func() tea.Msg { return LockMsg{} }
+			},
+		},
+		{
+			Name:    "quit",
+			Aliases: []string{"exit"},
+			Help:    "Exit Bokkoli. Connections are closed unless they belong to a running daemon.",
+			Run: func(args []string) tea.Cmd {
+				if err := m.backend.Close(); err != nil {
+					uiLog.Warn("could not close backend", logging.KeyErr, err)
+				}
+				return tea.Quit
+			},
+		},
+		{
+			Name:    "help",
+			Aliases: []string{"?"},
+			Help:    "Show this list of commands.",
+			Run: func(args []string) tea.Cmd {
+				m.showHelp = !m.showHelp
+				return nil
+			},
+		},
+	}
+
+	for _, cmd := range append(builtins, m.pluginBuiltins()...) {
+		if err := m.commands.Register(cmd); err != nil {
+			logging.Fatal(uiLog, "could not register built-in command", "command", cmd.Name, logging.KeyErr, err)
+		}
+	}
+}
+
+// Registry of slash-commands available in the chat view
+func (m *ChatModel) Commands() *command.Registry {
+	return m.commands
+}
+
+func (m *ChatModel) completeSettingsPort(partial string) []string {
+	if m.settings.Port == "" {
+		return nil
+	}
+	return []string{m.settings.Port}
+}
+
+// Run the input as a slash-command, any parse or validation error is shown as a notice
+func (m *ChatModel) executeCommand(input string) tea.Cmd {
+	cmd, err := m.commands.Execute(input)
+	if err != nil {
+		if errors.Is(err, command.ErrUnknownCommand) {
+			return errorCmd(fmt.Sprintf("%v, type /help for a list of commands", err))
+		}
+		return errorCmd(err.Error())
+	}
+
+	return cmd
+}
+
+// Complete the input line on tab; a unique match replaces the input, otherwise the candidates are listed
+func (m *ChatModel) completeInput() {
+	candidates := m.commands.Complete(m.input)
+	m.completions = nil
+
+	switch len(candidates) {
+	case 0:
+		return
+	case 1:
+		m.input = candidates[0]
+	default:
+		m.input = command.CommonPrefix(candidates)
+		m.completions = candidates
+	}
+}
+
+func (m *ChatModel) completePeer(partial string) []string {
+	var candidates []string
+	for _, address := range sortedPeers(m.peers) {
+		peer := m.peers[address]
+		if peer.incoming || peer.state != stateConnected {
+			continue
+		}
+		if peer.name != "" {
+			candidates = append(candidates, peer.name)
+		} else {
+			candidates = append(candidates, address)
+		}
+	}
+	return candidates
+}
+
+// Find a connected outgoing peer by username or address
+func (m *ChatModel) findPeer(name string) (string, bool) {
+	for address, peer := range m.peers {
+		if peer.incoming || peer.state != stateConnected {
+			continue
+		}
+		if address == name || peer.name == name {
+			return address, true
+		}
+	}
+	return "", false
+}
+
+func validatePortArg(port string) error {
+	if !validatePort(port) {
+		return fmt.Errorf("only ports in the range %d-%d are allowed", LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER)
+	}
+	return nil
+}
+
+func validateToggleArg(value string) error {
+	if value != "on" && value != "off" {
+		return errors.New("expected 'on' or 'off'")
+	}
+	return nil
+}
+
+func validateAddressArg(address string) error {
+	_, port := splitAddress(address)
+	return validatePortArg(port)
+}
+
+// Split "host:port" into its parts, a bare port is returned with an empty host
+func splitAddress(address string) (string, string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", address
+	}
+	return host, port
+}
@@ -0,0 +1,87 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/export"
+	"bokkoli/internal/logging"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Export the active conversation, or every conversation with "all"
+func (m *ChatModel) exportCommand(args []string) tea.Cmd {
+	format, err := export.ParseFormat(args[0])
+	if err != nil {
+		return errorCmd(err.Error())
+	}
+
+	filter := db.MessageFilter{}
+	name := "bokkoli"
+	if len(args) < 2 {
+		if m.active == "" {
+			return errorCmd("no active conversation, use /export " + args[0] + " all to export every conversation")
+		}
+		filter.Peer = m.activeConversation()
+		name = filter.Peer
+	}
+	path := filepath.Join(m.exportDir, export.FileName(name+"-"+time.Now().Format("20060102-150405"), format))
+	return exportCmd(m.backend, m.settings.Username, filter, format, path)
+}
+
+// Read the messages from the backend, so a chat attached to a daemon exports what the daemon stored
+func exportCmd(backend Backend, username string, filter db.MessageFilter, format export.Format, path string) tea.Cmd {
+	return func() tea.Msg {
+		messages, err := backend.History(filter)
+		if err != nil {
+			return toast{level: toastError, text: "could not read messages: " + err.Error()}
+		}
+		if len(messages) == 0 {
+			return toast{level: toastError, text: "nothing to export"}
+		}
+		if err := writeExport(path, format, export.NewTranscript(messages, username, filter)); err != nil {
+			uiLog.Error("could not export messages", logging.KeyErr, err)
+			return toast{level: toastError, text: "could not export: " + err.Error()}
+		}
+		return toast{level: toastInfo, text: fmt.Sprintf("exported %d messages to %s", len(messages), path)}
+	}
+}
+
+func writeExport(path string, format export.Format, transcript export.Transcript) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := export.Write(file, format, transcript); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func validateExportFormatArg(value string) error {
+	_, err := export.ParseFormat(value)
+	return err
+}
+
+func completeExportFormat(string) []string {
+	formats := make([]string, len(export.Formats))
+	for i, format := range export.Formats {
+		formats[i] = string(format)
+	}
+	return formats
+}
+
+func validateAllArg(value string) error {
+	if value != "all" {
+		return errors.New("expected 'all' or nothing")
+	}
+	return nil
+}
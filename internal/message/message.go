@@ -1,11 +1,18 @@
 package message
 
 import (
+	"bokkoli/internal/command"
+	"bokkoli/internal/config"
 	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/markdown"
+	"bokkoli/internal/plugin"
+	"bokkoli/internal/theme"
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -15,6 +22,12 @@ import (
 	"github.com/charmbracelet/lipgloss"
 )
 
+var (
+	netLog = logging.For(logging.NET)
+	uiLog  = logging.For(logging.UI)
+	dbLog  = logging.For(logging.DB)
+)
+
 const (
 	LOWERBOUND_PORT_NUMBER int = 1024
 	UPPERBOUND_PORT_NUMBER int = 49151
@@ -23,39 +36,51 @@ const (
 var timestampStyle = lipgloss.NewStyle().Italic(true).
 	Faint(true)
 
-var senderStyle = lipgloss.NewStyle().
-	Bold(true).
-	Foreground(lipgloss.Color("#FAFAFA")).
-	Background(lipgloss.Color("#a488f7"))
+func senderStyle() lipgloss.Style {
+	return lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Current().AccentText).
+		Background(theme.Current().Accent)
+}
 
 var timestampSenderStyle = lipgloss.NewStyle().
 	PaddingBottom(2)
 
 var maxLineLength = 50
 
-var messageStyle = lipgloss.NewStyle().
-	BorderStyle(lipgloss.RoundedBorder()).
-	MaxWidth(maxLineLength).
-	Padding(1, 1, 1)
+const MAX_SENDER_WIDTH int = 24
 
-var inputStyle = lipgloss.NewStyle().Faint(true)
-var inputLineIndicator = lipgloss.NewStyle().
-	Blink(true).
-	Foreground(lipgloss.Color("#1379af"))
+func messageStyle() lipgloss.Style {
+	return lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Current().Border).
+		MaxWidth(maxLineLength).
+		Padding(1, 1, 1)
+}
 
-type peerConn struct {
-	conn net.Conn
+func commandStyle() lipgloss.Style {
+	return lipgloss.NewStyle().
+		Foreground(theme.Current().Highlight).
+		Bold(true)
 }
 
-type listenerConn struct {
-	conn net.Conn
+func noticeStyle() lipgloss.Style {
+	return lipgloss.NewStyle().Foreground(theme.Current().Muted)
 }
 
-type errorOnMessageReceive struct {
-	err error
+func helpStyle() lipgloss.Style {
+	return lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Current().Border).
+		Padding(1, 2)
 }
-type errorOnMessageSend struct {
-	err error
+
+var inputStyle = lipgloss.NewStyle().Faint(true)
+
+func inputLineIndicator() lipgloss.Style {
+	return lipgloss.NewStyle().
+		Blink(true).
+		Foreground(theme.Current().Prompt)
 }
 
 type (
@@ -63,262 +88,458 @@ type (
 	incomingJson []byte
 )
 
+// Events are tagged with their subscription, a chat view that was replaced may still have one in flight
+type eventReceived struct {
+	events <-chan Event
+	event  Event
+}
+
+// The backend's event stream ended, e.g. the daemon went away
+type eventsClosed struct {
+	events <-chan Event
+}
+
+// Asks the program to lock the chat, sent by /lock
+type LockMsg struct{}
+
+// Result of a /connect, the backend normalizes the address it was given
+type connectResult struct {
+	address string
+	err     error
+}
+
+const HISTORY_SIZE int = 50
+
+// Random bytes in a message ID
+const MESSAGE_ID_SIZE int = 16
+
 type ChatModel struct {
-	messages     []db.Message
-	input        string
-	peerConn     net.Conn // TODO: implement an array of peers
-	listenerConn net.Conn
-	listener     net.Listener
-	isClient     bool
-	dbHandler    *db.DbHandler
-	settings     *db.Setup
+	messages    []db.Message
+	input       string
+	backend     Backend
+	events      <-chan Event
+	unsubscribe func()
+	dbHandler   *db.DbHandler
+	settings    *db.Setup
+	features    config.Features
+	commands    *command.Registry
+	showHelp    bool
+	completions []string
+	peers       map[string]*peerStatus
+	active      string // address of the peer messages are sent to
+	listening   string
+	toast       *toast
+	toastCount  int
+	// Peers that failed the room password challenge, most recent last
+	rejected []rejection
+	// Peers waiting for us to accept or deny them, oldest first
+	requests []Event
+	// Our public identity key, and the safety number /verify is showing
+	key       string
+	verifying *verification
+	// Disappearing message timers by conversation
+	timers map[string]time.Duration
+	// Behind the lock screen, see SetHidden
+	hidden  bool
+	plugins *plugin.Host
+	// Commands each running plugin registered, removed again when it is disabled
+	pluginCommands map[string][]string
+	widgets        map[string]string
+	// Where /export writes transcripts
+	exportDir string
 }
 
-func New() *ChatModel {
-	dbHandler, err := db.NewDbHandler(db.DefaultDbFilePath)
+// Chat view driven by a backend; the backend outlives the view, so leaving and re-entering the chat keeps connections
+func New(backend Backend, cfg *config.Config) *ChatModel {
+	dbHandler, err := db.NewDbHandler(cfg.DbPath())
 	if err != nil {
-		log.Fatal("Error upon DB creation: ", err)
+		logging.Fatal(uiLog, "could not open database", logging.KeyErr, err)
 	}
 
 	err = dbHandler.SetupSchemas()
 	if err != nil {
-		log.Fatal("Error upon schema creation: ", err)
+		logging.Fatal(uiLog, "could not create schema", logging.KeyErr, err)
 	}
 
 	settings, err := dbHandler.ReadSetup()
 	if err == nil {
-		log.Println("User connection settings read from DB: ", settings)
+		uiLog.Debug("settings read", "port", settings.Port)
+		if err := backend.SetUsername(settings.Username); err != nil {
+			uiLog.Warn("could not set username on backend", logging.KeyErr, err)
+		}
 	}
 
-	return &ChatModel{
+	m := &ChatModel{
 		messages:  []db.Message{},
 		input:     "",
-		isClient:  false,
+		backend:   backend,
 		settings:  &settings,
+		features:  cfg.Features,
 		dbHandler: dbHandler,
+		commands:  command.NewRegistry(),
+		peers:     make(map[string]*peerStatus),
+		plugins:   plugin.NewHost(cfg.PluginDir()),
+
+		pluginCommands: make(map[string][]string),
+		widgets:        make(map[string]string),
+		exportDir:      cfg.ExportDir(),
+	}
+	m.events, m.unsubscribe = backend.Subscribe()
+	m.loadTimers()
+	m.registerCommands()
+	m.startPlugins()
+	m.restore()
+
+	return m
+}
+
+// Pick up connections and recent messages that already exist, e.g. when attaching to a running daemon
+func (m *ChatModel) restore() {
+	status, err := m.backend.Status()
+	if err != nil {
+		uiLog.Warn("could not read backend status", logging.KeyErr, err)
+		return
+	}
+
+	m.listening = status.ListenAddress
+	m.key = status.Key
+	for _, peer := range status.Peers {
+		m.peers[peer.Address] = &peerStatus{name: peer.Name, incoming: peer.Incoming, state: stateConnected, key: peer.Key, verified: m.isVerified(peer.Key)}
+		if !peer.Incoming && m.active == "" {
+			m.active = peer.Address
+		}
 	}
+
+	history, err := m.backend.History(db.MessageFilter{Limit: HISTORY_SIZE})
+	if err != nil {
+		uiLog.Warn("could not read message history", logging.KeyErr, err)
+		return
+	}
+	m.messages = append(m.messages, history...)
+	m.markRead()
 }
 
 func (m *ChatModel) Init() tea.Cmd {
-	return nil
+	return tea.Batch(waitForEventCmd(m.events), pluginStatusCmd(m.plugins, 0), expiryCheckCmd())
+}
+
+// Stop receiving backend events and stop the plugins, the backend itself keeps running
+func (m *ChatModel) Close() {
+	m.unsubscribe()
+	m.plugins.Close()
+	m.dbHandler.Close()
+}
+
+func waitForEventCmd(events <-chan Event) tea.Cmd {
+	return func() tea.Msg {
+		event, ok := <-events
+		if !ok {
+			return eventsClosed{events: events}
+		}
+		return eventReceived{events: events, event: event}
+	}
+}
+
+// Send after the plugins had their say, a failing plugin doesn't hold up the message
+func sendCmd(backend Backend, plugins *plugin.Host, to string, text string) tea.Cmd {
+	return func() tea.Msg {
+		text, err := plugins.Transform(to, text)
+		if err != nil {
+			uiLog.Warn("plugin could not transform a message", logging.KeyErr, err)
+		}
+		if _, err := backend.Send(to, text); err != nil {
+			return toast{level: toastError, text: err.Error()}
+		}
+		return nil
+	}
+}
+
+func listenCmd(backend Backend, port string) tea.Cmd {
+	return func() tea.Msg {
+		if err := backend.Listen(port); err != nil {
+			return toast{level: toastError, text: err.Error()}
+		}
+		return nil
+	}
+}
+
+func connectCmd(backend Backend, address string) tea.Cmd {
+	return func() tea.Msg {
+		address, err := backend.Connect(address)
+		return connectResult{address: address, err: err}
+	}
 }
 
 func (m *ChatModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if m.showHelp {
+			m.showHelp = false
+			return m, nil
+		}
+		if len(m.requests) > 0 {
+			return m, m.answerRequest(msg.String())
+		}
+		if m.verifying != nil {
+			return m, m.answerVerify(msg.String())
+		}
+
+		if msg.String() != "tab" {
+			m.completions = nil
+		}
+
 		switch msg.String() {
 		case "enter":
-			// Start and return listener
-			suffix, success := parseStringSuffixFromPrefix(m.input, "start chat my port ")
-			if success && m.listener == nil {
-				m.input = ""
-				if suffix == "" {
-					suffix = m.settings.Port
-				}
-				m.settings.Port = suffix
-				return m, startListenerCmd(suffix)
-			}
+			input := strings.TrimSpace(m.input)
+			m.input = ""
 
-			if m.input == "exit" || m.input == "ctrl+c" {
-				defer m.peerConn.Close()
-				defer m.listenerConn.Close()
-				return m, tea.Quit
+			if input == "" {
+				return m, nil
 			}
 
-			// Need to connect to a client still
-			suffix, success = parseStringSuffixFromPrefix(m.input, "connect to port ")
-			if success && m.peerConn == nil {
-				m.input = ""
-				return m, createPeerConnCmd("", suffix)
+			if command.IsCommand(input) {
+				return m, m.executeCommand(input)
 			}
 
 			// Send messages command
-			if m.input != "" && m.peerConn != nil {
-				temp_input := m.input
-				m.input = ""
-				message := createMessage(temp_input, m.settings.Username, db.Outgoing)
-				return m, handleDbAndSendMessageCmd(message, m.peerConn, m.dbHandler)
+			if m.active != "" {
+				return m, sendCmd(m.backend, m.plugins, m.active, input)
 			}
 
-			log.Printf("Not all cases have been handled. There is an issue here.")
+			m.input = input
+			return m, errorCmd("not connected to anyone yet, use /connect <address>")
+		case "tab":
+			m.completeInput()
 		case "backspace":
 			m.input = deleteLastNCharacters(m.input, 1)
+		case "alt+enter":
+			m.input += "\n"
 		default:
-			m.input += msg.String()
+			// Pasted text arrives as a single key message, newlines included
+			if msg.Paste {
+				m.input += string(msg.Runes)
+			} else {
+				m.input += msg.String()
+			}
 		}
-	case db.Message:
-		switch msg.Direction {
-		case db.Outgoing:
-			m.messages = append(m.messages, msg)
-		case db.Incoming:
-			m.messages = append(m.messages, msg)
-			return m, handleListenerConnCmd(m.listenerConn)
-		default:
-			log.Fatal("There should not be any other directions. Crashing program.")
+	case eventReceived:
+		if msg.events != m.events {
+			return m, nil
+		}
+		return m, tea.Batch(m.applyEvent(msg.event), waitForEventCmd(m.events))
+	case eventsClosed:
+		if msg.events != m.events {
+			return m, nil
+		}
+		m.listening = ""
+		for _, peer := range m.peers {
+			peer.state = stateOffline
+		}
+		return m, errorCmd("lost the connection to the Bokkoli daemon")
+	case connectResult:
+		if msg.err != nil {
+			return m, errorCmd(msg.err.Error())
+		}
+		m.active = msg.address
+		return m, infoCmd("chatting with " + m.activeConversation())
+	case pluginResult:
+		return m, m.applyPluginResult(msg)
+	case pluginStatus:
+		if msg.host != m.plugins {
+			return m, nil
+		}
+		m.widgets = msg.widgets
+		return m, pluginStatusCmd(m.plugins, PLUGIN_STATUS_INTERVAL)
+	case expiryCheck:
+		m.dropExpired(time.Now())
+		return m, expiryCheckCmd()
+	case toast:
+		return m, m.showToast(msg)
+	case toastExpired:
+		if m.toast != nil && m.toast.id == msg.id {
+			m.toast = nil
 		}
-	case peerConn:
-		m.peerConn = msg.conn // TODO: Make into an array appending
-	case listenerConn:
-		log.Println("Connection read from listener on port: ", m.settings.Port)
-		m.listenerConn = msg.conn // TODO: Make into an array appending
-		return m, handleListenerConnCmd(m.listenerConn)
-	case incomingJson:
-		return m, handleDbAndReceiveMessageCmd(msg, m.dbHandler)
-	case errorOnMessageSend:
-		// Do something here based on that
-	case errorOnMessageReceive:
-		// Do something here based on that
-	case listener:
-		log.Println("Listener started on port: ", m.settings.Port)
-		m.listener = msg
-		// Read new connections
-		return m, readListenerCmd(m.listener)
 	}
 
 	return m, nil
 }
 
+// Update the view state from a backend event, returning a toast where the user should know about it
+func (m *ChatModel) applyEvent(event Event) tea.Cmd {
+	peer, known := m.peers[event.Peer]
+	if !known && event.Peer != "" && event.Type != EventListening && event.Type != EventError &&
+		event.Type != EventRejected && event.Type != EventRequest {
+		peer = &peerStatus{incoming: event.Incoming, state: stateConnected}
+		m.peers[event.Peer] = peer
+	}
+	if peer != nil && event.Name != "" && event.Name != event.Peer {
+		peer.name = event.Name
+	}
+	m.plugins.Notify(event)
+
+	switch event.Type {
+	case EventListening:
+		m.listening = event.Peer
+		return infoCmd("listening on " + event.Peer)
+	case EventConnected:
+		m.dropRequest(event.Peer)
+		peer.state = stateConnected
+		peer.key = event.Key
+		peer.verified = m.isVerified(event.Key)
+		if event.Incoming {
+			return infoCmd("incoming connection from " + event.Peer)
+		}
+		return infoCmd("connected to " + event.Peer)
+	case EventDisconnected:
+		peer.state = stateDisconnected
+		peer.latency = 0
+		name := event.Peer
+		if peer.name != "" {
+			name = peer.name
+		}
+		return errorCmd(name + " disconnected")
+	case EventMessage:
+		m.messages = append(m.messages, *event.Message)
+		m.markRead()
+	case EventTimer:
+		return m.applyTimerEvent(event)
+	case EventLatency:
+		if latency, err := time.ParseDuration(event.Latency); err == nil {
+			peer.latency = latency
+		}
+	case EventError:
+		uiLog.Warn("backend error", logging.KeyErr, event.Error)
+		return errorCmd(event.Error)
+	case EventRequest:
+		m.requests = append(m.requests, event)
+	case EventRejected:
+		m.dropRequest(event.Peer)
+		m.rejected = append(m.rejected, rejection{address: event.Peer, reason: event.Error, time: event.Time})
+		if len(m.rejected) > MAX_REJECTIONS {
+			m.rejected = m.rejected[len(m.rejected)-MAX_REJECTIONS:]
+		}
+		return errorCmd("rejected " + event.Peer + ": " + event.Error)
+	}
+
+	return nil
+}
+
 func (m *ChatModel) View() string {
 	// TODO: Consider asking for port number in a separate model/view
 
 	var chatView strings.Builder
 
-	chatView.WriteString(fmt.Sprintf("\n*** To start a chat server type %s followed by your port number. \n (If no port number is provided, the default entered in %s will be used.)\n\n",
-		lipgloss.NewStyle().Foreground(lipgloss.Color("#f47d56")).Bold(true).Render("'start chat my port <port>'"),
-		lipgloss.NewStyle().Foreground(lipgloss.Color("#f47d56")).Bold(true).Render("'user settings'"),
+	if m.showHelp {
+		return m.helpView()
+	}
+
+	chatView.WriteString(fmt.Sprintf("\n*** To start a chat server type %s. \n (If no port number is provided, the default entered in %s will be used.)\n\n",
+		commandStyle().Render("/listen [port]"),
+		commandStyle().Render("'user settings'"),
 	))
-	chatView.WriteString(fmt.Sprintf("*** To connect to a chat server type %s followed by the port number.",
-		lipgloss.NewStyle().Foreground(lipgloss.Color("#f47d56")).Bold(true).Render("'connect to port <port>'"),
+	chatView.WriteString(fmt.Sprintf("*** To connect to a chat server type %s. Type %s for all commands, %s completes them.",
+		commandStyle().Render("/connect <port>"),
+		commandStyle().Render("/help"),
+		commandStyle().Render("tab"),
 	))
 
 	chatView.WriteString(fmt.Sprintf("\n\n%s.\n\n",
-		lipgloss.NewStyle().Faint(true).Render("Press 'esc' to return to main menu.\nTo exit, type 'exit' or press 'ctrl + c' to exit program"),
+		noticeStyle().Render("Press 'esc' to return to main menu.\nTo exit, type '/quit' or press 'ctrl + c' to exit program"),
 	))
+	if timer := m.activeTimer(); timer > 0 {
+		chatView.WriteString(commandStyle().Render(fmt.Sprintf("⏱ Messages with %s disappear %s after they're read.", m.activeConversation(), formatTimer(timer))) + "\n\n")
+	}
 
 	for _, message := range m.messages {
-		tempChatView := fmt.Sprintf("%s - %s", timestampStyle.Render(message.Timestamp.Format("2006-01-02 15:04")), senderStyle.Render(message.Sender))
+		sender := senderStyle().Render(truncateText(message.Sender, MAX_SENDER_WIDTH))
+		if m.verifiedSender(message) {
+			sender += " " + lipgloss.NewStyle().Foreground(theme.Current().Success).Render("✓")
+		}
+		tempChatView := fmt.Sprintf("%s - %s", timestampStyle.Render(message.Timestamp.Format("2006-01-02 15:04")), sender)
 		tempChatView = timestampSenderStyle.Render(tempChatView) + "\n"
-		tempChatView += wrapText(message.Text, maxLineLength-messageStyle.GetHorizontalPadding())
-		chatView.WriteString(messageStyle.Render(tempChatView) + "\n")
+		tempChatView += m.renderText(message.Text, maxLineLength-messageStyle().GetHorizontalPadding())
+		chatView.WriteString(messageStyle().Render(tempChatView) + "\n")
 	}
 
-	indicator := inputLineIndicator.Render("> ")
-	return fmt.Sprintf("%s\n\n%s", chatView.String(), inputStyle.Render(indicator, m.input))
-}
-
-func deleteLastNCharacters(s string, n int) string {
-	size := len(s)
-
-	if size-n < 0 {
-		return s
+	if len(m.completions) > 0 {
+		chatView.WriteString("\n" + noticeStyle().Render(strings.Join(m.completions, "  ")))
 	}
-
-	s = s[:size-n]
-	return s
-}
-
-// Return a True or False on success for whether a prefix was found in the result.
-func parseStringSuffixFromPrefix(s string, prefix string) (string, bool) {
-	suffix, success := strings.CutPrefix(strings.ToLower(s), prefix)
-	if !success {
-		return "", false
+	if len(m.requests) > 0 {
+		chatView.WriteString("\n" + m.requestView())
+	} else if m.verifying != nil {
+		chatView.WriteString("\n" + m.verifyView())
+	}
+	if m.toast != nil {
+		chatView.WriteString("\n" + m.toastView())
 	}
 
-	return suffix, true
+	indicator := inputLineIndicator().Render("> ")
+	view := fmt.Sprintf("%s\n\n%s", chatView.String(), inputStyle.Render(indicator, m.input))
+	if m.features.StatusBar {
+		view += "\n\n" + m.statusBarView()
+	}
+	return view
 }
 
-func readListenerCmd(listener net.Listener) tea.Cmd {
-	return func() tea.Msg {
-		return readListener(listener)
+// Message body as Markdown, or as raw text keeping the sender's line breaks when Markdown is turned off
+func (m *ChatModel) renderText(text string, width int) string {
+	if m.features.Markdown && m.settings.RenderMarkdown {
+		return markdown.Render(text, width, theme.Current())
 	}
-}
 
-func readListener(listener net.Listener) listenerConn {
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Error accepting connection: %v\n", err)
-			continue
-		}
-		log.Println("Someone has connected: ", conn.LocalAddr().String())
-		return listenerConn{conn: conn}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = wrapText(line, width)
 	}
+	return strings.Join(lines, "\n")
 }
 
-func startListenerCmd(port string) tea.Cmd {
-	if !validatePort(port) {
-		return func() tea.Msg {
-			fmt.Printf("Only ports in the range %d-%d are allowed, re-enter", LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER)
-			return errorOnMessageReceive{err: fmt.Errorf("invalid port: %s", port)}
-		}
-	}
+// Overlay listing every registered command, generated from the registry
+func (m *ChatModel) helpView() string {
+	var help strings.Builder
+	help.WriteString(commandStyle().Render("Commands") + "\n\n")
 
-	listener, err := startServer(port)
-	if err != nil {
-		return func() tea.Msg { return errorOnMessageReceive{err: fmt.Errorf("port already in use: %s", port)} }
+	for _, cmd := range m.commands.Commands() {
+		help.WriteString(fmt.Sprintf("%-24s %s\n", cmd.Usage(), cmd.Help))
+		if len(cmd.Aliases) > 0 {
+			help.WriteString(noticeStyle().Render(fmt.Sprintf("%-24s aliases: /%s", "", strings.Join(cmd.Aliases, ", /"))) + "\n")
+		}
 	}
 
-	return func() tea.Msg {
-		return listener
-	}
+	help.WriteString("\n" + noticeStyle().Render("Press any key to close."))
+	return helpStyle().Render(help.String())
 }
 
-func startServer(port string) (listener, error) {
-	listener, err := net.Listen("tcp", ":"+port)
+// Listen on the port of the bind address, every interface when it is empty
+func startServer(bindAddress string, port string) (listener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddress, port))
 	if err != nil {
-		fmt.Printf("Error starting server, port '%s' is already in use, select a different port. ", port)
+		netLog.Warn("could not start server", "port", port, logging.KeyErr, err)
 		return listener, err
 	}
-	fmt.Printf("Server listening on port '%s'\n", port)
+	netLog.Info("server listening", "port", port)
 
 	return listener, nil
 }
 
-func createPeerConnCmd(address string, portNumber string) tea.Cmd {
-	return func() tea.Msg {
-		fullAddress := net.JoinHostPort(address, portNumber)
-		conn, err := net.Dial("tcp", fullAddress)
-		if err != nil {
-			fmt.Println("error: ", err)
-		}
-
-		fmt.Println("Connected to port: ", portNumber)
-		return peerConn{conn: conn}
-	}
-}
-
-func handleListenerConnCmd(conn net.Conn) tea.Cmd {
-	return func() tea.Msg {
-		if conn == nil {
-			return errorOnMessageReceive{err: fmt.Errorf("connection is nil")}
-		}
-
-		jsonMessage, err := handleListenerConn(conn)
-		if err != nil {
-			return errorOnMessageReceive{err: err}
-		}
-
-		return jsonMessage
-	}
-}
-
-func handleListenerConn(conn net.Conn) (incomingJson, error) {
-	reader := bufio.NewReader(conn)
-
-	log.Println("Listener is handling connection, awaiting read: ", conn.LocalAddr().String())
+// Read one frame; the reader must stay the same for the whole connection so frames arriving together are not lost
+func handleListenerConn(conn net.Conn, reader *bufio.Reader) (incomingJson, error) {
 	jsonMessage, err := reader.ReadBytes('\n')
 
 	if err != nil {
-		log.Println("Friend disconnected:", err)
+		netLog.Debug("connection closed", logging.KeyPeer, conn.RemoteAddr().String(), logging.KeyErr, err)
 		return nil, err
 	}
 
-	log.Println("Handle listener message received as: ", jsonMessage)
+	if logging.Tracing() {
+		netLog.Debug("frame received", logging.KeyPeer, conn.RemoteAddr().String(), logging.KeyFrame, string(jsonMessage))
+	}
 	return jsonMessage, nil
 }
 
 func createMessage(text string, sender string, direction db.Direction) db.Message {
 	return db.Message{
+		ID:        newMessageID(),
 		Text:      text,
 		Sender:    sender,
 		Direction: direction,
@@ -326,6 +547,13 @@ func createMessage(text string, sender string, direction db.Direction) db.Messag
 	}
 }
 
+// Random ID for a new message, the peer stores it under the same one
+func newMessageID() string {
+	id := make([]byte, MESSAGE_ID_SIZE)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 func serializeMessage(message db.Message) ([]byte, error) {
 	jsonData, err := json.Marshal(message)
 	return jsonData, err
@@ -337,18 +565,32 @@ func deserializeJsonMessage(jsonData []byte) (db.Message, error) {
 	return message, err
 }
 
-func handleDbAndReceiveMessage(jsonData []byte, dbHandler *db.DbHandler) (db.Message, error) {
+// Save a message that arrived on a connection whose peer proved the key, hex encoded
+func handleDbAndReceiveMessage(jsonData []byte, senderKey string, dbHandler *db.DbHandler) (db.Message, error) {
 	message, err := deserializeJsonMessage(jsonData)
 	if err != nil {
-		log.Println("Error deserializing JSON message: ", err)
+		netLog.Warn("could not decode message", logging.KeyErr, err)
 		return message, err
 	}
 
 	message.Direction = db.Incoming
+	message.Peer = message.Sender
+	message.SenderKey = senderKey
+	// Peers on older versions send no ID, the timer needs one to start once the message is read
+	if message.ID == "" {
+		message.ID = newMessageID()
+	}
+	// The timer starts once we read the message, not when the sender did, and within the bounds we accept
+	message.ExpiresAt = nil
+	if message.Timer < 0 {
+		message.Timer = 0
+	} else if validateTimer(time.Duration(message.Timer)*time.Second) != nil {
+		message.Timer = min(max(message.Timer, int64(MIN_TIMER/time.Second)), int64(MAX_TIMER/time.Second))
+	}
 
 	err = dbHandler.SaveMessage(message)
 	if err != nil {
-		log.Println("Error saving message to DB: ", err)
+		dbLog.Error("could not save incoming message", logging.KeyErr, err)
 		return message, err
 	}
 
@@ -358,103 +600,36 @@ func handleDbAndReceiveMessage(jsonData []byte, dbHandler *db.DbHandler) (db.Mes
 func handleDbAndSendMessage(message db.Message, conn net.Conn, dbHandler *db.DbHandler) (db.Message, error) {
 	err := dbHandler.SaveMessage(message)
 	if err != nil {
-		log.Println("Error saving message to DB: ", err)
+		dbLog.Error("could not save outgoing message", logging.KeyErr, err)
 	}
 
 	jsonData, err := serializeMessage(message)
 	if err != nil {
-		log.Println("Error marshalling message: ", err)
+		netLog.Error("could not encode message", logging.KeyErr, err)
 		return message, err
 	}
 
+	traceFrameSent(conn, jsonData)
 	// The newline enables reader to actually parse the delimiter appropriately
 	_, err = conn.Write(append(jsonData, '\n'))
 
 	if err != nil {
-		log.Printf("error sending messageL %v", err)
+		netLog.Warn("could not send message", logging.KeyPeer, conn.RemoteAddr().String(), logging.KeyErr, err)
 		return message, err
 	}
 
 	return message, nil
 }
 
-func handleDbAndSendMessageCmd(message db.Message, conn net.Conn, dbHandler *db.DbHandler) tea.Cmd {
-	return func() tea.Msg {
-		msg, err := handleDbAndSendMessage(message, conn, dbHandler)
-		if err != nil {
-			return errorOnMessageSend{err: err}
-		}
-
-		return msg
-	}
-}
-
-func handleDbAndReceiveMessageCmd(jsonData []byte, dbHandler *db.DbHandler) tea.Cmd {
-	return func() tea.Msg {
-		msg, err := handleDbAndReceiveMessage(jsonData, dbHandler)
-		if err != nil {
-			return errorOnMessageReceive{err: err}
-		}
-
-		return msg
-	}
-}
-
 func validatePort(port string) bool {
 	portNumber, err := strconv.Atoi(port)
 	if err != nil {
-		log.Printf("%s is not valid port number due to not being integer:", port)
+		netLog.Debug("port is not a number", "port", port)
 		return false
 	}
 	if !(LOWERBOUND_PORT_NUMBER <= portNumber && portNumber <= UPPERBOUND_PORT_NUMBER) {
-		log.Printf("%d is out of range [%d, %d]", portNumber, LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER)
+		netLog.Debug("port out of range", "port", portNumber, "min", LOWERBOUND_PORT_NUMBER, "max", UPPERBOUND_PORT_NUMBER)
 		return false
 	}
 	return true
 }
-
-// Intelligently wrap text based on max line length and breaks on spaces
-// If a word is longer than the max line length, it will break the word into parts
-func wrapText(text string, maxLineLength int) string {
-	words := strings.Fields(text)
-
-	const LONG_WORD_PADDING int = 2
-	var result strings.Builder
-	var line string
-
-	for _, word := range words {
-		if len(word) > maxLineLength {
-			if len(line) > 0 {
-				if len(line) < maxLineLength {
-					line += " "
-				}
-				result.WriteString(line)
-				result.WriteRune('\n')
-				line = ""
-			}
-			for len(word) > maxLineLength {
-				result.WriteString(word[:maxLineLength-LONG_WORD_PADDING])
-				result.WriteRune('\n')
-				word = word[maxLineLength-LONG_WORD_PADDING:]
-			}
-			if len(word) > 0 {
-				line = word
-			}
-			continue
-		}
-
-		if len(line) == 0 {
-			line = word
-		} else if len(line)+1+len(word) <= maxLineLength {
-			line += " " + word
-		} else {
-			result.WriteString(line)
-			result.WriteRune('\n')
-			line = word
-		}
-	}
-	if len(line) > 0 {
-		result.WriteString(line)
-	}
-	return result.String()
-}
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"bokkoli/internal/db"
 	"testing"
 )
 
@@ -18,3 +19,46 @@ func TestValidatePortNumberInRange(t *testing.T) {
 		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
 	}
 }
+
+func TestMentions(t *testing.T) {
+	cases := map[string]bool{
+		"@alice can you look":   true,
+		"thanks @Alice!":        true,
+		"ping @alice-bot":       false,
+		"alice without the at":  false,
+		"@alicex and @alice_2":  false,
+		"cc @bob, then @alice.": true,
+	}
+	for text, expected := range cases {
+		if mentions(text, "alice") != expected {
+			t.Errorf("%q: expected %v", text, expected)
+		}
+	}
+	if mentions("@ hello", "") {
+		t.Error("Expected no mentions without a username")
+	}
+}
+
+// The check mark goes by the key a message's connection proved, a verified peer's name alone doesn't earn it
+func TestVerifiedSender(t *testing.T) {
+	m := &ChatModel{peers: map[string]*peerStatus{
+		"localhost:1": {name: "bob", key: "b0b", verified: true},
+		"localhost:2": {name: "bob", key: "e7e"},
+	}}
+
+	tests := map[string]struct {
+		message  db.Message
+		verified bool
+	}{
+		"verified key":      {db.Message{Sender: "bob", SenderKey: "b0b", Direction: db.Incoming}, true},
+		"same name":         {db.Message{Sender: "bob", SenderKey: "e7e", Direction: db.Incoming}, false},
+		"no key":            {db.Message{Sender: "bob", Direction: db.Incoming}, false},
+		"our own":           {db.Message{Sender: "bob", SenderKey: "b0b", Direction: db.Outgoing}, false},
+		"verified, renamed": {db.Message{Sender: "robert", SenderKey: "b0b", Direction: db.Incoming}, true},
+	}
+	for name, test := range tests {
+		if verified := m.verifiedSender(test.message); verified != test.verified {
+			t.Errorf("%s: expected %v, got %v", name, test.verified, verified)
+		}
+	}
+}
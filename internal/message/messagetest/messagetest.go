@@ -0,0 +1,31 @@
+// Package messagetest sets up nodes for the tests of packages built on top of message.
+package messagetest
+
+import (
+	"bokkoli/internal/db/dbtest"
+	"bokkoli/internal/message"
+	"net"
+	"testing"
+)
+
+// A node on a database of its own, closed after the test
+func NewNode(t testing.TB, username string) *message.Node {
+	t.Helper()
+	node := message.NewNode(dbtest.New(t), username)
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// The port a backend listening on "0" was given
+func ListenPort(t testing.TB, backend message.Backend) string {
+	t.Helper()
+	status, err := backend.Status()
+	if err != nil {
+		t.Fatal("Got an error reading the status: ", err)
+	}
+	_, port, err := net.SplitHostPort(status.ListenAddress)
+	if err != nil {
+		t.Fatalf("Expected a listen address, got %q", status.ListenAddress)
+	}
+	return port
+}
@@ -0,0 +1,568 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"bokkoli/internal/logging"
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventListening    EventType = "listening"
+	EventConnected    EventType = "connected"
+	EventDisconnected EventType = "disconnected"
+	EventMessage      EventType = "message"
+	EventLatency      EventType = "latency"
+	EventError        EventType = "error"
+	// A peer that isn't in the contacts wants to connect to us, answer with Decide
+	EventRequest EventType = "request"
+	// A peer that connected to us was turned away, Error says why
+	EventRejected EventType = "rejected"
+	// Either side changed the disappearing message timer of the conversation, Timer holds the seconds
+	EventTimer EventType = "timer"
+)
+
+const EVENT_BUFFER_SIZE int = 64
+
+// Something that happened on a Node, delivered to every subscriber
+type Event struct {
+	Type EventType `json:"type"`
+	// Remote address of the connection the event is about
+	Peer string `json:"peer,omitempty"`
+	// Username the peer introduced itself with, once known
+	Name string `json:"name,omitempty"`
+	// Hex encoded identity key the peer proved it holds, and its fingerprint
+	Key         string      `json:"key,omitempty"`
+	Fingerprint string      `json:"fingerprint,omitempty"`
+	Incoming    bool        `json:"incoming,omitempty"`
+	Message     *db.Message `json:"message,omitempty"`
+	// Set on incoming messages that mention our username as @username
+	Mention bool      `json:"mention,omitempty"`
+	Latency string    `json:"latency,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Timer   int64     `json:"timer,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Told about every event in the goroutine that caused it, before subscribers. Unlike a subscriber,
+// a hook never misses an event, so it must hand slow work off instead of blocking. Closed along with the Node.
+type Hook interface {
+	HandleEvent(event Event)
+	Close() error
+}
+
+// Headless Bokkoli peer: owns the listener, the peer connections and the database writes,
+// and reports everything that happens as events. Used wherever there is no Bubbletea program to drive it.
+type Node struct {
+	dbHandler   *db.DbHandler
+	username    string
+	bindAddress string
+
+	mu          sync.Mutex
+	listener    net.Listener
+	peers       map[string]net.Conn // outgoing connections by dialed address
+	names       map[string]string   // usernames by address
+	incoming    map[net.Conn]struct{}
+	subscribers map[chan Event]struct{}
+	hooks       []Hook
+	closed      bool
+
+	roomPassword string
+	authFailures map[string][]time.Time // recent failed challenges by remote host
+	identity     ed25519.PrivateKey
+	keys         map[string]ed25519.PublicKey // identity keys peers proved, by address
+	policy       PeerPolicy
+	requests     map[string]chan Decision // peers waiting for a Decide, by address
+	timerAcks    map[string]chan int64    // SetTimer calls waiting for the peer to agree, by address
+	quit         chan struct{}            // closed along with the Node
+}
+
+func NewNode(dbHandler *db.DbHandler, username string) *Node {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		logging.Fatal(netLog, "could not generate an identity key", logging.KeyErr, err)
+	}
+	n := &Node{
+		dbHandler:    dbHandler,
+		username:     username,
+		peers:        make(map[string]net.Conn),
+		names:        make(map[string]string),
+		incoming:     make(map[net.Conn]struct{}),
+		subscribers:  make(map[chan Event]struct{}),
+		authFailures: make(map[string][]time.Time),
+		identity:     key,
+		keys:         make(map[string]ed25519.PublicKey),
+		policy:       PolicyAccept,
+		requests:     make(map[string]chan Decision),
+		timerAcks:    make(map[string]chan int64),
+		quit:         make(chan struct{}),
+	}
+	go dbHandler.PurgeLoop(PURGE_INTERVAL, n.quit)
+	return n
+}
+
+func (n *Node) Username() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.username
+}
+
+func (n *Node) SetUsername(username string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.username = username
+	return nil
+}
+
+// Host to accept connections on, every interface when empty; applies to the next Listen
+func (n *Node) SetBindAddress(host string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.bindAddress = host
+}
+
+// Receive every event from now on; call the returned function to stop
+func (n *Node) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, EVENT_BUFFER_SIZE)
+
+	n.mu.Lock()
+	n.subscribers[events] = struct{}{}
+	n.mu.Unlock()
+
+	unsubscribe := func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.subscribers[events]; ok {
+			delete(n.subscribers, events)
+			close(events)
+		}
+	}
+	return events, unsubscribe
+}
+
+// Run the hook on every event from now on
+func (n *Node) AddHook(hook Hook) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hooks = append(n.hooks, hook)
+}
+
+// Purge, apply the retention policy to and vacuum the database every interval, until the Node is closed
+func (n *Node) StartMaintenance(retention db.Retention, interval time.Duration) {
+	go n.dbHandler.MaintenanceLoop(retention, interval, n.quit)
+}
+
+func (n *Node) publish(event Event) {
+	event.Time = time.Now()
+
+	n.mu.Lock()
+	hooks := n.hooks
+	n.mu.Unlock()
+	for _, hook := range hooks {
+		hook.HandleEvent(event)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for events := range n.subscribers {
+		select {
+		case events <- event:
+		default:
+			netLog.Warn("subscriber is not keeping up, dropping event", "event", event.Type)
+		}
+	}
+}
+
+func (n *Node) publishError(peer string, err error) {
+	n.publish(Event{Type: EventError, Peer: peer, Error: err.Error()})
+}
+
+// Start accepting connections on the port, "0" picks a free one that Status then reports
+func (n *Node) Listen(port string) error {
+	if port != "0" && !validatePort(port) {
+		return fmt.Errorf("only ports in the range %d-%d are allowed, got %q", LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER, port)
+	}
+
+	n.mu.Lock()
+	if n.listener != nil {
+		n.mu.Unlock()
+		return fmt.Errorf("already listening on %s", n.listener.Addr())
+	}
+	bindAddress := n.bindAddress
+	n.mu.Unlock()
+
+	listener, err := startServer(bindAddress, port)
+	if err != nil {
+		return fmt.Errorf("port %s is already in use, select a different port", port)
+	}
+
+	n.mu.Lock()
+	n.listener = listener
+	n.mu.Unlock()
+
+	n.publish(Event{Type: EventListening, Peer: listener.Addr().String()})
+	go n.acceptLoop(listener)
+	return nil
+}
+
+func (n *Node) ListenAddress() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listener == nil {
+		return ""
+	}
+	return n.listener.Addr().String()
+}
+
+func (n *Node) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			netLog.Warn("could not accept connection", logging.KeyErr, err)
+			continue
+		}
+
+		if n.authBlocked(remoteHost(conn), time.Now()) {
+			netLog.Debug("refusing connection after too many failed attempts", logging.KeyPeer, conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go n.accept(conn)
+	}
+}
+
+// Let a peer in once it proved its identity key, and the room password if there is one, and we accepted it.
+// Then read from it.
+func (n *Node) accept(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	hello, err := n.challengePeer(conn, reader)
+	if err != nil {
+		n.rejectPeer(conn, hello, err)
+		return
+	}
+	n.clearAuthFailures(remoteHost(conn))
+	if err := n.admit(conn, hello); err != nil {
+		n.rejectPeer(conn, hello, err)
+		return
+	}
+
+	address := conn.RemoteAddr().String()
+	n.mu.Lock()
+	n.incoming[conn] = struct{}{}
+	n.keys[address] = hello.key
+	if hello.name != "" {
+		n.names[address] = hello.name
+	}
+	n.mu.Unlock()
+
+	netLog.Info("peer connected", logging.KeyPeer, address, "incoming", true)
+	n.publish(Event{Type: EventConnected, Peer: address, Name: hello.name, Key: hex.EncodeToString(hello.key), Fingerprint: identity.Fingerprint(hello.key), Incoming: true})
+	if hello.ping != nil {
+		if err := sendPong(conn, *hello.ping, n.Username()); err != nil {
+			conn.Close()
+		}
+	}
+	n.readLoop(conn, reader, address, true)
+}
+
+// Dial a peer by "port" or "host:port" and keep the connection for sending
+func (n *Node) Connect(address string) (string, error) {
+	host, port := splitAddress(address)
+	if !validatePort(port) {
+		return "", fmt.Errorf("only ports in the range %d-%d are allowed, got %q", LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER, port)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	address = net.JoinHostPort(host, port)
+
+	n.mu.Lock()
+	_, exists := n.peers[address]
+	n.mu.Unlock()
+	if exists {
+		return address, fmt.Errorf("already connected to %s", address)
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return address, fmt.Errorf("could not connect to %s: %v", address, err)
+	}
+	reader := bufio.NewReader(conn)
+	pong, key, err := n.handshake(conn, reader)
+	if err != nil {
+		conn.Close()
+		netLog.Warn("handshake failed", logging.KeyPeer, address, logging.KeyErr, err)
+		return address, fmt.Errorf("could not connect to %s: %v", address, err)
+	}
+
+	n.mu.Lock()
+	n.peers[address] = conn
+	event := Event{Type: EventConnected, Peer: address}
+	if key != nil {
+		n.keys[address] = key
+		event.Key = hex.EncodeToString(key)
+		event.Fingerprint = identity.Fingerprint(key)
+	}
+	n.mu.Unlock()
+
+	netLog.Info("peer connected", logging.KeyPeer, address, "incoming", false)
+	n.publish(event)
+	n.handlePong(address, pong)
+	go n.readLoop(conn, reader, address, false)
+	go n.pingLoop(conn, address)
+	return address, nil
+}
+
+// Addresses of the peers we can send to
+func (n *Node) Peers() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addresses := make([]string, 0, len(n.peers))
+	for address := range n.peers {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// Username a peer introduced itself with, or its address when unknown
+func (n *Node) PeerName(address string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if name, ok := n.names[address]; ok {
+		return name
+	}
+	return address
+}
+
+// Resolve a peer by address or username; an empty name picks the only connected peer.
+// Peers that connected to us are only found by the exact address they connected from.
+func (n *Node) resolvePeer(to string) (string, net.Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if to == "" {
+		if len(n.peers) != 1 {
+			return "", nil, fmt.Errorf("connected to %d peers, say who to send to", len(n.peers))
+		}
+		for address, conn := range n.peers {
+			return address, conn, nil
+		}
+	}
+
+	if conn, ok := n.peers[to]; ok {
+		return to, conn, nil
+	}
+	host, port := splitAddress(to)
+	if host == "" {
+		host = "localhost"
+	}
+	if conn, ok := n.peers[net.JoinHostPort(host, port)]; ok {
+		return net.JoinHostPort(host, port), conn, nil
+	}
+	for address, name := range n.names {
+		if conn, ok := n.peers[address]; ok && name == to {
+			return address, conn, nil
+		}
+	}
+	for conn := range n.incoming {
+		if conn.RemoteAddr().String() == to {
+			return to, conn, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("not connected to %s", to)
+}
+
+// Save and send a chat message to a connected peer, or back over a connection a peer opened to us
+func (n *Node) Send(to string, text string) (db.Message, error) {
+	address, conn, err := n.resolvePeer(to)
+	if err != nil {
+		return db.Message{}, err
+	}
+
+	message := createMessage(text, n.Username(), db.Outgoing)
+	message.Peer = n.PeerName(address)
+	n.applyTimer(&message)
+
+	message, err = handleDbAndSendMessage(message, conn, n.dbHandler)
+	if err != nil {
+		n.dropPeer(address, conn)
+		return message, fmt.Errorf("message not sent: %v", err)
+	}
+
+	n.publish(Event{Type: EventMessage, Peer: address, Name: message.Peer, Message: &message})
+	return message, nil
+}
+
+// Read frames until the connection fails; answers pings, saves messages and reports pongs as latency
+func (n *Node) readLoop(conn net.Conn, reader *bufio.Reader, address string, incoming bool) {
+	defer func() {
+		if incoming {
+			n.mu.Lock()
+			delete(n.incoming, conn)
+			n.mu.Unlock()
+			conn.Close()
+		} else {
+			n.dropPeer(address, conn)
+		}
+		netLog.Info("peer disconnected", logging.KeyPeer, address, "incoming", incoming)
+		n.publish(Event{Type: EventDisconnected, Peer: address, Name: n.PeerName(address), Incoming: incoming})
+	}()
+
+	for {
+		jsonData, err := handleListenerConn(conn, reader)
+		if err != nil {
+			return
+		}
+
+		f, err := decodeFrame(jsonData)
+		if err != nil {
+			n.publishError(address, fmt.Errorf("received a malformed message: %v", err))
+			continue
+		}
+
+		n.learnName(address, f)
+
+		switch f.Type {
+		case pingFrame:
+			if err := sendPong(conn, f, n.Username()); err != nil {
+				return
+			}
+		case pongFrame:
+			n.handlePong(address, f)
+		case timerFrame:
+			if err := n.acceptTimer(conn, address, f); err != nil {
+				return
+			}
+		case timerAckFrame:
+			n.confirmTimer(address, f)
+		case messageFrame:
+			message, err := handleDbAndReceiveMessage(jsonData, n.peerKey(address), n.dbHandler)
+			if err != nil {
+				n.publishError(address, fmt.Errorf("could not read an incoming message: %v", err))
+				continue
+			}
+			n.publish(Event{
+				Type: EventMessage, Peer: address, Name: message.Sender, Incoming: true, Message: &message,
+				Mention: mentions(message.Text, n.Username()),
+			})
+		default:
+			netLog.Debug("ignoring unknown frame type", "type", f.Type)
+		}
+	}
+}
+
+func (n *Node) learnName(address string, f frame) {
+	if f.Sender != "" {
+		n.mu.Lock()
+		n.names[address] = f.Sender
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) handlePong(address string, pong frame) {
+	n.learnName(address, pong)
+	latency := time.Since(pong.Timestamp).Round(time.Millisecond)
+	n.publish(Event{Type: EventLatency, Peer: address, Name: pong.Sender, Latency: latency.String()})
+}
+
+// Keep pinging after the handshake's ping until the connection is replaced or dropped
+func (n *Node) pingLoop(conn net.Conn, address string) {
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		n.mu.Lock()
+		current, ok := n.peers[address]
+		n.mu.Unlock()
+		if !ok || current != conn {
+			return
+		}
+
+		if err := sendPing(conn, n.Username()); err != nil {
+			return
+		}
+	}
+}
+
+func (n *Node) dropPeer(address string, conn net.Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if current, ok := n.peers[address]; ok && current == conn {
+		delete(n.peers, address)
+	}
+	conn.Close()
+}
+
+// Close the listener and every connection, and end all subscriptions
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.quit)
+	defer n.mu.Unlock()
+
+	var err error
+	if n.listener != nil {
+		err = n.listener.Close()
+	}
+	for _, conn := range n.peers {
+		conn.Close()
+	}
+	for conn := range n.incoming {
+		conn.Close()
+	}
+	for events := range n.subscribers {
+		delete(n.subscribers, events)
+		close(events)
+	}
+	for _, hook := range n.hooks {
+		if hookErr := hook.Close(); hookErr != nil && err == nil {
+			err = hookErr
+		}
+	}
+	return err
+}
+
+// Whether the text contains @username as a whole word, ignoring case
+func mentions(text string, username string) bool {
+	if username == "" {
+		return false
+	}
+	mention := "@" + strings.ToLower(username)
+	lower := strings.ToLower(text)
+	for start := 0; ; {
+		i := strings.Index(lower[start:], mention)
+		if i < 0 {
+			return false
+		}
+		end := start + i + len(mention)
+		if end == len(lower) || !isWordByte(lower[end]) {
+			return true
+		}
+		start = end
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b == '-' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 0x80
+}
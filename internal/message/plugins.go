@@ -0,0 +1,234 @@
+package message
+
+import (
+	"bokkoli/internal/command"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/plugin"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// How often plugins are asked for their status bar widget
+const PLUGIN_STATUS_INTERVAL time.Duration = 5 * time.Second
+
+// Widgets longer than this are cut off so the status bar stays on one line
+const MAX_WIDGET_WIDTH int = 24
+
+// Status bar widgets by plugin name, tagged with the host that produced them like events are with their subscription
+type pluginStatus struct {
+	host    *plugin.Host
+	widgets map[string]string
+}
+
+// What a plugin command produced, sent to the active peer when Send is set
+type pluginResult struct {
+	plugin string
+	result plugin.CommandResult
+	err    error
+}
+
+func pluginStatusCmd(host *plugin.Host, delay time.Duration) tea.Cmd {
+	return tea.Tick(delay, func(time.Time) tea.Msg {
+		return pluginStatus{host: host, widgets: host.Status()}
+	})
+}
+
+// Start the plugins enabled in settings; one that fails to start is reported in the log and by /plugins
+func (m *ChatModel) startPlugins() {
+	enabled, err := m.dbHandler.ReadEnabledPlugins()
+	if err != nil {
+		uiLog.Warn("could not read enabled plugins", logging.KeyErr, err)
+		return
+	}
+	for _, name := range enabled {
+		if err := m.startPlugin(name); err != nil {
+			uiLog.Warn("could not start plugin", "plugin", name, logging.KeyErr, err)
+		}
+	}
+}
+
+// Start a plugin and register the commands it declared; commands clashing with existing ones are skipped
+func (m *ChatModel) startPlugin(name string) error {
+	manifest, err := m.plugins.Start(name)
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range manifest.Commands {
+		err := m.commands.Register(command.Command{
+			Name: spec.Name,
+			Args: []command.Arg{{Name: "args", Rest: true}},
+			Help: spec.Help + " (plugin " + name + ")",
+			Run: func(args []string) tea.Cmd {
+				return pluginCommandCmd(m.plugins, name, spec.Name, m.active, args)
+			},
+		})
+		if err != nil {
+			uiLog.Warn("plugin command not registered", "plugin", name, logging.KeyErr, err)
+			continue
+		}
+		m.pluginCommands[name] = append(m.pluginCommands[name], spec.Name)
+	}
+	return nil
+}
+
+func (m *ChatModel) stopPlugin(name string) error {
+	for _, cmd := range m.pluginCommands[name] {
+		m.commands.Unregister(cmd)
+	}
+	delete(m.pluginCommands, name)
+	delete(m.widgets, name)
+	return m.plugins.Stop(name)
+}
+
+func pluginCommandCmd(host *plugin.Host, name string, cmd string, peer string, args []string) tea.Cmd {
+	return func() tea.Msg {
+		var fields []string
+		if len(args) > 0 {
+			fields = strings.Fields(args[0])
+		}
+		result, err := host.Command(name, cmd, peer, fields)
+		return pluginResult{plugin: name, result: result, err: err}
+	}
+}
+
+func (m *ChatModel) applyPluginResult(msg pluginResult) tea.Cmd {
+	if msg.err != nil {
+		return errorCmd(msg.err.Error())
+	}
+
+	var cmds []tea.Cmd
+	if msg.result.Notice != "" {
+		cmds = append(cmds, infoCmd(msg.result.Notice))
+	}
+	if msg.result.Send != "" {
+		if m.active == "" {
+			return errorCmd(msg.plugin + " wanted to send a message, but you're not chatting with anyone")
+		}
+		cmds = append(cmds, sendCmd(m.backend, m.plugins, m.active, msg.result.Send))
+	}
+	return tea.Batch(cmds...)
+}
+
+// /plugins lists the installed plugins, /plugin enable|disable <name> switches one and saves it to the settings
+func (m *ChatModel) pluginBuiltins() []command.Command {
+	return []command.Command{
+		{
+			Name: "plugins",
+			Help: "List the installed plugins and what they may do.",
+			Run: func(args []string) tea.Cmd {
+				return m.showPlugins()
+			},
+		},
+		{
+			Name: "plugin",
+			Args: []command.Arg{
+				{Name: "enable|disable", Required: true, Validate: validatePluginAction, Complete: completePluginAction},
+				{Name: "name", Required: true, Complete: m.completePlugin},
+			},
+			Help: "Enable or disable an installed plugin for this profile.",
+			Run: func(args []string) tea.Cmd {
+				return m.togglePlugin(args[0] == "enable", args[1])
+			},
+		},
+	}
+}
+
+func (m *ChatModel) showPlugins() tea.Cmd {
+	installed, err := plugin.Installed(m.plugins.Dir())
+	if len(installed) == 0 {
+		if err != nil {
+			return errorCmd(err.Error())
+		}
+		return infoCmd("no plugins installed, see 'bokkoli plugin install'")
+	}
+
+	running := make(map[string]bool)
+	for _, manifest := range m.plugins.Running() {
+		running[manifest.Name] = true
+	}
+	var lines []string
+	for _, manifest := range installed {
+		state := "disabled"
+		if running[manifest.Name] {
+			state = "enabled"
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", manifest.Name, state, strings.Join(manifest.Describe(), ", ")))
+	}
+	if err != nil {
+		lines = append(lines, err.Error())
+	}
+	return infoCmd(strings.Join(lines, "; "))
+}
+
+func (m *ChatModel) togglePlugin(enable bool, name string) tea.Cmd {
+	running := false
+	for _, manifest := range m.plugins.Running() {
+		running = running || manifest.Name == name
+	}
+
+	switch {
+	case enable && running:
+		return infoCmd(name + " is already enabled")
+	case enable:
+		if err := m.startPlugin(name); err != nil {
+			return errorCmd(err.Error())
+		}
+	case running:
+		if err := m.stopPlugin(name); err != nil {
+			return errorCmd(err.Error())
+		}
+	default:
+		return infoCmd(name + " is already disabled")
+	}
+
+	if err := m.dbHandler.SetPluginEnabled(name, enable); err != nil {
+		uiLog.Error("could not save plugin setting", "plugin", name, logging.KeyErr, err)
+		return errorCmd("plugin switched for this session only, saving failed")
+	}
+	if enable {
+		return infoCmd(name + " enabled")
+	}
+	return infoCmd(name + " disabled")
+}
+
+func validatePluginAction(action string) error {
+	if action != "enable" && action != "disable" {
+		return fmt.Errorf("expected 'enable' or 'disable'")
+	}
+	return nil
+}
+
+func completePluginAction(partial string) []string {
+	return []string{"enable", "disable"}
+}
+
+func (m *ChatModel) completePlugin(partial string) []string {
+	installed, _ := plugin.Installed(m.plugins.Dir())
+	names := make([]string, len(installed))
+	for i, manifest := range installed {
+		names[i] = manifest.Name
+	}
+	return names
+}
+
+// Status bar segment with every plugin widget, empty when there are none
+func (m *ChatModel) widgetsView() string {
+	names := make([]string, 0, len(m.widgets))
+	for name, text := range m.widgets {
+		if text != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	widgets := make([]string, len(names))
+	for i, name := range names {
+		widgets[i] = truncateText(m.widgets[name], MAX_WIDGET_WIDTH)
+	}
+	return strings.Join(widgets, noticeStyle().Render(" · "))
+}
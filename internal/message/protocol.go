@@ -0,0 +1,73 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+type frameType string
+
+const (
+	// Chat messages carry no type so older versions can still read them as a plain db.Message
+	messageFrame frameType = ""
+	pingFrame    frameType = "ping"
+	pongFrame    frameType = "pong"
+	// Room password handshake, see auth.go
+	challengeFrame frameType = "challenge"
+	authFrame      frameType = "auth"
+	welcomeFrame   frameType = "welcome"
+	waitFrame      frameType = "wait"
+	rejectFrame    frameType = "reject"
+	// Disappearing message timer proposed by one side and confirmed by the other, see timer.go
+	timerFrame    frameType = "timer"
+	timerAckFrame frameType = "timer_ack"
+)
+
+// A single JSON line on the wire. Control frames reuse the message fields, a ping's Timestamp is echoed back in the pong.
+type frame struct {
+	Type frameType `json:"type,omitempty"`
+	// Only set during the handshake: a random challenge or nonce, the HMAC proving the room password,
+	// the sender's identity key and its signature over both nonces
+	Nonce            string `json:"nonce,omitempty"`
+	Proof            string `json:"proof,omitempty"`
+	Key              string `json:"key,omitempty"`
+	Signature        string `json:"signature,omitempty"`
+	PasswordRequired bool   `json:"password_required,omitempty"`
+	db.Message
+}
+
+func decodeFrame(jsonData []byte) (frame, error) {
+	var f frame
+	err := json.Unmarshal(jsonData, &f)
+	return f, err
+}
+
+func writeFrame(conn net.Conn, f frame) error {
+	jsonData, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	traceFrameSent(conn, jsonData)
+	// The newline enables reader to actually parse the delimiter appropriately
+	_, err = conn.Write(append(jsonData, '\n'))
+	return err
+}
+
+func traceFrameSent(conn net.Conn, jsonData []byte) {
+	if logging.Tracing() {
+		netLog.Debug("frame sent", logging.KeyPeer, conn.RemoteAddr().String(), logging.KeyFrame, string(jsonData))
+	}
+}
+
+func sendPing(conn net.Conn, sender string) error {
+	return writeFrame(conn, frame{Type: pingFrame, Message: db.Message{Sender: sender, Timestamp: time.Now()}})
+}
+
+// Answer a ping on the connection it arrived on, so the round trip only depends on that one link
+func sendPong(conn net.Conn, ping frame, sender string) error {
+	return writeFrame(conn, frame{Type: pongFrame, Message: db.Message{Sender: sender, Timestamp: ping.Timestamp}})
+}
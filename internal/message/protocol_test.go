@@ -0,0 +1,60 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecodeLegacyMessageFrame(t *testing.T) {
+	jsonData, err := serializeMessage(createMessage("hello", "Pickle132", db.Outgoing))
+	if err != nil {
+		t.Fatal("Got an error serializing message: ", err)
+	}
+
+	f, err := decodeFrame(jsonData)
+	if err != nil {
+		t.Fatal("Got an error decoding frame: ", err)
+	}
+
+	if f.Type != messageFrame || f.Text != "hello" {
+		t.Errorf("Expected a message frame with text 'hello', got %q with %q", f.Type, f.Text)
+	}
+}
+
+func TestPingPongEchoesTimestamp(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go sendPing(client, "alice")
+
+	reader := bufio.NewReader(server)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatal("Got an error reading ping: ", err)
+	}
+
+	ping, err := decodeFrame(line)
+	if err != nil || ping.Type != pingFrame || ping.Sender != "alice" {
+		t.Fatalf("Expected a ping from alice, got %+v (%v)", ping, err)
+	}
+
+	go sendPong(server, ping, "bob")
+
+	line, err = bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal("Got an error reading pong: ", err)
+	}
+
+	pong, _ := decodeFrame(line)
+	if pong.Type != pongFrame || !pong.Timestamp.Equal(ping.Timestamp) {
+		t.Errorf("Expected a pong echoing %v, got %+v", ping.Timestamp, pong)
+	}
+
+	if latency := time.Since(pong.Timestamp); latency < 0 || latency > time.Second {
+		t.Errorf("Expected a small positive latency, got %v", latency)
+	}
+}
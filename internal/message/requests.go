@@ -0,0 +1,76 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Keys answering the connection request shown above the input line
+var requestKeys = map[string]Decision{
+	"a": DecisionAccept,
+	"A": DecisionAlways,
+	"d": DecisionDeny,
+	"b": DecisionBlock,
+}
+
+func decideCmd(backend Backend, event Event, decision Decision) tea.Cmd {
+	return func() tea.Msg {
+		if err := backend.Decide(event.Peer, decision); err != nil {
+			return toast{level: toastError, text: err.Error()}
+		}
+		switch decision {
+		case DecisionAlways:
+			return toast{level: toastInfo, text: requestName(event) + " added to your contacts"}
+		case DecisionBlock:
+			return toast{level: toastInfo, text: requestName(event) + " blocked"}
+		case DecisionDeny:
+			return toast{level: toastInfo, text: requestName(event) + " denied"}
+		}
+		return nil
+	}
+}
+
+// Answer the oldest request when the key is one of requestKeys; while a request is shown, other keys do nothing
+func (m *ChatModel) answerRequest(key string) tea.Cmd {
+	decision, ok := requestKeys[key]
+	if !ok {
+		return nil
+	}
+	event := m.requests[0]
+	m.requests = m.requests[1:]
+	return decideCmd(m.backend, event, decision)
+}
+
+// Forget a request once the peer got in or was turned away, whoever decided
+func (m *ChatModel) dropRequest(address string) {
+	for i, event := range m.requests {
+		if event.Peer == address {
+			m.requests = append(m.requests[:i], m.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+func requestName(event Event) string {
+	if event.Name == "" {
+		return event.Peer
+	}
+	return event.Name
+}
+
+func (m *ChatModel) requestView() string {
+	event := m.requests[0]
+	var view strings.Builder
+	view.WriteString(commandStyle().Render(requestName(event)+" wants to connect") + "\n\n")
+	view.WriteString(fmt.Sprintf("%-12s %s\n", "address", event.Peer))
+	view.WriteString(fmt.Sprintf("%-12s %s\n", "username", event.Name))
+	view.WriteString(fmt.Sprintf("%-12s %s\n\n", "fingerprint", event.Fingerprint))
+	view.WriteString(fmt.Sprintf("%s accept once  %s always accept  %s deny  %s block",
+		commandStyle().Render("a"), commandStyle().Render("A"), commandStyle().Render("d"), commandStyle().Render("b")))
+	if len(m.requests) > 1 {
+		view.WriteString("\n" + noticeStyle().Render(fmt.Sprintf("%d more waiting", len(m.requests)-1)))
+	}
+	return helpStyle().Render(view.String())
+}
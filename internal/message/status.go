@@ -0,0 +1,196 @@
+package message
+
+import (
+	"bokkoli/internal/theme"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	PING_INTERVAL  time.Duration = 5 * time.Second
+	TOAST_DURATION time.Duration = 4 * time.Second
+	// Rejected connection attempts kept for /rejected
+	MAX_REJECTIONS int = 20
+)
+
+type connState string
+
+const (
+	stateOffline      connState = "offline"
+	stateConnecting   connState = "connecting"
+	stateConnected    connState = "connected"
+	stateDisconnected connState = "disconnected"
+	stateFailed       connState = "failed"
+)
+
+// What we know about one connection, keyed by its address in ChatModel.peers.
+// Outgoing connections are the ones we dialed and send on, incoming ones were dialed by the peer.
+type peerStatus struct {
+	name     string
+	incoming bool
+	state    connState
+	latency  time.Duration
+	// Hex encoded identity key, and whether its safety number was compared
+	key      string
+	verified bool
+}
+
+// A connection attempt that failed the room password challenge
+type rejection struct {
+	address string
+	reason  string
+	time    time.Time
+}
+
+type toastLevel int
+
+const (
+	toastInfo toastLevel = iota
+	toastError
+)
+
+// Transient feedback shown above the input line until it expires
+type toast struct {
+	id    int
+	level toastLevel
+	text  string
+}
+
+type toastExpired struct {
+	id int
+}
+
+func infoCmd(text string) tea.Cmd {
+	return func() tea.Msg { return toast{level: toastInfo, text: text} }
+}
+
+func errorCmd(text string) tea.Cmd {
+	return func() tea.Msg { return toast{level: toastError, text: text} }
+}
+
+// Show the toast, replacing any previous one, and schedule it to disappear
+func (m *ChatModel) showToast(t toast) tea.Cmd {
+	m.toastCount++
+	t.id = m.toastCount
+	m.toast = &t
+
+	return tea.Tick(TOAST_DURATION, func(time.Time) tea.Msg {
+		return toastExpired{id: t.id}
+	})
+}
+
+// Name of the conversation being shown, the peer's username once known
+func (m *ChatModel) activeConversation() string {
+	if m.active == "" {
+		return "none"
+	}
+	if peer, ok := m.peers[m.active]; ok && peer.name != "" {
+		return peer.name
+	}
+	return m.active
+}
+
+func (m *ChatModel) listenAddress() string {
+	if m.listening == "" {
+		return "not listening"
+	}
+	return "listening on " + m.listening
+}
+
+func sortedPeers(peers map[string]*peerStatus) []string {
+	addresses := make([]string, 0, len(peers))
+	for address := range peers {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func stateView(label string, state connState) string {
+	color := theme.Current().Muted
+	switch state {
+	case stateConnected:
+		color = theme.Current().Success
+	case stateFailed, stateDisconnected:
+		color = theme.Current().Error
+	case stateConnecting:
+		color = theme.Current().Highlight
+	}
+
+	return lipgloss.NewStyle().Foreground(color).Render("● " + label + " " + string(state))
+}
+
+// Persistent bar with our identity, listener, every peer's connection state and the active conversation
+func (m *ChatModel) statusBarView() string {
+	separator := noticeStyle().Render(" │ ")
+
+	username := m.settings.Username
+	if username == "" {
+		username = "(no username)"
+	}
+
+	peers := []string{}
+	for _, address := range sortedPeers(m.peers) {
+		peer := m.peers[address]
+
+		name := address
+		if peer.name != "" {
+			name = peer.name
+		}
+		direction := "out"
+		if peer.incoming {
+			direction = "in"
+		}
+		latency := "–"
+		if peer.latency > 0 {
+			latency = peer.latency.Round(time.Millisecond).String()
+		}
+
+		name = truncateText(name, MAX_SENDER_WIDTH)
+		if mark := verifiedMark(peer); mark != "" {
+			name = mark + " " + name
+		}
+		peers = append(peers, strings.Join([]string{
+			name,
+			stateView(direction, peer.state),
+			noticeStyle().Render(latency),
+		}, " "))
+	}
+	if len(peers) == 0 {
+		peers = append(peers, "no peer")
+	}
+
+	segments := []string{
+		senderStyle().Render(" " + truncateText(username, MAX_SENDER_WIDTH) + " "),
+		noticeStyle().Render(m.listenAddress()),
+		strings.Join(peers, noticeStyle().Render(", ")),
+		noticeStyle().Render("chat: ") + m.activeConversation(),
+	}
+	if timer := m.activeTimer(); timer > 0 {
+		segments[len(segments)-1] += noticeStyle().Render(" ⏱ " + formatTimer(timer))
+	}
+	if len(m.rejected) > 0 {
+		segments = append(segments, lipgloss.NewStyle().Foreground(theme.Current().Error).Render(fmt.Sprintf("%d rejected", len(m.rejected))))
+	}
+	if widgets := m.widgetsView(); widgets != "" {
+		segments = append(segments, widgets)
+	}
+
+	return strings.Join(segments, separator)
+}
+
+func (m *ChatModel) toastView() string {
+	if m.toast == nil {
+		return ""
+	}
+
+	if m.toast.level == toastError {
+		return lipgloss.NewStyle().Foreground(theme.Current().Error).Render("✗ " + m.toast.text)
+	}
+	return lipgloss.NewStyle().Foreground(theme.Current().Success).Render("• " + m.toast.text)
+}
@@ -0,0 +1,148 @@
+package message
+
+import (
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+const ELLIPSIS string = "…"
+
+// Split text into grapheme clusters (user-perceived characters) with their display width in terminal cells.
+// A ZWJ emoji sequence or a Hangul syllable built from jamo is a single cluster.
+func graphemes(text string) ([]string, []int) {
+	var clusters []string
+	var widths []int
+
+	state := -1
+	for len(text) > 0 {
+		var cluster string
+		var width int
+		cluster, text, width, state = uniseg.FirstGraphemeClusterInString(text, state)
+		clusters = append(clusters, cluster)
+		widths = append(widths, width)
+	}
+
+	return clusters, widths
+}
+
+// Display width of text in terminal cells, wide characters such as Hangul, CJK and most emoji count as 2
+func displayWidth(text string) int {
+	return uniseg.StringWidth(text)
+}
+
+// Remove the last n user-perceived characters without splitting a multi-byte rune or grapheme cluster
+func deleteLastNCharacters(s string, n int) string {
+	clusters, _ := graphemes(s)
+	size := len(clusters)
+
+	if size-n < 0 {
+		return s
+	}
+
+	return strings.Join(clusters[:size-n], "")
+}
+
+// Shorten text to fit maxWidth cells, ending in an ellipsis when anything was cut off
+func truncateText(text string, maxWidth int) string {
+	if displayWidth(text) <= maxWidth {
+		return text
+	}
+
+	if maxWidth <= 0 {
+		return ""
+	}
+
+	clusters, widths := graphemes(text)
+	limit := maxWidth - displayWidth(ELLIPSIS)
+
+	var result strings.Builder
+	width := 0
+	for i, cluster := range clusters {
+		if width+widths[i] > limit {
+			break
+		}
+		result.WriteString(cluster)
+		width += widths[i]
+	}
+
+	return result.String() + ELLIPSIS
+}
+
+// Cut text after at most maxWidth cells, only ever between grapheme clusters. At least one cluster is always cut.
+func cutWidth(text string, maxWidth int) (string, string) {
+	state := -1
+	width := 0
+	head := 0
+	rest := text
+
+	for len(rest) > 0 {
+		cluster, next, clusterWidth, newState := uniseg.FirstGraphemeClusterInString(rest, state)
+		if width+clusterWidth > maxWidth && head > 0 {
+			break
+		}
+
+		head += len(cluster)
+		width += clusterWidth
+		rest, state = next, newState
+	}
+
+	return text[:head], rest
+}
+
+// Intelligently wrap text based on max line length and breaks on spaces
+// If a word is longer than the max line length, it will break the word into parts
+// Lengths are display widths in terminal cells, not bytes, so multilingual text and emoji wrap at the right column
+func wrapText(text string, maxLineLength int) string {
+	words := strings.Fields(text)
+
+	const LONG_WORD_PADDING int = 2
+	var result strings.Builder
+	var line string
+	lineWidth := 0
+
+	for _, word := range words {
+		wordWidth := displayWidth(word)
+
+		if wordWidth > maxLineLength {
+			if lineWidth > 0 {
+				if lineWidth < maxLineLength {
+					line += " "
+				}
+				result.WriteString(line)
+				result.WriteRune('\n')
+				line = ""
+				lineWidth = 0
+			}
+
+			for displayWidth(word) > maxLineLength {
+				var chunk string
+				chunk, word = cutWidth(word, max(maxLineLength-LONG_WORD_PADDING, 1))
+				result.WriteString(chunk)
+				result.WriteRune('\n')
+			}
+			if len(word) > 0 {
+				line = word
+				lineWidth = displayWidth(word)
+			}
+			continue
+		}
+
+		if lineWidth == 0 {
+			line = word
+			lineWidth = wordWidth
+		} else if lineWidth+1+wordWidth <= maxLineLength {
+			line += " " + word
+			lineWidth += 1 + wordWidth
+		} else {
+			result.WriteString(line)
+			result.WriteRune('\n')
+			line = word
+			lineWidth = wordWidth
+		}
+	}
+	if lineWidth > 0 {
+		result.WriteString(line)
+	}
+	return result.String()
+}
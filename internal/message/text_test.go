@@ -0,0 +1,106 @@
+package message
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWrapTextKorean(t *testing.T) {
+	// Every Hangul syllable is 2 cells wide, so each 4 syllable word is 8 cells
+	testString := "브로콜리 보끔밥을 맛있게 먹었어요"
+	expected :=
+		"브로콜리 보끔밥을\n" +
+			"맛있게 먹었어요"
+
+	result := wrapText(testString, 18)
+
+	if expected != result {
+		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
+	}
+}
+
+func TestWrapTextLongWideWord(t *testing.T) {
+	// No spaces to break on, the word is split on cell width instead of bytes
+	testString := "一二三四五六七八九十"
+	expected :=
+		"一二三四\n" +
+			"五六七八\n" +
+			"九十"
+
+	result := wrapText(testString, 10)
+
+	if expected != result {
+		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
+	}
+}
+
+func TestWrapTextKeepsGraphemeClusters(t *testing.T) {
+	family := "👨‍👩‍👧‍👦"
+	testString := strings.Repeat(family, 8)
+
+	result := wrapText(testString, 6)
+
+	for _, line := range strings.Split(result, "\n") {
+		if !utf8.ValidString(line) {
+			t.Fatalf("Line %q is not valid UTF-8", line)
+		}
+		if strings.ReplaceAll(line, family, "") != "" {
+			t.Errorf("ZWJ sequence was split apart in line %q", line)
+		}
+		if width := displayWidth(line); width > 6 {
+			t.Errorf("Line %q is %d cells wide, expected at most 6", line, width)
+		}
+	}
+}
+
+func TestWrapTextAccents(t *testing.T) {
+	// "é" written as "e" plus a combining acute accent is still a single cell
+	testString := "café café café"
+	expected :=
+		"café café\n" +
+			"café"
+
+	result := wrapText(testString, 9)
+
+	if expected != result {
+		t.Errorf("Expected \n'%s'\n, got \n'%s'", expected, result)
+	}
+}
+
+func TestDeleteLastCharacterMultibyte(t *testing.T) {
+	tests := map[string]string{
+		"hello": "hell",
+		"보끔":    "보",
+		"hi 👍🏽": "hi ",
+		"café": "caf",
+		"👨‍👩‍👧‍👦👨‍👩‍👧‍👦": "👨‍👩‍👧‍👦",
+		"": "",
+	}
+
+	for input, expected := range tests {
+		if result := deleteLastNCharacters(input, 1); result != expected {
+			t.Errorf("Expected %q, got %q", expected, result)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		text     string
+		width    int
+		expected string
+	}{
+		{"broccoli", 10, "broccoli"},
+		{"broccoli", 5, "broc…"},
+		{"브로콜리", 5, "브로…"},
+		{"브로콜리", 6, "브로…"},
+		{"👨‍👩‍👧‍👦 family", 4, "👨‍👩‍👧‍👦 …"},
+	}
+
+	for _, test := range tests {
+		if result := truncateText(test.text, test.width); result != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, result)
+		}
+	}
+}
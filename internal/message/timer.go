@@ -0,0 +1,270 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	// How long the peer has to agree to a new timer
+	TIMER_ACK_TIMEOUT time.Duration = 5 * time.Second
+	// How often the database is purged of expired messages, and the chat view of the ones it shows
+	PURGE_INTERVAL        time.Duration = 10 * time.Second
+	EXPIRY_CHECK_INTERVAL time.Duration = time.Second
+	// Shortest and longest timer a conversation can have
+	MIN_TIMER time.Duration = time.Minute
+	MAX_TIMER time.Duration = 365 * 24 * time.Hour
+)
+
+// Propose a disappearing message timer to the peer, 0 turns it off. It applies once the peer agreed,
+// to the messages either side sends from then on.
+func (n *Node) SetTimer(to string, timer time.Duration) error {
+	if err := validateTimer(timer); err != nil {
+		return err
+	}
+	address, conn, err := n.resolvePeer(to)
+	if err != nil {
+		return err
+	}
+	name := n.PeerName(address)
+	seconds := int64(timer / time.Second)
+
+	ack := make(chan int64, 1)
+	n.mu.Lock()
+	n.timerAcks[address] = ack
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.timerAcks, address)
+		n.mu.Unlock()
+	}()
+
+	if err := writeFrame(conn, frame{Type: timerFrame, Message: db.Message{Sender: n.Username(), Timer: seconds}}); err != nil {
+		n.dropPeer(address, conn)
+		return fmt.Errorf("timer not sent: %v", err)
+	}
+
+	timeout := time.NewTimer(TIMER_ACK_TIMEOUT)
+	defer timeout.Stop()
+	select {
+	case agreed := <-ack:
+		if agreed != seconds {
+			return fmt.Errorf("%s answered with another timer", name)
+		}
+	case <-timeout.C:
+		return fmt.Errorf("%s did not agree to the timer, it may run an older version of Bokkoli", name)
+	case <-n.quit:
+		return errors.New("closed before the peer agreed to the timer")
+	}
+
+	if err := n.dbHandler.SaveTimer(name, seconds); err != nil {
+		return fmt.Errorf("could not save the timer: %v", err)
+	}
+	netLog.Info("timer set", logging.KeyPeer, address, "seconds", seconds)
+	n.publish(Event{Type: EventTimer, Peer: address, Name: name, Timer: seconds})
+	return nil
+}
+
+// The peer set a timer: take it over for the conversation and confirm it on the same connection
+func (n *Node) acceptTimer(conn net.Conn, address string, proposal frame) error {
+	seconds := max(proposal.Timer, 0)
+	name := n.PeerName(address)
+	// Answering with the timer we keep tells the peer it wasn't taken over
+	if err := validateTimer(time.Duration(seconds) * time.Second); err != nil {
+		netLog.Warn("refused a timer set by peer", logging.KeyPeer, address, "seconds", seconds)
+		current, _ := n.dbHandler.ReadTimer(name)
+		return writeFrame(conn, frame{Type: timerAckFrame, Message: db.Message{Sender: n.Username(), Timer: current}})
+	}
+	if err := n.dbHandler.SaveTimer(name, seconds); err != nil {
+		n.publishError(address, fmt.Errorf("could not save the timer %s set: %v", name, err))
+		return nil
+	}
+	netLog.Info("timer set by peer", logging.KeyPeer, address, "seconds", seconds)
+	n.publish(Event{Type: EventTimer, Peer: address, Name: name, Incoming: true, Timer: seconds})
+	return writeFrame(conn, frame{Type: timerAckFrame, Message: db.Message{Sender: n.Username(), Timer: seconds}})
+}
+
+// Hand the peer's confirmation to the SetTimer waiting for it, a late one is dropped
+func (n *Node) confirmTimer(address string, ack frame) {
+	n.mu.Lock()
+	waiting, ok := n.timerAcks[address]
+	n.mu.Unlock()
+	if ok {
+		select {
+		case waiting <- ack.Timer:
+		default:
+		}
+	}
+}
+
+// Stamp an outgoing message with the conversation's timer. We read what we send, so its timer starts right away.
+func (n *Node) applyTimer(message *db.Message) {
+	seconds, err := n.dbHandler.ReadTimer(message.Peer)
+	if err != nil {
+		dbLog.Warn("could not read the conversation timer", logging.KeyErr, err)
+		return
+	}
+	if seconds > 0 {
+		expiresAt := message.Timestamp.Add(time.Duration(seconds) * time.Second)
+		message.Timer = seconds
+		message.ExpiresAt = &expiresAt
+	}
+}
+
+// Timers are off or between MIN_TIMER and MAX_TIMER, whichever side sets them
+func validateTimer(timer time.Duration) error {
+	if timer != 0 && (timer < MIN_TIMER || timer > MAX_TIMER) {
+		return fmt.Errorf("a timer must be between %s and %s", formatTimer(MIN_TIMER), formatTimer(MAX_TIMER))
+	}
+	return nil
+}
+
+// Parse a timer such as 30m, 12h or 7d; off or 0 turns it off
+func parseTimer(value string) (time.Duration, error) {
+	if value == "off" || value == "0" {
+		return 0, nil
+	}
+	var timer time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var count int
+		count, err = strconv.Atoi(days)
+		timer = time.Duration(count) * 24 * time.Hour
+	} else {
+		timer, err = time.ParseDuration(value)
+	}
+	if err != nil || timer < MIN_TIMER || timer > MAX_TIMER {
+		return 0, fmt.Errorf("expected 'off' or a time between %s and %s such as 30m, 12h or 7d", formatTimer(MIN_TIMER), formatTimer(MAX_TIMER))
+	}
+	return timer.Round(time.Second), nil
+}
+
+func validateTimerArg(value string) error {
+	_, err := parseTimer(value)
+	return err
+}
+
+// Shortest way to write the timer in days, hours, minutes or seconds
+func formatTimer(timer time.Duration) string {
+	switch {
+	case timer%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", timer/(24*time.Hour))
+	case timer%time.Hour == 0:
+		return fmt.Sprintf("%dh", timer/time.Hour)
+	case timer%time.Minute == 0:
+		return fmt.Sprintf("%dm", timer/time.Minute)
+	}
+	return fmt.Sprintf("%ds", timer/time.Second)
+}
+
+func setTimerCmd(backend Backend, to string, timer time.Duration) tea.Cmd {
+	return func() tea.Msg {
+		if err := backend.SetTimer(to, timer); err != nil {
+			return toast{level: toastError, text: err.Error()}
+		}
+		return nil
+	}
+}
+
+type expiryCheck struct{}
+
+func expiryCheckCmd() tea.Cmd {
+	return tea.Tick(EXPIRY_CHECK_INTERVAL, func(time.Time) tea.Msg { return expiryCheck{} })
+}
+
+// Show or change the timer of the active conversation
+func (m *ChatModel) timerCommand(args []string) tea.Cmd {
+	if m.active == "" {
+		return errorCmd("not connected to anyone yet, use /connect <address>")
+	}
+	if len(args) == 0 {
+		timer := m.activeTimer()
+		if timer == 0 {
+			return infoCmd("messages with " + m.activeConversation() + " are kept")
+		}
+		return infoCmd(fmt.Sprintf("messages with %s disappear %s after they're read", m.activeConversation(), formatTimer(timer)))
+	}
+
+	timer, err := parseTimer(args[0])
+	if err != nil {
+		return errorCmd(err.Error())
+	}
+	return setTimerCmd(m.backend, m.active, timer)
+}
+
+// Remember a timer either side set, and tell the user
+func (m *ChatModel) applyTimerEvent(event Event) tea.Cmd {
+	name := event.Name
+	if name == "" {
+		name = event.Peer
+	}
+	if event.Timer <= 0 {
+		delete(m.timers, name)
+		return infoCmd("disappearing messages with " + name + " turned off")
+	}
+	timer := time.Duration(event.Timer) * time.Second
+	m.timers[name] = timer
+	return infoCmd(fmt.Sprintf("messages with %s now disappear %s after they're read", name, formatTimer(timer)))
+}
+
+func (m *ChatModel) activeTimer() time.Duration {
+	return m.timers[m.activeConversation()]
+}
+
+// Everything in the chat view counts as read, so the timers of the incoming messages it shows start now.
+// Nothing is read while the chat is hidden behind the lock screen.
+func (m *ChatModel) markRead() {
+	if m.hidden {
+		return
+	}
+	now := time.Now()
+	var ids []string
+	for i := range m.messages {
+		message := &m.messages[i]
+		if message.Direction == db.Incoming && message.Timer > 0 && message.ExpiresAt == nil {
+			expiresAt := now.Add(time.Duration(message.Timer) * time.Second)
+			message.ExpiresAt = &expiresAt
+			ids = append(ids, message.ID)
+		}
+	}
+	if _, err := m.dbHandler.MarkRead(now, ids); err != nil {
+		uiLog.Warn("could not start message timers", logging.KeyErr, err)
+	}
+}
+
+// Hide the chat while locked, so the messages arriving meanwhile aren't read. Showing it again reads them.
+func (m *ChatModel) SetHidden(hidden bool) {
+	m.hidden = hidden
+	m.markRead()
+}
+
+// Take expired messages out of the view, the database purge deletes them for good
+func (m *ChatModel) dropExpired(now time.Time) {
+	kept := m.messages[:0]
+	for _, message := range m.messages {
+		if message.ExpiresAt == nil || now.Before(*message.ExpiresAt) {
+			kept = append(kept, message)
+		}
+	}
+	m.messages = kept
+}
+
+func (m *ChatModel) loadTimers() {
+	m.timers = make(map[string]time.Duration)
+	timers, err := m.dbHandler.ReadTimers()
+	if err != nil {
+		uiLog.Warn("could not read conversation timers", logging.KeyErr, err)
+		return
+	}
+	for peer, seconds := range timers {
+		m.timers[peer] = time.Duration(seconds) * time.Second
+	}
+}
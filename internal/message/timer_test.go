@@ -0,0 +1,135 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"testing"
+	"time"
+)
+
+func TestTimer(t *testing.T) {
+	alice := newTestNode(t, "alice", "")
+	port := listenOnFreePort(t, alice)
+	events, unsubscribe := alice.Subscribe()
+	defer unsubscribe()
+
+	bob := newTestNode(t, "bob", "")
+	if _, err := bob.Connect(port); err != nil {
+		t.Fatal("Got an error connecting: ", err)
+	}
+	if err := bob.SetTimer("alice", time.Second); err == nil {
+		t.Error("Expected a timer under a minute to be refused")
+	}
+	if err := bob.SetTimer("alice", time.Hour); err != nil {
+		t.Fatal("Expected alice to agree to the timer, got: ", err)
+	}
+	if event := awaitNodeEvent(t, events, EventTimer); event.Name != "bob" || event.Timer != 3600 {
+		t.Errorf("Expected alice to be told about bob's timer, got %+v", event)
+	}
+	for _, node := range []*Node{alice, bob} {
+		peer := "alice"
+		if node == alice {
+			peer = "bob"
+		}
+		if seconds, err := node.dbHandler.ReadTimer(peer); err != nil || seconds != 3600 {
+			t.Errorf("Expected both sides to keep the timer, got %d (%v)", seconds, err)
+		}
+	}
+
+	sent, err := bob.Send("alice", "this won't last")
+	if err != nil {
+		t.Fatal("Got an error sending: ", err)
+	}
+	if sent.Timer != 3600 || sent.ExpiresAt == nil {
+		t.Errorf("Expected the sent message to be on the timer right away, got %+v", sent)
+	}
+	received := awaitNodeEvent(t, events, EventMessage).Message
+	if received.Timer != 3600 || received.ExpiresAt != nil {
+		t.Errorf("Expected the received message to wait until it is read, got %+v", received)
+	}
+
+	// A peer bypassing SetTimer's bounds gets the timer alice keeps as the answer
+	address, conn, err := bob.resolvePeer("alice")
+	if err != nil {
+		t.Fatal("Got an error finding alice: ", err)
+	}
+	ack := make(chan int64, 1)
+	bob.mu.Lock()
+	bob.timerAcks[address] = ack
+	bob.mu.Unlock()
+	if err := writeFrame(conn, frame{Type: timerFrame, Message: db.Message{Sender: "bob", Timer: 1}}); err != nil {
+		t.Fatal("Got an error sending the timer: ", err)
+	}
+	select {
+	case agreed := <-ack:
+		if seconds, _ := alice.dbHandler.ReadTimer("bob"); agreed != 3600 || seconds != 3600 {
+			t.Errorf("Expected a one second timer refused, got %d and kept %d", agreed, seconds)
+		}
+	case <-time.After(TIMER_ACK_TIMEOUT):
+		t.Fatal("Expected alice to answer the timer")
+	}
+	bob.mu.Lock()
+	delete(bob.timerAcks, address)
+	bob.mu.Unlock()
+
+	if err := bob.SetTimer("alice", 0); err != nil {
+		t.Fatal("Expected the timer to be turned off, got: ", err)
+	}
+	if seconds, _ := alice.dbHandler.ReadTimer("bob"); seconds != 0 {
+		t.Errorf("Expected the timer to be off, got %d", seconds)
+	}
+}
+
+func TestParseTimer(t *testing.T) {
+	cases := map[string]time.Duration{"off": 0, "30m": 30 * time.Minute, "12h": 12 * time.Hour, "7d": 7 * 24 * time.Hour}
+	for value, expected := range cases {
+		if timer, err := parseTimer(value); err != nil || timer != expected {
+			t.Errorf("parseTimer(%q) = %v (%v), expected %v", value, timer, err, expected)
+		}
+		if expected > 0 && formatTimer(expected) != value {
+			t.Errorf("formatTimer(%v) = %q, expected %q", expected, formatTimer(expected), value)
+		}
+	}
+	for _, value := range []string{"", "10s", "soon", "400d"} {
+		if _, err := parseTimer(value); err == nil {
+			t.Errorf("Expected %q to be refused", value)
+		}
+	}
+}
+
+func TestDropExpired(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Second), now.Add(time.Minute)
+	m := &ChatModel{messages: []db.Message{{Text: "gone", ExpiresAt: &past}, {Text: "soon", ExpiresAt: &future}, {Text: "kept"}}}
+	m.dropExpired(now)
+	if len(m.messages) != 2 || m.messages[0].Text != "soon" || m.messages[1].Text != "kept" {
+		t.Errorf("Expected only the expired message to go, got %+v", m.messages)
+	}
+}
+
+func TestMarkRead(t *testing.T) {
+	node := newTestNode(t, "alice", "")
+	now := time.Now()
+	shown := db.Message{ID: "shown", Text: "hi", Sender: "bob", Direction: db.Incoming, Timestamp: now, Peer: "bob", Timer: 60}
+	older := db.Message{ID: "older", Text: "hi", Sender: "carol", Direction: db.Incoming, Timestamp: now, Peer: "carol", Timer: 60}
+	for _, msg := range []db.Message{shown, older} {
+		if err := node.dbHandler.SaveMessage(msg); err != nil {
+			t.Fatal("Saving message produced an error: ", err)
+		}
+	}
+
+	// Arrived while locked, so it stays unread until the chat is shown again
+	m := &ChatModel{dbHandler: node.dbHandler, messages: []db.Message{shown}}
+	m.SetHidden(true)
+	m.markRead()
+	if m.messages[0].ExpiresAt != nil {
+		t.Fatal("Expected nothing read while the chat is hidden")
+	}
+	m.SetHidden(false)
+
+	stored, _ := node.dbHandler.ReadMessages(db.MessageFilter{})
+	for _, msg := range stored {
+		if started := msg.ExpiresAt != nil; started != (msg.ID == "shown") {
+			t.Errorf("Expected only the shown message's timer started, got %+v", msg)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package message
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/qr"
+	"bokkoli/internal/theme"
+	"errors"
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Safety number shown by /verify until the user answers
+type verification struct {
+	address string
+	name    string
+	key     string
+	number  string
+	showQR  bool
+}
+
+// Show the safety number for the peer, the active conversation when no name is given
+func (m *ChatModel) startVerify(args []string) tea.Cmd {
+	address, peer, err := m.keyedPeer(args)
+	if err != nil {
+		return errorCmd(err.Error())
+	}
+
+	if m.key == "" {
+		status, err := m.backend.Status()
+		if err != nil {
+			return errorCmd("could not read our identity key: " + err.Error())
+		}
+		m.key = status.Key
+	}
+	ours, err := identity.ParseKey(m.key)
+	if err != nil {
+		return errorCmd("could not read our identity key: " + err.Error())
+	}
+	theirs, err := identity.ParseKey(peer.key)
+	if err != nil {
+		return errorCmd(err.Error())
+	}
+
+	m.verifying = &verification{address: address, name: peerName(address, peer), key: peer.key, number: identity.SafetyNumber(ours, theirs)}
+	return nil
+}
+
+// y marks the peer verified, q shows or hides the QR code, any other key closes without a change
+func (m *ChatModel) answerVerify(key string) tea.Cmd {
+	v := m.verifying
+	switch key {
+	case "q":
+		v.showQR = !v.showQR
+		return nil
+	case "y":
+		m.verifying = nil
+		if err := m.setVerified(v.key, v.name, true); err != nil {
+			uiLog.Error("could not save verification", logging.KeyErr, err)
+			return errorCmd("could not save the verification")
+		}
+		return infoCmd(v.name + " is verified")
+	}
+	m.verifying = nil
+	return nil
+}
+
+// Remember the verification in the contacts, a peer we only accepted once becomes an allowed contact
+func (m *ChatModel) setVerified(key string, name string, verified bool) error {
+	contact, ok, err := m.dbHandler.ReadContact(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		parsed, err := identity.ParseKey(key)
+		if err != nil {
+			return err
+		}
+		contact = db.Contact{Key: key, Fingerprint: identity.Fingerprint(parsed), Name: name, Status: db.ContactAllowed}
+	}
+	contact.Verified = verified
+	if verified && contact.Status == db.ContactPending {
+		contact.Status = db.ContactAllowed
+	}
+	if err := m.dbHandler.SaveContact(contact); err != nil {
+		return err
+	}
+
+	for _, peer := range m.peers {
+		if peer.key == key {
+			peer.verified = verified
+		}
+	}
+	return nil
+}
+
+func (m *ChatModel) unverify(args []string) tea.Cmd {
+	address, peer, err := m.keyedPeer(args)
+	if err != nil {
+		return errorCmd(err.Error())
+	}
+	if !peer.verified {
+		return infoCmd(peerName(address, peer) + " is not verified")
+	}
+	if err := m.setVerified(peer.key, peerName(address, peer), false); err != nil {
+		uiLog.Error("could not save verification", logging.KeyErr, err)
+		return errorCmd("could not save the verification")
+	}
+	return infoCmd(peerName(address, peer) + " is no longer verified")
+}
+
+// Whether the contact with the key was verified, looked up as peers connect
+func (m *ChatModel) isVerified(key string) bool {
+	if key == "" {
+		return false
+	}
+	contact, ok, err := m.dbHandler.ReadContact(key)
+	if err != nil {
+		uiLog.Warn("could not read contact", logging.KeyErr, err)
+	}
+	return ok && contact.Verified
+}
+
+// A connected peer with an identity key, incoming or outgoing, by username or address
+func (m *ChatModel) keyedPeer(args []string) (string, *peerStatus, error) {
+	name := m.active
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" {
+		return "", nil, errors.New("no active conversation, name the peer to verify")
+	}
+
+	for _, address := range sortedPeers(m.peers) {
+		peer := m.peers[address]
+		if peer.state != stateConnected || (address != name && peer.name != name) {
+			continue
+		}
+		if peer.key == "" {
+			return "", nil, fmt.Errorf("%s has no identity key, it runs an older version", name)
+		}
+		return address, peer, nil
+	}
+	return "", nil, fmt.Errorf("not connected to %s", name)
+}
+
+func (m *ChatModel) completeKeyedPeer(partial string) []string {
+	var candidates []string
+	for _, address := range sortedPeers(m.peers) {
+		peer := m.peers[address]
+		if peer.state == stateConnected && peer.key != "" {
+			candidates = append(candidates, peerName(address, peer))
+		}
+	}
+	return candidates
+}
+
+func peerName(address string, peer *peerStatus) string {
+	if peer.name != "" {
+		return peer.name
+	}
+	return address
+}
+
+// Whether the message came from a verified peer, by the key its connection proved and never by the name it claims
+func (m *ChatModel) verifiedSender(message db.Message) bool {
+	if message.Direction != db.Incoming || message.SenderKey == "" {
+		return false
+	}
+	for _, peer := range m.peers {
+		if peer.key == message.SenderKey && peer.verified {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark next to a peer's name: a check once verified, a question mark while its key is unconfirmed
+func verifiedMark(peer *peerStatus) string {
+	switch {
+	case peer.verified:
+		return lipgloss.NewStyle().Foreground(theme.Current().Success).Render("✓")
+	case peer.key != "":
+		return noticeStyle().Render("?")
+	}
+	return ""
+}
+
+func (m *ChatModel) verifyView() string {
+	v := m.verifying
+	groups := strings.Fields(v.number)
+
+	var view strings.Builder
+	view.WriteString(commandStyle().Render("Safety number with "+v.name) + "\n\n")
+	for i := 0; i < len(groups); i += 4 {
+		view.WriteString(strings.Join(groups[i:min(i+4, len(groups))], "  ") + "\n")
+	}
+	view.WriteString("\n" + noticeStyle().Render("Compare it with "+v.name+"'s screen, in person or on a call you trust.\nThe same number on both sides means you hold each other's keys.\nMessages are not encrypted, so it can't tell whether someone relays and reads the connection.") + "\n")
+
+	if v.showQR {
+		code, err := qr.Encode(strings.ReplaceAll(v.number, " ", ""))
+		if err == nil {
+			// Dark on light whatever the terminal's colors, scanners don't read inverted codes
+			view.WriteString("\n" + lipgloss.NewStyle().Foreground(lipgloss.Color("#000000")).Background(lipgloss.Color("#ffffff")).Render(code.String()) + "\n")
+		}
+	}
+
+	toggle := "show"
+	if v.showQR {
+		toggle = "hide"
+	}
+	view.WriteString(fmt.Sprintf("\n%s they match  %s %s QR code  %s close",
+		commandStyle().Render("y"), commandStyle().Render("q"), toggle, commandStyle().Render("any other key")))
+	return helpStyle().Render(view.String())
+}
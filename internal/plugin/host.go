@@ -0,0 +1,244 @@
+package plugin
+
+import (
+	"bokkoli/internal/logging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var logger = logging.For(logging.PLUGIN)
+
+// What a plugin's command asked for
+type CommandResult struct {
+	Notice string
+	// Text to send to the active peer, only ever set for plugins with the send permission
+	Send string
+}
+
+// Runs the enabled plugins of a profile, each in its own Lua sandbox, and only calls the hooks their manifest allows.
+// A plugin defines the hooks as globals:
+//
+//	function on_event(event) end         -- events
+//	function transform(peer, text) end   -- transform, returns the new text or nil
+//	commands = { name = function(peer, args) end }  -- commands, returns a notice or nil
+//	function status() end                -- status_bar, returns the widget text
+//
+// and can call bokkoli.log(...) and, in commands with the send permission, bokkoli.send(text).
+type Host struct {
+	dir string
+
+	mu      sync.Mutex
+	running map[string]*script
+}
+
+func NewHost(pluginDir string) *Host {
+	return &Host{dir: pluginDir, running: make(map[string]*script)}
+}
+
+func (h *Host) Dir() string {
+	return h.dir
+}
+
+// Start an installed plugin, returning its manifest for registering its commands
+func (h *Host) Start(name string) (Manifest, error) {
+	if !namePattern.MatchString(name) {
+		return Manifest{}, fmt.Errorf("invalid plugin name %q", name)
+	}
+	m, err := LoadManifest(filepath.Join(h.dir, name))
+	if err != nil {
+		return m, err
+	}
+
+	p, err := start(m)
+	if err != nil {
+		return m, err
+	}
+	h.mu.Lock()
+	if _, exists := h.running[name]; exists {
+		h.mu.Unlock()
+		p.stop()
+		return m, fmt.Errorf("plugin %s is already running", name)
+	}
+	h.running[name] = p
+	h.mu.Unlock()
+	return m, nil
+}
+
+func (h *Host) Stop(name string) error {
+	h.mu.Lock()
+	p, ok := h.running[name]
+	delete(h.running, name)
+	h.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("plugin %s is not running", name)
+	}
+	p.stop()
+	return nil
+}
+
+// Manifests of the running plugins, sorted by name
+func (h *Host) Running() []Manifest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	manifests := make([]Manifest, 0, len(h.running))
+	for _, p := range h.running {
+		manifests = append(manifests, p.manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name < manifests[j].Name })
+	return manifests
+}
+
+// Running plugins with the permission, sorted by name so transforms always apply in the same order
+func (h *Host) allowed(permission string) []*script {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var scripts []*script
+	for _, p := range h.running {
+		if p.manifest.Allows(permission) {
+			scripts = append(scripts, p)
+		}
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].manifest.Name < scripts[j].manifest.Name })
+	return scripts
+}
+
+// Pass an event to the plugins that subscribed to events, without waiting for them
+func (h *Host) Notify(event any) {
+	scripts := h.allowed(PermEvents)
+	if len(scripts) == 0 {
+		return
+	}
+	// Plugins see events as they look in JSON, the same as API and webhook clients
+	data, err := json.Marshal(event)
+	var decoded any
+	if err == nil {
+		err = json.Unmarshal(data, &decoded)
+	}
+	if err != nil {
+		logger.Warn("could not encode event for plugins", logging.KeyErr, err)
+		return
+	}
+	for _, p := range scripts {
+		err := p.notify(func(L *lua.LState) error {
+			_, err := callHook(L, L.GetGlobal("on_event"), jsonToLua(L, decoded))
+			return err
+		})
+		if err != nil {
+			logger.Debug("event not passed to plugin", "plugin", p.manifest.Name, logging.KeyErr, err)
+		}
+	}
+}
+
+// Run outgoing text through every transforming plugin in turn. A plugin that fails is skipped, the error says which.
+func (h *Host) Transform(peer string, text string) (string, error) {
+	var errs []error
+	for _, p := range h.allowed(PermTransform) {
+		var transformed string
+		err := p.call(func(L *lua.LState) error {
+			result, err := callHook(L, L.GetGlobal("transform"), lua.LString(peer), lua.LString(text))
+			transformed = luaText(result)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if transformed != "" {
+			text = sanitize(transformed, true)
+		}
+	}
+	return text, errors.Join(errs...)
+}
+
+// Run one of the commands a plugin declared
+func (h *Host) Command(plugin string, command string, peer string, args []string) (CommandResult, error) {
+	h.mu.Lock()
+	p, ok := h.running[plugin]
+	h.mu.Unlock()
+	if !ok {
+		return CommandResult{}, fmt.Errorf("plugin %s is not running", plugin)
+	}
+
+	declared := false
+	for _, cmd := range p.manifest.Commands {
+		declared = declared || cmd.Name == command
+	}
+	if !p.manifest.Allows(PermCommands) || !declared {
+		return CommandResult{}, fmt.Errorf("plugin %s has no command /%s", plugin, command)
+	}
+
+	var result CommandResult
+	err := p.call(func(L *lua.LState) error {
+		commands, ok := L.GetGlobal("commands").(*lua.LTable)
+		if !ok || commands.RawGetString(command) == lua.LNil {
+			return fmt.Errorf("/%s is declared but not defined in commands", command)
+		}
+		luaArgs := L.NewTable()
+		for _, arg := range args {
+			luaArgs.Append(lua.LString(arg))
+		}
+
+		var outbox []string
+		p.outbox = &outbox
+		defer func() { p.outbox = nil }()
+		notice, err := callHook(L, commands.RawGetString(command), lua.LString(peer), luaArgs)
+		result = CommandResult{Notice: sanitize(luaText(notice), false), Send: sanitize(strings.Join(outbox, "\n"), true)}
+		return err
+	})
+	return result, err
+}
+
+// Ask every plugin with a status bar widget for its text, by plugin name. Plugins that don't answer are left out.
+func (h *Host) Status() map[string]string {
+	scripts := h.allowed(PermStatusBar)
+	widgets := make(map[string]string, len(scripts))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range scripts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var widget string
+			err := p.call(func(L *lua.LState) error {
+				result, err := callHook(L, L.GetGlobal("status"))
+				widget = luaText(result)
+				return err
+			})
+			if err != nil {
+				logger.Debug("no status from plugin", "plugin", p.manifest.Name, logging.KeyErr, err)
+				return
+			}
+			mu.Lock()
+			widgets[p.manifest.Name] = sanitize(widget, false)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return widgets
+}
+
+// Stop every running plugin
+func (h *Host) Close() {
+	h.mu.Lock()
+	running := h.running
+	h.running = make(map[string]*script)
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range running {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.stop()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,186 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Every plugin directory has one, describing how to run the plugin and what it may do
+const MANIFEST_FILE_NAME string = "plugin.toml"
+
+// Script run when the manifest doesn't name one
+const DEFAULT_MAIN string = "main.lua"
+
+// What a plugin may do; hooks and host functions not declared are never called or refuse to work
+const (
+	// Receive every chat event: messages, connections and errors
+	PermEvents string = "events"
+	// Rewrite outgoing messages before they are sent
+	PermTransform string = "transform"
+	// Answer the slash-commands declared in the manifest
+	PermCommands string = "commands"
+	// Have command replies sent as messages to the active peer
+	PermSend string = "send"
+	// Show a widget in the status bar
+	PermStatusBar string = "status_bar"
+)
+
+var Permissions = []string{PermEvents, PermTransform, PermCommands, PermSend, PermStatusBar}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+type CommandSpec struct {
+	Name string `toml:"name" json:"name"`
+	Help string `toml:"help" json:"help"`
+}
+
+type Manifest struct {
+	Name        string `toml:"name" json:"name"`
+	Description string `toml:"description" json:"description,omitempty"`
+	Version     string `toml:"version" json:"version,omitempty"`
+	// Lua script inside the plugin directory
+	Main        string        `toml:"main" json:"main"`
+	Permissions []string      `toml:"permissions" json:"permissions"`
+	Commands    []CommandSpec `toml:"commands" json:"commands,omitempty"`
+
+	// Directory the manifest was read from
+	Dir string `toml:"-" json:"dir"`
+}
+
+func (m Manifest) Allows(permission string) bool {
+	return slices.Contains(m.Permissions, permission)
+}
+
+func (m Manifest) validate() error {
+	if !namePattern.MatchString(m.Name) {
+		return fmt.Errorf("invalid plugin name %q, use lower case letters, digits, '-' and '_'", m.Name)
+	}
+	if !filepath.IsLocal(m.Main) || filepath.Ext(m.Main) != ".lua" {
+		return fmt.Errorf("plugin %s: main must be a .lua file inside the plugin directory, got %q", m.Name, m.Main)
+	}
+	for _, permission := range m.Permissions {
+		if !slices.Contains(Permissions, permission) {
+			return fmt.Errorf("plugin %s: unknown permission %q, expected one of: %s", m.Name, permission, strings.Join(Permissions, ", "))
+		}
+	}
+	if len(m.Commands) > 0 && !m.Allows(PermCommands) {
+		return fmt.Errorf("plugin %s: declares commands without the %q permission", m.Name, PermCommands)
+	}
+	for _, cmd := range m.Commands {
+		if !namePattern.MatchString(cmd.Name) {
+			return fmt.Errorf("plugin %s: invalid command name %q", m.Name, cmd.Name)
+		}
+	}
+	return nil
+}
+
+// Plain words for each permission, shown before a plugin is enabled
+func (m Manifest) Describe() []string {
+	var lines []string
+	for _, permission := range m.Permissions {
+		switch permission {
+		case PermEvents:
+			lines = append(lines, "read incoming and outgoing messages and connection events")
+		case PermTransform:
+			lines = append(lines, "rewrite your messages before they are sent")
+		case PermCommands:
+			names := make([]string, len(m.Commands))
+			for i, cmd := range m.Commands {
+				names[i] = "/" + cmd.Name
+			}
+			lines = append(lines, "add the commands "+strings.Join(names, ", "))
+		case PermSend:
+			lines = append(lines, "send messages from its commands")
+		case PermStatusBar:
+			lines = append(lines, "show a widget in the status bar")
+		}
+	}
+	return lines
+}
+
+func LoadManifest(dir string) (Manifest, error) {
+	m := Manifest{Main: DEFAULT_MAIN}
+	meta, err := toml.DecodeFile(filepath.Join(dir, MANIFEST_FILE_NAME), &m)
+	if err != nil {
+		return m, fmt.Errorf("could not read the plugin manifest: %v", err)
+	}
+	m.Dir = dir
+	if meta.IsDefined("exec") {
+		return m, fmt.Errorf("plugin %s: plugins are Lua scripts now, exec is no longer supported", m.Name)
+	}
+	return m, m.validate()
+}
+
+// Manifests of the plugins in the directory, sorted by name. Broken plugins are reported but don't hide the others.
+func Installed(pluginDir string) ([]Manifest, error) {
+	entries, err := os.ReadDir(pluginDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []Manifest
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		m, err := LoadManifest(filepath.Join(pluginDir, entry.Name()))
+		if err == nil && m.Name != entry.Name() {
+			err = fmt.Errorf("plugin %s is installed as %s", m.Name, entry.Name())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", entry.Name(), err))
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name < manifests[j].Name })
+	return manifests, errors.Join(errs...)
+}
+
+// Copy a plugin directory into the plugin directory, under the name from its manifest
+func Install(source string, pluginDir string) (Manifest, error) {
+	m, err := LoadManifest(source)
+	if err != nil {
+		return m, err
+	}
+
+	target := filepath.Join(pluginDir, m.Name)
+	if _, err := os.Stat(target); err == nil {
+		return m, fmt.Errorf("plugin %s is already installed, remove it first", m.Name)
+	}
+	if err := os.MkdirAll(pluginDir, 0o700); err != nil {
+		return m, err
+	}
+
+	if err := os.CopyFS(target, os.DirFS(source)); err != nil {
+		os.RemoveAll(target)
+		return m, fmt.Errorf("could not copy the plugin: %v", err)
+	}
+	m.Dir = target
+	return m, nil
+}
+
+func Remove(pluginDir string, name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid plugin name %q", name)
+	}
+	target := filepath.Join(pluginDir, name)
+	if _, err := os.Stat(filepath.Join(target, MANIFEST_FILE_NAME)); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("plugin %s is not installed", name)
+	}
+	return os.RemoveAll(target)
+}
@@ -0,0 +1,206 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every permission, counts message events and answers /yell with a notice and a message
+const upperScript = `
+local events = 0
+
+function on_event(event)
+	if event.type == "message" then events = events + 1 end
+end
+
+function transform(peer, text)
+	return string.upper(text) .. "\27[31m"
+end
+
+commands = {
+	yell = function(peer, args)
+		bokkoli.send(table.concat(args, " "))
+		return "to " .. peer
+	end,
+}
+
+function status()
+	return events .. "\nmessages"
+end
+`
+
+func writePlugin(t *testing.T, dir string, name string, permissions []string, script string, commands ...string) string {
+	pluginDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(pluginDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	quoted := make([]string, len(permissions))
+	for i, permission := range permissions {
+		quoted[i] = fmt.Sprintf("%q", permission)
+	}
+	manifest := fmt.Sprintf("name = %q\npermissions = [%s]\n", name, strings.Join(quoted, ", "))
+	for _, cmd := range commands {
+		manifest += fmt.Sprintf("\n[[commands]]\nname = %q\nhelp = \"test\"\n", cmd)
+	}
+	if err := os.WriteFile(filepath.Join(pluginDir, MANIFEST_FILE_NAME), []byte(manifest), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pluginDir, DEFAULT_MAIN), []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pluginDir
+}
+
+func newTestHost(t *testing.T, dir string, names ...string) *Host {
+	host := NewHost(dir)
+	t.Cleanup(host.Close)
+	for _, name := range names {
+		if _, err := host.Start(name); err != nil {
+			t.Fatal("Got an error starting the plugin: ", err)
+		}
+	}
+	return host
+}
+
+func TestPermissions(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "upper", []string{PermEvents, PermTransform, PermCommands, PermSend, PermStatusBar}, upperScript, "yell")
+	// Defines every hook, but may only run its command
+	writePlugin(t, dir, "quiet", []string{PermCommands}, upperScript+"commands.peek = commands.yell", "peek")
+	host := newTestHost(t, dir, "upper", "quiet")
+
+	// Only upper may transform, and what it sends back is cleaned of escape sequences
+	text, err := host.Transform("bob", "hi there")
+	if err != nil || text != "HI THERE[31m" {
+		t.Errorf("Expected the text in capitals without the escape, got %q (%v)", text, err)
+	}
+
+	host.Notify(map[string]string{"type": "message"})
+	host.Notify(map[string]string{"type": "connected"})
+	host.Notify(map[string]string{"type": "message"})
+	if widgets := host.Status(); len(widgets) != 1 || widgets["upper"] != "2 messages" {
+		t.Errorf("Expected a one line widget from upper only, got %q", widgets)
+	}
+
+	result, err := host.Command("upper", "yell", "bob", []string{"ship", "it"})
+	if err != nil || result.Send != "ship it" || result.Notice != "to bob" {
+		t.Errorf("Expected the command to send, got %+v (%v)", result, err)
+	}
+	if result, err := host.Command("quiet", "peek", "bob", []string{"sneaky"}); err == nil || !strings.Contains(err.Error(), "may not send") || result.Send != "" {
+		t.Errorf("Expected sending to be refused without the permission, got %+v (%v)", result, err)
+	}
+	if _, err := host.Command("upper", "peek", "bob", nil); err == nil {
+		t.Error("Expected an error for a command the plugin didn't declare")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "escape", []string{PermStatusBar}, `
+function status()
+	local reachable = {}
+	for _, name in ipairs({"io", "os", "package", "debug", "require", "dofile", "loadfile", "print"}) do
+		if _G[name] ~= nil then table.insert(reachable, name) end
+	end
+	local ok = pcall(string.rep, "x", 1e9)
+	return table.concat(reachable, ",") .. (ok and " rep" or "")
+end
+`)
+	host := newTestHost(t, dir, "escape")
+	if widgets := host.Status(); widgets["escape"] != "" {
+		t.Errorf("Expected nothing outside the sandbox reachable, got %q", widgets["escape"])
+	}
+
+	writePlugin(t, dir, "broken", nil, "error('no')")
+	if _, err := host.Start("broken"); err == nil || !strings.Contains(err.Error(), "no") {
+		t.Errorf("Expected a script failing at load not to start, got %v", err)
+	}
+
+	native := writePlugin(t, dir, "native", nil, "")
+	os.WriteFile(filepath.Join(native, MANIFEST_FILE_NAME), []byte("name = \"native\"\nexec = [\"/bin/sh\"]\n"), 0o600)
+	if _, err := host.Start("native"); err == nil || !strings.Contains(err.Error(), "exec is no longer supported") {
+		t.Errorf("Expected a native plugin to be refused, got %v", err)
+	}
+}
+
+func TestUnresponsivePlugin(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "slow", []string{PermTransform}, `
+function transform(peer, text)
+	while text == "loop" do end
+	return text .. "!"
+end
+`)
+	host := newTestHost(t, dir, "slow")
+
+	text, err := host.Transform("bob", "loop")
+	if text != "loop" || err == nil || !strings.Contains(err.Error(), "did not answer") {
+		t.Errorf("Expected the text unchanged and a timeout, got %q (%v)", text, err)
+	}
+	// The endless loop was interrupted, the plugin keeps working
+	if text, err := host.Transform("bob", "hi"); err != nil || text != "hi!" {
+		t.Errorf("Expected the plugin to answer again, got %q (%v)", text, err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		host.Stop("slow")
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(CALL_TIMEOUT):
+		t.Fatal("Expected the plugin to stop right away")
+	}
+	if len(host.Running()) != 0 {
+		t.Errorf("Expected no running plugins, got %+v", host.Running())
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "b-plugin", []string{PermEvents}, "")
+	writePlugin(t, dir, "a-plugin", []string{PermCommands}, "", "hello")
+	writePlugin(t, dir, "broken", []string{"filesystem"}, "")
+	writePlugin(t, dir, "greedy", nil, "", "hello")
+
+	installed, err := Installed(dir)
+	if len(installed) != 2 || installed[0].Name != "a-plugin" || installed[1].Name != "b-plugin" {
+		t.Errorf("Expected the valid plugins sorted by name, got %+v", installed)
+	}
+	if err == nil || !strings.Contains(err.Error(), `unknown permission "filesystem"`) || !strings.Contains(err.Error(), "without the") {
+		t.Errorf("Expected the broken plugins reported, got %v", err)
+	}
+
+	if describe := installed[0].Describe(); len(describe) != 1 || describe[0] != "add the commands /hello" {
+		t.Errorf("Expected the permissions described, got %q", describe)
+	}
+}
+
+func TestInstallAndRemove(t *testing.T) {
+	source := writePlugin(t, t.TempDir(), "hello", []string{PermEvents}, "")
+	dir := filepath.Join(t.TempDir(), "plugins")
+
+	manifest, err := Install(source, dir)
+	if err != nil || manifest.Dir != filepath.Join(dir, "hello") {
+		t.Fatalf("Expected the plugin copied, got %+v (%v)", manifest, err)
+	}
+	if _, err := Install(source, dir); err == nil {
+		t.Error("Expected installing twice to fail")
+	}
+
+	if err := Remove(dir, "../hello"); err == nil {
+		t.Error("Expected an invalid name to be refused")
+	}
+	if err := Remove(dir, "hello"); err != nil {
+		t.Fatal("Got an error removing: ", err)
+	}
+	if installed, _ := Installed(dir); len(installed) != 0 {
+		t.Errorf("Expected nothing installed, got %+v", installed)
+	}
+}
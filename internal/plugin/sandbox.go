@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Text going in or out of a plugin is capped, so a plugin can't flood the chat or the peers
+const MAX_TEXT_SIZE int = 256 * 1024
+
+// Lua call stack depth, deep enough for any plugin and shallow enough to stop runaway recursion early
+const CALL_STACK_SIZE int = 256
+
+// Slots of the Lua value stack, which never grows past this
+const REGISTRY_SIZE int = 64 * 1024
+
+// Libraries a plugin gets. There is no io, os, package or debug: a plugin can't touch files, run programs,
+// load code from disk or open connections, only compute and call the bokkoli functions.
+// Nothing caps the memory a plugin allocates, gopher-lua has no allocation limit and "s = s .. s" doubles a
+// string per step. The timeout bounds how long a plugin runs, not how much it holds on to.
+var safeLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+	{lua.CoroutineLibName, lua.OpenCoroutine},
+}
+
+// Base functions that reach outside the sandbox: files, modules and stdout, which belongs to the chat
+var unsafeGlobals = []string{"dofile", "loadfile", "require", "module", "print", "_printregs"}
+
+// A fresh Lua state with the safe libraries and the bokkoli table of host functions
+func newSandbox(s *script) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:     true,
+		CallStackSize:    CALL_STACK_SIZE,
+		RegistrySize:     REGISTRY_SIZE,
+		RegistryMaxSize:  REGISTRY_SIZE,
+		RegistryGrowStep: lua.RegistryGrowStep,
+	})
+	for _, lib := range safeLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	// string.rep would build a huge string in a single step, which the timeout can't interrupt
+	stringLib := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	rep := stringLib.RawGetString("rep")
+	stringLib.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		if size, count := len(L.CheckString(1)), L.CheckInt(2); size > 0 && count > MAX_TEXT_SIZE/size {
+			L.RaiseError("string.rep result larger than %d bytes", MAX_TEXT_SIZE)
+		}
+		L.Push(rep)
+		L.Push(L.Get(1))
+		L.Push(L.Get(2))
+		L.Call(2, 1)
+		return 1
+	}))
+
+	bokkoli := L.NewTable()
+	bokkoli.RawSetString("plugin", lua.LString(s.manifest.Name))
+	bokkoli.RawSetString("log", L.NewFunction(s.luaLog))
+	bokkoli.RawSetString("send", L.NewFunction(s.luaSend))
+	L.SetGlobal("bokkoli", bokkoli)
+	return L
+}
+
+// bokkoli.log(...) writes its arguments to the debug log
+func (s *script) luaLog(L *lua.LState) int {
+	parts := make([]string, L.GetTop())
+	for i := range parts {
+		parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	logger.Debug("plugin log", "plugin", s.manifest.Name, "line", strings.Join(parts, " "))
+	return 0
+}
+
+// bokkoli.send(text) sends text to the open chat once the command finishes, with the send permission only
+func (s *script) luaSend(L *lua.LState) int {
+	text := L.CheckString(1)
+	switch {
+	case !s.manifest.Allows(PermSend):
+		L.RaiseError("plugin %s may not send messages", s.manifest.Name)
+	case s.outbox == nil:
+		L.RaiseError("bokkoli.send only works in commands")
+	case len(text) > MAX_TEXT_SIZE:
+		L.RaiseError("message larger than %d bytes", MAX_TEXT_SIZE)
+	}
+	*s.outbox = append(*s.outbox, text)
+	return 0
+}
+
+// Call a plugin function with the arguments and return its first result. A hook the plugin doesn't define returns nil.
+func callHook(L *lua.LState, fn lua.LValue, args ...lua.LValue) (lua.LValue, error) {
+	if fn == lua.LNil {
+		return lua.LNil, nil
+	}
+	if fn.Type() != lua.LTFunction {
+		return lua.LNil, fmt.Errorf("expected a function, got a %s", fn.Type())
+	}
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...); err != nil {
+		return lua.LNil, luaError(err)
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	return result, nil
+}
+
+// The message of a Lua error without the stack trace
+func luaError(err error) error {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) && apiErr.Object != nil {
+		return errors.New(apiErr.Object.String())
+	}
+	return err
+}
+
+// A string result of a hook, nil and other types count as no answer
+func luaText(value lua.LValue) string {
+	if text, ok := value.(lua.LString); ok && len(text) <= MAX_TEXT_SIZE {
+		return string(text)
+	}
+	return ""
+}
+
+// A decoded JSON value as Lua sees it: objects become tables with string keys, arrays tables indexed from 1
+func jsonToLua(L *lua.LState, value any) lua.LValue {
+	switch value := value.(type) {
+	case map[string]any:
+		table := L.NewTable()
+		for key, field := range value {
+			table.RawSetString(key, jsonToLua(L, field))
+		}
+		return table
+	case []any:
+		table := L.NewTable()
+		for _, item := range value {
+			table.Append(jsonToLua(L, item))
+		}
+		return table
+	case string:
+		return lua.LString(value)
+	case float64:
+		return lua.LNumber(value)
+	case bool:
+		return lua.LBool(value)
+	}
+	return lua.LNil
+}
+
+// Drop control characters from plugin output so it can't move the cursor or recolor the terminal; newlines only where allowed
+func sanitize(text string, keepNewlines bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' && keepNewlines:
+			return r
+		case r == '\n' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, text)
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"bokkoli/internal/logging"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// How long a hook may run before it is interrupted and the host carries on without it
+	CALL_TIMEOUT time.Duration = 2 * time.Second
+	// Hooks waiting to run; events are dropped when a plugin falls this far behind
+	QUEUE_SIZE int = 64
+)
+
+var errNotKeepingUp = errors.New("plugin is not keeping up")
+
+// A running plugin: its Lua state, owned by one goroutine that runs the hooks one at a time
+type script struct {
+	manifest Manifest
+	state    *lua.LState
+
+	mu     sync.Mutex
+	queue  chan func()
+	closed bool
+	// Every hook runs under a context derived from this one, cancelled when the plugin is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Messages bokkoli.send collected, only set while a command runs
+	outbox *[]string
+
+	// Closed once the state is closed
+	done chan struct{}
+}
+
+// Load the plugin's script into a fresh sandbox and run its top level, which defines the hooks
+func start(m Manifest) (*script, error) {
+	source, err := os.ReadFile(filepath.Join(m.Dir, m.Main))
+	if err != nil {
+		return nil, fmt.Errorf("could not read plugin %s: %v", m.Name, err)
+	}
+
+	s := &script{manifest: m, queue: make(chan func(), QUEUE_SIZE), done: make(chan struct{})}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.state = newSandbox(s)
+
+	ctx, cancel := context.WithTimeout(s.ctx, CALL_TIMEOUT)
+	defer cancel()
+	s.state.SetContext(ctx)
+	err = s.state.DoString(string(source))
+	s.state.RemoveContext()
+	if err != nil {
+		s.cancel()
+		s.state.Close()
+		return nil, fmt.Errorf("could not start plugin %s: %v", m.Name, luaError(err))
+	}
+
+	go s.run()
+	logger.Info("plugin started", "plugin", m.Name)
+	return s, nil
+}
+
+func (s *script) run() {
+	for hook := range s.queue {
+		hook()
+	}
+	s.state.Close()
+	close(s.done)
+}
+
+// Queue a hook, run with the Lua state under the context's deadline. A hook whose caller gave up is skipped.
+func (s *script) enqueue(ctx context.Context, hook func(L *lua.LState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("plugin %s is stopped", s.manifest.Name)
+	}
+
+	job := func() {
+		if ctx.Err() != nil {
+			return
+		}
+		s.state.SetContext(ctx)
+		hook(s.state)
+		s.state.RemoveContext()
+		s.state.SetTop(0)
+	}
+	select {
+	case s.queue <- job:
+		return nil
+	default:
+		return errNotKeepingUp
+	}
+}
+
+// Run a hook without waiting for it
+func (s *script) notify(hook func(L *lua.LState) error) error {
+	ctx, cancel := context.WithTimeout(s.ctx, CALL_TIMEOUT)
+	err := s.enqueue(ctx, func(L *lua.LState) {
+		defer cancel()
+		if err := hook(L); err != nil {
+			logger.Debug("plugin hook failed", "plugin", s.manifest.Name, logging.KeyErr, err)
+		}
+	})
+	if err != nil {
+		cancel()
+	}
+	return err
+}
+
+// Run a hook and wait for it, for at most CALL_TIMEOUT
+func (s *script) call(hook func(L *lua.LState) error) error {
+	ctx, cancel := context.WithTimeout(s.ctx, CALL_TIMEOUT)
+	defer cancel()
+
+	answer := make(chan error, 1)
+	if err := s.enqueue(ctx, func(L *lua.LState) { answer <- hook(L) }); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-answer:
+		if err != nil {
+			return fmt.Errorf("%s: %s", s.manifest.Name, sanitize(err.Error(), false))
+		}
+		return nil
+	case <-ctx.Done():
+		if s.ctx.Err() != nil {
+			return fmt.Errorf("plugin %s is stopped", s.manifest.Name)
+		}
+		return fmt.Errorf("plugin %s did not answer within %s", s.manifest.Name, CALL_TIMEOUT)
+	}
+}
+
+// Interrupt the running hook, skip the queued ones and close the state
+func (s *script) stop() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.cancel()
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
@@ -0,0 +1,68 @@
+// Package qr draws QR codes of short strings of digits, like safety numbers, in the terminal.
+// The encoding itself is left to rsc.io/qr.
+package qr
+
+import (
+	"errors"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// A square of modules, true for dark, without the quiet zone
+type Code [][]bool
+
+// Modules of light border scanners expect around the code
+const QUIET_ZONE int = 4
+
+// Encode a string of digits at error correction level M, in the smallest version it fits
+func Encode(digits string) (Code, error) {
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return nil, errors.New("only digits can be encoded")
+		}
+	}
+
+	encoded, err := qr.Encode(digits, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	code := make(Code, encoded.Size)
+	for y := range code {
+		code[y] = make([]bool, encoded.Size)
+		for x := range code[y] {
+			code[y][x] = encoded.Black(x, y)
+		}
+	}
+	return code, nil
+}
+
+// Two rows of modules per line of half blocks, dark modules drawn in the foreground color.
+// Print it dark on light, many scanners don't read an inverted code.
+func (code Code) String() string {
+	size := len(code) + 2*QUIET_ZONE
+	dark := func(x int, y int) bool {
+		x, y = x-QUIET_ZONE, y-QUIET_ZONE
+		return x >= 0 && y >= 0 && x < len(code) && y < len(code) && code[y][x]
+	}
+
+	var view strings.Builder
+	for y := 0; y < size; y += 2 {
+		if y > 0 {
+			view.WriteString("\n")
+		}
+		for x := range size {
+			switch top, bottom := dark(x, y), dark(x, y+1); {
+			case top && bottom:
+				view.WriteString("█")
+			case top:
+				view.WriteString("▀")
+			case bottom:
+				view.WriteString("▄")
+			default:
+				view.WriteString(" ")
+			}
+		}
+	}
+	return view.String()
+}
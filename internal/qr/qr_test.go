@@ -0,0 +1,32 @@
+package qr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	code, err := Encode(strings.Repeat("0123456789", 6))
+	if err != nil {
+		t.Fatal("Got an error encoding: ", err)
+	}
+	if len(code) != 25 {
+		t.Errorf("Expected 60 digits to need version 2, got a size of %d", len(code))
+	}
+	// Finder corners and the dark module next to the lower left finder
+	if !code[0][0] || !code[0][24] || !code[24][0] || code[1][1] || !code[25-8][8] {
+		t.Error("Expected the finder patterns and the dark module in place")
+	}
+
+	lines := strings.Split(code.String(), "\n")
+	if len(lines) != (25+2*QUIET_ZONE+1)/2 || len([]rune(lines[0])) != 25+2*QUIET_ZONE {
+		t.Errorf("Expected half block lines with a quiet zone, got %d lines", len(lines))
+	}
+
+	if _, err := Encode("12ab"); err == nil {
+		t.Error("Expected letters to be refused")
+	}
+	if _, err := Encode(strings.Repeat("9", 8000)); err == nil {
+		t.Error("Expected too many digits to be refused")
+	}
+}
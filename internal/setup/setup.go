@@ -2,11 +2,15 @@ package setup
 
 import (
 	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/plugin"
+	"bokkoli/internal/theme"
 	"errors"
 	"fmt"
-	"log"
 	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/huh"
@@ -18,79 +22,126 @@ const (
 	UPPERBOUND_PORT_NUMBER int = 49151
 )
 
+var logger = logging.For(logging.UI)
+
 var (
-	username   string //= "Username-read-from-db" // db.readUsername()
-	portNumber string //= "8080"                  // db.readPortNumber()
-	confirm    bool
+	username       string //= "Username-read-from-db" // db.readUsername()
+	portNumber     string //= "8080"                  // db.readPortNumber()
+	themeName      string
+	renderMarkdown bool
+	enabledPlugins []string
+	confirm        bool
 )
 
 type SetupModel struct {
-	Form                    *huh.Form
-	dbHandler               *db.DbHandler
+	Form *huh.Form
+	// The database is only open while the settings are read and saved, the model is copied on every update
+	dbPath                  string
+	plugins                 []plugin.Manifest
 	isValidDataAndCompleted bool
 }
 
-func New() *SetupModel {
+// Settings form for the profile's database; the plugins installed in pluginDir can be switched on and off
+func New(dbPath string, pluginDir string) *SetupModel {
 
-	dbHandler, err := db.NewDbHandler(db.DefaultDbFilePath)
+	dbHandler, err := db.NewDbHandler(dbPath)
 	if err != nil {
-		log.Fatal("DB failed to open in setup model.")
+		logging.Fatal(logger, "DB failed to open in setup model", logging.KeyErr, err)
 	}
+	defer dbHandler.Close()
 
 	err = dbHandler.SetupSchemas()
 	if err != nil {
-		log.Fatal("DB failed to set up schema for setup.")
+		logging.Fatal(logger, "DB failed to set up schema for setup", logging.KeyErr, err)
+	}
+
+	themeName = theme.Current().Name
+	settings, _ := dbHandler.ReadSetup()
+	renderMarkdown = settings.RenderMarkdown
+
+	plugins, err := plugin.Installed(pluginDir)
+	if err != nil {
+		logger.Warn("some plugins could not be read", logging.KeyErr, err)
+	}
+	enabledPlugins, err = dbHandler.ReadEnabledPlugins()
+	if err != nil {
+		logger.Warn("could not read enabled plugins", logging.KeyErr, err)
 	}
 
 	// Create the form with proper validation
-	form := huh.NewForm(
-		huh.NewGroup(
-			huh.NewInput().
-				Title(""), // bubbletea Huh bug, possibly remove this field if not needed
-			huh.NewInput().
-				Key("username").
-				Title("Input username").
-				Placeholder("<username>").
-				Value(&username).
-				Validate(func(str string) error {
-					if str == "" {
-						return errors.New("sorry, username cannot be left empty")
-					}
-					return nil
-				}),
-			huh.NewInput().
-				Key("port").
-				Title("Enter new port number").
-				Placeholder("<port number>").
-				Value(&portNumber).
-				Validate(func(str string) error {
-					// Try to convert the port string to an integer
-					portInt, err := strconv.Atoi(str)
-					if err != nil {
-						return errors.New("invalid port number, ports are numbers")
-					}
-
-					// Port validation logic: must be in the range [1024, 49151]
-					if portInt < LOWERBOUND_PORT_NUMBER || portInt > UPPERBOUND_PORT_NUMBER {
-						return fmt.Errorf("sorry, only ports in the range %d-%d are allowed", LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER)
-					}
-					return nil
-				}),
-			huh.NewConfirm().
-				Title("Please confirm username and port number").
-				Validate(func(v bool) error {
-					if !v {
-						return fmt.Errorf("no isn't actually an option, press 'Save' ~(^-^~)")
-					}
-					return nil
-				}).
-				Affirmative("Save").
-				Value(&confirm),
-		),
+	fields := []huh.Field{
+		huh.NewInput().
+			Title(""), // bubbletea Huh bug, possibly remove this field if not needed
+		huh.NewInput().
+			Key("username").
+			Title("Input username").
+			Placeholder("<username>").
+			Value(&username).
+			Validate(func(str string) error {
+				if str == "" {
+					return errors.New("sorry, username cannot be left empty")
+				}
+				return nil
+			}),
+		huh.NewInput().
+			Key("port").
+			Title("Enter new port number").
+			Placeholder("<port number>").
+			Value(&portNumber).
+			Validate(func(str string) error {
+				// Try to convert the port string to an integer
+				portInt, err := strconv.Atoi(str)
+				if err != nil {
+					return errors.New("invalid port number, ports are numbers")
+				}
+
+				// Port validation logic: must be in the range [1024, 49151]
+				if portInt < LOWERBOUND_PORT_NUMBER || portInt > UPPERBOUND_PORT_NUMBER {
+					return fmt.Errorf("sorry, only ports in the range %d-%d are allowed", LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER)
+				}
+				return nil
+			}),
+		huh.NewSelect[string]().
+			Key("theme").
+			Title("Color theme").
+			Options(huh.NewOptions(theme.Names()...)...).
+			Value(&themeName),
+		huh.NewConfirm().
+			Key("markdown").
+			Title("How should messages be shown?").
+			Affirmative("Markdown").
+			Negative("Raw text").
+			Value(&renderMarkdown),
+	}
+	if len(plugins) > 0 {
+		options := make([]huh.Option[string], len(plugins))
+		for i, manifest := range plugins {
+			options[i] = huh.NewOption(manifest.Name+": "+strings.Join(manifest.Describe(), ", "), manifest.Name)
+		}
+		fields = append(fields, huh.NewMultiSelect[string]().
+			Key("plugins").
+			Title("Enabled plugins").
+			Options(options...).
+			Value(&enabledPlugins))
+	}
+	fields = append(fields,
+		huh.NewConfirm().
+			Title("Please confirm username, port number and theme").
+			Validate(func(v bool) error {
+				if !v {
+					return fmt.Errorf("no isn't actually an option, press 'Save' ~(^-^~)")
+				}
+				return nil
+			}).
+			Affirmative("Save").
+			Value(&confirm),
 	)
+
+	form := huh.NewForm(huh.NewGroup(fields...))
 	return &SetupModel{
-		Form:      form,
-		dbHandler: dbHandler,
+		Form:    form,
+		dbPath:  dbPath,
+		plugins: plugins,
 	}
 }
 
@@ -103,7 +154,7 @@ func (m SetupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	if f, ok := form.(*huh.Form); ok {
 		m.Form = f
 	} else {
-		log.Fatal("Wrong type assertion, expected *huh.Form, got ", reflect.TypeOf(form))
+		logging.Fatal(logger, "wrong type assertion, expected *huh.Form", "got", reflect.TypeOf(form))
 	}
 
 	if m.Form.State == huh.StateCompleted && !m.isValidDataAndCompleted {
@@ -111,25 +162,20 @@ func (m SetupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		tempPort := m.Form.GetString("port")
 
 		if !validateUsername(tempUsername) {
-			log.Println("Bad username, clearing it out.")
+			logger.Debug("bad username, clearing it out")
 			username = ""
 		}
 
 		if !validatePort(tempPort) {
-			log.Println("Bad port, clearing it out.")
+			logger.Debug("bad port, clearing it out")
 			portNumber = ""
 		}
 
 		if validateUsername(tempUsername) && validatePort(tempPort) {
-			err := m.dbHandler.SaveSetup(tempPort, tempUsername)
-
-			if err != nil {
-				log.Panicf("DB did not save record properly to settings.\nPort: %s\nUsername: %s", tempPort, tempUsername)
-			}
+			m.save(tempPort, tempUsername)
 			m.isValidDataAndCompleted = true
 			if m.Form.State == huh.StateCompleted && !m.isValidDataAndCompleted {
-				fmt.Printf("Form State: %v\n", m.Form.State)
-				fmt.Printf("isValidDataAndCompleted: %v\n", m.isValidDataAndCompleted)
+				logger.Debug("form state", "state", m.Form.State, "isValidDataAndCompleted", m.isValidDataAndCompleted)
 			}
 		}
 
@@ -138,6 +184,43 @@ func (m SetupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+func (m SetupModel) save(port string, username string) {
+	dbHandler, err := db.NewDbHandler(m.dbPath)
+	if err != nil {
+		logging.Fatal(logger, "DB failed to open to save the settings", logging.KeyErr, err)
+	}
+	defer dbHandler.Close()
+
+	if err := dbHandler.SaveSetup(port, username); err != nil {
+		logging.Fatal(logger, "DB did not save record properly to settings", "port", port, logging.KeyErr, err)
+	}
+	saveTheme(dbHandler, m.Form.GetString("theme"))
+	if err := dbHandler.SaveRenderMarkdown(m.Form.GetBool("markdown")); err != nil {
+		logger.Error("DB did not save the Markdown setting", logging.KeyErr, err)
+	}
+	m.savePlugins(dbHandler)
+}
+
+func saveTheme(dbHandler *db.DbHandler, name string) {
+	if err := theme.Set(name); err != nil {
+		logger.Warn("selected theme could not be applied", logging.KeyErr, err)
+		return
+	}
+
+	if err := dbHandler.SaveTheme(name); err != nil {
+		logger.Error("DB did not save the selected theme", logging.KeyErr, err)
+	}
+}
+
+// Plugins are switched on and off in the database, running chats pick the change up when they are opened again
+func (m SetupModel) savePlugins(dbHandler *db.DbHandler) {
+	for _, manifest := range m.plugins {
+		if err := dbHandler.SetPluginEnabled(manifest.Name, slices.Contains(enabledPlugins, manifest.Name)); err != nil {
+			logger.Error("DB did not save the plugin setting", "plugin", manifest.Name, logging.KeyErr, err)
+		}
+	}
+}
+
 func validateUsername(username string) bool {
 	return username != ""
 }
@@ -145,12 +228,12 @@ func validateUsername(username string) bool {
 func validatePort(port string) bool {
 	portNumber, err := strconv.Atoi(port)
 	if err != nil {
-		log.Printf("%s is not valid port number due to not being integer: ", port)
+		logger.Debug("port is not a number", "port", port)
 		return false
 	}
 
 	if !(LOWERBOUND_PORT_NUMBER <= portNumber && portNumber <= UPPERBOUND_PORT_NUMBER) {
-		log.Printf("%d is out of range [%d, %d]", portNumber, LOWERBOUND_PORT_NUMBER, UPPERBOUND_PORT_NUMBER)
+		logger.Debug("port out of range", "port", portNumber, "min", LOWERBOUND_PORT_NUMBER, "max", UPPERBOUND_PORT_NUMBER)
 		return false
 	}
 
@@ -160,8 +243,39 @@ func validatePort(port string) bool {
 func (m SetupModel) View() string {
 	if m.isValidDataAndCompleted {
 		return m.Form.View() +
-			fmt.Sprintf("\n\nSaved successfully, you selected username: %s, port: %s", username, portNumber) +
-			lipgloss.NewStyle().Faint(true).Render("\nPress 'esc' to return back to main menu.")
+			fmt.Sprintf("\n\nSaved successfully, you selected username: %s, port: %s, theme: %s", username, portNumber, themeName) +
+			lipgloss.NewStyle().Foreground(theme.Current().Muted).Render("\nPress 'esc' to return back to main menu.")
+	}
+
+	// Live preview of the theme currently highlighted in the form
+	preview, ok := theme.Get(themeName)
+	if !ok {
+		return m.Form.View()
 	}
-	return m.Form.View()
+	return lipgloss.JoinHorizontal(lipgloss.Top, m.Form.View(), "   ", previewView(preview))
+}
+
+// Sample chat rendered with the given theme
+func previewView(t theme.Theme) string {
+	sender := lipgloss.NewStyle().Bold(true).Foreground(t.AccentText).Background(t.Accent)
+	muted := lipgloss.NewStyle().Foreground(t.Muted)
+	text := lipgloss.NewStyle().Foreground(t.Text)
+
+	message := lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(t.Border).
+		Padding(0, 1).
+		Render(muted.Italic(true).Render("12:34") + " - " + sender.Render("broccoli") + "\n\n" + text.Render("Veggie-to-veggie hello!"))
+
+	lines := []string{
+		lipgloss.NewStyle().Bold(true).Foreground(t.Text).Render("Preview: " + t.Name),
+		"",
+		message,
+		lipgloss.NewStyle().Foreground(t.Highlight).Bold(true).Render("/connect <address>") + muted.Render(" connect to a peer"),
+		lipgloss.NewStyle().Foreground(t.Selected).Bold(true).Render("(•) Start Chatting"),
+		lipgloss.NewStyle().Foreground(t.Success).Render("✓ connected") + "  " + lipgloss.NewStyle().Foreground(t.Error).Render("✗ send failed"),
+		lipgloss.NewStyle().Foreground(t.Prompt).Render("> ") + muted.Render("type a message"),
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left, lines...)
 }
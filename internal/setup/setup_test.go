@@ -1,6 +1,8 @@
 package setup
 
 import (
+	"bokkoli/internal/db"
+	"path/filepath"
 	"testing"
 )
 
@@ -56,3 +58,20 @@ func TestValidateUsernameEmpty(t *testing.T) {
 		t.Errorf("Expected %t, got %t", expected, result)
 	}
 }
+
+// The model opens the database only to read and save the settings, so saving goes through a fresh handler
+func TestSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test-bokkoli.db")
+	m := New(path, t.TempDir())
+	m.save("8080", "alice")
+
+	dbHandler, err := db.NewDbHandler(path)
+	if err != nil {
+		t.Fatal("Got an error on DB creation: ", err)
+	}
+	defer dbHandler.Close()
+	settings, err := dbHandler.ReadSetup()
+	if err != nil || settings.Port != "8080" || settings.Username != "alice" {
+		t.Errorf("Expected the saved port and username, got %+v (%v)", settings, err)
+	}
+}
@@ -0,0 +1,276 @@
+package theme
+
+import (
+	"bokkoli/internal/logging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+const DEFAULT_THEME string = "auto"
+
+var logger = logging.For(logging.UI)
+
+// Named palette of semantic colors used across every view.
+// Colors are adaptive, the Light or Dark value is picked from the terminal background.
+type Theme struct {
+	Name       string
+	Text       lipgloss.AdaptiveColor
+	Muted      lipgloss.AdaptiveColor
+	Accent     lipgloss.AdaptiveColor
+	AccentText lipgloss.AdaptiveColor
+	Highlight  lipgloss.AdaptiveColor
+	Border     lipgloss.AdaptiveColor
+	Selected   lipgloss.AdaptiveColor
+	Prompt     lipgloss.AdaptiveColor
+	Error      lipgloss.AdaptiveColor
+	Success    lipgloss.AdaptiveColor
+}
+
+// Same color regardless of the terminal background
+func fixed(color string) lipgloss.AdaptiveColor {
+	return lipgloss.AdaptiveColor{Light: color, Dark: color}
+}
+
+var dark = Theme{
+	Name:       "dark",
+	Text:       fixed("#E4E4E4"),
+	Muted:      fixed("241"),
+	Accent:     fixed("#a488f7"),
+	AccentText: fixed("#FAFAFA"),
+	Highlight:  fixed("#f47d56"),
+	Border:     fixed("69"),
+	Selected:   fixed("34"),
+	Prompt:     fixed("#1379af"),
+	Error:      fixed("#ff6b6b"),
+	Success:    fixed("#5fd787"),
+}
+
+var light = Theme{
+	Name:       "light",
+	Text:       fixed("#1F1F1F"),
+	Muted:      fixed("#6B6B6B"),
+	Accent:     fixed("#6A4FC9"),
+	AccentText: fixed("#FFFFFF"),
+	Highlight:  fixed("#B8420E"),
+	Border:     fixed("#3B5BDB"),
+	Selected:   fixed("#1A7F37"),
+	Prompt:     fixed("#0B5C8A"),
+	Error:      fixed("#C62828"),
+	Success:    fixed("#2E7D32"),
+}
+
+var highContrast = Theme{
+	Name:       "high-contrast",
+	Text:       lipgloss.AdaptiveColor{Light: "0", Dark: "15"},
+	Muted:      lipgloss.AdaptiveColor{Light: "0", Dark: "15"},
+	Accent:     lipgloss.AdaptiveColor{Light: "0", Dark: "11"},
+	AccentText: lipgloss.AdaptiveColor{Light: "15", Dark: "0"},
+	Highlight:  lipgloss.AdaptiveColor{Light: "4", Dark: "14"},
+	Border:     lipgloss.AdaptiveColor{Light: "0", Dark: "15"},
+	Selected:   lipgloss.AdaptiveColor{Light: "2", Dark: "10"},
+	Prompt:     lipgloss.AdaptiveColor{Light: "0", Dark: "15"},
+	Error:      lipgloss.AdaptiveColor{Light: "1", Dark: "9"},
+	Success:    lipgloss.AdaptiveColor{Light: "2", Dark: "10"},
+}
+
+// Light palette on light terminals, dark palette on dark ones
+var auto = Theme{
+	Name:       DEFAULT_THEME,
+	Text:       adapt(light.Text, dark.Text),
+	Muted:      adapt(light.Muted, dark.Muted),
+	Accent:     adapt(light.Accent, dark.Accent),
+	AccentText: adapt(light.AccentText, dark.AccentText),
+	Highlight:  adapt(light.Highlight, dark.Highlight),
+	Border:     adapt(light.Border, dark.Border),
+	Selected:   adapt(light.Selected, dark.Selected),
+	Prompt:     adapt(light.Prompt, dark.Prompt),
+	Error:      adapt(light.Error, dark.Error),
+	Success:    adapt(light.Success, dark.Success),
+}
+
+func adapt(l lipgloss.AdaptiveColor, d lipgloss.AdaptiveColor) lipgloss.AdaptiveColor {
+	return lipgloss.AdaptiveColor{Light: l.Light, Dark: d.Dark}
+}
+
+var (
+	mu      sync.RWMutex
+	themes  = map[string]Theme{}
+	builtin = []string{auto.Name, dark.Name, light.Name, highContrast.Name}
+	current = auto
+)
+
+func init() {
+	for _, t := range []Theme{auto, dark, light, highContrast} {
+		themes[t.Name] = t
+	}
+}
+
+// Theme currently used to render every view
+func Current() Theme {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Switch the current theme by name
+func Set(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	t, ok := themes[name]
+	if !ok {
+		return fmt.Errorf("unknown theme %q", name)
+	}
+
+	current = t
+	return nil
+}
+
+func Get(name string) (Theme, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	t, ok := themes[name]
+	return t, ok
+}
+
+// Built-in theme names first, followed by user-defined themes sorted by name
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var user []string
+	for name := range themes {
+		if !isBuiltin(name) {
+			user = append(user, name)
+		}
+	}
+	sort.Strings(user)
+
+	return append(append([]string{}, builtin...), user...)
+}
+
+func isBuiltin(name string) bool {
+	for _, b := range builtin {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Color as written in the themes file, either "#a488f7" / "69" or {"light": "...", "dark": "..."}
+type fileColor lipgloss.AdaptiveColor
+
+func (c *fileColor) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*c = fileColor(fixed(single))
+		return nil
+	}
+
+	var pair struct {
+		Light string `json:"light"`
+		Dark  string `json:"dark"`
+	}
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return fmt.Errorf("color must be a string or {\"light\", \"dark\"} pair: %v", err)
+	}
+	if pair.Light == "" || pair.Dark == "" {
+		return errors.New("color pair needs both a light and a dark value")
+	}
+
+	*c = fileColor{Light: pair.Light, Dark: pair.Dark}
+	return nil
+}
+
+type fileTheme struct {
+	Name       string     `json:"name"`
+	Extends    string     `json:"extends"`
+	Text       *fileColor `json:"text"`
+	Muted      *fileColor `json:"muted"`
+	Accent     *fileColor `json:"accent"`
+	AccentText *fileColor `json:"accent_text"`
+	Highlight  *fileColor `json:"highlight"`
+	Border     *fileColor `json:"border"`
+	Selected   *fileColor `json:"selected"`
+	Prompt     *fileColor `json:"prompt"`
+	Error      *fileColor `json:"error"`
+	Success    *fileColor `json:"success"`
+}
+
+// Parse user-defined themes; colors that are left out come from the theme named in "extends", "auto" by default
+func Parse(data []byte) ([]Theme, error) {
+	var file struct {
+		Themes []fileTheme `json:"themes"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse themes: %v", err)
+	}
+
+	parsed := make([]Theme, 0, len(file.Themes))
+	for _, ft := range file.Themes {
+		if ft.Name == "" {
+			return nil, errors.New("every theme needs a name")
+		}
+		if isBuiltin(ft.Name) {
+			return nil, fmt.Errorf("theme %q would replace a built-in theme", ft.Name)
+		}
+
+		if ft.Extends == "" {
+			ft.Extends = DEFAULT_THEME
+		}
+		base, ok := Get(ft.Extends)
+		if !ok {
+			return nil, fmt.Errorf("theme %q extends unknown theme %q", ft.Name, ft.Extends)
+		}
+
+		t := base
+		t.Name = ft.Name
+		overrides := map[*lipgloss.AdaptiveColor]*fileColor{
+			&t.Text: ft.Text, &t.Muted: ft.Muted, &t.Accent: ft.Accent, &t.AccentText: ft.AccentText,
+			&t.Highlight: ft.Highlight, &t.Border: ft.Border, &t.Selected: ft.Selected,
+			&t.Prompt: ft.Prompt, &t.Error: ft.Error, &t.Success: ft.Success,
+		}
+		for field, color := range overrides {
+			if color != nil {
+				*field = lipgloss.AdaptiveColor(*color)
+			}
+		}
+
+		parsed = append(parsed, t)
+	}
+
+	return parsed, nil
+}
+
+// Load user-defined themes from a JSON file and make them selectable. A missing file is not an error.
+func LoadFile(filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read themes file: %v", err)
+	}
+
+	parsed, err := Parse(data)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, t := range parsed {
+		themes[t.Name] = t
+	}
+
+	logger.Info("loaded user themes", "count", len(parsed), "path", filePath)
+	return nil
+}
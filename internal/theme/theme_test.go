@@ -0,0 +1,77 @@
+package theme
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+func TestNamesBuiltinFirst(t *testing.T) {
+	expected := []string{"auto", "dark", "light", "high-contrast"}
+	result := Names()
+
+	if !slices.Equal(expected, result[:len(expected)]) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestSetUnknownTheme(t *testing.T) {
+	if err := Set("veggie-town"); err == nil {
+		t.Error("Expected an error for an unknown theme, got nil")
+	}
+}
+
+func TestSetTheme(t *testing.T) {
+	defer Set(DEFAULT_THEME)
+
+	if err := Set("light"); err != nil {
+		t.Fatal("Got an error setting theme: ", err)
+	}
+
+	if result := Current().Name; result != "light" {
+		t.Errorf("Expected light, got %s", result)
+	}
+}
+
+func TestParseExtendsBaseTheme(t *testing.T) {
+	data := []byte(`{
+		"themes": [{
+			"name": "pickle",
+			"extends": "dark",
+			"accent": "#00ff00",
+			"border": {"light": "#000000", "dark": "#ffffff"}
+		}]
+	}`)
+
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal("Got an error parsing themes: ", err)
+	}
+
+	pickle := parsed[0]
+	if expected := (lipgloss.AdaptiveColor{Light: "#00ff00", Dark: "#00ff00"}); pickle.Accent != expected {
+		t.Errorf("Expected accent %v, got %v", expected, pickle.Accent)
+	}
+	if expected := (lipgloss.AdaptiveColor{Light: "#000000", Dark: "#ffffff"}); pickle.Border != expected {
+		t.Errorf("Expected border %v, got %v", expected, pickle.Border)
+	}
+	if pickle.Highlight != dark.Highlight {
+		t.Errorf("Expected highlight from dark theme %v, got %v", dark.Highlight, pickle.Highlight)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing name":     `{"themes": [{"accent": "#00ff00"}]}`,
+		"builtin override": `{"themes": [{"name": "dark"}]}`,
+		"unknown base":     `{"themes": [{"name": "pickle", "extends": "cucumber"}]}`,
+		"half color pair":  `{"themes": [{"name": "pickle", "accent": {"light": "#000000"}}]}`,
+	}
+
+	for name, data := range tests {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error, got nil", name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package vault seals data at rest with a key derived from the profile passphrase. Sealed values are text,
+// so they fit in the columns and files that held the plain values before.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Prefix of every sealed value, the version leaves room for another cipher later
+const PREFIX string = "sealed:v1:"
+
+// scrypt cost for new passphrases, about a tenth of a second on a laptop
+const (
+	SCRYPT_N   int = 1 << 15
+	SCRYPT_R   int = 8
+	SCRYPT_P   int = 1
+	SALT_SIZE  int = 16
+	KEY_SIZE   int = 32
+	MIN_LENGTH int = 8
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrNotSealed       = errors.New("not a sealed value")
+)
+
+// How a key is derived from the passphrase, stored next to the data it protects
+type Params struct {
+	Salt []byte
+	N    int
+	R    int
+	P    int
+}
+
+// Fresh parameters with a random salt, for setting or changing the passphrase
+func NewParams() (Params, error) {
+	salt := make([]byte, SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return Params{}, err
+	}
+	return Params{Salt: salt, N: SCRYPT_N, R: SCRYPT_R, P: SCRYPT_P}, nil
+}
+
+// Seals and opens values with AES-256-GCM
+type Key struct {
+	aead cipher.AEAD
+}
+
+func Derive(passphrase string, params Params) (*Key, error) {
+	secret, err := scrypt.Key([]byte(passphrase), params.Salt, params.N, params.R, params.P, KEY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead}, nil
+}
+
+// Encrypt under a random nonce, the result is PREFIX followed by the nonce and ciphertext in base64
+func (k *Key) Seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, plaintext, nil)
+	return PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a value from Seal, failing with ErrWrongPassphrase when it was sealed with another key or tampered with
+func (k *Key) Open(sealed string) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, ErrNotSealed
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, PREFIX))
+	if err != nil || len(data) < k.aead.NonceSize() {
+		return nil, ErrNotSealed
+	}
+	plaintext, err := k.aead.Open(nil, data[:k.aead.NonceSize()], data[k.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, PREFIX)
+}
+
+// Refuse passphrases too short to hold up against guessing
+func Validate(passphrase string) error {
+	if len([]rune(passphrase)) < MIN_LENGTH {
+		return errors.New("pick a passphrase of at least 8 characters")
+	}
+	return nil
+}
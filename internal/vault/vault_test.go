@@ -0,0 +1,53 @@
+package vault
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Cheap parameters so the tests don't spend their time in scrypt
+func testParams(t *testing.T) Params {
+	params, err := NewParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.N = 1 << 10
+	return params
+}
+
+func TestSealAndOpen(t *testing.T) {
+	params := testParams(t)
+	key, err := Derive("correct horse", params)
+	if err != nil {
+		t.Fatal("Got an error deriving: ", err)
+	}
+
+	sealed, err := key.Seal([]byte("meet at noon"))
+	if err != nil || !IsSealed(sealed) || strings.Contains(sealed, "noon") {
+		t.Fatalf("Expected a sealed value, got %q (%v)", sealed, err)
+	}
+	if again, _ := key.Seal([]byte("meet at noon")); again == sealed {
+		t.Error("Expected a fresh nonce for every value")
+	}
+	if plaintext, err := key.Open(sealed); err != nil || string(plaintext) != "meet at noon" {
+		t.Errorf("Expected the text back, got %q (%v)", plaintext, err)
+	}
+
+	other, _ := Derive("wrong horse", params)
+	if _, err := other.Open(sealed); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Expected another passphrase to fail, got %v", err)
+	}
+	if _, err := key.Open("meet at noon"); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("Expected plain text to be refused, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if Validate("short") == nil {
+		t.Error("Expected a short passphrase to be refused")
+	}
+	if err := Validate("long enough"); err != nil {
+		t.Error("Expected a long passphrase to be accepted, got: ", err)
+	}
+}
@@ -0,0 +1,339 @@
+package webhook
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/logging"
+	"bokkoli/internal/message"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of activity a webhook can be told about
+const (
+	EventMessage    string = "message"
+	EventMention    string = "mention"
+	EventConnect    string = "connect"
+	EventDisconnect string = "disconnect"
+)
+
+var Events = []string{EventMessage, EventMention, EventConnect, EventDisconnect}
+
+// Headers sent with every delivery
+const (
+	HEADER_EVENT     string = "X-Bokkoli-Event"
+	HEADER_DELIVERY  string = "X-Bokkoli-Delivery"
+	HEADER_SIGNATURE string = "X-Bokkoli-Signature"
+)
+
+// A delivery is given up after this many attempts, waiting twice as long before each retry
+const (
+	MAX_ATTEMPTS    int           = 6
+	INITIAL_BACKOFF time.Duration = 2 * time.Second
+	REQUEST_TIMEOUT time.Duration = 10 * time.Second
+)
+
+var logger = logging.For(logging.NET)
+
+// JSON body of a delivery
+type Payload struct {
+	Event    string      `json:"event"`
+	Peer     string      `json:"peer,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Incoming bool        `json:"incoming,omitempty"`
+	Message  *db.Message `json:"message,omitempty"`
+	Time     time.Time   `json:"time"`
+}
+
+// Turns node events into webhook deliveries. Every delivery is recorded in the database first
+// and then attempted in the background, so deliveries still pending on Close are resumed by the next Dispatcher.
+type Dispatcher struct {
+	dbHandler *db.DbHandler
+	client    *http.Client
+	backoff   time.Duration
+
+	mu      sync.Mutex
+	retries map[int64]*time.Timer
+	due     []db.WebhookDelivery
+	closed  bool
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+var _ message.Hook = (*Dispatcher)(nil)
+
+func NewDispatcher(dbHandler *db.DbHandler) *Dispatcher {
+	d := &Dispatcher{
+		dbHandler: dbHandler,
+		client:    &http.Client{Timeout: REQUEST_TIMEOUT},
+		backoff:   INITIAL_BACKOFF,
+		retries:   make(map[int64]*time.Timer),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go d.run()
+	d.resume()
+	return d
+}
+
+// Pick up deliveries that were still pending when the last Dispatcher stopped
+func (d *Dispatcher) resume() {
+	pending, err := d.dbHandler.ReadDeliveries(db.DeliveryPending, 0)
+	if err != nil {
+		logger.Error("could not read pending webhook deliveries", logging.KeyErr, err)
+		return
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		d.schedule(pending[i], 0)
+	}
+}
+
+// Record a delivery for every webhook interested in the event
+func (d *Dispatcher) HandleEvent(event message.Event) {
+	kinds := eventKinds(event)
+	if len(kinds) == 0 {
+		return
+	}
+
+	webhooks, err := d.dbHandler.ReadWebhooks()
+	if err != nil {
+		logger.Error("could not read webhooks", logging.KeyErr, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		kind, ok := firstSubscribed(webhook, kinds)
+		if !ok {
+			continue
+		}
+
+		payload, err := json.Marshal(Payload{
+			Event: kind, Peer: event.Peer, Name: event.Name, Incoming: event.Incoming, Message: event.Message, Time: event.Time,
+		})
+		if err != nil {
+			logger.Error("could not encode webhook payload", logging.KeyErr, err)
+			continue
+		}
+
+		delivery := db.WebhookDelivery{WebhookID: webhook.ID, Event: kind, Payload: string(payload), Status: db.DeliveryPending}
+		if delivery.ID, err = d.dbHandler.SaveDelivery(delivery); err != nil {
+			logger.Error("could not record webhook delivery", "webhook", webhook.ID, logging.KeyErr, err)
+			continue
+		}
+		d.schedule(delivery, 0)
+	}
+}
+
+// Webhook events an event counts as, most specific first
+func eventKinds(event message.Event) []string {
+	switch event.Type {
+	case message.EventMessage:
+		if !event.Incoming {
+			return nil
+		}
+		if event.Mention {
+			return []string{EventMention, EventMessage}
+		}
+		return []string{EventMessage}
+	case message.EventConnected:
+		return []string{EventConnect}
+	case message.EventDisconnected:
+		return []string{EventDisconnect}
+	}
+	return nil
+}
+
+func firstSubscribed(webhook db.Webhook, kinds []string) (string, bool) {
+	for _, kind := range kinds {
+		for _, subscribed := range webhook.Events {
+			if subscribed == kind {
+				return kind, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Queue the delivery after the delay, without blocking the caller
+func (d *Dispatcher) schedule(delivery db.WebhookDelivery, delay time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+
+	d.retries[delivery.ID] = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		delete(d.retries, delivery.ID)
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		d.due = append(d.due, delivery)
+		d.mu.Unlock()
+
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// Deliveries are attempted one at a time, in the order they became due
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-d.wake:
+		}
+
+		for {
+			d.mu.Lock()
+			if d.closed || len(d.due) == 0 {
+				d.mu.Unlock()
+				break
+			}
+			delivery := d.due[0]
+			d.due = d.due[1:]
+			d.mu.Unlock()
+
+			d.attempt(delivery)
+		}
+	}
+}
+
+func (d *Dispatcher) attempt(delivery db.WebhookDelivery) {
+	webhook, err := d.dbHandler.ReadWebhook(delivery.WebhookID)
+	if err != nil {
+		// Removed since the delivery was recorded
+		logger.Info("dropping delivery for a removed webhook", "webhook", delivery.WebhookID, "delivery", delivery.ID)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.StatusCode, err = d.post(webhook, delivery)
+	delivery.Error = ""
+	switch {
+	case err == nil:
+		delivery.Status = db.DeliveryDelivered
+	case delivery.Attempts >= MAX_ATTEMPTS:
+		delivery.Status, delivery.Error = db.DeliveryFailed, err.Error()
+		logger.Warn("giving up on webhook delivery", "webhook", webhook.ID, "delivery", delivery.ID, "attempts", delivery.Attempts, logging.KeyErr, err)
+	default:
+		delivery.Error = err.Error()
+		delay := d.backoff << (delivery.Attempts - 1)
+		logger.Info("webhook delivery failed, retrying", "webhook", webhook.ID, "delivery", delivery.ID, "in", delay, logging.KeyErr, err)
+		d.schedule(delivery, delay)
+	}
+
+	if err := d.dbHandler.UpdateDelivery(delivery); err != nil {
+		logger.Error("could not record webhook delivery", "delivery", delivery.ID, logging.KeyErr, err)
+	}
+}
+
+// Anything but a 2xx response counts as a failure
+func (d *Dispatcher) post(webhook db.Webhook, delivery db.WebhookDelivery) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "bokkoli-webhook")
+	request.Header.Set(HEADER_EVENT, delivery.Event)
+	request.Header.Set(HEADER_DELIVERY, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(HEADER_SIGNATURE, Sign(webhook.Secret, []byte(delivery.Payload)))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// Stop retrying and wait for the delivery in flight; anything still pending is resumed next time
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for id, timer := range d.retries {
+		timer.Stop()
+		delete(d.retries, id)
+	}
+	close(d.stop)
+	d.mu.Unlock()
+
+	<-d.done
+	return nil
+}
+
+// "sha256=" followed by the hex HMAC-SHA256 of the body, keyed with the webhook's secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether a signature header matches the body, for receivers written in Go
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Check a webhook before it is saved, generating a secret when none was given
+func New(rawURL string, events []string, secret string) (db.Webhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return db.Webhook{}, fmt.Errorf("expected an http or https URL, got %q", rawURL)
+	}
+
+	if len(events) == 0 {
+		return db.Webhook{}, fmt.Errorf("expected at least one event out of: %s", strings.Join(Events, ", "))
+	}
+	for _, event := range events {
+		if !isEvent(event) {
+			return db.Webhook{}, fmt.Errorf("unknown event %q, expected one of: %s", event, strings.Join(Events, ", "))
+		}
+	}
+
+	if secret == "" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return db.Webhook{}, err
+		}
+		secret = hex.EncodeToString(random)
+	}
+
+	return db.Webhook{URL: rawURL, Events: events, Secret: secret}, nil
+}
+
+func isEvent(name string) bool {
+	for _, event := range Events {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package webhook
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/db/dbtest"
+	"bokkoli/internal/message"
+	"bokkoli/internal/message/messagetest"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type received struct {
+	header  http.Header
+	body    []byte
+	payload Payload
+}
+
+// Local stand-in for a webhook endpoint, answering with the given status codes in turn and 200 after that
+func newStandIn(t *testing.T, statuses ...int) (*httptest.Server, <-chan received) {
+	requests := make(chan received, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload Payload
+		json.Unmarshal(body, &payload)
+		requests <- received{header: r.Header, body: body, payload: payload}
+
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func addWebhook(t *testing.T, dbHandler *db.DbHandler, url string, events ...string) db.Webhook {
+	hook, err := New(url, events, "")
+	if err != nil {
+		t.Fatal("Got an error creating the webhook: ", err)
+	}
+	if hook.ID, err = dbHandler.SaveWebhook(hook); err != nil {
+		t.Fatal("Got an error saving the webhook: ", err)
+	}
+	return hook
+}
+
+func newTestDispatcher(t *testing.T, dbHandler *db.DbHandler) *Dispatcher {
+	d := NewDispatcher(dbHandler)
+	d.backoff = 10 * time.Millisecond
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func awaitRequest(t *testing.T, requests <-chan received) received {
+	select {
+	case request := <-requests:
+		return request
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a delivery")
+	}
+	return received{}
+}
+
+func awaitDelivery(t *testing.T, dbHandler *db.DbHandler, status db.DeliveryStatus) db.WebhookDelivery {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err := dbHandler.ReadDeliveries(status, 1)
+		if err != nil {
+			t.Fatal("Got an error reading deliveries: ", err)
+		}
+		if len(deliveries) == 1 {
+			return deliveries[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for a %s delivery", status)
+	return db.WebhookDelivery{}
+}
+
+func incomingMessage(text string, mention bool) message.Event {
+	return message.Event{
+		Type: message.EventMessage, Peer: "127.0.0.1:50000", Name: "bob", Incoming: true, Mention: mention,
+		Message: &db.Message{Text: text, Sender: "bob", Direction: db.Incoming, Timestamp: time.Now()},
+		Time:    time.Now(),
+	}
+}
+
+func TestSignedDelivery(t *testing.T) {
+	dbHandler := dbtest.New(t)
+	server, requests := newStandIn(t)
+	hook := addWebhook(t, dbHandler, server.URL, EventMessage)
+
+	newTestDispatcher(t, dbHandler).HandleEvent(incomingMessage("ship it", false))
+
+	request := awaitRequest(t, requests)
+	if !Verify(hook.Secret, request.body, request.header.Get(HEADER_SIGNATURE)) {
+		t.Errorf("Expected a valid signature, got %q", request.header.Get(HEADER_SIGNATURE))
+	}
+	if request.header.Get(HEADER_EVENT) != EventMessage || request.payload.Message == nil || request.payload.Message.Text != "ship it" {
+		t.Errorf("Expected the message as payload, got %s %s", request.header.Get(HEADER_EVENT), request.body)
+	}
+
+	delivery := awaitDelivery(t, dbHandler, db.DeliveryDelivered)
+	if delivery.Attempts != 1 || delivery.StatusCode != http.StatusOK {
+		t.Errorf("Expected one successful attempt, got %+v", delivery)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	dbHandler := dbtest.New(t)
+	server, requests := newStandIn(t)
+	addWebhook(t, dbHandler, server.URL, EventMention)
+	d := newTestDispatcher(t, dbHandler)
+
+	d.HandleEvent(incomingMessage("no mention here", false))
+	d.HandleEvent(message.Event{Type: message.EventConnected, Peer: "localhost:8080"})
+	d.HandleEvent(incomingMessage("@alice look", true))
+
+	request := awaitRequest(t, requests)
+	if request.payload.Event != EventMention || request.payload.Message.Text != "@alice look" {
+		t.Errorf("Expected only the mention to be delivered, got %s", request.body)
+	}
+
+	deliveries, err := dbHandler.ReadDeliveries("", 0)
+	if err != nil || len(deliveries) != 1 {
+		t.Errorf("Expected a single recorded delivery, got %+v (%v)", deliveries, err)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	dbHandler := dbtest.New(t)
+	server, requests := newStandIn(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	addWebhook(t, dbHandler, server.URL, EventConnect)
+
+	newTestDispatcher(t, dbHandler).HandleEvent(message.Event{Type: message.EventConnected, Peer: "localhost:8080"})
+
+	for range 3 {
+		awaitRequest(t, requests)
+	}
+	delivery := awaitDelivery(t, dbHandler, db.DeliveryDelivered)
+	if delivery.Attempts != 3 || delivery.Error != "" {
+		t.Errorf("Expected delivery on the third attempt, got %+v", delivery)
+	}
+}
+
+func TestGivesUp(t *testing.T) {
+	dbHandler := dbtest.New(t)
+	statuses := make([]int, MAX_ATTEMPTS)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	server, _ := newStandIn(t, statuses...)
+	addWebhook(t, dbHandler, server.URL, EventDisconnect)
+
+	d := newTestDispatcher(t, dbHandler)
+	d.backoff = time.Millisecond
+	d.HandleEvent(message.Event{Type: message.EventDisconnected, Peer: "localhost:8080"})
+
+	delivery := awaitDelivery(t, dbHandler, db.DeliveryFailed)
+	if delivery.Attempts != MAX_ATTEMPTS || delivery.StatusCode != http.StatusBadGateway || delivery.Error == "" {
+		t.Errorf("Expected to give up after %d attempts, got %+v", MAX_ATTEMPTS, delivery)
+	}
+}
+
+func TestResumesPending(t *testing.T) {
+	dbHandler := dbtest.New(t)
+	server, requests := newStandIn(t)
+	hook := addWebhook(t, dbHandler, server.URL, EventMessage)
+
+	// Left behind by a process that stopped before delivering
+	if _, err := dbHandler.SaveDelivery(db.WebhookDelivery{WebhookID: hook.ID, Event: EventMessage, Payload: `{"event":"message"}`}); err != nil {
+		t.Fatal("Got an error saving the delivery: ", err)
+	}
+
+	newTestDispatcher(t, dbHandler)
+	request := awaitRequest(t, requests)
+	if string(request.body) != `{"event":"message"}` {
+		t.Errorf("Expected the pending payload, got %s", request.body)
+	}
+	awaitDelivery(t, dbHandler, db.DeliveryDelivered)
+}
+
+// A mention arriving over the network is delivered through the node's receive path
+func TestFromReceivePath(t *testing.T) {
+	dbHandler := dbtest.New(t)
+	server, requests := newStandIn(t)
+	addWebhook(t, dbHandler, server.URL, EventMention)
+
+	receiver := message.NewNode(dbHandler, "alice")
+	receiver.AddHook(newTestDispatcher(t, dbHandler))
+	t.Cleanup(func() { receiver.Close() })
+	if err := receiver.Listen("0"); err != nil {
+		t.Fatal("Got an error listening: ", err)
+	}
+
+	sender := message.NewNode(dbtest.New(t), "bob")
+	t.Cleanup(func() { sender.Close() })
+	address, err := sender.Connect(messagetest.ListenPort(t, receiver))
+	if err != nil {
+		t.Fatal("Got an error connecting: ", err)
+	}
+	if _, err := sender.Send(address, "hey @Alice, the build is red"); err != nil {
+		t.Fatal("Got an error sending: ", err)
+	}
+
+	request := awaitRequest(t, requests)
+	if request.payload.Event != EventMention || request.payload.Name != "bob" {
+		t.Errorf("Expected a mention from bob, got %s", request.body)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("ftp://example.com", []string{EventMessage}, ""); err == nil {
+		t.Error("Expected an error for a non-HTTP URL")
+	}
+	if _, err := New("https://example.com/hook", []string{"file"}, ""); err == nil {
+		t.Error("Expected an error for an unknown event")
+	}
+	hook, err := New("https://example.com/hook", []string{EventMessage}, "")
+	if err != nil || len(hook.Secret) != 64 {
+		t.Errorf("Expected a generated secret, got %+v (%v)", hook, err)
+	}
+}
@@ -1,29 +1,45 @@
 package main
 
 import (
+	"bokkoli/internal/cli"
+	"bokkoli/internal/config"
+	"bokkoli/internal/daemon"
+	"bokkoli/internal/db"
+	"bokkoli/internal/identity"
+	"bokkoli/internal/logging"
 	"bokkoli/internal/login"
 	"bokkoli/internal/message"
 	"bokkoli/internal/setup"
+	"bokkoli/internal/theme"
+	"bokkoli/internal/vault"
+	"bokkoli/internal/webhook"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
 
-var (
-	focusedModelStyle = lipgloss.NewStyle().
-				Width(30).
-				Height(8).
-				Align(lipgloss.Center, lipgloss.Center).
-				BorderStyle(lipgloss.NormalBorder()).
-				BorderForeground(lipgloss.Color("69"))
+func focusedModelStyle() lipgloss.Style {
+	return lipgloss.NewStyle().
+		Width(30).
+		Height(8).
+		Align(lipgloss.Center, lipgloss.Center).
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(theme.Current().Border)
+}
 
-	helpStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("241"))
-)
+func helpStyle() lipgloss.Style {
+	return lipgloss.NewStyle().
+		Foreground(theme.Current().Muted)
+}
+
+var logger = logging.For(logging.UI)
 
 type sessionState uint
 
@@ -31,33 +47,166 @@ const (
 	loginView sessionState = iota
 	chatView
 	setupView
+	// Locked after being idle or with /lock, only the unlock screen is shown
+	lockedView
 )
 
+// How often the time since the last key press is checked against lock_after
+const IDLE_CHECK_INTERVAL time.Duration = 5 * time.Second
+
 type mainModel struct {
-	state sessionState
-	login login.Model
-	chat  *message.ChatModel
-	setup *setup.SetupModel
+	state   sessionState
+	config  *config.Config
+	backend message.Backend
+	// Stops the backend when the program exits
+	closeBackend func()
+	login        login.Model
+	chat         *message.ChatModel
+	setup        *setup.SetupModel
+
+	// Only a profile with a passphrase can lock, the passphrase is what unlocks it
+	encrypted bool
+	lockAfter time.Duration
+	lastInput time.Time
+	// View shown again once unlocked, and the incoming messages counted while locked
+	resume          sessionState
+	lockEvents      <-chan message.Event
+	unsubscribeLock func()
+	missed          int
+}
+
+type idleCheck struct{}
+
+// Backend event seen while locked, tagged with its subscription like the chat's events
+type lockEvent struct {
+	events <-chan message.Event
+	event  message.Event
+	closed bool
+}
+
+// Result of checking the passphrase on the unlock screen, in the background as deriving the key takes a moment
+type unlockResult struct {
+	key *vault.Key
+	err error
 }
 
-func newModel() mainModel {
-	m := mainModel{state: loginView}
+// Without a backend the profile is encrypted: the unlock screen comes first and the backend is started after it
+func newModel(cfg *config.Config, backend message.Backend, closeBackend func()) mainModel {
+	m := mainModel{state: loginView, config: cfg, backend: backend, closeBackend: closeBackend}
 	m.login = login.New()
-	m.chat = message.New()
-	m.setup = setup.New()
+	if backend == nil {
+		m.login = login.NewLocked()
+		m.encrypted = true
+	}
+	m.lockAfter = time.Duration(cfg.LockAfter) * time.Minute
+	m.lastInput = time.Now()
+	m.setup = setup.New(cfg.DbPath(), cfg.PluginDir())
 	return m
 }
 
+func unlockCmd(cfg *config.Config, passphrase string) tea.Cmd {
+	return func() tea.Msg {
+		dbHandler, err := db.NewDbHandler(cfg.DbPath())
+		if err != nil {
+			return unlockResult{err: err}
+		}
+		defer dbHandler.Close()
+
+		key, err := dbHandler.Unlock(passphrase)
+		return unlockResult{key: key, err: err}
+	}
+}
+
 func (m mainModel) Init() tea.Cmd {
+	if m.encrypted && m.lockAfter > 0 {
+		return idleCheckCmd()
+	}
 	return nil
 }
 
+func idleCheckCmd() tea.Cmd {
+	return tea.Tick(IDLE_CHECK_INTERVAL, func(time.Time) tea.Msg { return idleCheck{} })
+}
+
+func waitForLockEventCmd(events <-chan message.Event) tea.Cmd {
+	return func() tea.Msg {
+		event, ok := <-events
+		return lockEvent{events: events, event: event, closed: !ok}
+	}
+}
+
+// Hide everything behind the unlock screen. The backend keeps receiving and storing messages,
+// the lock screen only counts them.
+func (m *mainModel) lock() tea.Cmd {
+	m.resume = m.state
+	m.state = lockedView
+	m.login = login.NewLocked()
+	m.missed = 0
+	if m.chat != nil {
+		m.chat.SetHidden(true)
+	}
+	m.lockEvents, m.unsubscribeLock = m.backend.Subscribe()
+	logger.Info("chat locked")
+	return waitForLockEventCmd(m.lockEvents)
+}
+
+func (m *mainModel) unlock() {
+	m.state = m.resume
+	if m.chat != nil && m.state == chatView {
+		m.chat.SetHidden(false)
+	}
+	m.unsubscribeLock()
+	m.lockEvents = nil
+	m.lastInput = time.Now()
+	logger.Info("chat unlocked")
+}
+
+func (m *mainModel) updateChat(msg tea.Msg) tea.Cmd {
+	updatedChat, cmd := m.chat.Update(msg)
+	if chatModel, ok := updatedChat.(*message.ChatModel); ok {
+		m.chat = chatModel
+	} else {
+		logger.Error("unexpected type assertion failure for ChatModel")
+	}
+	return cmd
+}
+
 func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 	var cmds []tea.Cmd
 
 	switch msg := msg.(type) {
+	case login.UnlockMsg:
+		return m, unlockCmd(m.config, msg.Passphrase)
+	case unlockResult:
+		if msg.err == nil && m.backend == nil {
+			m.backend, m.closeBackend, msg.err = newBackend(m.config, msg.key)
+		}
+		if msg.err == nil && m.state == lockedView {
+			m.unlock()
+		}
+		m.login, cmd = m.login.Update(login.UnlockedMsg{Err: msg.err})
+		return m, cmd
+	case idleCheck:
+		if m.backend != nil && m.state != lockedView && time.Since(m.lastInput) >= m.lockAfter {
+			cmd = m.lock()
+		}
+		return m, tea.Batch(cmd, idleCheckCmd())
+	case message.LockMsg:
+		if m.encrypted && m.state != lockedView {
+			return m, m.lock()
+		}
+		return m, nil
+	case lockEvent:
+		if msg.closed || msg.events != m.lockEvents {
+			return m, nil
+		}
+		if msg.event.Type == message.EventMessage && msg.event.Message != nil && msg.event.Message.Direction == db.Incoming {
+			m.missed++
+		}
+		return m, waitForLockEventCmd(m.lockEvents)
 	case tea.KeyMsg:
+		m.lastInput = time.Now()
 		switch msg.String() {
 		case "ctrl+c":
 			return m, tea.Quit
@@ -69,16 +218,20 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
-		if msg.String() == "enter" && m.state == loginView {
+		if msg.String() == "enter" && m.state == loginView && !m.login.Locked() {
 			switch m.login.Cursor {
 			case 0:
-				m.chat = message.New()
+				if m.chat != nil {
+					m.chat.Close()
+				}
+				m.chat = message.New(m.backend, m.config)
+				cmds = append(cmds, m.chat.Init())
 				m.state = chatView
-				log.Println("Entered chat view state.")
+				logger.Debug("entered chat view state")
 			case 1:
-				m.setup = setup.New()
+				m.setup = setup.New(m.config.DbPath(), m.config.PluginDir())
 				m.state = setupView
-				log.Println("Entered setup view state.")
+				logger.Debug("entered setup view state")
 			}
 		}
 
@@ -89,15 +242,15 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.login, cmd = m.login.Update(msg)
 		cmds = append(cmds, cmd)
 	case chatView:
-		var updatedChat tea.Model
-		updatedChat, cmd = m.chat.Update(msg)
-
-		if chatModel, ok := updatedChat.(*message.ChatModel); ok {
-			m.chat = chatModel
-		} else {
-			log.Println("Unexpected type assertion failure for ChatModel")
+		cmds = append(cmds, m.updateChat(msg))
+	case lockedView:
+		// Keys go to the unlock screen, while the chat keeps taking in backend events out of sight
+		if _, ok := msg.(tea.KeyMsg); ok {
+			m.login, cmd = m.login.Update(msg)
+			cmds = append(cmds, cmd)
+		} else if m.resume == chatView {
+			cmds = append(cmds, m.updateChat(msg))
 		}
-		cmds = append(cmds, cmd)
 	case setupView:
 		var updatedSetup tea.Model
 		updatedSetup, cmd = m.setup.Update(msg)
@@ -105,7 +258,7 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if setup, ok := updatedSetup.(setup.SetupModel); ok {
 			m.setup = &setup
 		} else {
-			log.Println("Unexpected type assertion failure, expected setup.SetupModel, got ", reflect.TypeOf(updatedSetup))
+			logger.Error("unexpected type assertion failure, expected setup.SetupModel", "got", reflect.TypeOf(updatedSetup))
 		}
 
 		cmds = append(cmds, cmd)
@@ -123,25 +276,203 @@ func (m mainModel) View() string {
 		return m.setup.View()
 	}
 
+	help := "\nPress ↑/↓ to navigate • Press 'Enter/Return' to select • Press 'ctrl + c' to quit program"
+	if m.login.Locked() {
+		help = "\nType your passphrase and press 'Enter/Return' • Press 'ctrl + c' to quit program"
+	}
+	if m.state == lockedView && m.missed > 0 {
+		help = fmt.Sprintf("\n%d new message(s) while locked", m.missed) + help
+	}
 	return lipgloss.JoinVertical(lipgloss.Left,
-		focusedModelStyle.Render(m.login.View()),
-		helpStyle.Render("\nPress ↑/↓ to navigate • Press 'Enter/Return' to select • Press 'ctrl + c' to quit program"),
+		focusedModelStyle().Render(m.login.View()),
+		helpStyle().Render(help),
 	)
 }
 
 func main() {
-	f, err := tea.LogToFile("debug.log", "debug")
+	cfg, args, err := config.Load(os.Args[1:], os.LookupEnv, os.Stderr)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		args = []string{"help"}
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "bokkoli:", err)
+		os.Exit(cli.EXIT_USAGE)
+	}
+
+	if legacy, err := cfg.MoveLegacyDb("."); err != nil {
+		fmt.Fprintln(os.Stderr, "bokkoli:", err)
+	} else if legacy != "" {
+		fmt.Fprintf(os.Stderr, "bokkoli: moved %s to %s\n", legacy, filepath.Join(cfg.DataDir, config.DB_FILE_NAME))
+	}
+
+	f, err := setupLogging(&cfg)
 	if err != nil {
 		fmt.Println("fatal:", err)
 		os.Exit(1)
 	}
 	defer f.Close()
 
+	// Headless subcommands for scripting, the interactive chat otherwise
+	if len(args) > 0 {
+		code := cli.Run(&cfg, args, os.Stdin, os.Stdout, os.Stderr)
+		f.Close()
+		os.Exit(code)
+	}
+
+	loadTheme(&cfg)
+
+	encrypted, err := profileEncrypted(&cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bokkoli:", err)
+		f.Close()
+		os.Exit(cli.EXIT_FAILURE)
+	}
+
+	// An encrypted profile starts its backend once unlocked
+	var backend message.Backend
+	var closeBackend func()
+	if !encrypted {
+		backend, closeBackend, err = newBackend(&cfg, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "bokkoli:", err)
+			f.Close()
+			os.Exit(cli.EXIT_FAILURE)
+		}
+	}
+
 	fmt.Println("\nWelcome to Bokkoli! :D")
 
-	p := tea.NewProgram(newModel())
+	p := tea.NewProgram(newModel(&cfg, backend, closeBackend))
+
+	final, err := p.Run()
+	if err != nil {
+		logging.Fatal(logger, "program failed", logging.KeyErr, err)
+	}
+	if m, ok := final.(mainModel); ok {
+		// Stops the plugins of the open chat
+		if m.chat != nil {
+			m.chat.Close()
+		}
+		if m.closeBackend != nil {
+			m.closeBackend()
+		}
+	}
+}
+
+func profileEncrypted(cfg *config.Config) (bool, error) {
+	if err := os.MkdirAll(cfg.ProfileDir(), 0o700); err != nil {
+		return false, err
+	}
+	dbHandler, err := db.NewDbHandler(cfg.DbPath())
+	if err != nil {
+		return false, fmt.Errorf("error upon DB creation: %v", err)
+	}
+	defer dbHandler.Close()
+
+	if err := dbHandler.SetupSchemas(); err != nil {
+		return false, fmt.Errorf("error upon schema creation: %v", err)
+	}
+	return dbHandler.Encrypted()
+}
+
+// Log to the profile's rotating log file, at the configured level and redacted unless tracing
+func setupLogging(cfg *config.Config) (*logging.RotatingFile, error) {
+	if err := os.MkdirAll(cfg.ProfileDir(), 0o700); err != nil {
+		return nil, err
+	}
+
+	f, err := logging.OpenRotatingFile(cfg.LogPath(), int64(cfg.LogMaxSize)*logging.MEGABYTE, cfg.LogBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.Setup(f, cfg.SlogLevel(), cfg.LogTrace)
+	return f, nil
+}
+
+// Attach to the daemon when one is running, so connections outlive the TUI; otherwise chat in-process,
+// holding the profile lock so no other process uses the same database. The key unlocks an encrypted profile.
+func newBackend(cfg *config.Config, vaultKey *vault.Key) (message.Backend, func(), error) {
+	if cfg.Features.Daemon {
+		client, err := daemon.Dial(cfg.SocketPath())
+		if err == nil {
+			logger.Info("attached to daemon", "socket", cfg.SocketPath())
+			return client, func() { client.Close() }, nil
+		}
+	}
+
+	profileLock, err := cfg.LockProfile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dbHandler, err := db.NewDbHandler(cfg.DbPath())
+	if err != nil {
+		profileLock.Release()
+		return nil, nil, fmt.Errorf("error upon DB creation: %v", err)
+	}
+	if err := dbHandler.SetupSchemas(); err != nil {
+		profileLock.Release()
+		return nil, nil, fmt.Errorf("error upon schema creation: %v", err)
+	}
+	dbHandler.SetKey(vaultKey)
+
+	key, err := identity.Load(cfg.IdentityPath(), vaultKey)
+	if err != nil {
+		dbHandler.Close()
+		profileLock.Release()
+		return nil, nil, fmt.Errorf("could not load your identity key: %v", err)
+	}
+
+	settings, _ := dbHandler.ReadSetup()
+	node := message.NewNode(dbHandler, settings.Username)
+	node.SetIdentity(key)
+	node.SetBindAddress(cfg.BindAddress)
+	node.SetRoomPassword(cfg.RoomPassword)
+	node.SetUnknownPeers(message.PeerPolicy(cfg.UnknownPeers))
+	node.AddHook(webhook.NewDispatcher(dbHandler))
+	if cfg.MaintenanceInterval > 0 {
+		retention := db.Retention{Days: cfg.RetentionDays, Messages: cfg.RetentionMessages}
+		node.StartMaintenance(retention, time.Duration(cfg.MaintenanceInterval)*time.Hour)
+	}
+	return node, func() {
+		node.Close()
+		dbHandler.Close()
+		profileLock.Release()
+	}, nil
+}
+
+// Load user-defined themes and apply the configured theme, or else the one saved in the user settings
+func loadTheme(cfg *config.Config) {
+	if err := theme.LoadFile(cfg.ThemesPath()); err != nil {
+		logger.Warn("could not load user themes", logging.KeyErr, err)
+	}
+
+	if cfg.Theme != "" {
+		if err := theme.Set(cfg.Theme); err != nil {
+			logger.Warn("configured theme is not available, using default", logging.KeyErr, err)
+		}
+		return
+	}
+
+	dbHandler, err := db.NewDbHandler(cfg.DbPath())
+	if err != nil {
+		logger.Error("could not open DB to read theme", logging.KeyErr, err)
+		return
+	}
+	defer dbHandler.Close()
+
+	if err := dbHandler.SetupSchemas(); err != nil {
+		logger.Error("could not create schema", logging.KeyErr, err)
+		return
+	}
+
+	settings, _ := dbHandler.ReadSetup()
+	if settings.Theme == "" {
+		return
+	}
 
-	if _, err := p.Run(); err != nil {
-		log.Fatal(err)
+	if err := theme.Set(settings.Theme); err != nil {
+		logger.Warn("saved theme is not available, using default", logging.KeyErr, err)
 	}
 }
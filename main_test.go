@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bokkoli/internal/db"
+	"bokkoli/internal/login"
+	"bokkoli/internal/message"
+	"testing"
+	"time"
+)
+
+// Hands out one subscription, the lock screen's, and notes when it's dropped
+type lockBackend struct {
+	message.Backend
+	events       chan message.Event
+	unsubscribed bool
+}
+
+func (b *lockBackend) Subscribe() (<-chan message.Event, func()) {
+	return b.events, func() { b.unsubscribed = true }
+}
+
+func update(t *testing.T, m mainModel, msg any) mainModel {
+	t.Helper()
+	updated, _ := m.Update(msg)
+	return updated.(mainModel)
+}
+
+func TestLock(t *testing.T) {
+	backend := &lockBackend{events: make(chan message.Event)}
+	m := mainModel{state: setupView, backend: backend, encrypted: true, login: login.New(), lockAfter: time.Minute}
+
+	m.lastInput = time.Now()
+	if m = update(t, m, idleCheck{}); m.state != setupView {
+		t.Fatalf("Expected no lock before lock_after passed, got state %d", m.state)
+	}
+	m.lastInput = time.Now().Add(-2 * time.Minute)
+	if m = update(t, m, idleCheck{}); m.state != lockedView || m.resume != setupView || !m.login.Locked() {
+		t.Fatalf("Expected the idle chat to lock, got state %d resuming %d", m.state, m.resume)
+	}
+
+	incoming := message.Event{Type: message.EventMessage, Message: &db.Message{Direction: db.Incoming}}
+	outgoing := message.Event{Type: message.EventMessage, Message: &db.Message{Direction: db.Outgoing}}
+	m = update(t, m, lockEvent{events: m.lockEvents, event: incoming})
+	m = update(t, m, lockEvent{events: m.lockEvents, event: outgoing})
+	m = update(t, m, lockEvent{events: make(chan message.Event), event: incoming})
+	if m.missed != 1 {
+		t.Errorf("Expected only the incoming message of the lock's subscription counted, got %d", m.missed)
+	}
+
+	m = update(t, m, unlockResult{err: db.ErrLocked})
+	if m.state != lockedView || backend.unsubscribed {
+		t.Fatalf("Expected a wrong passphrase to keep the lock, got state %d", m.state)
+	}
+	m = update(t, m, unlockResult{})
+	if m.state != setupView || !backend.unsubscribed || m.lockEvents != nil || time.Since(m.lastInput) > time.Minute {
+		t.Errorf("Expected unlocking to resume the setup view and drop the subscription, got state %d", m.state)
+	}
+
+	m.encrypted = false
+	if m = update(t, m, message.LockMsg{}); m.state == lockedView {
+		t.Error("Expected /lock to do nothing without a passphrase")
+	}
+}